@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// setupTestApp replaces the global app with one backed by in-memory stores.
+func setupTestApp(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app = App{
+		Store:    sessions.NewCookieStore([]byte("test-secret")),
+		Location: location,
+		Logins:   NewLoginLimiter(),
+		Currency: "PLN",
+		// printable pages are rendered from the templates of the repository
+		TemplatesPath: "templates",
+		// price list of SeedServices
+		DefaultPrice: Money{Amount: 9000, Currency: "PLN"},
+
+		EmployeeDeletePolicy: RefuseDelete,
+		ClientDeletePolicy:   ArchiveOnDelete,
+	}
+	app.UseMemoryStores()
+	app.InitDB()
+}
+
+// testSession is an HTTP client which keeps the session cookie between requests.
+type testSession struct {
+	t       *testing.T
+	handler http.Handler
+	cookies []*http.Cookie
+}
+
+func newTestSession(t *testing.T) *testSession {
+	return &testSession{t: t, handler: NewRouter()}
+}
+
+func (s *testSession) do(r *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range s.cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		s.cookies = cookies
+	}
+	return w
+}
+
+func (s *testSession) login(name, code string) *httptest.ResponseRecorder {
+	form := url.Values{"name": {name}, "code": {code}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.do(r)
+}
+
+func (s *testSession) request(method, path string, body interface{}) *httptest.ResponseRecorder {
+	return s.requestIfMatch(method, path, "", body)
+}
+
+func (s *testSession) requestIfMatch(method, path, etag string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &buf)
+	if etag != "" {
+		r.Header.Set("If-Match", etag)
+	}
+	return s.do(r)
+}
+
+func TestRecordsAPI(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+
+	if w := s.request("GET", "/records", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 before login, got: %d", w.Code)
+	}
+	if w := s.login("admin", "1234"); w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", w.Code, w.Body)
+	}
+
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(context.Background(), &client)
+	w := s.request("PUT", "/records", map[string]interface{}{"date": "2020-03-01 - 10:00", "price": 90, "clientId": client.Id.Hex()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+	var created Record
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Id.IsZero() {
+		t.Fatal("Created record has no id")
+	}
+
+	w = s.request("GET", "/records", nil)
+	var page RecordPage
+	json.NewDecoder(w.Body).Decode(&page)
+	if len(page.Records) != 1 || !page.Records[0].Price.Equal(units(90)) || page.Total != 1 {
+		t.Errorf("Unexpected records: %s", w.Body)
+	}
+
+	if w = s.request("DELETE", "/records/"+created.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Errorf("Delete failed: %d %s", w.Code, w.Body)
+	}
+	if w = s.request("DELETE", "/records/"+created.Id.Hex(), nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for removed record, got: %d", w.Code)
+	}
+}
+
+func TestInvalidRouteIds(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	for _, path := range []string{"/records/invalid", "/clients/invalid", "/employees/invalid", "/services/invalid", "/packages/invalid"} {
+		if w := s.request("GET", path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got: %d", path, w.Code)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+
+	for i := 0; i < app.Logins.AccountPolicy.FreeAttempts; i++ {
+		if w := s.login("Admin", "1111"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for invalid code, got: %d", w.Code)
+		}
+	}
+	if w := s.login("admin", "1111"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for invalid code, got: %d", w.Code)
+	}
+	w := s.login("admin", "1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with Retry-After when locked out, got: %d", w.Code)
+	}
+
+	app.Logins.ClearAccount("admin")
+	if w := s.login("admin", "1234"); w.Code != http.StatusOK {
+		t.Fatalf("Expected login after clearing lockout, got: %d %s", w.Code, w.Body)
+	}
+	if len(app.Logins.Lockouts()) != 0 {
+		t.Errorf("Successful login should reset counters, got: %v", app.Logins.Lockouts())
+	}
+}
+
+func TestEmployeeCodeIsHashed(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	w := s.request("PUT", "/employees", map[string]interface{}{"name": "Anna", "code": "4321"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "4321") || strings.Contains(w.Body.String(), "code") {
+		t.Errorf("Response should not expose the code: %s", w.Body)
+	}
+	anna, err := app.Employees.GetByName(context.Background(), "anna")
+	if err != nil || anna.CodeHash == "" || anna.Code != "" || !anna.CheckCode("4321") {
+		t.Errorf("Code should be stored hashed: %+v", anna)
+	}
+	if w := s.request("PUT", "/employees", map[string]interface{}{"name": "ANNA", "code": "1111"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate name, got: %d", w.Code)
+	}
+}
+
+func TestPartialUpdates(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	w := s.request("PUT", "/clients", map[string]interface{}{
+		"name": "Jan", "tel": "123", "birthday": "2015-05-01",
+		"address": map[string]string{"city": "Kraków", "street": "Długa 1"},
+	})
+	var client Client
+	json.NewDecoder(w.Body).Decode(&client)
+
+	w = s.request("PATCH", "/clients/"+client.Id.Hex(), map[string]interface{}{
+		"name": "Jan Kowalski", "address": map[string]string{"city": "Warszawa"}, "registered": "2000-01-01T00:00:00Z",
+	})
+	var updated Client
+	json.NewDecoder(w.Body).Decode(&updated)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", w.Code, w.Body)
+	}
+	if updated.Name != "Jan Kowalski" || updated.Tel != "123" || updated.Birthday != client.Birthday ||
+		updated.Address.City != "Warszawa" || updated.Address.Street != "Długa 1" {
+		t.Errorf("Only present fields should change: %+v", updated)
+	}
+	if updated.Registered != client.Registered || updated.LastModified < client.LastModified {
+		t.Errorf("Registered should be kept and LastModified bumped: %+v", updated)
+	}
+
+	w = s.request("PUT", "/records", map[string]interface{}{"date": "2020-03-01 - 10:00", "price": 90, "employeeIncome": 60, "clientId": client.Id.Hex()})
+	var record Record
+	json.NewDecoder(w.Body).Decode(&record)
+	w = s.request("POST", "/records/"+record.Id.Hex(), map[string]interface{}{"price": 100})
+	var updatedRecord Record
+	json.NewDecoder(w.Body).Decode(&updatedRecord)
+	if !updatedRecord.Price.Equal(units(100)) || !updatedRecord.EmployeeIncome.Equal(units(60)) || updatedRecord.Date != record.Date {
+		t.Errorf("Only price should change: %+v", updatedRecord)
+	}
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	w := s.request("PUT", "/clients", map[string]interface{}{"name": "Jan"})
+	etag := w.Header().Get("ETag")
+	var client Client
+	json.NewDecoder(w.Body).Decode(&client)
+	path := "/clients/" + client.Id.Hex()
+	if etag == "" || etag != client.ETag() {
+		t.Fatalf("Expected ETag of created client, got: %q", etag)
+	}
+	if w := s.request("GET", path, nil); w.Header().Get("ETag") != etag {
+		t.Errorf("Expected the same ETag on GET, got: %q", w.Header().Get("ETag"))
+	}
+
+	w = s.requestIfMatch("POST", path, etag, map[string]interface{}{"tel": "111"})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("Expected update with a new ETag, got: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	w = s.requestIfMatch("POST", path, etag, map[string]interface{}{"tel": "222"})
+	var conflict struct {
+		Code    string `json:"code"`
+		Details Client `json:"details"`
+	}
+	json.NewDecoder(w.Body).Decode(&conflict)
+	if w.Code != http.StatusPreconditionFailed || conflict.Code != "version-conflict" || conflict.Details.Tel != "111" {
+		t.Errorf("Expected 412 with the current copy, got: %d %+v", w.Code, conflict)
+	}
+
+	if w := s.requestIfMatch("DELETE", path, etag, nil); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for stale delete, got: %d", w.Code)
+	}
+	if w := s.requestIfMatch("DELETE", path, "W/"+conflict.Details.ETag(), nil); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a weak tag, got: %d", w.Code)
+	}
+	if w := s.requestIfMatch("DELETE", path, conflict.Details.ETag(), nil); w.Code != http.StatusOK {
+		t.Errorf("Expected delete with current ETag, got: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRecordsPaging(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	admin, _ := app.Employees.GetByName(ctx, "admin")
+	therapist := Employee{Name: "Therapist"}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := primitive.NewObjectID()
+
+	day := time.Date(2020, 3, 1, 10, 0, 0, 0, app.Location)
+	for i := 0; i < 10; i++ {
+		record := Record{EmployeeId: admin.Id, ClientId: client, Date: primitive.NewDateTimeFromTime(day.AddDate(0, 0, i/2)), Price: units(int64(10 * i))}
+		if i%3 == 0 {
+			record.EmployeeId = therapist.Id
+			record.ClientId = primitive.NewObjectID()
+		}
+		app.Records.Insert(ctx, &record)
+	}
+
+	s := newTestSession(t)
+	s.login("admin", "1234")
+	fetch := func(query string) RecordPage {
+		w := s.request("GET", "/records?"+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Listing %q failed: %d %s", query, w.Code, w.Body)
+		}
+		var page RecordPage
+		json.NewDecoder(w.Body).Decode(&page)
+		return page
+	}
+
+	var seen []Record
+	query := "limit=3"
+	for {
+		page := fetch(query)
+		if page.Total != 10 {
+			t.Fatalf("Expected total of 10, got: %d", page.Total)
+		}
+		seen = append(seen, page.Records...)
+		if page.Next == "" {
+			break
+		}
+		query = "limit=3&cursor=" + page.Next
+	}
+	if len(seen) != 10 {
+		t.Fatalf("Expected to page through 10 records, got: %d", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i].Date > seen[i-1].Date || seen[i].Id == seen[i-1].Id {
+			t.Errorf("Records out of order at %d: %v, %v", i, seen[i-1], seen[i])
+		}
+	}
+
+	if page := fetch("sort=date&limit=1"); !page.Records[0].Price.IsZero() && !page.Records[0].Price.Equal(units(10)) {
+		t.Errorf("Expected the oldest record first, got: %+v", page.Records[0])
+	}
+	if page := fetch("from=2020-03-02&to=2020-03-03"); page.Total != 4 {
+		t.Errorf("Expected 4 records in range, got: %d", page.Total)
+	}
+	if page := fetch("client=" + client.Hex() + "&minPrice=20&maxPrice=80"); page.Total != 5 {
+		t.Errorf("Expected 5 records of client in price range, got: %d", page.Total)
+	}
+	if w := s.request("GET", "/records?limit=0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid limit, got: %d", w.Code)
+	}
+
+	other := newTestSession(t)
+	other.login("therapist", "1111")
+	w := other.request("GET", "/records?employee="+admin.Id.Hex(), nil)
+	var page RecordPage
+	json.NewDecoder(w.Body).Decode(&page)
+	if page.Total != 4 {
+		t.Errorf("Expected non-admin to see only own 4 records, got: %d", page.Total)
+	}
+}
+
+func TestClientSearchAndArchive(t *testing.T) {
+	setupTestApp(t)
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	clients := []map[string]interface{}{
+		{"name": "Łukasz Żółć", "tel": "+48 601 234 567", "address": map[string]string{"city": "Kraków", "post_code": "30-001"}},
+		{"name": "Anna Nowak", "email": "anna@example.com", "address": map[string]string{"city": "Łódź"}},
+		{"name": "Ścibor Lis", "tel": "602 000 111"},
+	}
+	ids := make(map[string]string)
+	for _, client := range clients {
+		w := s.request("PUT", "/clients", client)
+		var created Client
+		json.NewDecoder(w.Body).Decode(&created)
+		ids[created.Name] = created.Id.Hex()
+	}
+
+	search := func(query string) ClientPage {
+		var page ClientPage
+		w := s.request("GET", "/clients?"+query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Search %q failed: %d %s", query, w.Code, w.Body)
+		}
+		json.NewDecoder(w.Body).Decode(&page)
+		return page
+	}
+	names := func(page ClientPage) (names []string) {
+		for _, client := range page.Clients {
+			names = append(names, client.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"Anna Nowak", "Łukasz Żółć", "Ścibor Lis"}},
+		{"q=zol", []string{"Łukasz Żółć"}},
+		{"q=LUK+krak", []string{"Łukasz Żółć"}},
+		{"q=601234", []string{"Łukasz Żółć"}},
+		{"q=30-0", []string{"Łukasz Żółć"}},
+		{"q=anna%40exa", []string{"Anna Nowak"}},
+		{"q=lodz", []string{"Anna Nowak"}},
+		{"q=scib", []string{"Ścibor Lis"}},
+		{"q=nowakowski", nil},
+	}
+	for _, test := range tests {
+		if got := names(search(test.query)); !reflect.DeepEqual(got, test.names) {
+			t.Errorf("Search %q: expected %v, got %v", test.query, test.names, got)
+		}
+	}
+
+	page := search("limit=2")
+	if page.Total != 3 || page.Count != 2 || page.Next == "" {
+		t.Fatalf("Unexpected first page: %+v", page)
+	}
+	if got := names(search("limit=2&cursor=" + page.Next)); !reflect.DeepEqual(got, []string{"Ścibor Lis"}) {
+		t.Errorf("Unexpected second page: %v", got)
+	}
+
+	path := "/clients/" + ids["Anna Nowak"]
+	if w := s.request("DELETE", path, nil); w.Code != http.StatusOK {
+		t.Fatalf("Archiving failed: %d %s", w.Code, w.Body)
+	}
+	if w := s.request("GET", path, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected archived client to stay resolvable, got: %d", w.Code)
+	}
+	if got := names(search("q=anna")); got != nil {
+		t.Errorf("Expected archived client to be hidden, got: %v", got)
+	}
+	archived := search("archived=true")
+	if got := names(archived); !reflect.DeepEqual(got, []string{"Anna Nowak"}) || archived.Clients[0].ArchivedAt == 0 {
+		t.Errorf("Expected archived client with timestamp, got: %+v", archived.Clients)
+	}
+	if page := search("archived=all"); page.Total != 3 {
+		t.Errorf("Expected all clients, got: %d", page.Total)
+	}
+
+	if w := s.request("POST", path+"/restore", nil); w.Code != http.StatusOK {
+		t.Fatalf("Restoring failed: %d %s", w.Code, w.Body)
+	}
+	if got := names(search("q=anna")); !reflect.DeepEqual(got, []string{"Anna Nowak"}) {
+		t.Errorf("Expected restored client, got: %v", got)
+	}
+}
+
+func TestReferentialIntegrity(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	s := newTestSession(t)
+	s.login("admin", "1234")
+
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	therapist := Employee{Name: "Therapist"}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	other := Employee{Name: "Other"}
+	other.SetCode("2222")
+	app.Employees.Insert(ctx, &other)
+
+	apiError := func(w *httptest.ResponseRecorder) (apiErr APIError) {
+		json.NewDecoder(w.Body).Decode(&apiErr)
+		return apiErr
+	}
+
+	date := "2020-03-01 - 10:00"
+	invalid := []map[string]interface{}{
+		{"date": date, "clientId": primitive.NewObjectID().Hex()},
+		{"date": date, "clientId": client.Id.Hex(), "employeeId": primitive.NewObjectID().Hex()},
+	}
+	for _, body := range invalid {
+		if w := s.request("PUT", "/records", body); w.Code != http.StatusUnprocessableEntity || apiError(w).Code != "invalid-reference" {
+			t.Errorf("Expected 422 for %v, got: %d", body, w.Code)
+		}
+	}
+
+	w := s.request("PUT", "/records", map[string]interface{}{"date": date, "clientId": client.Id.Hex(), "employeeId": therapist.Id.Hex()})
+	var record Record
+	json.NewDecoder(w.Body).Decode(&record)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+
+	w = s.request("DELETE", "/employees/"+therapist.Id.Hex(), nil)
+	var blocked struct {
+		Code    string `json:"code"`
+		Details struct {
+			Total   int64    `json:"total"`
+			Records []Record `json:"records"`
+		} `json:"details"`
+	}
+	json.NewDecoder(w.Body).Decode(&blocked)
+	if w.Code != http.StatusConflict || blocked.Code != "has-records" || blocked.Details.Total != 1 || blocked.Details.Records[0].Id != record.Id {
+		t.Errorf("Expected 409 listing the record, got: %d %+v", w.Code, blocked)
+	}
+	if w := s.request("DELETE", "/clients/"+client.Id.Hex()+"?policy=refuse", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for client with records, got: %d", w.Code)
+	}
+	if w := s.request("DELETE", "/clients/"+client.Id.Hex()+"?policy=reassign", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for reassigning client records, got: %d", w.Code)
+	}
+
+	// appointments, series, packages, payments and invoices block removal as well
+	third := Employee{Name: "Third"}
+	app.Employees.Insert(ctx, &third)
+	series := Series{EmployeeId: third.Id, ClientId: client.Id, Start: record.Date, Duration: 60, RRule: "FREQ=WEEKLY;COUNT=2"}
+	app.Series.Insert(ctx, &series)
+	paying := Client{Name: "Paying"}
+	app.Clients.Insert(ctx, &paying)
+	app.Payments.Insert(ctx, &Payment{ClientId: paying.Id, Date: "2020-01-01", Amount: units(90), Method: Cash})
+	for _, path := range []string{"/employees/" + third.Id.Hex(), "/clients/" + paying.Id.Hex()} {
+		if w := s.request("DELETE", path+"?policy=refuse", nil); w.Code != http.StatusConflict || apiError(w).Code != "has-references" {
+			t.Errorf("Expected 409 for %s with references, got: %d %s", path, w.Code, w.Body)
+		}
+	}
+	appointment := Appointment{EmployeeId: therapist.Id, ClientId: client.Id, Start: record.Date, Duration: 60, Status: Planned}
+	app.Appointments.Insert(ctx, &appointment)
+
+	path := "/employees/" + therapist.Id.Hex() + "?policy=reassign&to="
+	if w := s.request("DELETE", path+therapist.Id.Hex(), nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for reassigning to self, got: %d", w.Code)
+	}
+	if w := s.requestIfMatch("DELETE", path+other.Id.Hex(), `"stale"`, nil); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale employee, got: %d", w.Code)
+	}
+	if kept, _ := app.Records.Get(ctx, record.Id); kept.EmployeeId != therapist.Id {
+		t.Errorf("Expected no records moved for a stale employee, got: %+v", kept)
+	}
+	if w := s.request("DELETE", path+other.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Fatalf("Reassign failed: %d %s", w.Code, w.Body)
+	}
+	if moved, _ := app.Records.Get(ctx, record.Id); moved.EmployeeId != other.Id {
+		t.Errorf("Expected record to be reassigned, got: %+v", moved)
+	}
+	if moved, _ := app.Appointments.Get(ctx, appointment.Id); moved.EmployeeId != other.Id {
+		t.Errorf("Expected appointment to be reassigned, got: %+v", moved)
+	}
+	if _, err := app.Employees.Get(ctx, therapist.Id); err != ErrNotFound {
+		t.Errorf("Expected employee to be removed, got: %v", err)
+	}
+
+	if w := s.request("DELETE", "/employees/"+other.Id.Hex()+"?policy=archive", nil); w.Code != http.StatusOK {
+		t.Fatalf("Archive failed: %d %s", w.Code, w.Body)
+	}
+	if w := newTestSession(t).login("other", "2222"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected archived employee not to log in, got: %d", w.Code)
+	}
+	if w := s.request("DELETE", "/clients/"+client.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Fatalf("Archive failed: %d %s", w.Code, w.Body)
+	}
+	if w := s.request("PUT", "/records", map[string]interface{}{"date": date, "clientId": client.Id.Hex()}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for archived client, got: %d", w.Code)
+	}
+	if w := s.request("PATCH", "/records/"+record.Id.Hex(), map[string]interface{}{"price": 100}); w.Code != http.StatusOK {
+		t.Errorf("Expected records of archived client to stay editable, got: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AppointmentStatus string
+
+const (
+	Planned   AppointmentStatus = "planned"
+	Completed AppointmentStatus = "completed"
+	Cancelled AppointmentStatus = "cancelled"
+	NoShow    AppointmentStatus = "no-show"
+)
+
+// defaultDuration of an appointment in minutes.
+const defaultDuration = 60
+
+// Appointment is a planned session, it becomes a Record once completed.
+type Appointment struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	ClientId   primitive.ObjectID `json:"clientId"`
+	Start      primitive.DateTime `json:"start"`
+	Duration   int                `json:"duration"` // minutes
+	Room       string             `json:"room"`
+	HomeVisit  bool               `json:"homeVisit"`
+	Status     AppointmentStatus  `json:"status"`
+	RecordId   primitive.ObjectID `json:"recordId,omitempty" bson:"recordid,omitempty"` // set on completion
+	// SeriesId and Occurrence (the day in ShortDateLayout) identify an
+	// occurrence of a series stored because it was changed or completed.
+	SeriesId   primitive.ObjectID `json:"seriesId,omitempty" bson:"seriesid,omitempty"`
+	Occurrence string             `json:"occurrence,omitempty" bson:"occurrence,omitempty"`
+	Override   *ConflictOverride  `json:"override,omitempty" bson:"override,omitempty"`
+	Version    int64              `json:"version"`
+}
+
+func (a *Appointment) End() primitive.DateTime {
+	return primitive.NewDateTimeFromTime(a.Start.Time().Add(time.Duration(a.Duration) * time.Minute))
+}
+
+func (a *Appointment) MarshalJSON() ([]byte, error) {
+	type Alias Appointment
+	return json.Marshal(&struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+		*Alias
+	}{
+		Start: MarshalDate(a.Start, DateTimeLayout),
+		End:   MarshalDate(a.End(), DateTimeLayout),
+		Alias: (*Alias)(a),
+	})
+}
+
+// UnmarshalJSON leaves the start untouched when missing in data, see Client.UnmarshalJSON.
+func (a *Appointment) UnmarshalJSON(data []byte) error {
+	type Alias Appointment
+	aux := &struct {
+		Start *string `json:"start"`
+		*Alias
+	}{
+		Alias: (*Alias)(a),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Start != nil {
+		if err := UnmarshalDate(*aux.Start, &a.Start, DateTimeLayout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func invalidAppointment(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-appointment", Message: message}
+}
+
+// validate checks the fields and the references of the appointment, stored is nil for new ones.
+func (a *Appointment) validate(ctx context.Context, stored *Appointment) error {
+	if a.Start == 0 {
+		return invalidAppointment("Start of the appointment is required")
+	}
+	if a.Duration <= 0 {
+		return invalidAppointment("Duration of the appointment has to be positive")
+	}
+	switch a.Status {
+	case Planned, Cancelled, NoShow:
+	case Completed:
+		if stored == nil || stored.Status != Completed {
+			return invalidAppointment("Appointments are completed with the complete action")
+		}
+	default:
+		return invalidAppointment(fmt.Sprintf("Unknown status %q", a.Status))
+	}
+	if stored == nil || a.EmployeeId != stored.EmployeeId {
+		if _, err := activeEmployee(ctx, "employeeId", a.EmployeeId); err != nil {
+			return err
+		}
+	}
+	if stored == nil || a.ClientId != stored.ClientId {
+		if _, err := activeClient(ctx, "clientId", a.ClientId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeAppointment lets admins manage all appointments, others only their own.
+func authorizeAppointment(e *Employee, appointment *Appointment) error {
+	if e.Admin || appointment.EmployeeId == e.Id {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    "not-owner",
+		Message: "Appointments of other employees cannot be changed",
+	}
+}
+
+func appointmentCompleted(appointment *Appointment) error {
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "appointment-completed",
+		Message: "The appointment has been completed, change its record instead",
+		Details: map[string]string{"recordId": appointment.RecordId.Hex()},
+	}
+}
+
+// ParseAppointmentFilter reads the listing parameters: from, to (days, inclusive), employee and client.
+func ParseAppointmentFilter(query url.Values) (filter AppointmentFilter, err error) {
+	filter.Limit = maxPageSize
+	ids := map[string]*primitive.ObjectID{"employee": &filter.EmployeeId, "client": &filter.ClientId}
+	for name, id := range ids {
+		if value := query.Get(name); value != "" {
+			if *id, err = primitive.ObjectIDFromHex(value); err != nil {
+				return filter, invalidParameter(name, err)
+			}
+		}
+	}
+	days := map[string]*time.Time{"from": &filter.From, "to": &filter.To}
+	for name, day := range days {
+		if value := query.Get(name); value != "" {
+			if *day, err = parseDay(value, name == "to"); err != nil {
+				return filter, invalidParameter(name, err)
+			}
+		}
+	}
+	return filter, nil
+}
+
+func showAppointments(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointments []Appointment
+	filter, err := ParseAppointmentFilter(r.URL.Query())
+	if err == nil {
+		if !e.Admin {
+			filter.EmployeeId = e.Id
+		}
+		appointments, err = ListAppointments(ctx, filter)
+	}
+	if err == nil {
+		if appointments == nil {
+			appointments = []Appointment{}
+		}
+		tags := make([]string, len(appointments))
+		for i := range appointments {
+			tags[i] = appointments[i].ETag()
+		}
+		w.Header().Set("ETag", listETag(tags))
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(appointments)
+	} else {
+		writeError(w, err)
+	}
+}
+
+func createAppointment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment Appointment
+	err := json.NewDecoder(r.Body).Decode(&appointment)
+	if err == nil {
+		appointment.Id = primitive.NilObjectID
+		appointment.RecordId = primitive.NilObjectID
+		appointment.SeriesId, appointment.Occurrence = primitive.NilObjectID, ""
+		appointment.Override = nil
+		if appointment.EmployeeId.IsZero() {
+			appointment.EmployeeId = e.Id
+		}
+		if appointment.Duration == 0 {
+			appointment.Duration = defaultDuration
+		}
+		if appointment.Status == "" {
+			appointment.Status = Planned
+		}
+		err = authorizeAppointment(e, &appointment)
+	}
+	if err == nil {
+		err = appointment.validate(ctx, nil)
+	}
+	if err == nil {
+		appointment.Override, err = appointment.checkConflicts(ctx, r, e, nil)
+	}
+	if err == nil {
+		err = app.Appointments.Insert(ctx, &appointment)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(&appointment)
+	}
+}
+
+func showAppointment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment *Appointment
+	appointmentId, err := routeId(r)
+	if err == nil {
+		appointment, err = app.Appointments.Get(ctx, appointmentId)
+	}
+
+	if err == nil && !e.Admin && appointment.EmployeeId != e.Id {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(appointment)
+	}
+}
+
+func updateAppointment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment *Appointment
+	appointmentId, err := routeId(r)
+	if err == nil {
+		appointment, err = app.Appointments.Get(ctx, appointmentId)
+	}
+
+	if err == nil {
+		err = authorizeAppointment(e, appointment)
+	}
+
+	if err == nil && !ifMatch(r, appointment.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil && appointment.Status == Completed {
+		err = appointmentCompleted(appointment)
+	}
+
+	var stored Appointment
+	if err == nil {
+		stored = *appointment
+		err = decodePatch(r, appointment)
+		appointment.Id = appointmentId
+		appointment.Version = stored.Version
+		appointment.RecordId = stored.RecordId
+		appointment.SeriesId, appointment.Occurrence = stored.SeriesId, stored.Occurrence
+		appointment.Override = stored.Override
+	}
+
+	if err == nil {
+		err = authorizeAppointment(e, appointment)
+	}
+
+	if err == nil {
+		err = appointment.validate(ctx, &stored)
+	}
+
+	if err == nil {
+		appointment.Override, err = appointment.checkConflicts(ctx, r, e, &stored)
+	}
+
+	if err == nil {
+		err = app.Appointments.Update(ctx, appointmentId, appointment)
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		appointment, err = app.Appointments.Get(ctx, appointmentId)
+		if err == nil && conflict {
+			writeConflict(w, appointment.ETag(), appointment)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(appointment)
+	}
+}
+
+func removeAppointment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment *Appointment
+	appointmentId, err := routeId(r)
+	if err == nil {
+		appointment, err = app.Appointments.Get(ctx, appointmentId)
+	}
+
+	if err == nil {
+		err = authorizeAppointment(e, appointment)
+	}
+
+	if err == nil && !ifMatch(r, appointment.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil {
+		err = app.Appointments.Delete(ctx, appointmentId, expectedVersion(r, appointment.Version))
+	}
+
+	if err == ErrConflict {
+		if appointment, err = app.Appointments.Get(ctx, appointmentId); err == nil {
+			writeConflict(w, appointment.ETag(), appointment)
+			return
+		}
+	}
+
+	if err == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(appointmentId)
+	} else {
+		writeError(w, err)
+	}
+}
+
+// Completion
+
+type AppointmentCompletion struct {
+	Appointment *Appointment `json:"appointment"`
+	Record      *Record      `json:"record"`
+}
+
+// complete turns a planned appointment into a record of the session. The
+// appointment is updated in place, ErrConflict means it has changed meanwhile.
+func complete(ctx context.Context, e *Employee, appointment *Appointment) (*Record, error) {
+	if appointment.Status == Completed {
+		return nil, appointmentCompleted(appointment)
+	} else if appointment.Status != Planned {
+		return nil, &APIError{
+			Status:  http.StatusConflict,
+			Code:    "appointment-not-planned",
+			Message: "Only planned appointments can be completed",
+		}
+	}
+
+	employee, err := activeEmployee(ctx, "employeeId", appointment.EmployeeId)
+	if err != nil {
+		return nil, err
+	}
+	client, err := app.Clients.Get(ctx, appointment.ClientId)
+	if err != nil {
+		return nil, err
+	}
+
+	record := Record{
+		AppointmentId: appointment.Id,
+		EmployeeId:    employee.Id,
+		ClientId:      client.Id,
+		Date:          appointment.Start,
+		Duration:      appointment.Duration,
+		HomeVisit:     appointment.HomeVisit,
+	}
+	if err = authorizeRecord(e, &record); err != nil {
+		return nil, err
+	}
+	if err = record.applyRates(ctx, nil); err != nil {
+		return nil, err
+	}
+	if err = app.Records.Insert(ctx, &record); err == ErrDuplicate {
+		return nil, appointmentCompleted(appointment)
+	} else if err != nil {
+		return nil, err
+	}
+
+	appointment.Status = Completed
+	appointment.RecordId = record.Id
+	if err = app.Appointments.Update(ctx, appointment.Id, appointment); err != nil {
+		// the appointment has changed meanwhile, do not leave a record of it behind
+		app.Records.Delete(ctx, record.Id, AnyVersion)
+		return nil, err
+	}
+	renumberSessions(ctx, &record, nil)
+	return &record, nil
+}
+
+func completeAppointment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment *Appointment
+	appointmentId, err := routeId(r)
+	if err == nil {
+		appointment, err = app.Appointments.Get(ctx, appointmentId)
+	}
+
+	if err == nil {
+		err = authorizeAppointment(e, appointment)
+	}
+
+	if err == nil && !ifMatch(r, appointment.ETag()) {
+		err = ErrConflict
+	}
+
+	var record *Record
+	if err == nil {
+		record, err = complete(ctx, e, appointment)
+	}
+
+	if err == ErrConflict {
+		if appointment, err = app.Appointments.Get(ctx, appointmentId); err == nil {
+			writeConflict(w, appointment.ETag(), appointment)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(AppointmentCompletion{appointment, record})
+	}
+}
+
+// Calendar
+
+var isoWeekPattern = regexp.MustCompile(`^(\d{4})-W(\d{2})$`)
+
+// ParseWeek returns the start of the week, Monday midnight in the clinic
+// time zone. The week is given as ISO week ("2020-W10") or any day in it.
+func ParseWeek(value string) (time.Time, error) {
+	if m := isoWeekPattern.FindStringSubmatch(value); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		week, _ := strconv.Atoi(m[2])
+		// January 4th is always in the first week
+		jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, app.Location)
+		start := weekStart(jan4).AddDate(0, 0, 7*(week-1))
+		if y, w := start.ISOWeek(); week < 1 || y != year || w != week {
+			return time.Time{}, fmt.Errorf("no week %d in %d", week, year)
+		}
+		return start, nil
+	}
+	day, err := time.ParseInLocation(ShortDateLayout, value, app.Location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a week like 2020-W10 or a date")
+	}
+	return weekStart(day), nil
+}
+
+func weekStart(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, app.Location)
+}
+
+type CalendarDay struct {
+	Date         string        `json:"date"`
+	Appointments []Appointment `json:"appointments"`
+}
+
+type Calendar struct {
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	Week       string             `json:"week"`
+	Days       []CalendarDay      `json:"days"`
+}
+
+func isoWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// BuildCalendar lists appointments of the employee in the week starting at start, day by day.
+func BuildCalendar(ctx context.Context, employeeId primitive.ObjectID, start time.Time) (*Calendar, error) {
+	calendar := Calendar{EmployeeId: employeeId, Week: isoWeek(start)}
+	end := start.AddDate(0, 0, 7)
+	appointments, err := ListAppointments(ctx, AppointmentFilter{EmployeeId: employeeId, From: start, To: end})
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 7; i++ {
+		// days are counted by date, as they are not always 24 hours long
+		dayStart := start.AddDate(0, 0, i)
+		dayEnd := start.AddDate(0, 0, i+1)
+		day := CalendarDay{Date: dayStart.Format(ShortDateLayout), Appointments: []Appointment{}}
+		for _, appointment := range appointments {
+			if t := appointment.Start.Time(); !t.Before(dayStart) && t.Before(dayEnd) {
+				day.Appointments = append(day.Appointments, appointment)
+			}
+		}
+		calendar.Days = append(calendar.Days, day)
+	}
+	return &calendar, nil
+}
+
+// showCalendar returns the week of an employee, non-admins see only their own calendar.
+func showCalendar(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var calendar *Calendar
+	vars := mux.Vars(r)
+	employeeId, err := routeId(r)
+	if err == nil && !e.Admin && employeeId != e.Id {
+		err = ErrNotFound
+	}
+	if err == nil {
+		_, err = app.Employees.Get(ctx, employeeId)
+	}
+	var start time.Time
+	if err == nil {
+		if start, err = ParseWeek(vars["week"]); err != nil {
+			err = invalidParameter("week", err)
+		}
+	}
+	if err == nil {
+		calendar, err = BuildCalendar(ctx, employeeId, start)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(calendar)
+	}
+}
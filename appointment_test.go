@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseWeek(t *testing.T) {
+	setupTestApp(t)
+	tests := []struct {
+		value, monday string
+	}{
+		{"2020-W10", "2020-03-02"},
+		{"2020-03-08", "2020-03-02"},
+		{"2020-03-02", "2020-03-02"},
+		{"2021-W01", "2021-01-04"},
+		{"2020-W53", "2020-12-28"},
+		{"2020-10-25", "2020-10-19"}, // end of summer time
+	}
+	for _, test := range tests {
+		start, err := ParseWeek(test.value)
+		if err != nil {
+			t.Errorf("ParseWeek(%q): %v", test.value, err)
+			continue
+		}
+		if got := start.Format(ShortDateLayout); got != test.monday || start.Hour() != 0 || start.Location() != app.Location {
+			t.Errorf("ParseWeek(%q): expected %s midnight, got %v", test.value, test.monday, start)
+		}
+	}
+	for _, value := range []string{"2021-W53", "2020-W00", "next week"} {
+		if _, err := ParseWeek(value); err == nil {
+			t.Errorf("ParseWeek(%q): expected an error", value)
+		}
+	}
+}
+
+func TestAppointments(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(50)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	regular := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &regular)
+	special := Client{Name: "Anna", Prices: specialPrice(t, 70)}
+	app.Clients.Insert(ctx, &special)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+
+	today := time.Now().In(app.Location)
+	start := time.Date(today.Year(), today.Month(), today.Day(), 9, 0, 0, 0, app.Location)
+	create := func(client Client, start time.Time) Appointment {
+		w := s.request("PUT", "/appointments", map[string]interface{}{
+			"clientId": client.Id.Hex(),
+			"start":    start.Format(DateTimeLayout),
+			"room":     "1",
+		})
+		var appointment Appointment
+		json.NewDecoder(w.Body).Decode(&appointment)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+		}
+		return appointment
+	}
+	first := create(regular, start)
+	second := create(special, start.Add(2*time.Hour))
+	if first.EmployeeId != therapist.Id || first.Status != Planned || first.Duration != defaultDuration {
+		t.Errorf("Unexpected defaults: %+v", first)
+	}
+
+	if w := s.request("PUT", "/appointments", map[string]interface{}{"clientId": regular.Id.Hex()}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 without start, got: %d", w.Code)
+	}
+	if w := s.request("PATCH", "/appointments/"+first.Id.Hex(), map[string]interface{}{"status": "completed"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for completing with PATCH, got: %d", w.Code)
+	}
+
+	w := s.request("GET", "/employees/"+therapist.Id.Hex()+"/calendar/"+start.Format(ShortDateLayout), nil)
+	var calendar Calendar
+	json.NewDecoder(w.Body).Decode(&calendar)
+	if w.Code != http.StatusOK || len(calendar.Days) != 7 {
+		t.Fatalf("Calendar failed: %d %s", w.Code, w.Body)
+	}
+	weekday := (int(start.Weekday()) + 6) % 7
+	if day := calendar.Days[weekday]; day.Date != start.Format(ShortDateLayout) || len(day.Appointments) != 2 {
+		t.Errorf("Expected both appointments on %s, got: %+v", start.Format(ShortDateLayout), calendar.Days)
+	}
+	admin, _ := app.Employees.GetByName(ctx, "admin")
+	if w := s.request("GET", "/employees/"+admin.Id.Hex()+"/calendar/2020-W10", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected calendar of another employee to be hidden, got: %d", w.Code)
+	}
+
+	prices := map[Appointment]Money{first: units(90), second: units(70)}
+	for appointment, price := range prices {
+		w := s.request("POST", "/appointments/"+appointment.Id.Hex()+"/complete", nil)
+		var completion struct {
+			Appointment Appointment `json:"appointment"`
+			Record      Record      `json:"record"`
+		}
+		json.NewDecoder(w.Body).Decode(&completion)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Complete failed: %d %s", w.Code, w.Body)
+		}
+		record := completion.Record
+		if !record.Price.Equal(price) || !record.EmployeeIncome.Equal(units(50)) || record.Date != appointment.Start || record.AppointmentId != appointment.Id {
+			t.Errorf("Unexpected record: %+v", record)
+		}
+		if completion.Appointment.Status != Completed || completion.Appointment.RecordId != record.Id {
+			t.Errorf("Unexpected appointment: %+v", completion.Appointment)
+		}
+	}
+
+	if w := s.request("POST", "/appointments/"+first.Id.Hex()+"/complete", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for completing twice, got: %d", w.Code)
+	}
+	if count, _ := app.Records.Count(ctx, RecordFilter{}); count != 2 {
+		t.Errorf("Expected 2 records, got: %d", count)
+	}
+}
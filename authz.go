@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EmployeeHandlerFunc handles a request on behalf of the logged in employee, nil if nobody is logged in.
+type EmployeeHandlerFunc func(http.ResponseWriter, *http.Request, *Employee)
+
+// RequireLogin rejects anonymous callers with 401.
+func RequireLogin(h EmployeeHandlerFunc) EmployeeHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, e *Employee) {
+		if e == nil {
+			http.Error(w, "Please log in", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, e)
+	}
+}
+
+// RequireAdmin rejects anonymous callers with 401 and other employees with 403.
+func RequireAdmin(h EmployeeHandlerFunc) EmployeeHandlerFunc {
+	return RequireLogin(func(w http.ResponseWriter, r *http.Request, e *Employee) {
+		if !e.Admin {
+			accessDenied(w)
+			return
+		}
+		h(w, r, e)
+	})
+}
+
+func accessDenied(w http.ResponseWriter) {
+	http.Error(w, "Access denied", http.StatusForbidden)
+}
+
+// EditWindow limits how far back non-admin employees may create, change
+// or remove records. The zero value does not limit anything.
+type EditWindow struct {
+	CurrentMonth bool
+	Duration     time.Duration
+}
+
+// ParseEditWindow accepts "month" for the current calendar month,
+// "unlimited", or a duration such as "168h".
+func ParseEditWindow(s string) (EditWindow, error) {
+	switch s {
+	case "month":
+		return EditWindow{CurrentMonth: true}, nil
+	case "unlimited", "":
+		return EditWindow{}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return EditWindow{}, fmt.Errorf("invalid edit window %q: %v", s, err)
+	}
+	return EditWindow{Duration: d}, nil
+}
+
+// Start returns the earliest date which may be edited, zero if unlimited.
+func (ew EditWindow) Start(now time.Time) time.Time {
+	if ew.CurrentMonth {
+		now = now.In(app.Location)
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, app.Location)
+	}
+	if ew.Duration > 0 {
+		return now.Add(-ew.Duration)
+	}
+	return time.Time{}
+}
+
+func (ew EditWindow) Contains(date, now time.Time) bool {
+	return !date.Before(ew.Start(now))
+}
+
+// authorizeRecord checks that the employee may manage the record:
+// admins manage all records, others only their own within the edit window.
+func authorizeRecord(e *Employee, record *Record) error {
+	if e.Admin {
+		return nil
+	}
+	if record.EmployeeId != e.Id {
+		return &APIError{
+			Status:  http.StatusForbidden,
+			Code:    "not-owner",
+			Message: "Records of other employees cannot be changed",
+		}
+	}
+	now := time.Now()
+	if !app.RecordEditWindow.Contains(record.Date.Time(), now) {
+		start := primitive.NewDateTimeFromTime(app.RecordEditWindow.Start(now))
+		return &APIError{
+			Status:  http.StatusForbidden,
+			Code:    "edit-window-closed",
+			Message: "Records before " + MarshalDate(start, DateTimeLayout) + " cannot be changed",
+			Details: map[string]string{"editableFrom": MarshalDate(start, DateTimeLayout)},
+		}
+	}
+	return nil
+}
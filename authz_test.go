@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRouteAuthorization(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist"}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	id := primitive.NewObjectID().Hex()
+
+	const (
+		login = iota
+		admin
+	)
+	routes := []struct {
+		method, path string
+		policy       int
+	}{
+		{"GET", "/employees", admin},
+		{"GET", "/employees?only-names=true", login},
+		{"PUT", "/employees", admin},
+		{"GET", "/employees/" + id, admin},
+		{"POST", "/employees/" + id, admin},
+		{"DELETE", "/employees/" + id, admin},
+		{"GET", "/employees/lockouts", admin},
+		{"DELETE", "/employees/lockouts", admin},
+		{"DELETE", "/employees/" + id + "/lockout", admin},
+		{"GET", "/records", login},
+		{"GET", "/records.csv", admin},
+		{"GET", "/records/2020-01.xlsx", admin},
+		{"GET", "/records.xlsx?from=2020-01-01&to=2020-01-31", admin},
+		{"PUT", "/records", login},
+		{"GET", "/records/" + id, login},
+		{"POST", "/records/" + id, login},
+		{"DELETE", "/records/" + id, login},
+		{"GET", "/clients", login},
+		{"PUT", "/clients", login},
+		{"GET", "/clients/" + id, login},
+		{"POST", "/clients/" + id, login},
+		{"DELETE", "/clients/" + id, admin},
+		{"POST", "/clients/" + id + "/restore", admin},
+		{"POST", "/employees/" + id + "/restore", admin},
+		{"GET", "/appointments", login},
+		{"PUT", "/appointments", login},
+		{"GET", "/appointments/" + id, login},
+		{"POST", "/appointments/" + id, login},
+		{"DELETE", "/appointments/" + id, login},
+		{"POST", "/appointments/" + id + "/complete", login},
+		{"GET", "/employees/" + id + "/calendar/2020-W10", login},
+		{"POST", "/employees/" + id + "/feed-token", login},
+		{"GET", "/reports/hours", login},
+		{"GET", "/reports/revenue", admin},
+		{"GET", "/payroll/2020-01", login},
+		{"GET", "/payroll/2020-01.xlsx", login},
+		{"GET", "/payroll/2020-01.html", login},
+		{"POST", "/compensation/2020-01/recalculate", admin},
+		{"GET", "/services", login},
+		{"PUT", "/services", admin},
+		{"GET", "/services/" + id, login},
+		{"PATCH", "/services/" + id, admin},
+		{"GET", "/clients/" + id + "/packages", login},
+		{"PUT", "/clients/" + id + "/packages", login},
+		{"GET", "/packages/" + id, login},
+		{"PATCH", "/packages/" + id, admin},
+		{"DELETE", "/packages/" + id, admin},
+		{"GET", "/reports/packages", admin},
+		{"GET", "/clients/" + id + "/payments", login},
+		{"PUT", "/clients/" + id + "/payments", login},
+		{"GET", "/clients/" + id + "/statement", login},
+		{"GET", "/payments/" + id, login},
+		{"PATCH", "/payments/" + id, admin},
+		{"DELETE", "/payments/" + id, admin},
+		{"GET", "/reports/balances", admin},
+		{"GET", "/invoices", admin},
+		{"PUT", "/invoices", admin},
+		{"GET", "/invoices/" + id, admin},
+		{"GET", "/invoices/" + id + ".pdf", admin},
+		{"PUT", "/invoices/" + id + "/corrections", admin},
+		{"GET", "/series", login},
+		{"PUT", "/series", login},
+		{"GET", "/series/" + id, login},
+		{"POST", "/series/" + id, login},
+		{"DELETE", "/series/" + id, login},
+		{"POST", "/series/" + id + "/occurrences/2020-03-02", login},
+		{"DELETE", "/series/" + id + "/occurrences/2020-03-02", login},
+		{"POST", "/series/" + id + "/occurrences/2020-03-02/complete", login},
+	}
+
+	anonymous := newTestSession(t)
+	employee := newTestSession(t)
+	if w := employee.login("therapist", "1111"); w.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d", w.Code)
+	}
+
+	for _, route := range routes {
+		w := anonymous.request(route.method, route.path, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 for anonymous caller, got: %d", route.method, route.path, w.Code)
+		}
+
+		w = employee.request(route.method, route.path, nil)
+		switch route.policy {
+		case admin:
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s: expected 403 for non-admin, got: %d", route.method, route.path, w.Code)
+			}
+		case login:
+			if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+				t.Errorf("%s %s: expected access for employee, got: %d", route.method, route.path, w.Code)
+			}
+		}
+	}
+}
+
+func TestRecordOwnership(t *testing.T) {
+	setupTestApp(t)
+	app.RecordEditWindow = EditWindow{CurrentMonth: true}
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist"}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	admin, _ := app.Employees.GetByName(ctx, "admin")
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+
+	now := time.Now().In(app.Location)
+	today := MarshalDate(primitive.NewDateTimeFromTime(now), DateTimeLayout)
+	lastYear := MarshalDate(primitive.NewDateTimeFromTime(now.AddDate(-1, 0, 0)), DateTimeLayout)
+
+	adminRecord := Record{EmployeeId: admin.Id, Date: primitive.NewDateTimeFromTime(now)}
+	app.Records.Insert(ctx, &adminRecord)
+	oldRecord := Record{EmployeeId: therapist.Id, Date: primitive.NewDateTimeFromTime(now.AddDate(-1, 0, 0))}
+	app.Records.Insert(ctx, &oldRecord)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+
+	w := s.request("PUT", "/records", map[string]interface{}{"date": today, "price": 90, "clientId": client.Id.Hex()})
+	var own Record
+	json.NewDecoder(w.Body).Decode(&own)
+	if w.Code != http.StatusOK || own.EmployeeId != therapist.Id {
+		t.Fatalf("Expected record to be assigned to the caller, got: %d %+v", w.Code, own)
+	}
+
+	denied := []struct {
+		method, path string
+		body         interface{}
+		code         string
+	}{
+		{"PUT", "/records", map[string]interface{}{"date": today, "employeeId": admin.Id.Hex()}, "not-owner"},
+		{"PUT", "/records", map[string]interface{}{"date": lastYear}, "edit-window-closed"},
+		{"POST", "/records/" + adminRecord.Id.Hex(), map[string]interface{}{"date": today}, "not-owner"},
+		{"DELETE", "/records/" + adminRecord.Id.Hex(), nil, "not-owner"},
+		{"POST", "/records/" + own.Id.Hex(), map[string]interface{}{"date": today, "employeeId": admin.Id.Hex()}, "not-owner"},
+		{"POST", "/records/" + own.Id.Hex(), map[string]interface{}{"date": lastYear}, "edit-window-closed"},
+		{"DELETE", "/records/" + oldRecord.Id.Hex(), nil, "edit-window-closed"},
+	}
+	for _, d := range denied {
+		w := s.request(d.method, d.path, d.body)
+		var apiErr APIError
+		json.NewDecoder(w.Body).Decode(&apiErr)
+		if w.Code != http.StatusForbidden || apiErr.Code != d.code {
+			t.Errorf("%s %s: expected 403 %s, got: %d %+v", d.method, d.path, d.code, w.Code, apiErr)
+		}
+	}
+
+	if w := s.request("DELETE", "/records/"+own.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Errorf("Expected owner to remove own record, got: %d %s", w.Code, w.Body)
+	}
+
+	a := newTestSession(t)
+	a.login("admin", "1234")
+	if w := a.request("DELETE", "/records/"+oldRecord.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Errorf("Expected admin to remove any record, got: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CompensationScheme tells how the income of a session is computed from a CompensationRule.
+type CompensationScheme string
+
+const (
+	// Hourly pays Amount per hour, prorated by the duration of the session.
+	Hourly CompensationScheme = "hourly"
+	// PerSession pays Amount for each session regardless of its duration.
+	PerSession CompensationScheme = "per-session"
+	// PercentOfPrice pays Percent of the price of the session.
+	PercentOfPrice CompensationScheme = "percent"
+)
+
+// CompensationRule is the way an employee is paid from EffectiveFrom on, until the next rule.
+type CompensationRule struct {
+	EffectiveFrom string             `json:"effectiveFrom"` // day in ShortDateLayout
+	Scheme        CompensationScheme `json:"scheme"`
+	Amount        Money              `json:"amount"`
+	Percent       float64            `json:"percent"`
+	// HomeVisitAmount and HomeVisitPercent replace Amount and Percent for home visits, unless zero.
+	HomeVisitAmount  Money   `json:"homeVisitAmount"`
+	HomeVisitPercent float64 `json:"homeVisitPercent"`
+	// BonusAmount is added to every session of a month above the first BonusThreshold ones.
+	BonusThreshold int   `json:"bonusThreshold"`
+	BonusAmount    Money `json:"bonusAmount"`
+}
+
+func invalidCompensation(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-compensation", Message: message}
+}
+
+// validateCompensation checks the rules of the employee and sorts them by date.
+func (e *Employee) validateCompensation() error {
+	days := make(map[string]bool)
+	for _, rule := range e.Compensation {
+		if _, err := time.ParseInLocation(ShortDateLayout, rule.EffectiveFrom, app.Location); err != nil {
+			return invalidCompensation(fmt.Sprintf("Invalid effective date %q", rule.EffectiveFrom))
+		}
+		if days[rule.EffectiveFrom] {
+			return invalidCompensation("Only one rule can take effect on " + rule.EffectiveFrom)
+		}
+		days[rule.EffectiveFrom] = true
+		switch rule.Scheme {
+		case Hourly, PerSession:
+		case PercentOfPrice:
+			if rule.Percent > 100 || rule.HomeVisitPercent > 100 {
+				return invalidCompensation("Percentage cannot exceed 100")
+			}
+		default:
+			return invalidCompensation(fmt.Sprintf("Unknown scheme %q", rule.Scheme))
+		}
+		if rule.Amount.IsNegative() || rule.HomeVisitAmount.IsNegative() || rule.BonusAmount.IsNegative() ||
+			rule.Percent < 0 || rule.HomeVisitPercent < 0 || rule.BonusThreshold < 0 {
+			return invalidCompensation("Amounts cannot be negative")
+		}
+	}
+	sort.Slice(e.Compensation, func(i, j int) bool {
+		return e.Compensation[i].EffectiveFrom < e.Compensation[j].EffectiveFrom
+	})
+	return nil
+}
+
+// CompensationRule returns the rule in effect on the date. Employees without
+// rules in effect are paid HourlyNet per hour.
+func (e *Employee) CompensationRule(date primitive.DateTime) CompensationRule {
+	day := MarshalDate(date, ShortDateLayout)
+	rule := CompensationRule{Scheme: Hourly, Amount: e.HourlyNet}
+	for _, r := range e.Compensation {
+		if r.EffectiveFrom > day {
+			break
+		}
+		rule = r
+	}
+	return rule
+}
+
+// Income of the session, which is the ordinal-th session of the employee in its month, counted from 1.
+func (rule CompensationRule) Income(record *Record, ordinal int) Money {
+	amount, percent := rule.Amount, rule.Percent
+	if record.HomeVisit && !rule.HomeVisitAmount.IsZero() {
+		amount = rule.HomeVisitAmount
+	}
+	if record.HomeVisit && rule.HomeVisitPercent > 0 {
+		percent = rule.HomeVisitPercent
+	}
+	var income Money
+	switch rule.Scheme {
+	case PerSession:
+		income = amount
+	case PercentOfPrice:
+		income = record.Price.Percent(percent)
+	default:
+		income = prorate(amount, record.Duration)
+	}
+	if !rule.BonusAmount.IsZero() && ordinal > rule.BonusThreshold {
+		income = income.Add(rule.BonusAmount)
+	}
+	return income
+}
+
+// monthBounds returns the first instants of the month of t and of the next one, in the clinic time zone.
+func monthBounds(t time.Time) (time.Time, time.Time) {
+	t = t.In(app.Location)
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, app.Location)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// monthOrdinal counts the sessions of the employee in the month of the record up to the record.
+// Sessions at the same time are ordered by id, as RecordCursor does, records not stored yet come last.
+func monthOrdinal(ctx context.Context, record *Record) (int, error) {
+	start, _ := monthBounds(record.Date.Time())
+	filter := RecordFilter{EmployeeId: record.EmployeeId, From: start, To: record.Date.Time()}
+	count, err := app.Records.Count(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	filter.From, filter.To = record.Date.Time(), record.Date.Time().Add(time.Millisecond)
+	simultaneous, err := app.Records.List(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	for _, other := range simultaneous {
+		if other.Id != record.Id && (record.Id.IsZero() || other.Id.Hex() < record.Id.Hex()) {
+			count++
+		}
+	}
+	return int(count) + 1, nil
+}
+
+// renumberSessions adds or takes away the bonus of the employee's other sessions
+// in the month of the added and of the removed session, whose ordinals it has
+// shifted. The rest of their incomes stays as it is, rules changed since are
+// applied by RecalculateIncomes only. Failures are logged, the records stay saved.
+func renumberSessions(ctx context.Context, added, removed *Record) {
+	done := make(map[string]bool)
+	for _, record := range []*Record{added, removed} {
+		if record == nil {
+			continue
+		}
+		start, end := monthBounds(record.Date.Time())
+		key := record.EmployeeId.Hex() + start.Format("2006-01")
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		if err := renumberMonth(ctx, record.EmployeeId, start, end, added, removed); err != nil {
+			log.Printf("Cannot renumber sessions of employee %s in %s: %v", record.EmployeeId.Hex(), start.Format("2006-01"), err)
+		}
+	}
+}
+
+func renumberMonth(ctx context.Context, employeeId primitive.ObjectID, start, end time.Time, added, removed *Record) error {
+	employee, err := app.Employees.Get(ctx, employeeId)
+	if err != nil {
+		return err
+	}
+	records, err := app.Records.List(ctx, RecordFilter{EmployeeId: employeeId, From: start, To: end, Ascending: true})
+	if err != nil {
+		return err
+	}
+	// before tells whether the session of the month came before the record, in the order of RecordCursor
+	before := func(session, record *Record) bool {
+		if session == nil || session.EmployeeId != employeeId || session.Date.Time().Before(start) || !session.Date.Time().Before(end) {
+			return false
+		}
+		return session.Date < record.Date || (session.Date == record.Date && session.Id.Hex() < record.Id.Hex())
+	}
+	for i, record := range records {
+		if record.IncomeOverridden || (added != nil && record.Id == added.Id) {
+			continue
+		}
+		ordinal := i + 1
+		previous := ordinal
+		if before(added, &record) {
+			previous--
+		}
+		if before(removed, &record) {
+			previous++
+		}
+		rule := employee.CompensationRule(record.Date)
+		bonus, hadBonus := ordinal > rule.BonusThreshold, previous > rule.BonusThreshold
+		if rule.BonusAmount.IsZero() || bonus == hadBonus {
+			continue
+		}
+		if bonus {
+			record.EmployeeIncome = record.EmployeeIncome.Add(rule.BonusAmount)
+		} else {
+			record.EmployeeIncome = record.EmployeeIncome.Sub(rule.BonusAmount)
+		}
+		if err = app.Records.Update(ctx, record.Id, &record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncomeChange is a record whose income has been recalculated.
+type IncomeChange struct {
+	RecordId   primitive.ObjectID `json:"recordId"`
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	Date       string             `json:"date"`
+	From       Money              `json:"from"`
+	To         Money              `json:"to"`
+}
+
+type Recalculation struct {
+	Month   string         `json:"month"`
+	Records int            `json:"records"`
+	Changes []IncomeChange `json:"changes"`
+	DryRun  bool           `json:"dryRun"`
+}
+
+// RecalculateIncomes derives incomes of the records in the month again from the
+// rules in effect, e.g. after a rule has been changed retroactively. Incomes set
+// by hand stay as they are.
+func RecalculateIncomes(ctx context.Context, month time.Time, employeeId primitive.ObjectID, dryRun bool) (*Recalculation, error) {
+	start, end := monthBounds(month)
+	result := Recalculation{Month: start.Format("2006-01"), Changes: []IncomeChange{}, DryRun: dryRun}
+	// the bonus depends on the order of sessions, so all sessions of the employees are needed
+	records, err := app.Records.List(ctx, RecordFilter{EmployeeId: employeeId, From: start, To: end, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	_, employees, err := loadNameMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ordinals := make(map[primitive.ObjectID]int)
+	for _, record := range records {
+		ordinals[record.EmployeeId]++
+		if record.IncomeOverridden {
+			continue
+		}
+		employee := employees[record.EmployeeId]
+		income := employee.CompensationRule(record.Date).Income(&record, ordinals[record.EmployeeId])
+		if income.Equal(record.EmployeeIncome) {
+			continue
+		}
+		result.Changes = append(result.Changes, IncomeChange{
+			RecordId:   record.Id,
+			EmployeeId: record.EmployeeId,
+			Date:       MarshalDate(record.Date, DateTimeLayout),
+			From:       record.EmployeeIncome,
+			To:         income,
+		})
+		if !dryRun {
+			record.EmployeeIncome = income
+			if err = app.Records.Update(ctx, record.Id, &record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	result.Records = len(records)
+	if !dryRun {
+		log.Printf("Recalculated incomes of %s: %d of %d records changed.", result.Month, len(result.Changes), len(records))
+	}
+	return &result, nil
+}
+
+// recalculateIncomes is the admin endpoint for RecalculateIncomes, optionally
+// limited to an employee and run with dryRun=true to only preview changes.
+func recalculateIncomes(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var result *Recalculation
+	var employeeId primitive.ObjectID
+	query := r.URL.Query()
+	month, err := time.ParseInLocation("2006-01", mux.Vars(r)["month"], app.Location)
+	if err != nil {
+		err = invalidParameter("month", err)
+	}
+	if value := query.Get("employee"); value != "" && err == nil {
+		if employeeId, err = primitive.ObjectIDFromHex(value); err != nil {
+			err = invalidParameter("employee", err)
+		}
+	}
+	if err == nil {
+		result, err = RecalculateIncomes(ctx, month, employeeId, query.Get("dryRun") == "true")
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCompensationRule(t *testing.T) {
+	setupTestApp(t)
+	employee := Employee{HourlyNet: units(50), Compensation: []CompensationRule{
+		{EffectiveFrom: "2021-03-01", Scheme: PercentOfPrice, Percent: 50, HomeVisitPercent: 60},
+		{EffectiveFrom: "2021-01-01", Scheme: PerSession, Amount: units(40), BonusThreshold: 2, BonusAmount: units(5)},
+	}}
+	if err := employee.validateCompensation(); err != nil {
+		t.Fatal(err)
+	}
+	date := func(day string) primitive.DateTime {
+		t, _ := time.ParseInLocation(ShortDateLayout, day, app.Location)
+		return primitive.NewDateTimeFromTime(t.Add(10 * time.Hour))
+	}
+	tests := []struct {
+		day       string
+		homeVisit bool
+		ordinal   int
+		expected  Money
+	}{
+		{"2020-12-31", false, 1, NewMoney(3750)}, // hourly, before any rule
+		{"2021-01-01", false, 2, units(40)},
+		{"2021-02-28", false, 3, units(45)}, // with the bonus
+		{"2021-03-01", false, 3, NewMoney(4375)},
+		{"2021-03-01", true, 1, NewMoney(5250)},
+	}
+	for _, test := range tests {
+		record := Record{Date: date(test.day), Duration: 45, Price: NewMoney(8750), HomeVisit: test.homeVisit}
+		if income := employee.CompensationRule(record.Date).Income(&record, test.ordinal); !income.Equal(test.expected) {
+			t.Errorf("%+v: got %s", test, income)
+		}
+	}
+
+	for _, rules := range [][]CompensationRule{
+		{{EffectiveFrom: "2021-13-01", Scheme: Hourly}},
+		{{EffectiveFrom: "2021-01-01", Scheme: "weekly"}},
+		{{EffectiveFrom: "2021-01-01", Scheme: PercentOfPrice, Percent: 120}},
+		{{EffectiveFrom: "2021-01-01", Scheme: Hourly}, {EffectiveFrom: "2021-01-01", Scheme: PerSession}},
+	} {
+		employee := Employee{Compensation: rules}
+		if err, ok := employee.validateCompensation().(*APIError); !ok || err.Status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %+v, got: %v", rules, err)
+		}
+	}
+}
+
+func TestRecalculateIncomes(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(60)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+
+	month, _ := monthBounds(time.Now().AddDate(0, -1, 0))
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	var records []Record
+	for i, income := range []int{0, 0, 70} {
+		w := s.request("PUT", "/records", map[string]interface{}{
+			"clientId":       client.Id.Hex(),
+			"date":           month.Add(time.Duration(24*i+9) * time.Hour).Format(DateTimeLayout),
+			"employeeIncome": income,
+		})
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+		}
+		records = append(records, record)
+	}
+
+	// a retroactive rule paying a bonus from the second session on
+	therapist.Compensation = []CompensationRule{{EffectiveFrom: month.Format(ShortDateLayout), Scheme: PerSession, Amount: units(50), BonusThreshold: 1, BonusAmount: units(15)}}
+	app.Employees.Update(ctx, therapist.Id, &therapist)
+
+	path := "/compensation/" + month.Format("2006-01") + "/recalculate"
+	if w := s.request("POST", path, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-admin, got: %d", w.Code)
+	}
+	s.login("admin", "1234")
+	recalculate := func(query string) Recalculation {
+		w := s.request("POST", path+query, nil)
+		var result Recalculation
+		json.NewDecoder(w.Body).Decode(&result)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Recalculation failed: %d %s", w.Code, w.Body)
+		}
+		return result
+	}
+	result := recalculate("?dryRun=true")
+	if !result.DryRun || result.Records != 3 || len(result.Changes) != 2 || !result.Changes[1].To.Equal(units(65)) {
+		t.Errorf("Unexpected dry run: %+v", result)
+	}
+	if record, _ := app.Records.Get(ctx, records[0].Id); !record.EmployeeIncome.Equal(units(60)) {
+		t.Errorf("Dry run changed the income: %s", record.EmployeeIncome)
+	}
+
+	result = recalculate("?employee=" + therapist.Id.Hex())
+	if result.DryRun || len(result.Changes) != 2 {
+		t.Errorf("Unexpected recalculation: %+v", result)
+	}
+	for i, expected := range []int64{50, 65, 70} {
+		if record, _ := app.Records.Get(ctx, records[i].Id); !record.EmployeeIncome.Equal(units(expected)) {
+			t.Errorf("Expected income %d of record %d, got: %s", expected, i, record.EmployeeIncome)
+		}
+	}
+	if result = recalculate(""); len(result.Changes) != 0 {
+		t.Errorf("Expected no more changes, got: %+v", result.Changes)
+	}
+}
+
+func TestIncomesFollowSessionOrder(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	month, _ := monthBounds(time.Now().AddDate(0, -1, 0))
+	therapist := Employee{Name: "Therapist", Compensation: []CompensationRule{
+		{EffectiveFrom: month.Format(ShortDateLayout), Scheme: PerSession, Amount: units(50), BonusThreshold: 1, BonusAmount: units(15)},
+	}}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	create := func(hours int) Record {
+		w := s.request("PUT", "/records", map[string]interface{}{
+			"clientId": client.Id.Hex(),
+			"date":     month.Add(time.Duration(hours) * time.Hour).Format(DateTimeLayout),
+		})
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+		}
+		return record
+	}
+	expect := func(records []Record, incomes ...int64) {
+		t.Helper()
+		for i, expected := range incomes {
+			if record, _ := app.Records.Get(ctx, records[i].Id); !record.EmployeeIncome.Equal(units(expected)) {
+				t.Errorf("Expected income %d of record %d, got: %s", expected, i, record.EmployeeIncome)
+			}
+		}
+	}
+
+	// sessions at the same time are ordered by id, the ones not stored yet come last
+	at := primitive.NewDateTimeFromTime(month.Add(33 * time.Hour))
+	records := make([]Record, 2)
+	for i, income := range []int64{50, 65} {
+		records[i] = Record{EmployeeId: therapist.Id, ClientId: client.Id, Date: at, Duration: 60, EmployeeIncome: units(income)}
+		app.Records.Insert(ctx, &records[i])
+	}
+	for i, record := range append(records, Record{EmployeeId: therapist.Id, Date: at}) {
+		if ordinal, err := monthOrdinal(ctx, &record); err != nil || ordinal != i+1 {
+			t.Errorf("Expected ordinal %d of record %d, got: %d %v", i+1, i, ordinal, err)
+		}
+	}
+
+	// a rule changed retroactively is applied to new sessions, the others only gain or lose the bonus
+	therapist.Compensation[0].Amount = units(40)
+	app.Employees.Update(ctx, therapist.Id, &therapist)
+	earlier := create(9)
+	expect(append(records, earlier), 65, 65, 40)
+
+	if w := s.request("DELETE", "/records/"+earlier.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body)
+	}
+	expect(records, 50, 65)
+
+	if w := s.request("PATCH", "/records/"+records[0].Id.Hex(), map[string]interface{}{"date": month.Add(57 * time.Hour).Format(DateTimeLayout)}); w.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", w.Code, w.Body)
+	}
+	expect(records, 55, 50)
+}
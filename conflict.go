@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxConflicts limits how many entries are listed in a scheduling-conflict error.
+const maxConflicts = 20
+
+// seriesConflictHorizon limits how far occurrences of open-ended series are checked for conflicts.
+const seriesConflictHorizon = 365 * 24 * time.Hour
+
+// slot is a period of time taken by an employee, a client and optionally a room.
+type slot struct {
+	kind       string             // appointment or record
+	id         primitive.ObjectID // zero for new entries and occurrences not stored
+	linkId     primitive.ObjectID // record of a completed appointment, appointment of a record
+	seriesId   primitive.ObjectID
+	occurrence string
+	employeeId primitive.ObjectID
+	clientId   primitive.ObjectID
+	room       string
+	start, end time.Time
+}
+
+func appointmentSlot(a *Appointment) slot {
+	return slot{
+		kind:       "appointment",
+		id:         a.Id,
+		linkId:     a.RecordId,
+		seriesId:   a.SeriesId,
+		occurrence: a.Occurrence,
+		employeeId: a.EmployeeId,
+		clientId:   a.ClientId,
+		room:       a.Room,
+		start:      a.Start.Time(),
+		end:        a.End().Time(),
+	}
+}
+
+func recordSlot(r *Record) slot {
+	return slot{
+		kind:       "record",
+		id:         r.Id,
+		linkId:     r.AppointmentId,
+		employeeId: r.EmployeeId,
+		clientId:   r.ClientId,
+		start:      r.Date.Time(),
+		end:        r.End().Time(),
+	}
+}
+
+// seriesSlots returns the occurrences of the series as slots, up to the horizon.
+func seriesSlots(s *Series) []slot {
+	from := s.Start.Time()
+	var slots []slot
+	for _, start := range s.Occurrences(from, from.Add(seriesConflictHorizon)) {
+		occurrence := s.Appointment(start)
+		slots = append(slots, appointmentSlot(&occurrence))
+	}
+	return slots
+}
+
+// moved tells whether the slot takes another time, person or room than before.
+func (s slot) moved(before slot) bool {
+	return !s.start.Equal(before.start) || !s.end.Equal(before.end) || s.employeeId != before.employeeId ||
+		s.clientId != before.clientId || s.room != before.room
+}
+
+// same tells whether both slots are the same entry, e.g. before and after a change.
+func (s slot) same(other slot) bool {
+	if !s.id.IsZero() && (s.id == other.id || s.id == other.linkId) {
+		return true
+	}
+	return !s.seriesId.IsZero() && s.seriesId == other.seriesId && s.occurrence == other.occurrence
+}
+
+// Conflict describes an entry overlapping with the one being saved.
+type Conflict struct {
+	Kind       string             `json:"kind"`
+	Id         primitive.ObjectID `json:"id"`
+	SeriesId   primitive.ObjectID `json:"seriesId,omitempty"`
+	Occurrence string             `json:"occurrence,omitempty"`
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	ClientId   primitive.ObjectID `json:"clientId"`
+	Room       string             `json:"room,omitempty"`
+	Start      string             `json:"start"`
+	End        string             `json:"end"`
+	With       []string           `json:"with"` // employee, client and/or room
+}
+
+// overlap returns what both slots share at the same time.
+func overlap(s, other slot) []string {
+	if !s.start.Before(other.end) || !other.start.Before(s.end) {
+		return nil
+	}
+	var with []string
+	if s.employeeId == other.employeeId {
+		with = append(with, "employee")
+	}
+	if s.clientId == other.clientId {
+		with = append(with, "client")
+	}
+	if s.room != "" && s.room == other.room {
+		with = append(with, "room")
+	}
+	return with
+}
+
+// findConflicts returns stored and expanded entries overlapping with the
+// slots. Entries for which ignore returns true are skipped, so are the ones
+// which are not going to take place.
+func findConflicts(ctx context.Context, slots []slot, ignore func(slot) bool) ([]Conflict, error) {
+	if len(slots) == 0 {
+		return nil, nil
+	}
+	from, to := slots[0].start, slots[0].end
+	for _, s := range slots {
+		if s.start.Before(from) {
+			from = s.start
+		}
+		if s.end.After(to) {
+			to = s.end
+		}
+	}
+
+	// sessions last less than a day, earlier ones cannot overlap
+	appointments, err := ListAppointments(ctx, AppointmentFilter{From: from.AddDate(0, 0, -1), To: to})
+	if err != nil {
+		return nil, err
+	}
+	records, err := app.Records.List(ctx, RecordFilter{From: from.AddDate(0, 0, -1), To: to, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	var existing []slot
+	for i := range appointments {
+		// completed appointments are checked as records
+		if appointments[i].Status == Planned {
+			existing = append(existing, appointmentSlot(&appointments[i]))
+		}
+	}
+	for i := range records {
+		existing = append(existing, recordSlot(&records[i]))
+	}
+
+	var conflicts []Conflict
+	for _, other := range existing {
+		if ignore != nil && ignore(other) {
+			continue
+		}
+		for _, s := range slots {
+			if s.same(other) {
+				continue
+			}
+			if with := overlap(s, other); len(with) > 0 {
+				conflicts = append(conflicts, Conflict{
+					Kind:       other.kind,
+					Id:         other.id,
+					SeriesId:   other.seriesId,
+					Occurrence: other.occurrence,
+					EmployeeId: other.employeeId,
+					ClientId:   other.clientId,
+					Room:       other.room,
+					Start:      other.start.In(app.Location).Format(DateTimeLayout),
+					End:        other.end.In(app.Location).Format(DateTimeLayout),
+					With:       with,
+				})
+				break
+			}
+		}
+		if len(conflicts) == maxConflicts {
+			break
+		}
+	}
+	return conflicts, nil
+}
+
+// checkConflicts checks planned appointments which are new, moved or planned again.
+func (a *Appointment) checkConflicts(ctx context.Context, r *http.Request, e *Employee, stored *Appointment) (*ConflictOverride, error) {
+	if stored == nil {
+		stored = &Appointment{}
+	} else if stored.Status == Planned && !appointmentSlot(a).moved(appointmentSlot(stored)) {
+		return stored.Override, nil
+	}
+	if a.Status != Planned {
+		return stored.Override, nil
+	}
+	return checkConflicts(ctx, r, e, stored.Override, []slot{appointmentSlot(a)}, nil)
+}
+
+// ConflictOverride records that an admin saved the entry despite scheduling conflicts.
+type ConflictOverride struct {
+	By        primitive.ObjectID `json:"by"`
+	At        primitive.DateTime `json:"at"`
+	Conflicts int                `json:"conflicts"`
+}
+
+// overrideRequested reads the override parameter, which only admins may use.
+func overrideRequested(r *http.Request, e *Employee) (bool, error) {
+	value := r.URL.Query().Get("override")
+	if value == "" {
+		return false, nil
+	}
+	override, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, invalidParameter("override", err)
+	}
+	if override && !e.Admin {
+		return false, &APIError{
+			Status:  http.StatusForbidden,
+			Code:    "override-forbidden",
+			Message: "Only admins can override scheduling conflicts",
+		}
+	}
+	return override, nil
+}
+
+// checkConflicts fails with 409 listing the conflicts of the slots, unless an
+// admin overrides them. It returns the override to be recorded with the entry,
+// none when there is nothing to override any more.
+func checkConflicts(ctx context.Context, r *http.Request, e *Employee, previous *ConflictOverride, slots []slot, ignore func(slot) bool) (*ConflictOverride, error) {
+	override, err := overrideRequested(r, e)
+	if err != nil {
+		return previous, err
+	}
+	conflicts, err := findConflicts(ctx, slots, ignore)
+	if err != nil {
+		return previous, err
+	}
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+	if override {
+		return &ConflictOverride{By: e.Id, At: primitive.NewDateTimeFromTime(time.Now()), Conflicts: len(conflicts)}, nil
+	}
+	return previous, &APIError{
+		Status:  http.StatusConflict,
+		Code:    "scheduling-conflict",
+		Message: "The entry overlaps with other appointments or sessions",
+		Details: conflicts,
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSchedulingConflicts(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(50)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	var clients [3]Client
+	for i := range clients {
+		clients[i].Name = "Client " + string('A'+rune(i))
+		app.Clients.Insert(ctx, &clients[i])
+	}
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	start := time.Date(2020, 3, 2, 9, 0, 0, 0, app.Location)
+	appointment := func(client Client, start time.Time, room string) map[string]interface{} {
+		return map[string]interface{}{
+			"clientId": client.Id.Hex(),
+			"start":    start.Format(DateTimeLayout),
+			"room":     room,
+		}
+	}
+	conflicts := func(w *httptest.ResponseRecorder) []Conflict {
+		var body struct {
+			Code    string     `json:"code"`
+			Details []Conflict `json:"details"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		if body.Code != "scheduling-conflict" {
+			t.Errorf("Expected a scheduling-conflict error, got: %s", body.Code)
+		}
+		return body.Details
+	}
+
+	w := s.request("PUT", "/appointments", appointment(clients[0], start, "1"))
+	var first Appointment
+	json.NewDecoder(w.Body).Decode(&first)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+
+	// the therapist is busy
+	w = s.request("PUT", "/appointments", appointment(clients[1], start.Add(30*time.Minute), "2"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a double-booked employee, got: %d", w.Code)
+	}
+	if c := conflicts(w); len(c) != 1 || c[0].Id != first.Id || len(c[0].With) != 1 || c[0].With[0] != "employee" {
+		t.Errorf("Unexpected conflicts: %+v", c)
+	}
+	if w := s.request("PUT", "/appointments?override=true", appointment(clients[1], start.Add(30*time.Minute), "2")); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an override by non-admin, got: %d", w.Code)
+	}
+
+	// the room is taken, the admin overrides
+	w = admin.request("PUT", "/appointments", appointment(clients[2], start.Add(30*time.Minute), "1"))
+	if c := conflicts(w); w.Code != http.StatusConflict || len(c) != 1 || c[0].With[0] != "room" {
+		t.Errorf("Expected 409 for a taken room, got: %d %+v", w.Code, c)
+	}
+	w = admin.request("PUT", "/appointments?override=true", appointment(clients[2], start.Add(30*time.Minute), "1"))
+	var overridden Appointment
+	json.NewDecoder(w.Body).Decode(&overridden)
+	if w.Code != http.StatusOK || overridden.Override == nil || overridden.Override.Conflicts != 1 {
+		t.Fatalf("Expected the override to be recorded, got: %d %+v", w.Code, overridden)
+	}
+
+	// sessions are checked as well
+	w = admin.request("PUT", "/records", map[string]interface{}{
+		"employeeId": therapist.Id.Hex(),
+		"clientId":   clients[0].Id.Hex(),
+		"date":       start.Add(15 * time.Minute).Format(DateTimeLayout),
+		"price":      90,
+	})
+	if c := conflicts(w); w.Code != http.StatusConflict || len(c) != 1 || len(c[0].With) != 2 || c[0].With[1] != "client" {
+		t.Errorf("Expected 409 for a record, got: %d %+v", w.Code, c)
+	}
+
+	// entries which are not moved are not checked again
+	if w := s.request("PATCH", "/appointments/"+first.Id.Hex(), map[string]interface{}{"room": "1"}); w.Code != http.StatusOK {
+		t.Errorf("Expected an update in place to succeed, got: %d %s", w.Code, w.Body)
+	}
+	if w := s.request("PATCH", "/appointments/"+first.Id.Hex(), map[string]interface{}{"duration": 45}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a moved appointment, got: %d", w.Code)
+	}
+	if w := s.request("PATCH", "/appointments/"+first.Id.Hex(), map[string]interface{}{"status": "cancelled"}); w.Code != http.StatusOK {
+		t.Errorf("Expected cancelling to succeed, got: %d %s", w.Code, w.Body)
+	}
+
+	// occurrences of series are checked as well
+	w = s.request("PUT", "/series", map[string]interface{}{
+		"clientId": clients[2].Id.Hex(),
+		"start":    start.AddDate(0, 0, -14).Add(45 * time.Minute).Format(DateTimeLayout),
+		"rrule":    "FREQ=WEEKLY;COUNT=4",
+	})
+	if c := conflicts(w); w.Code != http.StatusConflict || len(c) != 1 || c[0].Id != overridden.Id {
+		t.Errorf("Expected 409 for a series, got: %d %+v", w.Code, c)
+	}
+
+	// the override is dropped once the entry is moved away from the conflicts
+	w = admin.request("PATCH", "/appointments/"+overridden.Id.Hex(), map[string]interface{}{"start": start.Add(5 * time.Hour).Format(DateTimeLayout)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the move to succeed, got: %d %s", w.Code, w.Body)
+	}
+	if stored, _ := app.Appointments.Get(ctx, overridden.Id); stored.Override != nil {
+		t.Errorf("Expected the override to be cleared, got: %+v", stored.Override)
+	}
+}
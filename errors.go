@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// APIError is reported to the client as a JSON document, so that the UI
+// can tell apart the reasons of a rejected request.
+type APIError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"error"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// writeError maps known errors to HTTP status codes, anything else is a 500.
+func writeError(w http.ResponseWriter, err error) {
+	if apiErr, ok := err.(*APIError); ok {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(apiErr.Status)
+		json.NewEncoder(w).Encode(apiErr)
+	} else if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err == ErrCodeRequired || err == ErrCodeDigits || err == ErrNameRequired {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err == ErrDuplicateName || err == ErrDuplicate {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ETag identifies a version of a single document. The tag is strong, a version
+// is stored once and its representation does not change.
+func ETag(id primitive.ObjectID, version int64) string {
+	return fmt.Sprintf(`"%s-%d"`, id.Hex(), version)
+}
+
+func (e *Employee) ETag() string {
+	return ETag(e.Id, e.Version)
+}
+
+func (c *Client) ETag() string {
+	return ETag(c.Id, c.Version)
+}
+
+func (r *Record) ETag() string {
+	return ETag(r.Id, r.Version)
+}
+
+func (a *Appointment) ETag() string {
+	return ETag(a.Id, a.Version)
+}
+
+func (s *Series) ETag() string {
+	return ETag(s.Id, s.Version)
+}
+
+func (s *Service) ETag() string {
+	return ETag(s.Id, s.Version)
+}
+
+func (p *Package) ETag() string {
+	return ETag(p.Id, p.Version)
+}
+
+func (p *Payment) ETag() string {
+	return ETag(p.Id, p.Version)
+}
+
+// ETag of an invoice never changes, issued invoices are immutable.
+func (i *Invoice) ETag() string {
+	return ETag(i.Id, 1)
+}
+
+// listETag builds a weak tag of a listing from the tags of its documents.
+func listETag(tags []string) string {
+	h := fnv.New64a()
+	for _, tag := range tags {
+		h.Write([]byte(tag))
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// ifMatch tells whether the If-Match header of the request, if any, matches the current tag.
+// Tags are compared strongly as RFC 7232 requires, so weak ones never match.
+func ifMatch(r *http.Request, current string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == current && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion returns the version a delete is conditional on.
+func expectedVersion(r *http.Request, version int64) int64 {
+	if r.Header.Get("If-Match") == "" {
+		return AnyVersion
+	}
+	return version
+}
+
+// writeConflict rejects a stale write with 412, sending back the current
+// copy of the document so that the UI can let the user resolve the conflict.
+func writeConflict(w http.ResponseWriter, etag string, current interface{}) {
+	w.Header().Set("ETag", etag)
+	writeError(w, &APIError{
+		Status:  http.StatusPreconditionFailed,
+		Code:    "version-conflict",
+		Message: "The entry has been modified in the meantime",
+		Details: current,
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// exportRow is a record being exported with what its columns refer to.
+type exportRow struct {
+	record   *Record
+	client   *Client
+	employee *Employee
+	service  *Service
+	decimal  string // separator of decimals
+}
+
+func (x *exportRow) number(s string) string {
+	return strings.Replace(s, ".", x.decimal, 1)
+}
+
+func formatId(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return ""
+	}
+	return id.Hex()
+}
+
+// csvColumn is a column of the CSV export of records.
+type csvColumn struct {
+	name  string
+	value func(x *exportRow) string
+}
+
+// csvColumns can be selected by name with the columns parameter.
+var csvColumns = []csvColumn{
+	{"id", func(x *exportRow) string { return x.record.Id.Hex() }},
+	{"date", func(x *exportRow) string { return MarshalDate(x.record.Date, ShortDateLayout) }},
+	{"time", func(x *exportRow) string { return MarshalDate(x.record.Date, "15:04") }},
+	{"duration", func(x *exportRow) string { return strconv.Itoa(x.record.Duration) }},
+	{"hours", func(x *exportRow) string {
+		return x.number(strconv.FormatFloat(x.record.Hours(), 'f', -1, 64))
+	}},
+	{"homeVisit", func(x *exportRow) string { return strconv.FormatBool(x.record.HomeVisit) }},
+	{"service", func(x *exportRow) string { return x.service.Name }},
+	{"serviceId", func(x *exportRow) string { return formatId(x.service.Id) }},
+	{"packageId", func(x *exportRow) string { return formatId(x.record.PackageId) }},
+	{"appointmentId", func(x *exportRow) string { return formatId(x.record.AppointmentId) }},
+	{"price", func(x *exportRow) string { return x.number(x.record.Price.Decimal()) }},
+	{"employeeIncome", func(x *exportRow) string { return x.number(x.record.EmployeeIncome.Decimal()) }},
+	{"currency", func(x *exportRow) string { return x.record.Price.currency() }},
+	{"client", func(x *exportRow) string { return x.client.Name }},
+	{"clientId", func(x *exportRow) string { return formatId(x.record.ClientId) }},
+	{"clientEmail", func(x *exportRow) string { return x.client.Email }},
+	{"clientTel", func(x *exportRow) string { return x.client.Tel }},
+	{"clientStreet", func(x *exportRow) string { return x.client.Address.Street }},
+	{"clientPostCode", func(x *exportRow) string { return x.client.Address.PostCode }},
+	{"clientCity", func(x *exportRow) string { return x.client.Address.City }},
+	{"employee", func(x *exportRow) string { return x.employee.Name }},
+	{"employeeId", func(x *exportRow) string { return formatId(x.record.EmployeeId) }},
+}
+
+// defaultCSVColumns are exported when no columns are selected.
+var defaultCSVColumns = []string{"date", "price", "employeeIncome", "client", "employee", "hours"}
+
+// CSVExport describes the CSV export of records.
+type CSVExport struct {
+	Filter    RecordFilter
+	Columns   []csvColumn
+	Delimiter rune
+	Decimal   string
+	// Encoding of the text, nil for UTF-8.
+	Encoding encoding.Encoding
+	Charset  string
+	Header   bool
+}
+
+// ParseCSVExport reads the parameters of the export: the filters of the
+// records listing without paging, sorted from the oldest by default;
+// columns separated by commas; delimiter (comma, semicolon, tab or pipe);
+// decimal (point or comma); encoding (utf-8 or windows-1250) and
+// header (false to leave out the names of the columns).
+func ParseCSVExport(query url.Values) (export CSVExport, err error) {
+	if export.Filter, err = ParseRecordFilter(query); err != nil {
+		return export, err
+	}
+	export.Filter.Limit, export.Filter.After = 0, nil
+	export.Filter.Ascending = query.Get("sort") != "-date"
+
+	names := defaultCSVColumns
+	if value := query.Get("columns"); value != "" {
+		names = strings.Split(value, ",")
+	}
+next:
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		for _, column := range csvColumns {
+			if column.name == name {
+				export.Columns = append(export.Columns, column)
+				continue next
+			}
+		}
+		return export, invalidParameter("columns", fmt.Errorf("unknown column %q", name))
+	}
+
+	switch query.Get("delimiter") {
+	case "", ",", "comma":
+		export.Delimiter = ','
+	case ";", "semicolon":
+		export.Delimiter = ';'
+	case "tab":
+		export.Delimiter = '\t'
+	case "|", "pipe":
+		export.Delimiter = '|'
+	default:
+		return export, invalidParameter("delimiter", fmt.Errorf("expected comma, semicolon, tab or pipe"))
+	}
+	switch query.Get("decimal") {
+	case "", ".", "point":
+		export.Decimal = "."
+	case ",", "comma":
+		export.Decimal = ","
+	default:
+		return export, invalidParameter("decimal", fmt.Errorf("expected point or comma"))
+	}
+	switch strings.ToLower(query.Get("encoding")) {
+	case "", "utf-8", "utf8":
+		export.Charset = "utf-8"
+	case "windows-1250", "cp1250":
+		export.Encoding, export.Charset = charmap.Windows1250, "windows-1250"
+	default:
+		return export, invalidParameter("encoding", fmt.Errorf("expected utf-8 or windows-1250"))
+	}
+	switch query.Get("header") {
+	case "", "true":
+		export.Header = true
+	case "false":
+	default:
+		return export, invalidParameter("header", fmt.Errorf("expected true or false"))
+	}
+	return export, nil
+}
+
+// exportLookup fetches what the records refer to as they are exported,
+// keeping only the documents which were referred to.
+type exportLookup struct {
+	clients   map[primitive.ObjectID]*Client
+	employees map[primitive.ObjectID]*Employee
+	services  map[primitive.ObjectID]*Service
+}
+
+func newExportLookup() *exportLookup {
+	return &exportLookup{
+		clients:   make(map[primitive.ObjectID]*Client),
+		employees: make(map[primitive.ObjectID]*Employee),
+		services:  make(map[primitive.ObjectID]*Service),
+	}
+}
+
+func (l *exportLookup) row(ctx context.Context, record *Record, decimal string) (*exportRow, error) {
+	var err error
+	x := &exportRow{record: record, decimal: decimal}
+	if x.client = l.clients[record.ClientId]; x.client == nil {
+		if x.client, err = app.Clients.Get(ctx, record.ClientId); err == ErrNotFound {
+			x.client, err = &Client{}, nil
+		}
+		l.clients[record.ClientId] = x.client
+	}
+	if x.employee = l.employees[record.EmployeeId]; x.employee == nil && err == nil {
+		if x.employee, err = app.Employees.Get(ctx, record.EmployeeId); err == ErrNotFound {
+			x.employee, err = &Employee{}, nil
+		}
+		l.employees[record.EmployeeId] = x.employee
+	}
+	if x.service = l.services[record.ServiceId]; x.service == nil && err == nil {
+		if record.ServiceId.IsZero() {
+			x.service, err = defaultService(ctx)
+		} else {
+			x.service, err = app.Services.Get(ctx, record.ServiceId)
+		}
+		if err == ErrNotFound {
+			x.service, err = &Service{}, nil
+		}
+		l.services[record.ServiceId] = x.service
+	}
+	return x, err
+}
+
+// startedWriter tells whether anything was written to the response.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// exportRecords streams the records as CSV, see ParseCSVExport.
+func exportRecords(w http.ResponseWriter, r *http.Request, e *Employee) {
+	// the export of years of records takes a while, it stops when the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+
+	export, err := ParseCSVExport(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out := &startedWriter{w: w}
+	var text io.Writer = out
+	var encoder *transform.Writer
+	if export.Encoding != nil {
+		// characters missing from the encoding become "?"
+		encoder = transform.NewWriter(out, encoding.ReplaceUnsupported(export.Encoding.NewEncoder()))
+		text = encoder
+	}
+	w.Header().Set("Content-Type", "text/csv; charset="+export.Charset)
+	w.Header().Set("Content-Disposition", `attachment; filename="records.csv"`)
+
+	wr := csv.NewWriter(text)
+	wr.Comma = export.Delimiter
+	if export.Header {
+		names := make([]string, len(export.Columns))
+		for i, column := range export.Columns {
+			names[i] = column.name
+		}
+		err = wr.Write(names)
+	}
+	lookup := newExportLookup()
+	row := make([]string, len(export.Columns))
+	if err == nil {
+		err = app.Records.Each(ctx, export.Filter, func(record *Record) error {
+			x, err := lookup.row(ctx, record, export.Decimal)
+			if err != nil {
+				return err
+			}
+			for i, column := range export.Columns {
+				row[i] = column.value(x)
+			}
+			return wr.Write(row)
+		})
+	}
+	if err == nil {
+		wr.Flush()
+		err = wr.Error()
+	}
+	if err == nil && encoder != nil {
+		err = encoder.Close()
+	}
+
+	if err != nil && !out.started {
+		writeError(w, err)
+	} else if err != nil {
+		// the status was sent, the client has to notice the broken download
+		log.Printf("Export of records failed: %v.", err)
+		panic(http.ErrAbortHandler)
+	}
+}
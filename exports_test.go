@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tealeg/xlsx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// insertRecordsAt inserts a record of an employee and a client at each of the times.
+func insertRecordsAt(t *testing.T, times ...time.Time) {
+	ctx := context.Background()
+	employee := Employee{Name: "Therapist"}
+	client := Client{Name: "Jan"}
+	if err := app.Employees.Insert(ctx, &employee); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Clients.Insert(ctx, &client); err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range times {
+		record := Record{EmployeeId: employee.Id, ClientId: client.Id, Date: primitive.NewDateTimeFromTime(at), Duration: 60, Price: units(90), EmployeeIncome: units(45)}
+		if err := app.Records.Insert(ctx, &record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// excelDates reads the days of the first column of the first sheet, below the header.
+func excelDates(t *testing.T, body []byte) []string {
+	file, err := xlsx.OpenBinary(body)
+	if err != nil {
+		t.Fatalf("Cannot open the workbook: %v", err)
+	}
+	var dates []string
+	for _, row := range file.Sheets[0].Rows[1:] {
+		date, err := row.Cells[0].GetTime(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dates = append(dates, date.Format(ShortDateLayout))
+	}
+	return dates
+}
+
+func TestExportMonthBoundaries(t *testing.T) {
+	setupTestApp(t)
+	insertRecordsAt(t,
+		time.Date(2021, 3, 1, 0, 15, 0, 0, app.Location),   // February in UTC
+		time.Date(2021, 3, 31, 23, 30, 0, 0, app.Location), // March in UTC too
+		time.Date(2021, 4, 1, 0, 30, 0, 0, app.Location),   // March in UTC
+	)
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	w := admin.request("GET", "/records/2021-03.xlsx", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-03-01,2021-03-31" {
+		t.Errorf("Expected the sessions of March in Warsaw, got: %v", dates)
+	}
+	w = admin.request("GET", "/records/2021-04.xlsx", nil)
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-04-01" {
+		t.Errorf("Expected the session after midnight in April, got: %v", dates)
+	}
+
+	w = admin.request("GET", "/records.csv", nil)
+	var days []string
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n")[1:] {
+		days = append(days, strings.Split(line, ",")[0])
+	}
+	if strings.Join(days, ",") != "2021-03-01,2021-03-31,2021-04-01" {
+		t.Errorf("Expected the days in Warsaw, got: %v", days)
+	}
+}
+
+func TestExportDaylightSavingTime(t *testing.T) {
+	setupTestApp(t)
+	insertRecordsAt(t,
+		time.Date(2021, 3, 28, 0, 30, 0, 0, time.UTC),   // 01:30 CET
+		time.Date(2021, 3, 28, 1, 30, 0, 0, time.UTC),   // 03:30 CEST
+		time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC),  // 02:30 CEST
+		time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC),  // 02:30 CET
+		time.Date(2021, 10, 31, 23, 30, 0, 0, time.UTC), // 00:30 CET on the 1st of November
+	)
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	w := admin.request("GET", "/payroll/2021-03.xlsx", nil)
+	file, err := xlsx.OpenBinary(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Cannot open the workbook: %v", err)
+	}
+	var times []string
+	for _, row := range file.Sheets[0].Rows[7:] {
+		date, _ := row.Cells[0].GetTime(false)
+		times = append(times, date.Round(time.Minute).Format("15:04"))
+	}
+	if strings.Join(times, ",") != "01:30,03:30" {
+		t.Errorf("Expected the times in Warsaw, got: %v", times)
+	}
+
+	statements, err := Payroll(context.Background(), time.Date(2021, 10, 1, 0, 0, 0, 0, app.Location), primitive.NilObjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 1 || len(statements[0].Records) != 2 ||
+		statements[0].Records[0].Date != "2021-10-31 - 02:30" || statements[0].Records[1].Date != "2021-10-31 - 02:30" {
+		t.Errorf("Expected both sessions at 02:30 in October, got: %+v", statements)
+	}
+	w = admin.request("GET", "/records/2021-11.xlsx", nil)
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-11-01" {
+		t.Errorf("Expected the session after midnight in November, got: %v", dates)
+	}
+}
+
+func TestExportTimezoneFromConfig(t *testing.T) {
+	setupTestApp(t)
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Location = location
+	insertRecordsAt(t, time.Date(2021, 4, 1, 2, 0, 0, 0, time.UTC)) // the evening of March 31st in New York
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	w := admin.request("GET", "/records/2021-03.xlsx", nil)
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-03-31" {
+		t.Errorf("Expected the session in March in New York, got: %v", dates)
+	}
+	w = admin.request("GET", "/records.csv", nil)
+	if !strings.Contains(w.Body.String(), "\n2021-03-31,") {
+		t.Errorf("Expected the day in New York, got: %s", w.Body.String())
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	insertRecordsAt(t,
+		time.Date(2021, 1, 15, 10, 0, 0, 0, app.Location),
+		time.Date(2021, 2, 15, 10, 0, 0, 0, app.Location),
+	)
+	client := Client{Name: "Łucja Żółć", Email: "lucja@example.com", Tel: "600 100 200", Address: Address{City: "Kraków"}}
+	app.Clients.Insert(ctx, &client)
+	employees, _ := app.Employees.List(ctx)
+	var employee Employee
+	for _, e := range employees {
+		if !e.Admin {
+			employee = e
+		}
+	}
+	record := Record{EmployeeId: employee.Id, ClientId: client.Id, Date: primitive.NewDateTimeFromTime(time.Date(2021, 2, 20, 9, 30, 0, 0, app.Location)),
+		Duration: 45, HomeVisit: true, EmployeeIncome: units(30)}
+	record.Price = NewMoney(6750)
+	app.Records.Insert(ctx, &record)
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	w := admin.request("GET", "/records.csv?from=2021-02-01&to=2021-02-28&sort=-date&columns=id,date,time,duration,hours,homeVisit,service,price,currency,client,clientId,clientEmail,clientTel,clientCity,employee", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	expected := []string{
+		"id,date,time,duration,hours,homeVisit,service,price,currency,client,clientId,clientEmail,clientTel,clientCity,employee",
+		record.Id.Hex() + ",2021-02-20,09:30,45,0.75,true,Therapy session,67.50,PLN,Łucja Żółć," + client.Id.Hex() + ",lucja@example.com,600 100 200,Kraków,Therapist",
+	}
+	if len(lines) != 3 || lines[0] != expected[0] || lines[1] != expected[1] || !strings.Contains(lines[2], ",2021-02-15,10:00,60,1,false,") {
+		t.Errorf("Unexpected export:\n%s", w.Body.String())
+	}
+
+	w = admin.request("GET", "/records.csv?client="+client.Id.Hex()+"&columns=client,price,hours&delimiter=semicolon&decimal=comma&encoding=windows-1250&header=false", nil)
+	if w.Header().Get("Content-Type") != "text/csv; charset=windows-1250" {
+		t.Errorf("Unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); body != "\xa3ucja \xaf\xf3\xb3\xe6;67,50;0,75\n" {
+		t.Errorf("Expected Windows-1250 with semicolons and decimal commas, got: %q", body)
+	}
+
+	for _, query := range []string{"columns=date,secret", "delimiter=x", "decimal=x", "encoding=latin1", "header=no", "from=2021-13-01"} {
+		if w := admin.request("GET", "/records.csv?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got: %d", query, w.Code)
+		}
+	}
+}
+
+func TestRecordsWorkbook(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	insertRecordsAt(t,
+		time.Date(2021, 1, 10, 10, 0, 0, 0, app.Location),
+		time.Date(2021, 3, 31, 23, 30, 0, 0, app.Location),
+		time.Date(2021, 4, 1, 0, 30, 0, 0, app.Location),
+	)
+	anna := Employee{Name: "Anna"}
+	app.Employees.Insert(ctx, &anna)
+	ewa := Client{Name: "Ewa"}
+	app.Clients.Insert(ctx, &ewa)
+	record := Record{EmployeeId: anna.Id, ClientId: ewa.Id, Date: primitive.NewDateTimeFromTime(time.Date(2021, 2, 1, 12, 0, 0, 0, app.Location)),
+		Duration: 30, Price: units(100), EmployeeIncome: units(60)}
+	app.Records.Insert(ctx, &record)
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+
+	w := admin.request("GET", "/records/2021-Q1.xlsx", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), "records-2021-Q1.xlsx") {
+		t.Fatalf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	file, err := xlsx.OpenBinary(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Cannot open the workbook: %v", err)
+	}
+	var names []string
+	for _, sheet := range file.Sheets {
+		names = append(names, sheet.Name)
+	}
+	if strings.Join(names, ",") != "Records,Anna,Therapist,Clients,Totals" {
+		t.Fatalf("Unexpected sheets: %v", names)
+	}
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-01-10,2021-02-01,2021-03-31" {
+		t.Errorf("Unexpected records: %v", dates)
+	}
+	if margin := file.Sheet["Records"].Rows[2].Cells[9]; margin.Formula() != "H3-I3" || margin.Value != "40" {
+		t.Errorf("Unexpected margin: %s = %s", margin.Formula(), margin.Value)
+	}
+
+	therapist := file.Sheet["Therapist"]
+	if len(therapist.Rows) != 4 {
+		t.Fatalf("Expected two records and the subtotal, got: %d rows", len(therapist.Rows))
+	}
+	if subtotal := therapist.Rows[3].Cells[6]; subtotal.Formula() != "SUM(G2:G3)" || subtotal.Value != "180" {
+		t.Errorf("Unexpected subtotal: %s = %s", subtotal.Formula(), subtotal.Value)
+	}
+
+	clients := file.Sheet["Clients"]
+	if len(clients.Rows) != 4 || clients.Rows[1].Cells[0].Value != "Ewa" || clients.Rows[2].Cells[1].Value != "2" {
+		t.Errorf("Unexpected clients: %d rows", len(clients.Rows))
+	}
+
+	totals := file.Sheet["Totals"]
+	expected := [][]string{
+		{"Anna", "COUNT('Anna'!A2:A2)", "'Anna'!E3", "'Anna'!G3", "'Anna'!H3", "D2-E2"},
+		{"Therapist", "COUNT('Therapist'!A2:A3)", "'Therapist'!E4", "'Therapist'!G4", "'Therapist'!H4", "D3-E3"},
+		{"Total", "SUM(B2:B3)", "SUM(C2:C3)", "SUM(D2:D3)", "SUM(E2:E3)", "D4-E4"},
+	}
+	for i, cells := range expected {
+		row := totals.Rows[i+1]
+		for j, formula := range cells {
+			if actual := row.Cells[j].Formula(); j > 0 && actual != formula || j == 0 && row.Cells[j].Value != formula {
+				t.Errorf("Unexpected cell %d of row %d: %q %q", j, i+2, actual, row.Cells[j].Value)
+			}
+		}
+	}
+	if total := totals.Rows[3]; total.Cells[1].Value != "3" || total.Cells[3].Value != "280" || total.Cells[5].Value != "130" {
+		t.Errorf("Unexpected totals: %s %s %s", total.Cells[1].Value, total.Cells[3].Value, total.Cells[5].Value)
+	}
+	if to, _ := totals.Rows[6].Cells[1].GetTime(false); to.Format(ShortDateLayout) != "2021-03-31" {
+		t.Errorf("Expected the last day of the quarter, got: %s", to)
+	}
+
+	w = admin.request("GET", "/records.xlsx?from=2021-03-31&to=2021-04-01", nil)
+	if dates := excelDates(t, w.Body.Bytes()); strings.Join(dates, ",") != "2021-03-31,2021-04-01" {
+		t.Errorf("Unexpected records of the custom range: %v", dates)
+	}
+	w = admin.request("GET", "/records/2021-05.xlsx", nil)
+	if file, err := xlsx.OpenBinary(w.Body.Bytes()); err != nil || len(file.Sheets) != 3 || len(file.Sheet["Totals"].Rows) != 5 {
+		t.Errorf("Expected the sheets of a month without records: %v", err)
+	}
+
+	for _, path := range []string{"/records/2021-Q5.xlsx", "/records/2021.xlsx", "/records.xlsx?from=2021-01-01", "/records.xlsx?from=2021-01-01&to=2022-06-01"} {
+		if w := admin.request("GET", path, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got: %d", path, w.Code)
+		}
+	}
+}
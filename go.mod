@@ -9,5 +9,6 @@ require (
 	github.com/gorilla/sessions v1.1.3
 	github.com/tealeg/xlsx v1.0.3
 	go.mongodb.org/mongo-driver v1.4.4
-	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
+	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
+	golang.org/x/text v0.3.3
 )
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The calendar feed covers sessions of the last three months and appointments of the next six.
+const (
+	feedPast   = 90 * 24 * time.Hour
+	feedFuture = 180 * 24 * time.Hour
+)
+
+const icalLocalLayout = "20060102T150405"
+
+// hashFeedToken returns the hash stored instead of the token, like codes are never stored as given.
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newFeedToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// FeedToken is shown once, when generated, as only its hash is stored.
+type FeedToken struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// regenerateFeedToken gives the employee a new calendar feed URL, the old one stops working.
+func regenerateFeedToken(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var employee *Employee
+	var feed FeedToken
+	employeeId, err := routeId(r)
+	if err == nil && !e.Admin && employeeId != e.Id {
+		err = ErrNotFound
+	}
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
+	if err == nil && !ifMatch(r, employee.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil {
+		feed.Token, err = newFeedToken()
+	}
+	if err == nil {
+		employee.FeedTokenHash = hashFeedToken(feed.Token)
+		feed.URL = "/calendar/" + feed.Token + ".ics"
+		err = app.Employees.Update(ctx, employeeId, employee)
+	}
+
+	if err == ErrConflict {
+		if employee, err = app.Employees.Get(ctx, employeeId); err == nil {
+			writeConflict(w, employee.ETag(), employee)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(feed)
+	}
+}
+
+// showFeed renders the calendar of the employee owning the token, it needs no session
+// so that calendar applications can subscribe to it.
+func showFeed(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var feed []byte
+	employee, err := app.Employees.GetByFeedToken(ctx, hashFeedToken(mux.Vars(r)["token"]))
+	if err == nil && employee.Archived {
+		err = ErrNotFound
+	}
+	if err == nil {
+		feed, err = BuildFeed(ctx, employee, time.Now())
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Write(feed)
+	}
+}
+
+// BuildFeed renders appointments and records of the employee around now as an RFC 5545 calendar.
+// Events keep their UIDs when appointments are stored, moved or completed into records.
+func BuildFeed(ctx context.Context, employee *Employee, now time.Time) ([]byte, error) {
+	from, to := now.Add(-feedPast), now.Add(feedFuture)
+	appointments, err := ListAppointments(ctx, AppointmentFilter{EmployeeId: employee.Id, From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	records, err := app.Records.List(ctx, RecordFilter{EmployeeId: employee.Id, From: from, To: to, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	clients, _, err := loadNameMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := icalWriter{stamp: now.UTC().Format(icalLocalLayout) + "Z"}
+	c.line("BEGIN", "VCALENDAR")
+	c.line("VERSION", "2.0")
+	c.line("PRODID", "-//Pszczolka//logo-spy//PL")
+	c.line("CALSCALE", "GREGORIAN")
+	c.line("METHOD", "PUBLISH")
+	c.line("X-WR-CALNAME", icalText(employee.Name))
+	c.line("X-WR-TIMEZONE", app.Location.String())
+	c.timezone(app.Location, from, to)
+
+	completed := make(map[primitive.ObjectID]*Appointment)
+	for i := range appointments {
+		appointment := &appointments[i]
+		if appointment.Status == Completed {
+			// shown as its record
+			completed[appointment.Id] = appointment
+			continue
+		}
+		status := "CONFIRMED"
+		if appointment.Status == Cancelled || appointment.Status == NoShow {
+			status = "CANCELLED"
+		}
+		c.event(appointmentUID(appointment), appointment.Start.Time(), appointment.End().Time(),
+			clients[appointment.ClientId].Name, appointment.Room, status, appointment.Version)
+	}
+	for _, record := range records {
+		uid, sequence := "record-"+record.Id.Hex(), record.Version
+		if !record.AppointmentId.IsZero() {
+			uid = "appointment-" + record.AppointmentId.Hex()
+			if appointment, ok := completed[record.AppointmentId]; ok {
+				uid, sequence = appointmentUID(appointment), appointment.Version+record.Version
+			}
+		}
+		c.event(uid, record.Date.Time(), record.End().Time(), clients[record.ClientId].Name, "", "CONFIRMED", sequence)
+	}
+	c.line("END", "VCALENDAR")
+	return c.buf.Bytes(), nil
+}
+
+// appointmentUID identifies occurrences of series by their day, as they may not be stored yet.
+func appointmentUID(a *Appointment) string {
+	if !a.SeriesId.IsZero() {
+		return "series-" + a.SeriesId.Hex() + "-" + strings.Replace(a.Occurrence, "-", "", -1)
+	}
+	return "appointment-" + a.Id.Hex()
+}
+
+type icalWriter struct {
+	buf   bytes.Buffer
+	stamp string
+}
+
+// line writes a content line folded at 75 octets, without splitting characters.
+func (c *icalWriter) line(name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		c.buf.WriteString(line[:cut])
+		c.buf.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	c.buf.WriteString(line)
+	c.buf.WriteString("\r\n")
+}
+
+func (c *icalWriter) localTime(name string, t time.Time) {
+	c.line(name+";TZID="+app.Location.String(), t.In(app.Location).Format(icalLocalLayout))
+}
+
+func (c *icalWriter) event(uid string, start, end time.Time, summary, room, status string, sequence int64) {
+	c.line("BEGIN", "VEVENT")
+	c.line("UID", uid+"@logo-spy")
+	c.line("DTSTAMP", c.stamp)
+	c.localTime("DTSTART", start)
+	c.localTime("DTEND", end)
+	c.line("SUMMARY", icalText(summary))
+	if room != "" {
+		c.line("LOCATION", icalText("Room "+room))
+	}
+	c.line("STATUS", status)
+	c.line("SEQUENCE", fmt.Sprint(sequence))
+	c.line("END", "VEVENT")
+}
+
+// timezone writes the VTIMEZONE of loc with its actual transitions around [from, to],
+// so that it always matches the zone used to compute the times.
+func (c *icalWriter) timezone(loc *time.Location, from, to time.Time) {
+	c.line("BEGIN", "VTIMEZONE")
+	c.line("TZID", loc.String())
+	transitions := zoneTransitions(loc, from.AddDate(-1, 0, 0), to.AddDate(1, 0, 0))
+	if len(transitions) == 0 {
+		name, offset := from.In(loc).Zone()
+		c.observance("STANDARD", name, offset, offset, time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+	for _, t := range transitions {
+		_, before := t.Add(-time.Second).In(loc).Zone()
+		name, after := t.In(loc).Zone()
+		kind := "STANDARD"
+		if after > before {
+			kind = "DAYLIGHT"
+		}
+		// the onset is given in the local time in effect before it
+		c.observance(kind, name, before, after, t.Add(time.Duration(before)*time.Second).UTC())
+	}
+	c.line("END", "VTIMEZONE")
+}
+
+func (c *icalWriter) observance(kind, name string, from, to int, start time.Time) {
+	c.line("BEGIN", kind)
+	c.line("DTSTART", start.Format(icalLocalLayout))
+	c.line("TZOFFSETFROM", icalOffset(from))
+	c.line("TZOFFSETTO", icalOffset(to))
+	c.line("TZNAME", name)
+	c.line("END", kind)
+}
+
+// zoneTransitions returns the instants in [from, to] at which the UTC offset of loc changes.
+func zoneTransitions(loc *time.Location, from, to time.Time) []time.Time {
+	var transitions []time.Time
+	from = from.Truncate(time.Hour) // whole seconds for the bisection
+	offset := func(t time.Time) int {
+		_, offset := t.In(loc).Zone()
+		return offset
+	}
+	for t := from; t.Before(to); t = t.Add(24 * time.Hour) {
+		next := t.Add(24 * time.Hour)
+		if offset(t) == offset(next) {
+			continue
+		}
+		low, high := t, next
+		for high.Sub(low) > time.Second {
+			middle := low.Add(high.Sub(low) / 2).Truncate(time.Second)
+			if offset(middle) == offset(low) {
+				low = middle
+			} else {
+				high = middle
+			}
+		}
+		transitions = append(transitions, high)
+	}
+	return transitions
+}
+
+func icalOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalText(s string) string {
+	return icalEscaper.Replace(s)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZoneTransitions(t *testing.T) {
+	setupTestApp(t)
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	transitions := zoneTransitions(app.Location, from, from.AddDate(1, 0, 0))
+	expected := []time.Time{
+		time.Date(2020, 3, 29, 1, 0, 0, 0, time.UTC),
+		time.Date(2020, 10, 25, 1, 0, 0, 0, time.UTC),
+	}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, transitions)
+	}
+	for i := range expected {
+		if !transitions[i].Equal(expected[i]) {
+			t.Errorf("Expected %v, got %v", expected[i], transitions[i])
+		}
+	}
+
+	var c icalWriter
+	c.timezone(app.Location, from, from)
+	for _, line := range []string{"TZID:Europe/Warsaw", "BEGIN:DAYLIGHT\r\nDTSTART:20200329T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST",
+		"BEGIN:STANDARD\r\nDTSTART:20201025T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET"} {
+		if !strings.Contains(c.buf.String(), line) {
+			t.Errorf("Expected %q in:\n%s", line, c.buf.String())
+		}
+	}
+}
+
+func TestFeed(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(50)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Kowalski; Jan, junior"}
+	app.Clients.Insert(ctx, &client)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	admin, _ := app.Employees.GetByName(ctx, "admin")
+	if w := s.request("POST", "/employees/"+admin.Id.Hex()+"/feed-token", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a token of another employee, got: %d", w.Code)
+	}
+	token := func() FeedToken {
+		w := s.request("POST", "/employees/"+therapist.Id.Hex()+"/feed-token", nil)
+		var feed FeedToken
+		json.NewDecoder(w.Body).Decode(&feed)
+		if w.Code != http.StatusOK || feed.URL != "/calendar/"+feed.Token+".ics" {
+			t.Fatalf("Token failed: %d %s", w.Code, w.Body)
+		}
+		return feed
+	}
+	feed := token()
+
+	today := time.Now().In(app.Location)
+	start := time.Date(today.Year(), today.Month(), today.Day(), 9, 0, 0, 0, app.Location)
+	create := func(start time.Time) Appointment {
+		w := s.request("PUT", "/appointments", map[string]interface{}{
+			"clientId": client.Id.Hex(),
+			"start":    start.Format(DateTimeLayout),
+			"room":     "2",
+		})
+		var appointment Appointment
+		json.NewDecoder(w.Body).Decode(&appointment)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+		}
+		return appointment
+	}
+	planned := create(start.AddDate(0, 0, 7))
+	cancelled := create(start.AddDate(0, 0, 8))
+	s.request("PATCH", "/appointments/"+cancelled.Id.Hex(), map[string]interface{}{"status": "cancelled"})
+	completed := create(start.AddDate(0, 0, -1))
+	s.request("POST", "/appointments/"+completed.Id.Hex()+"/complete", nil)
+
+	anonymous := newTestSession(t)
+	w := anonymous.request("GET", feed.URL, nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("Feed failed: %d %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"BEGIN:VTIMEZONE\r\nTZID:Europe/Warsaw\r\n",
+		"UID:appointment-" + planned.Id.Hex() + "@logo-spy\r\n",
+		"DTSTART;TZID=Europe/Warsaw:" + start.AddDate(0, 0, 7).Format(icalLocalLayout) + "\r\n",
+		"LOCATION:Room 2\r\n",
+		"SUMMARY:Kowalski\\; Jan\\, junior\r\n",
+		"UID:appointment-" + cancelled.Id.Hex() + "@logo-spy\r\nDTSTAMP",
+		"STATUS:CANCELLED\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in feed:\n%s", expected, body)
+		}
+	}
+	if n := strings.Count(body, "UID:appointment-"+completed.Id.Hex()); n != 1 {
+		t.Errorf("Expected the completed appointment once, as its record, got %d times", n)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		if len(line) > 75 || strings.Contains(line, "\n") {
+			t.Errorf("Line not folded: %q", line)
+		}
+	}
+
+	// a new token revokes the old one
+	renewed := token()
+	if w := anonymous.request("GET", feed.URL, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a revoked token, got: %d", w.Code)
+	}
+	if w := anonymous.request("GET", renewed.URL, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected the new token to work, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeletePolicy decides what happens on removal of an employee or a client
+// who is referenced by records, appointments or series, and for clients also
+// by packages, payments or invoices.
+type DeletePolicy string
+
+const (
+	// RefuseDelete removes only documents which nothing refers to.
+	RefuseDelete DeletePolicy = "refuse"
+	// ArchiveOnDelete hides the document, references keep pointing at it.
+	ArchiveOnDelete DeletePolicy = "archive"
+	// ReassignOnDelete moves the records, appointments and series to another
+	// employee and removes the document.
+	ReassignOnDelete DeletePolicy = "reassign"
+)
+
+func ParseDeletePolicy(value string) (DeletePolicy, error) {
+	switch policy := DeletePolicy(value); policy {
+	case RefuseDelete, ArchiveOnDelete, ReassignOnDelete:
+		return policy, nil
+	}
+	return "", fmt.Errorf("expected refuse, archive or reassign")
+}
+
+// deletePolicy reads the policy parameter of a delete request, falling back to the configured one.
+func deletePolicy(r *http.Request, configured DeletePolicy) (DeletePolicy, error) {
+	value := r.URL.Query().Get("policy")
+	if value == "" {
+		return configured, nil
+	}
+	policy, err := ParseDeletePolicy(value)
+	if err != nil {
+		return "", invalidParameter("policy", err)
+	}
+	return policy, nil
+}
+
+// maxBlockingRecords limits how many records are listed in a has-records error.
+const maxBlockingRecords = 20
+
+// checkNoRecords fails with 409 listing the records matching the filter, if there are any.
+func checkNoRecords(ctx context.Context, filter RecordFilter, what string) error {
+	total, err := app.Records.Count(ctx, filter)
+	if err != nil || total == 0 {
+		return err
+	}
+	filter.Limit = maxBlockingRecords
+	records, err := app.Records.List(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "has-records",
+		Message: fmt.Sprintf("The %s has %d records, archive it or reassign the records instead", what, total),
+		Details: map[string]interface{}{"total": total, "records": records},
+	}
+}
+
+// references lists the kinds of documents besides records which refer to
+// the employee or the client, give one of them.
+func references(ctx context.Context, employeeId, clientId primitive.ObjectID) ([]string, error) {
+	var kinds []string
+	appointments, err := app.Appointments.List(ctx, AppointmentFilter{EmployeeId: employeeId, ClientId: clientId, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(appointments) > 0 {
+		kinds = append(kinds, "appointments")
+	}
+	series, err := app.Series.List(ctx, SeriesFilter{EmployeeId: employeeId, ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	if len(series) > 0 {
+		kinds = append(kinds, "series")
+	}
+	if clientId.IsZero() {
+		return kinds, nil
+	}
+	packages, err := app.Packages.List(ctx, PackageFilter{ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) > 0 {
+		kinds = append(kinds, "packages")
+	}
+	payments, err := app.Payments.List(ctx, PaymentFilter{ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	if len(payments) > 0 {
+		kinds = append(kinds, "payments")
+	}
+	invoices, err := app.Invoices.List(ctx, InvoiceFilter{ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	if len(invoices) > 0 {
+		kinds = append(kinds, "invoices")
+	}
+	return kinds, nil
+}
+
+// checkNoReferences fails with 409 naming the kinds of documents which refer
+// to the employee or the client, see references.
+func checkNoReferences(ctx context.Context, employeeId, clientId primitive.ObjectID) error {
+	kinds, err := references(ctx, employeeId, clientId)
+	if err != nil || len(kinds) == 0 {
+		return err
+	}
+	message := "The client has " + strings.Join(kinds, ", ") + ", archive it instead"
+	if clientId.IsZero() {
+		message = "The employee has " + strings.Join(kinds, ", ") + ", archive it or reassign them instead"
+	}
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "has-references",
+		Message: message,
+		Details: map[string]interface{}{"references": kinds},
+	}
+}
+
+func invalidReference(field string, id primitive.ObjectID, reason string) error {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "invalid-reference",
+		Message: reason,
+		Details: map[string]string{"field": field, "id": id.Hex()},
+	}
+}
+
+// activeEmployee loads the employee referenced by field, who has to exist and not be archived.
+func activeEmployee(ctx context.Context, field string, id primitive.ObjectID) (*Employee, error) {
+	employee, err := app.Employees.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, invalidReference(field, id, "Employee does not exist")
+	}
+	if err == nil && employee.Archived {
+		return nil, invalidReference(field, id, "Employee "+employee.Name+" is archived")
+	}
+	return employee, err
+}
+
+func activeClient(ctx context.Context, field string, id primitive.ObjectID) (*Client, error) {
+	client, err := app.Clients.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, invalidReference(field, id, "Client does not exist")
+	}
+	if err == nil && client.Archived {
+		return nil, invalidReference(field, id, "Client "+client.Name+" is archived")
+	}
+	return client, err
+}
+
+// checkRecordReferences ensures the employee and the client of the record
+// exist and are active. References left unchanged by an update are not
+// checked again, so that old records of archived clients stay editable.
+func checkRecordReferences(ctx context.Context, record, stored *Record) error {
+	if stored == nil || record.EmployeeId != stored.EmployeeId {
+		if _, err := activeEmployee(ctx, "employeeId", record.EmployeeId); err != nil {
+			return err
+		}
+	}
+	if stored == nil || record.ClientId != stored.ClientId {
+		if _, err := activeClient(ctx, "clientId", record.ClientId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type InvoiceKind string
+
+const (
+	InvoiceKindInvoice InvoiceKind = "invoice"
+	// InvoiceKindCorrection amends an issued invoice, which never changes itself.
+	InvoiceKindCorrection InvoiceKind = "correction"
+)
+
+// Party is the seller or the buyer named on an invoice.
+type Party struct {
+	Name        string `json:"name"`
+	Street      string `json:"street"`
+	PostCode    string `json:"post_code"`
+	City        string `json:"city"`
+	TaxId       string `json:"taxId,omitempty"`
+	BankAccount string `json:"bankAccount,omitempty"`
+}
+
+// InvoiceLine is an invoiced session, or an adjustment on a correction.
+type InvoiceLine struct {
+	RecordId    primitive.ObjectID `json:"recordId,omitempty" bson:"recordid,omitempty"`
+	Date        string             `json:"date"` // day in ShortDateLayout
+	Description string             `json:"description"`
+	Amount      Money              `json:"amount"`
+}
+
+// Invoice is issued once and never changed, mistakes are amended by
+// corrections which are numbered like invoices.
+type Invoice struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	// Number is the Sequence within the Year, e.g. "7/2021", assigned by InvoiceStore.Issue.
+	Number   string      `json:"number"`
+	Year     int         `json:"year"`
+	Sequence int         `json:"sequence"`
+	Kind     InvoiceKind `json:"kind"`
+	// Corrects is the invoice amended by a correction, for the Reason.
+	Corrects   primitive.ObjectID `json:"corrects,omitempty" bson:"corrects,omitempty"`
+	Reason     string             `json:"reason,omitempty"`
+	ClientId   primitive.ObjectID `json:"clientId"`
+	IssueDate  string             `json:"issueDate"` // day in ShortDateLayout
+	SaleFrom   string             `json:"saleFrom"`
+	SaleTo     string             `json:"saleTo"`
+	Seller     Party              `json:"seller"`
+	Buyer      Party              `json:"buyer"`
+	Lines      []InvoiceLine      `json:"lines"`
+	Total      Money              `json:"total"`
+	Note       string             `json:"note,omitempty"`
+	EmployeeId primitive.ObjectID `json:"employeeId"` // who issued it
+	Issued     primitive.DateTime `json:"issued"`
+}
+
+func invalidInvoice(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-invoice", Message: message}
+}
+
+func (i *Invoice) sum() {
+	i.Total = NewMoney(0)
+	for _, line := range i.Lines {
+		i.Total = i.Total.Add(line.Amount)
+	}
+}
+
+func clientParty(c *Client) Party {
+	return Party{Name: c.Name, Street: c.Address.Street, PostCode: c.Address.PostCode, City: c.Address.City}
+}
+
+// checkNotInvoiced refuses changes of records which have been invoiced.
+func checkNotInvoiced(ctx context.Context, recordId primitive.ObjectID) error {
+	invoices, err := app.Invoices.List(ctx, InvoiceFilter{RecordId: recordId})
+	if err != nil || len(invoices) == 0 {
+		return err
+	}
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "invoiced",
+		Message: "The record is on invoice " + invoices[0].Number + ", issue a correction instead",
+		Details: map[string]string{"invoiceId": invoices[0].Id.Hex()},
+	}
+}
+
+// InvoiceRequest names the client and the days of the sessions to invoice.
+type InvoiceRequest struct {
+	ClientId primitive.ObjectID `json:"clientId"`
+	From     string             `json:"from"`
+	To       string             `json:"to"`
+}
+
+// buildInvoice invoices the sessions of the client between the days which
+// have not been invoiced yet.
+func buildInvoice(ctx context.Context, request InvoiceRequest) (*Invoice, error) {
+	if app.Seller.Name == "" {
+		return nil, invalidInvoice("Seller details are not configured, see SELLER_NAME")
+	}
+	from, err := time.ParseInLocation(ShortDateLayout, request.From, app.Location)
+	if err != nil {
+		return nil, invalidInvoice(fmt.Sprintf("Invalid date %q", request.From))
+	}
+	to, err := time.ParseInLocation(ShortDateLayout, request.To, app.Location)
+	if err != nil || to.Before(from) {
+		return nil, invalidInvoice(fmt.Sprintf("Invalid date %q", request.To))
+	}
+	client, err := app.Clients.Get(ctx, request.ClientId)
+	if err == ErrNotFound {
+		return nil, invalidReference("clientId", request.ClientId, "Client does not exist")
+	} else if err != nil {
+		return nil, err
+	}
+
+	issued, err := app.Invoices.List(ctx, InvoiceFilter{ClientId: client.Id})
+	if err != nil {
+		return nil, err
+	}
+	invoiced := make(map[primitive.ObjectID]bool)
+	for _, invoice := range issued {
+		for _, line := range invoice.Lines {
+			if invoice.Kind == InvoiceKindInvoice {
+				invoiced[line.RecordId] = true
+			}
+		}
+	}
+	records, err := app.Records.List(ctx, RecordFilter{ClientId: client.Id, From: from, To: to.AddDate(0, 0, 1), Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	services, err := loadServiceMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invoice := &Invoice{
+		Kind:      InvoiceKindInvoice,
+		ClientId:  client.Id,
+		IssueDate: now.In(app.Location).Format(ShortDateLayout),
+		SaleFrom:  request.From,
+		SaleTo:    request.To,
+		Seller:    app.Seller,
+		Buyer:     clientParty(client),
+		Note:      app.InvoiceNote,
+		Issued:    primitive.NewDateTimeFromTime(now),
+	}
+	for _, record := range records {
+		if invoiced[record.Id] || record.Price.IsZero() {
+			continue
+		}
+		invoice.Lines = append(invoice.Lines, InvoiceLine{
+			RecordId:    record.Id,
+			Date:        MarshalDate(record.Date, ShortDateLayout),
+			Description: services[record.ServiceId].Name,
+			Amount:      record.Price,
+		})
+	}
+	if len(invoice.Lines) == 0 {
+		return nil, invalidInvoice("There are no sessions to invoice between " + request.From + " and " + request.To)
+	}
+	invoice.sum()
+	return invoice, nil
+}
+
+// CorrectionRequest amends an invoice by the lines, negative amounts reduce it.
+type CorrectionRequest struct {
+	Reason string        `json:"reason"`
+	Lines  []InvoiceLine `json:"lines"`
+	Buyer  *Party        `json:"buyer"` // corrected details of the buyer
+}
+
+func buildCorrection(original *Invoice, request CorrectionRequest) (*Invoice, error) {
+	if original.Kind != InvoiceKindInvoice {
+		return nil, invalidInvoice("Correct the invoice " + original.Number + " itself instead")
+	}
+	if request.Reason == "" {
+		return nil, invalidInvoice("Correction needs a reason")
+	}
+	if len(request.Lines) == 0 && request.Buyer == nil {
+		return nil, invalidInvoice("Correction needs lines or details of the buyer")
+	}
+	now := time.Now()
+	correction := &Invoice{
+		Kind:      InvoiceKindCorrection,
+		Corrects:  original.Id,
+		Reason:    request.Reason,
+		ClientId:  original.ClientId,
+		IssueDate: now.In(app.Location).Format(ShortDateLayout),
+		SaleFrom:  original.SaleFrom,
+		SaleTo:    original.SaleTo,
+		Seller:    original.Seller,
+		Buyer:     original.Buyer,
+		Lines:     []InvoiceLine{},
+		Note:      original.Note,
+		Issued:    primitive.NewDateTimeFromTime(now),
+	}
+	if request.Buyer != nil {
+		correction.Buyer = *request.Buyer
+	}
+	for _, line := range request.Lines {
+		if line.Description == "" || line.Amount.IsZero() {
+			return nil, invalidInvoice("Lines of a correction need a description and an amount")
+		}
+		if line.Date == "" {
+			line.Date = correction.IssueDate
+		} else if _, err := time.ParseInLocation(ShortDateLayout, line.Date, app.Location); err != nil {
+			return nil, invalidInvoice(fmt.Sprintf("Invalid date %q", line.Date))
+		}
+		correction.Lines = append(correction.Lines, line)
+	}
+	correction.sum()
+	return correction, nil
+}
+
+func showInvoices(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var invoices []Invoice
+	var filter InvoiceFilter
+	var err error
+	query := r.URL.Query()
+	if value := query.Get("clientId"); value != "" {
+		if filter.ClientId, err = primitive.ObjectIDFromHex(value); err != nil {
+			err = invalidParameter("clientId", err)
+		}
+	}
+	if value := query.Get("year"); value != "" && err == nil {
+		if filter.Year, err = strconv.Atoi(value); err != nil {
+			err = invalidParameter("year", err)
+		}
+	}
+	if err == nil {
+		invoices, err = app.Invoices.List(ctx, filter)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if invoices == nil {
+		invoices = []Invoice{}
+	}
+	tags := make([]string, len(invoices))
+	for i := range invoices {
+		tags[i] = invoices[i].ETag()
+	}
+	w.Header().Set("ETag", listETag(tags))
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+// createInvoice issues an invoice for the sessions of a client in a range of days.
+func createInvoice(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var request InvoiceRequest
+	var invoice *Invoice
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil {
+		invoice, err = buildInvoice(ctx, request)
+	}
+	if err == nil {
+		invoice.EmployeeId = e.Id
+		err = app.Invoices.Issue(ctx, invoice)
+	}
+	if err == ErrDuplicate {
+		err = &APIError{
+			Status:  http.StatusConflict,
+			Code:    "invoiced",
+			Message: "Some of the sessions have been invoiced in the meantime, issue the invoice again",
+		}
+	}
+	writeInvoice(w, invoice, err)
+}
+
+func loadInvoice(ctx context.Context, r *http.Request) (*Invoice, error) {
+	id, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.Invoices.Get(ctx, id)
+}
+
+func showInvoice(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	invoice, err := loadInvoice(ctx, r)
+	writeInvoice(w, invoice, err)
+}
+
+// createCorrection issues a correction of the invoice.
+func createCorrection(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var request CorrectionRequest
+	var correction *Invoice
+	original, err := loadInvoice(ctx, r)
+	if err == nil {
+		err = json.NewDecoder(r.Body).Decode(&request)
+	}
+	if err == nil {
+		correction, err = buildCorrection(original, request)
+	}
+	if err == nil {
+		correction.EmployeeId = e.Id
+		err = app.Invoices.Issue(ctx, correction)
+	}
+	writeInvoice(w, correction, err)
+}
+
+func writeInvoice(w http.ResponseWriter, invoice *Invoice, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", invoice.ETag())
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(invoice)
+}
+
+// exportInvoicePDF renders the invoice for printing.
+func exportInvoicePDF(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	invoice, err := loadInvoice(ctx, r)
+	var original *Invoice
+	if err == nil && invoice.Kind == InvoiceKindCorrection {
+		original, err = app.Invoices.Get(ctx, invoice.Corrects)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="invoice-%d-%d.pdf"`, invoice.Year, invoice.Sequence))
+	renderInvoice(invoice, original).WriteTo(w)
+}
+
+// renderInvoice lays out the invoice, original is the corrected invoice of a correction.
+func renderInvoice(invoice, original *Invoice) *pdfDocument {
+	const left, right, lineHeight = 50.0, 545.0, 16.0
+	d := newPDFDocument()
+	title := "Invoice " + invoice.Number
+	if original != nil {
+		title = "Correcting invoice " + invoice.Number
+	}
+	d.Text(left, 70, 18, true, title)
+	y := 92.0
+	d.Text(left, y, 10, false, "Issue date: "+invoice.IssueDate)
+	d.TextRight(right, y, 10, "Sale: "+invoice.SaleFrom+" - "+invoice.SaleTo)
+	if original != nil {
+		y += lineHeight
+		d.Text(left, y, 10, false, "Corrects invoice "+original.Number+" of "+original.IssueDate)
+		y += lineHeight
+		d.Text(left, y, 10, false, "Reason: "+invoice.Reason)
+	}
+
+	y += 2 * lineHeight
+	party := func(x float64, label string, p Party) {
+		d.Text(x, y, 10, true, label)
+		lines := []string{p.Name, p.Street, p.PostCode + " " + p.City}
+		if p.TaxId != "" {
+			lines = append(lines, "Tax ID: "+p.TaxId)
+		}
+		for i, line := range lines {
+			d.Text(x, y+float64(i+1)*lineHeight, 10, false, line)
+		}
+	}
+	party(left, "Seller", invoice.Seller)
+	party(310, "Buyer", invoice.Buyer)
+
+	y += 6 * lineHeight
+	header := func() {
+		d.Text(left, y, 10, true, "No.")
+		d.Text(left+30, y, 10, true, "Date")
+		d.Text(left+110, y, 10, true, "Description")
+		d.Text(right-60, y, 10, true, "Amount")
+		d.Line(left, y+5, right, y+5)
+		y += lineHeight + 4
+	}
+	header()
+	for i, line := range invoice.Lines {
+		if y > pdfPageHeight-80 {
+			d.AddPage()
+			y = 70
+			header()
+		}
+		d.Text(left, y, 10, false, strconv.Itoa(i+1))
+		d.Text(left+30, y, 10, false, line.Date)
+		d.Text(left+110, y, 10, false, line.Description)
+		d.TextRight(right, y, 10, line.Amount.String())
+		y += lineHeight
+	}
+	d.Line(left, y-10, right, y-10)
+	y += 4
+	d.Text(right-200, y, 11, true, "Total")
+	d.TextRight(right, y, 11, invoice.Total.String())
+
+	y += 2 * lineHeight
+	if invoice.Seller.BankAccount != "" {
+		d.Text(left, y, 10, false, "Bank account: "+invoice.Seller.BankAccount)
+		y += lineHeight
+	}
+	if invoice.Note != "" {
+		d.Text(left, y, 9, false, invoice.Note)
+	}
+	return d
+}
+
+// invoiceYear is the year of the issue date, which invoices are numbered within.
+func invoiceYear(invoice *Invoice) (int, error) {
+	day, err := time.ParseInLocation(ShortDateLayout, invoice.IssueDate, app.Location)
+	if err != nil {
+		return 0, invalidInvoice(fmt.Sprintf("Invalid issue date %q", invoice.IssueDate))
+	}
+	return day.Year(), nil
+}
+
+func (i *Invoice) numbered(year, sequence int) {
+	i.Year, i.Sequence = year, sequence
+	i.Number = fmt.Sprintf("%d/%d", sequence, year)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestInvoices(t *testing.T) {
+	setupTestApp(t)
+	app.Seller = Party{Name: "Gabinet Logopedyczny", Street: "Długa 1", PostCode: "00-001", City: "Łódź", TaxId: "123-456-78-90"}
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist"}
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan", Address: Address{Street: "Krótka 2", PostCode: "00-002", City: "Warszawa"}}
+	app.Clients.Insert(ctx, &client)
+	day := func(month time.Month, d int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2021, month, d, 10, 0, 0, 0, app.Location))
+	}
+	records := []Record{
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(3, 1), Duration: 60, Price: units(90)},
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(3, 31), Duration: 60, Price: units(100)},
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(4, 1), Duration: 60, Price: units(100)},
+	}
+	for i := range records {
+		app.Records.Insert(ctx, &records[i])
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	issue := func(path string, body interface{}) (Invoice, int) {
+		w := admin.request("PUT", path, body)
+		var invoice Invoice
+		json.NewDecoder(w.Body).Decode(&invoice)
+		return invoice, w.Code
+	}
+	year := time.Now().In(app.Location).Year()
+	march, code := issue("/invoices", map[string]interface{}{"clientId": client.Id.Hex(), "from": "2021-03-01", "to": "2021-03-31"})
+	if code != http.StatusOK || march.Number != fmt.Sprintf("1/%d", year) || len(march.Lines) != 2 || !march.Total.Equal(units(190)) {
+		t.Fatalf("Unexpected invoice: %d %+v", code, march)
+	}
+	if march.Buyer.City != "Warszawa" || march.Seller.Name != app.Seller.Name {
+		t.Errorf("Unexpected parties: %+v %+v", march.Seller, march.Buyer)
+	}
+	if _, code = issue("/invoices", map[string]interface{}{"clientId": client.Id.Hex(), "from": "2021-03-01", "to": "2021-04-30"}); code != http.StatusOK {
+		t.Errorf("Expected the April session to be invoiced, got: %d", code)
+	}
+	if _, code = issue("/invoices", map[string]interface{}{"clientId": client.Id.Hex(), "from": "2021-03-01", "to": "2021-04-30"}); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for sessions invoiced already, got: %d", code)
+	}
+
+	correction, code := issue("/invoices/"+march.Id.Hex()+"/corrections", map[string]interface{}{
+		"reason": "Discount", "lines": []map[string]interface{}{{"description": "Discount", "amount": "-19"}},
+	})
+	if code != http.StatusOK || correction.Number != fmt.Sprintf("3/%d", year) || correction.Corrects != march.Id || !correction.Total.Equal(units(-19)) {
+		t.Errorf("Unexpected correction: %d %+v", code, correction)
+	}
+	if _, code = issue("/invoices/"+correction.Id.Hex()+"/corrections", map[string]interface{}{"reason": "Again"}); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a correction of a correction, got: %d", code)
+	}
+	if w := admin.request("PATCH", "/invoices/"+march.Id.Hex(), map[string]interface{}{"total": "1"}); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected issued invoices to be immutable, got: %d", w.Code)
+	}
+	if w := admin.request("DELETE", "/records/"+records[0].Id.Hex(), nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for an invoiced record, got: %d", w.Code)
+	}
+	for _, patch := range []map[string]interface{}{{"date": "2021-03-02 - 10:00"}, {"duration": 30}} {
+		if w := admin.request("PATCH", "/records/"+records[1].Id.Hex(), patch); w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 for %v of an invoiced record, got: %d %s", patch, w.Code, w.Body)
+		}
+	}
+
+	for _, invoice := range []Invoice{march, correction} {
+		w := admin.request("GET", "/invoices/"+invoice.Id.Hex()+".pdf", nil)
+		pdf := w.Body.Bytes()
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/pdf" ||
+			!bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+			t.Errorf("Unexpected PDF of %s: %d %q", invoice.Number, w.Code, w.Header())
+		}
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	if encoded := pdfEncode("Łódź (ul. Długa) €"); bytes.ContainsRune(encoded[:17], '?') || encoded[len(encoded)-1] != '?' {
+		t.Errorf("Unexpected encoding: %q", encoded)
+	}
+	if width := pdfTextWidth("90.00 PLN", 10); width < 45 || width > 55 {
+		t.Errorf("Unexpected width: %.2f", width)
+	}
+	if escaped := pdfEscape([]byte(`a(b)\`)); escaped != `a\(b\)\\` {
+		t.Errorf("Unexpected escaping: %s", escaped)
+	}
+}
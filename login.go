@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrCodeRequired  = errors.New("Employee code is required")
+	ErrCodeDigits    = errors.New("Employee code can contain only digits")
+	ErrNameRequired  = errors.New("Employee name is required")
+	ErrDuplicateName = errors.New("Employee with this name already exists")
+)
+
+// dummyCodeHash is compared against when the employee does not exist,
+// so that unknown names take as long to reject as invalid codes.
+var dummyCodeHash, _ = bcrypt.GenerateFromPassword([]byte("0000"), bcrypt.DefaultCost)
+
+// validCode tells whether the code consists of digits only. Codes are kept
+// as entered, so that leading zeros count and "0123" differs from "123".
+func validCode(code string) bool {
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return code != ""
+}
+
+// SetCode replaces the employee code with its salted hash.
+func (e *Employee) SetCode(code string) error {
+	if code == "" {
+		return ErrCodeRequired
+	}
+	if !validCode(code) {
+		return ErrCodeDigits
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	e.CodeHash = string(hash)
+	e.Code = ""
+	e.LegacyCode = 0
+	return nil
+}
+
+func (e *Employee) CheckCode(code string) bool {
+	if e == nil || e.CodeHash == "" || !validCode(code) {
+		bcrypt.CompareHashAndPassword(dummyCodeHash, []byte(code))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(e.CodeHash), []byte(code)) == nil
+}
+
+// MigrateEmployeeCodes hashes plaintext codes left by older versions of the application.
+func (app *App) MigrateEmployeeCodes(ctx context.Context) error {
+	employees, err := app.Employees.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, employee := range employees {
+		if employee.LegacyCode == 0 {
+			continue
+		}
+		if employee.CodeHash == "" {
+			if err = employee.SetCode(strconv.Itoa(employee.LegacyCode)); err != nil {
+				return err
+			}
+		}
+		employee.LegacyCode = 0
+		if err = app.Employees.Update(ctx, employee.Id, &employee); err != nil {
+			return err
+		}
+		log.Printf("Hashed code of employee: %s.", employee.Name)
+	}
+	return nil
+}
+
+// Attempt counters
+
+type loginAttempts struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+type LoginPolicy struct {
+	FreeAttempts int           // failures allowed before backoff starts
+	BaseDelay    time.Duration // lockout after the first failure above FreeAttempts, doubled with each next one
+	MaxDelay     time.Duration
+	ResetAfter   time.Duration // counters are forgotten after this long without failures
+}
+
+func (p LoginPolicy) lockout(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-p.FreeAttempts-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// LoginLimiter throttles login attempts per client IP and per account
+// with exponential backoff. State is kept in memory of the process.
+type LoginLimiter struct {
+	AccountPolicy LoginPolicy
+	IPPolicy      LoginPolicy
+
+	// MaxCounters bounds the counters kept of each kind, the ones with the oldest failures are dropped first.
+	MaxCounters int
+
+	mu       sync.Mutex
+	accounts map[string]*loginAttempts
+	ips      map[string]*loginAttempts
+	swept    time.Time
+	now      func() time.Time
+}
+
+// sweepInterval is how often expired counters are dropped, see sweep.
+const sweepInterval = 10 * time.Minute
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		AccountPolicy: LoginPolicy{FreeAttempts: 3, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, ResetAfter: 24 * time.Hour},
+		IPPolicy:      LoginPolicy{FreeAttempts: 10, BaseDelay: 10 * time.Second, MaxDelay: 15 * time.Minute, ResetAfter: time.Hour},
+		accounts:      make(map[string]*loginAttempts),
+		MaxCounters:   10000,
+		ips:           make(map[string]*loginAttempts),
+		now:           time.Now,
+	}
+}
+
+func accountKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func (l *LoginLimiter) lookup(m map[string]*loginAttempts, key string, policy LoginPolicy) *loginAttempts {
+	a, ok := m[key]
+	if ok && l.now().Sub(a.LastFailure) > policy.ResetAfter {
+		delete(m, key)
+		ok = false
+	}
+	if !ok {
+		return nil
+	}
+	return a
+}
+
+// Allow returns how long the caller has to wait before the next attempt, zero if it may proceed.
+func (l *LoginLimiter) Allow(ip, account string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	if a := l.lookup(l.ips, ip, l.IPPolicy); a != nil && a.LockedUntil.After(now) {
+		wait = a.LockedUntil.Sub(now)
+	}
+	if a := l.lookup(l.accounts, accountKey(account), l.AccountPolicy); a != nil && a.LockedUntil.After(now) {
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (l *LoginLimiter) Fail(ip, account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := l.now(); now.Sub(l.swept) > sweepInterval || len(l.ips) >= l.MaxCounters || len(l.accounts) >= l.MaxCounters {
+		l.sweep(l.ips, l.IPPolicy)
+		l.sweep(l.accounts, l.AccountPolicy)
+		l.swept = now
+	}
+	l.fail(l.ips, ip, l.IPPolicy)
+	l.fail(l.accounts, accountKey(account), l.AccountPolicy)
+}
+
+func (l *LoginLimiter) fail(m map[string]*loginAttempts, key string, policy LoginPolicy) {
+	a := l.lookup(m, key, policy)
+	if a == nil {
+		a = &loginAttempts{}
+		m[key] = a
+	}
+	a.Failures++
+	a.LastFailure = l.now()
+	if d := policy.lockout(a.Failures); d > 0 {
+		a.LockedUntil = a.LastFailure.Add(d)
+	}
+}
+
+// sweep drops expired counters, which are otherwise dropped only when looked up
+// again, and then the oldest ones above MaxCounters, leaving room for the next
+// failure. Names and addresses made up by the caller cannot grow the maps unbounded.
+func (l *LoginLimiter) sweep(m map[string]*loginAttempts, policy LoginPolicy) {
+	now := l.now()
+	for key, a := range m {
+		if now.Sub(a.LastFailure) > policy.ResetAfter {
+			delete(m, key)
+		}
+	}
+	if len(m) < l.MaxCounters {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return m[keys[i]].LastFailure.Before(m[keys[j]].LastFailure)
+	})
+	for _, key := range keys[:len(m)-l.MaxCounters+1] {
+		delete(m, key)
+	}
+}
+
+func (l *LoginLimiter) Succeed(ip, account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ips, ip)
+	delete(l.accounts, accountKey(account))
+}
+
+type Lockout struct {
+	Account string `json:"account,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	loginAttempts
+}
+
+// Lockouts lists all counters with recorded failures.
+func (l *LoginLimiter) Lockouts() []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lockouts := []Lockout{}
+	for key := range l.accounts {
+		if a := l.lookup(l.accounts, key, l.AccountPolicy); a != nil {
+			lockouts = append(lockouts, Lockout{Account: key, loginAttempts: *a})
+		}
+	}
+	for key := range l.ips {
+		if a := l.lookup(l.ips, key, l.IPPolicy); a != nil {
+			lockouts = append(lockouts, Lockout{IP: key, loginAttempts: *a})
+		}
+	}
+	return lockouts
+}
+
+func (l *LoginLimiter) ClearAccount(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, accountKey(account))
+}
+
+func (l *LoginLimiter) ClearIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ips, ip)
+}
+
+func (l *LoginLimiter) ClearAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accounts = make(map[string]*loginAttempts)
+	l.ips = make(map[string]*loginAttempts)
+}
+
+// ParseTrustedProxies returns the number of proxies in front of the application
+// which append to X-Forwarded-For, "true" standing for a single router.
+func ParseTrustedProxies(s string) (int, error) {
+	switch s {
+	case "true":
+		return 1, nil
+	case "false", "":
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(s)
+	if err != nil || hops < 0 {
+		return 0, fmt.Errorf("invalid number of trusted proxies %q", s)
+	}
+	return hops, nil
+}
+
+// clientIP returns the address of the caller. Behind trusted proxies it is taken
+// from X-Forwarded-For, counting back the proxy hops from the right, since
+// the entries on the left are set by the client and cannot be trusted.
+func clientIP(r *http.Request) string {
+	if app.TrustedProxies > 0 {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(header, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		if len(entries) >= app.TrustedProxies {
+			return entries[len(entries)-app.TrustedProxies]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many login attempts, try again in "+strconv.Itoa(seconds)+" seconds", http.StatusTooManyRequests)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEmployeeCodeAsEntered(t *testing.T) {
+	var e Employee
+	if err := e.SetCode("0123"); err != nil {
+		t.Fatal(err)
+	}
+	if !e.CheckCode("0123") || e.CheckCode("123") {
+		t.Error("Expected leading zeros to be part of the code")
+	}
+	for code, expected := range map[string]error{"": ErrCodeRequired, "12a4": ErrCodeDigits, " 1234": ErrCodeDigits, "0": nil} {
+		if err := e.SetCode(code); err != expected {
+			t.Errorf("Expected %v for code %q, got: %v", expected, code, err)
+		}
+	}
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLoginLimiter()
+	l.now = func() time.Time { return now }
+	policy := l.AccountPolicy
+
+	for i := 0; i < policy.FreeAttempts; i++ {
+		l.Fail("10.0.0.1", "anna")
+	}
+	if wait := l.Allow("10.0.0.1", "anna"); wait != 0 {
+		t.Errorf("Expected no lockout within free attempts, got: %v", wait)
+	}
+	l.Fail("10.0.0.1", "anna")
+	if wait := l.Allow("10.0.0.2", "Anna"); wait != policy.BaseDelay {
+		t.Errorf("Expected lockout of %v, got: %v", policy.BaseDelay, wait)
+	}
+	l.Fail("10.0.0.1", "anna")
+	if wait := l.Allow("10.0.0.2", "anna"); wait != 2*policy.BaseDelay {
+		t.Errorf("Expected doubled lockout, got: %v", wait)
+	}
+	if wait := l.Allow("10.0.0.2", "piotr"); wait != 0 {
+		t.Errorf("Other accounts should not be locked, got: %v", wait)
+	}
+
+	now = now.Add(policy.ResetAfter + time.Second)
+	if wait := l.Allow("10.0.0.1", "anna"); wait != 0 {
+		t.Errorf("Expected counters to reset, got: %v", wait)
+	}
+	if len(l.Lockouts()) != 0 {
+		t.Errorf("Expected expired counters to be dropped, got: %v", l.Lockouts())
+	}
+}
+
+func TestLoginLimiterPerIP(t *testing.T) {
+	l := NewLoginLimiter()
+	for i := 0; i <= l.IPPolicy.FreeAttempts; i++ {
+		l.Fail("10.0.0.1", "user"+string(rune('a'+i)))
+	}
+	if wait := l.Allow("10.0.0.1", "someone"); wait == 0 {
+		t.Error("Expected IP to be locked out")
+	}
+	l.ClearIP("10.0.0.1")
+	if wait := l.Allow("10.0.0.1", "someone"); wait != 0 {
+		t.Errorf("Expected no lockout after clearing, got: %v", wait)
+	}
+}
+
+func TestLoginLimiterSweep(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLoginLimiter()
+	l.now = func() time.Time { return now }
+	l.MaxCounters = 3
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		l.Fail("10.0.0."+strconv.Itoa(i), "user"+strconv.Itoa(i))
+	}
+	if len(l.accounts) != 3 || len(l.ips) != 3 || l.accounts["user4"] == nil || l.accounts["user1"] != nil {
+		t.Errorf("Expected the oldest counters to be dropped, got: %v", l.accounts)
+	}
+
+	now = now.Add(l.AccountPolicy.ResetAfter + time.Second)
+	l.Fail("10.0.0.9", "someone")
+	if len(l.accounts) != 1 || len(l.ips) != 1 {
+		t.Errorf("Expected expired counters to be swept, got: %v %v", l.accounts, l.ips)
+	}
+}
+
+func TestClientIPIgnoresSpoofedForwarding(t *testing.T) {
+	setupTestApp(t)
+	app.TrustedProxies = 1
+	request := func(forwarded string) string {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		return clientIP(r)
+	}
+
+	for i := 0; i <= app.Logins.IPPolicy.FreeAttempts; i++ {
+		ip := request("198.51.100." + strconv.Itoa(i) + ", 203.0.113.7")
+		if ip != "203.0.113.7" {
+			t.Fatalf("Expected address appended by the router, got: %s", ip)
+		}
+		app.Logins.Fail(ip, "user"+strconv.Itoa(i))
+	}
+	if wait := app.Logins.Allow(request("192.0.2.1, 203.0.113.7"), "someone"); wait == 0 {
+		t.Error("Spoofed leftmost address should not reset the limiter")
+	}
+
+	app.TrustedProxies = 2
+	if ip := request("192.0.2.1, 203.0.113.7, 10.0.0.2"); ip != "203.0.113.7" {
+		t.Errorf("Expected address two hops back, got: %s", ip)
+	}
+	if ip := request("203.0.113.7"); ip != "192.0.2.1" {
+		t.Errorf("Expected remote address with fewer entries than proxies, got: %s", ip)
+	}
+}
+
+func TestMigrateEmployeeCodes(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	legacy := Employee{Name: "Legacy", LegacyCode: 5555}
+	app.Employees.Insert(ctx, &legacy)
+
+	if err := app.MigrateEmployeeCodes(ctx); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	migrated, _ := app.Employees.Get(ctx, legacy.Id)
+	if migrated.LegacyCode != 0 || !migrated.CheckCode("5555") {
+		t.Errorf("Expected code to be hashed: %+v", migrated)
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/tealeg/xlsx"
@@ -14,10 +13,9 @@ import (
 	"net/http"
 	"os"
 	"runtime"
-	"strconv"
+	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -27,42 +25,104 @@ import (
 type App struct {
 	Store         *sessions.CookieStore
 	Mongo         *mongo.Client
-	DB            *mongo.Database
+	Employees     EmployeeStore
+	Clients       ClientStore
+	Records       RecordStore
+	Appointments  AppointmentStore
+	Series        SeriesStore
+	Services      ServiceStore
+	Packages      PackageStore
+	Payments      PaymentStore
+	Invoices      InvoiceStore
 	TemplatesPath string
 	StaticPath    string
 	Bind          string
 	Location      *time.Location
+	Logins        *LoginLimiter
+	// TrustedProxies is the number of proxies appending to X-Forwarded-For, see clientIP.
+	TrustedProxies int
+	// RecordEditWindow limits changes of records by non-admin employees.
+	RecordEditWindow EditWindow
+	// Currency of all amounts, see Money.
+	Currency string
+	// DefaultPrice of services on the price list created at the first start, see SeedServices.
+	DefaultPrice Money
+	// Seller named on invoices with the note printed at their bottom, e.g. the legal basis of a VAT exemption.
+	Seller      Party
+	InvoiceNote string
+	// Default policies for removal of employees and clients who have records.
+	EmployeeDeletePolicy DeletePolicy
+	ClientDeletePolicy   DeletePolicy
 }
 
 func (app *App) Init() {
 	var err error
 
-	app.Location, err = time.LoadLocation("Europe/Warsaw")
+	// dates are reported, and months and days bounded, in the timezone of the clinic
+	app.Location, err = time.LoadLocation(GetenvDefault("TIMEZONE", "Europe/Warsaw"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	app.Store = sessions.NewCookieStore([]byte("07FdEM5Obo7BM2Kn4e1m-tZCC3IMfWLan0ealKM31"))
-
-	mongoUri := GetenvDefault("MONGO_URI", "localhost")
-	log.Printf("Connecting to MongoDB: %s...", mongoUri)
-
-	options := options.Client().ApplyURI(mongoUri)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(ctx, options)
+	app.Logins = NewLoginLimiter()
+	app.TrustedProxies, err = ParseTrustedProxies(GetenvDefault("TRUST_PROXY", "false"))
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	cs, err := connstring.Parse(mongoUri)
+	app.RecordEditWindow, err = ParseEditWindow(GetenvDefault("RECORD_EDIT_WINDOW", "month"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Currency = strings.ToUpper(GetenvDefault("CURRENCY", "PLN"))
+	app.DefaultPrice, err = ParseMoney(GetenvDefault("DEFAULT_PRICE", "90"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Seller = Party{
+		Name:        os.Getenv("SELLER_NAME"),
+		Street:      os.Getenv("SELLER_STREET"),
+		PostCode:    os.Getenv("SELLER_POST_CODE"),
+		City:        os.Getenv("SELLER_CITY"),
+		TaxId:       os.Getenv("SELLER_TAX_ID"),
+		BankAccount: os.Getenv("SELLER_BANK_ACCOUNT"),
+	}
+	app.InvoiceNote = os.Getenv("INVOICE_NOTE")
+	app.EmployeeDeletePolicy, err = ParseDeletePolicy(GetenvDefault("EMPLOYEE_DELETE_POLICY", "refuse"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.ClientDeletePolicy, err = ParseDeletePolicy(GetenvDefault("CLIENT_DELETE_POLICY", "archive"))
+	if err == nil && app.ClientDeletePolicy == ReassignOnDelete {
+		err = fmt.Errorf("records cannot be reassigned to another client")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	db := client.Database(cs.Database)
 
-	app.Mongo = client
-	app.DB = db
+	storage := GetenvDefault("STORAGE", "mongo")
+	if storage == "memory" {
+		log.Printf("Using in-memory storage, all data will be lost on exit.")
+		app.UseMemoryStores()
+	} else {
+		mongoUri := GetenvDefault("MONGO_URI", "localhost")
+		log.Printf("Connecting to MongoDB: %s...", mongoUri)
+
+		options := options.Client().ApplyURI(mongoUri)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(ctx, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cs, err := connstring.Parse(mongoUri)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Mongo = client
+		app.UseMongoStores(client.Database(cs.Database))
+	}
 	app.InitDB()
 
 	app.TemplatesPath = GetenvDefault("TEMPLATES_PATH", "templates")
@@ -72,7 +132,34 @@ func (app *App) Init() {
 	app.Bind = GetenvDefault("BIND_ADDR", ":"+port)
 }
 
+func (app *App) UseMongoStores(db *mongo.Database) {
+	app.Employees = NewMongoEmployeeStore(db)
+	app.Clients = NewMongoClientStore(db)
+	app.Records = NewMongoRecordStore(db)
+	app.Appointments = NewMongoAppointmentStore(db)
+	app.Series = NewMongoSeriesStore(db)
+	app.Services = NewMongoServiceStore(db)
+	app.Packages = NewMongoPackageStore(db)
+	app.Payments = NewMongoPaymentStore(db)
+	app.Invoices = NewMongoInvoiceStore(db)
+}
+
+func (app *App) UseMemoryStores() {
+	app.Employees = NewMemoryEmployeeStore()
+	app.Clients = NewMemoryClientStore()
+	app.Records = NewMemoryRecordStore()
+	app.Appointments = NewMemoryAppointmentStore()
+	app.Series = NewMemorySeriesStore()
+	app.Services = NewMemoryServiceStore()
+	app.Packages = NewMemoryPackageStore()
+	app.Payments = NewMemoryPaymentStore()
+	app.Invoices = NewMemoryInvoiceStore()
+}
+
 func (app *App) Close() {
+	if app.Mongo == nil {
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 	app.Mongo.Disconnect(ctx)
@@ -81,14 +168,39 @@ func (app *App) Close() {
 func (app *App) InitDB() {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	employees := app.DB.Collection("employees")
-	count, err := employees.CountDocuments(ctx, bson.D{})
+	count, err := app.Employees.Count(ctx)
 	if err != nil {
 		panic(err)
 	}
 	if count == 0 {
-		admin := Employee{Name: "admin", Code: 1234, Admin: true}
-		employees.InsertOne(ctx, admin)
+		admin := Employee{Name: "admin", Admin: true}
+		admin.SetCode("1234")
+		app.Employees.Insert(ctx, &admin)
+	}
+	for _, store := range []interface{}{app.Employees, app.Clients, app.Records, app.Appointments, app.Series, app.Services, app.Packages, app.Payments, app.Invoices} {
+		if indexer, ok := store.(Indexer); ok {
+			if err = indexer.EnsureIndexes(ctx); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err = app.MigrateEmployeeCodes(ctx); err != nil {
+		panic(err)
+	}
+	if err = app.MigrateClientSearchFields(ctx); err != nil {
+		panic(err)
+	}
+	if err = app.MigrateMoney(ctx); err != nil {
+		panic(err)
+	}
+	if err = app.SeedServices(ctx); err != nil {
+		panic(err)
+	}
+	if err = app.MigrateClientPrices(ctx); err != nil {
+		panic(err)
+	}
+	if err = app.MigrateRecordDurations(ctx); err != nil {
+		panic(err)
 	}
 }
 
@@ -100,6 +212,16 @@ func GetenvDefault(key string, default_value string) string {
 	return value
 }
 
+// routeId returns the id in the path of the request. An invalid id names
+// no document, so it is reported as ErrNotFound like a missing one.
+func routeId(r *http.Request) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return id, ErrNotFound
+	}
+	return id, nil
+}
+
 var app App
 
 type ShortDate struct {
@@ -109,9 +231,21 @@ type ShortDate struct {
 type Employee struct {
 	Id        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	Name      string             `json:"name"`
-	Code      int                `json:"code"`
-	HourlyNet int                `json:"hourlyNet"`
-	Admin     bool               `json:"admin"`
+	Code      string             `json:"code,omitempty" bson:"-"` // only accepted on input, see SetCode
+	CodeHash  string             `json:"-" bson:"codehash,omitempty"`
+	HourlyNet Money              `json:"hourlyNet"` // paid per hour unless Compensation has a rule in effect
+	// Compensation rules sorted by the effective date, see CompensationRule.
+	Compensation []CompensationRule `json:"compensation"`
+	Admin        bool               `json:"admin"`
+	// Archived employees cannot log in and cannot be assigned new records.
+	Archived   bool               `json:"archived"`
+	ArchivedAt primitive.DateTime `json:"archivedAt"`
+	// FeedTokenHash protects the calendar feed, see regenerateFeedToken.
+	FeedTokenHash string `json:"-" bson:"feedtokenhash,omitempty"`
+	Version       int64  `json:"version"`
+
+	// LegacyCode holds plaintext codes stored by older versions until MigrateEmployeeCodes hashes them.
+	LegacyCode int `json:"-" bson:"code,omitempty"`
 }
 
 type Address struct {
@@ -121,16 +255,27 @@ type Address struct {
 }
 
 type Client struct {
-	Id           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Name         string             `json:"name"`
-	Address      Address            `json:"address"`
-	Email        string             `json:"email"`
-	Tel          string             `json:"tel"`
-	Birthday     primitive.DateTime `json:"birthday"`
-	TherapyFrom  primitive.DateTime `json:"therapyFrom"`
-	SpecialPrice int                `json:"specialPrice"`
+	Id          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name"`
+	Address     Address            `json:"address"`
+	Email       string             `json:"email"`
+	Tel         string             `json:"tel"`
+	Birthday    primitive.DateTime `json:"birthday"`
+	TherapyFrom primitive.DateTime `json:"therapyFrom"`
+	// Prices of the client overriding the price list, see servicePrice.
+	Prices       []ClientPrice      `json:"prices"`
 	Registered   primitive.DateTime `json:"registered"`
 	LastModified primitive.DateTime `json:"lastModified"`
+	Archived     bool               `json:"archived"`
+	ArchivedAt   primitive.DateTime `json:"archivedAt"`
+	Version      int64              `json:"version"`
+
+	// Maintained by stores, see updateSearchFields.
+	SortName string   `json:"-"`
+	Keywords []string `json:"-"`
+
+	// LegacySpecialPrice holds the price stored by older versions until MigrateClientPrices moves it to Prices.
+	LegacySpecialPrice int `json:"-" bson:"specialprice,omitempty"`
 }
 
 var ShortDateLayout = "2006-01-02"
@@ -156,6 +301,11 @@ func UnmarshalDate(s string, dt *primitive.DateTime, layout string) error {
 	return nil
 }
 
+// setExcelDate sets the cell to the time of the clinic, Excel dates have no timezone.
+func setExcelDate(cell *xlsx.Cell, t time.Time, format string) {
+	cell.SetDateWithOptions(t, xlsx.DateTimeOptions{Location: app.Location, ExcelTimeFormat: format})
+}
+
 func (c *Client) MarshalJSON() ([]byte, error) {
 	type Alias Client
 	return json.Marshal(&struct {
@@ -169,11 +319,13 @@ func (c *Client) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// UnmarshalJSON leaves dates missing in data untouched, so that a request
+// can be decoded onto a stored client to apply a partial update.
 func (c *Client) UnmarshalJSON(data []byte) error {
 	type Alias Client
 	aux := &struct {
-		Birthday    string `json:"birthday"`
-		TherapyFrom string `json:"therapyFrom"`
+		Birthday    *string `json:"birthday"`
+		TherapyFrom *string `json:"therapyFrom"`
 		*Alias
 	}{
 		Alias: (*Alias)(c),
@@ -181,22 +333,39 @@ func (c *Client) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
-	if err := UnmarshalDate(aux.Birthday, &c.Birthday, ShortDateLayout); err != nil {
-		return err
+	if aux.Birthday != nil {
+		if err := UnmarshalDate(*aux.Birthday, &c.Birthday, ShortDateLayout); err != nil {
+			return err
+		}
 	}
-	if err := UnmarshalDate(aux.TherapyFrom, &c.TherapyFrom, ShortDateLayout); err != nil {
-		return err
+	if aux.TherapyFrom != nil {
+		if err := UnmarshalDate(*aux.TherapyFrom, &c.TherapyFrom, ShortDateLayout); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 type Record struct {
-	Id             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	EmployeeId     primitive.ObjectID `json:"employeeId"`
-	ClientId       primitive.ObjectID `json:"clientId"`
-	Date           primitive.DateTime `json:"date"`
-	Price          int                `json:"price"`
-	EmployeeIncome int                `json:"employeeIncome"`
+	Id         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	ClientId   primitive.ObjectID `json:"clientId"`
+	Date       primitive.DateTime `json:"date"`
+	Duration   int                `json:"duration"` // minutes
+	HomeVisit  bool               `json:"homeVisit"`
+	// ServiceId on the price list, the default service when zero.
+	ServiceId primitive.ObjectID `json:"serviceId" bson:"serviceid,omitempty"`
+	// PackageId of the client's package which pays for the session instead of the price list.
+	PackageId      primitive.ObjectID `json:"packageId,omitempty" bson:"packageid,omitempty"`
+	Price          Money              `json:"price"`
+	EmployeeIncome Money              `json:"employeeIncome"`
+	// PriceOverridden and IncomeOverridden flag amounts set by hand instead of computed by applyRates.
+	PriceOverridden  bool `json:"priceOverridden"`
+	IncomeOverridden bool `json:"incomeOverridden"`
+	// AppointmentId links records created by completing an appointment.
+	AppointmentId primitive.ObjectID `json:"appointmentId,omitempty" bson:"appointmentid,omitempty"`
+	Override      *ConflictOverride  `json:"override,omitempty" bson:"override,omitempty"`
+	Version       int64              `json:"version"`
 }
 
 func (r *Record) MarshalJSON() ([]byte, error) {
@@ -210,10 +379,11 @@ func (r *Record) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// UnmarshalJSON leaves the date untouched when missing in data, see Client.UnmarshalJSON.
 func (r *Record) UnmarshalJSON(data []byte) error {
 	type Alias Record
 	aux := &struct {
-		Date string `json:"date"`
+		Date *string `json:"date"`
 		*Alias
 	}{
 		Alias: (*Alias)(r),
@@ -221,8 +391,10 @@ func (r *Record) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
-	if err := UnmarshalDate(aux.Date, &r.Date, DateTimeLayout); err != nil {
-		return err
+	if aux.Date != nil {
+		if err := UnmarshalDate(*aux.Date, &r.Date, DateTimeLayout); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -237,24 +409,7 @@ func main() {
 	app.Init()
 	defer app.Close()
 
-	rtr := mux.NewRouter()
-	rtr.Handle("/login", SessionHandler(processLogin, app.Store)).Methods("POST")
-	rtr.Handle("/logout", SessionHandler(processLogout, app.Store)).Methods("GET")
-	rtr.Handle("/employees", EmployeeHandler(showEmployees, &app)).Methods("GET")
-	rtr.Handle("/employees", EmployeeHandler(createEmployee, &app)).Methods("PUT")
-	rtr.Handle("/employees/{id}", EmployeeHandler(updateEmployee, &app)).Methods("POST")
-	rtr.Handle("/employees/{id}", EmployeeHandler(removeEmployee, &app)).Methods("DELETE")
-	rtr.Handle("/records", EmployeeHandler(showRecords, &app)).Methods("GET")
-	rtr.Handle("/records.csv", EmployeeHandler(exportRecords, &app)).Methods("GET")
-	rtr.Handle("/records/{date}.xlsx", EmployeeHandler(exportExcel, &app)).Methods("GET")
-	rtr.Handle("/records", EmployeeHandler(createRecord, &app)).Methods("PUT")
-	rtr.Handle("/records/{id}", EmployeeHandler(updateRecord, &app)).Methods("POST")
-	rtr.Handle("/records/{id}", EmployeeHandler(removeRecord, &app)).Methods("DELETE")
-	rtr.Handle("/clients", EmployeeHandler(showClients, &app)).Methods("GET")
-	rtr.Handle("/clients", EmployeeHandler(createClient, &app)).Methods("PUT")
-	rtr.Handle("/clients/{id}", EmployeeHandler(updateClient, &app)).Methods("POST")
-	rtr.Handle("/clients/{id}", EmployeeHandler(removeClient, &app)).Methods("DELETE")
-	rtr.Handle("/", EmployeeHandler(showIndex, &app)).Methods("GET")
+	rtr := NewRouter()
 
 	log.Printf("Serving static files from: %s.", app.StaticPath)
 	log.Printf("Templates directory: %s.", app.TemplatesPath)
@@ -268,25 +423,111 @@ func main() {
 	http.ListenAndServe(app.Bind, nil)
 }
 
+// NewRouter registers all application routes.
+func NewRouter() *mux.Router {
+	rtr := mux.NewRouter()
+	rtr.Handle("/login", SessionHandler(processLogin, app.Store)).Methods("POST")
+	rtr.Handle("/logout", SessionHandler(processLogout, app.Store)).Methods("GET")
+	rtr.Handle("/employees", EmployeeHandler(RequireLogin(showEmployees), &app)).Methods("GET")
+	rtr.Handle("/employees", EmployeeHandler(RequireAdmin(createEmployee), &app)).Methods("PUT")
+	rtr.Handle("/employees/lockouts", EmployeeHandler(RequireAdmin(showLockouts), &app)).Methods("GET")
+	rtr.Handle("/employees/lockouts", EmployeeHandler(RequireAdmin(clearLockouts), &app)).Methods("DELETE")
+	rtr.Handle("/employees/{id}/lockout", EmployeeHandler(RequireAdmin(clearEmployeeLockout), &app)).Methods("DELETE")
+	rtr.Handle("/employees/{id}", EmployeeHandler(RequireAdmin(showEmployee), &app)).Methods("GET")
+	rtr.Handle("/employees/{id}", EmployeeHandler(RequireAdmin(updateEmployee), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/employees/{id}", EmployeeHandler(RequireAdmin(removeEmployee), &app)).Methods("DELETE")
+	rtr.Handle("/employees/{id}/restore", EmployeeHandler(RequireAdmin(restoreEmployee), &app)).Methods("POST")
+	rtr.Handle("/records", EmployeeHandler(RequireLogin(showRecords), &app)).Methods("GET")
+	rtr.Handle("/records.csv", EmployeeHandler(RequireAdmin(exportRecords), &app)).Methods("GET")
+	rtr.Handle("/records.xlsx", EmployeeHandler(RequireAdmin(exportExcel), &app)).Methods("GET")
+	rtr.Handle("/records/{date}.xlsx", EmployeeHandler(RequireAdmin(exportExcel), &app)).Methods("GET")
+	rtr.Handle("/records", EmployeeHandler(RequireLogin(createRecord), &app)).Methods("PUT")
+	rtr.Handle("/records/{id}", EmployeeHandler(RequireLogin(showRecord), &app)).Methods("GET")
+	rtr.Handle("/records/{id}", EmployeeHandler(RequireLogin(updateRecord), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/records/{id}", EmployeeHandler(RequireLogin(removeRecord), &app)).Methods("DELETE")
+	rtr.Handle("/appointments", EmployeeHandler(RequireLogin(showAppointments), &app)).Methods("GET")
+	rtr.Handle("/appointments", EmployeeHandler(RequireLogin(createAppointment), &app)).Methods("PUT")
+	rtr.Handle("/appointments/{id}", EmployeeHandler(RequireLogin(showAppointment), &app)).Methods("GET")
+	rtr.Handle("/appointments/{id}", EmployeeHandler(RequireLogin(updateAppointment), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/appointments/{id}", EmployeeHandler(RequireLogin(removeAppointment), &app)).Methods("DELETE")
+	rtr.Handle("/appointments/{id}/complete", EmployeeHandler(RequireLogin(completeAppointment), &app)).Methods("POST")
+	rtr.Handle("/employees/{id}/calendar/{week}", EmployeeHandler(RequireLogin(showCalendar), &app)).Methods("GET")
+	rtr.Handle("/services", EmployeeHandler(RequireLogin(showServices), &app)).Methods("GET")
+	rtr.Handle("/services", EmployeeHandler(RequireAdmin(createService), &app)).Methods("PUT")
+	rtr.Handle("/services/{id}", EmployeeHandler(RequireLogin(showService), &app)).Methods("GET")
+	rtr.Handle("/services/{id}", EmployeeHandler(RequireAdmin(updateService), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/clients/{id}/packages", EmployeeHandler(RequireLogin(showClientPackages), &app)).Methods("GET")
+	rtr.Handle("/clients/{id}/packages", EmployeeHandler(RequireLogin(createPackage), &app)).Methods("PUT")
+	rtr.Handle("/packages/{id}", EmployeeHandler(RequireLogin(showPackage), &app)).Methods("GET")
+	rtr.Handle("/packages/{id}", EmployeeHandler(RequireAdmin(updatePackage), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/packages/{id}", EmployeeHandler(RequireAdmin(removePackage), &app)).Methods("DELETE")
+	rtr.Handle("/reports/packages", EmployeeHandler(RequireAdmin(showPackageExpiry), &app)).Methods("GET")
+	rtr.Handle("/clients/{id}/payments", EmployeeHandler(RequireLogin(showClientPayments), &app)).Methods("GET")
+	rtr.Handle("/clients/{id}/payments", EmployeeHandler(RequireLogin(createPayment), &app)).Methods("PUT")
+	rtr.Handle("/clients/{id}/statement", EmployeeHandler(RequireLogin(showStatement), &app)).Methods("GET")
+	rtr.Handle("/payments/{id}", EmployeeHandler(RequireLogin(showPayment), &app)).Methods("GET")
+	rtr.Handle("/payments/{id}", EmployeeHandler(RequireAdmin(updatePayment), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/payments/{id}", EmployeeHandler(RequireAdmin(removePayment), &app)).Methods("DELETE")
+	rtr.Handle("/reports/balances", EmployeeHandler(RequireAdmin(showOutstandingBalances), &app)).Methods("GET")
+	rtr.Handle("/invoices", EmployeeHandler(RequireAdmin(showInvoices), &app)).Methods("GET")
+	rtr.Handle("/invoices", EmployeeHandler(RequireAdmin(createInvoice), &app)).Methods("PUT")
+	rtr.Handle("/invoices/{id}.pdf", EmployeeHandler(RequireAdmin(exportInvoicePDF), &app)).Methods("GET")
+	rtr.Handle("/invoices/{id}", EmployeeHandler(RequireAdmin(showInvoice), &app)).Methods("GET")
+	rtr.Handle("/invoices/{id}/corrections", EmployeeHandler(RequireAdmin(createCorrection), &app)).Methods("PUT")
+	rtr.Handle("/compensation/{month}/recalculate", EmployeeHandler(RequireAdmin(recalculateIncomes), &app)).Methods("POST")
+	rtr.Handle("/reports/hours", EmployeeHandler(RequireLogin(showHours), &app)).Methods("GET")
+	rtr.Handle("/reports/revenue", EmployeeHandler(RequireAdmin(showRevenue), &app)).Methods("GET")
+	rtr.Handle("/payroll/{month}.xlsx", EmployeeHandler(RequireLogin(exportPayrollExcel), &app)).Methods("GET")
+	rtr.Handle("/payroll/{month}.html", EmployeeHandler(RequireLogin(showPayrollPage), &app)).Methods("GET")
+	rtr.Handle("/payroll/{month}", EmployeeHandler(RequireLogin(showPayroll), &app)).Methods("GET")
+	rtr.Handle("/employees/{id}/feed-token", EmployeeHandler(RequireLogin(regenerateFeedToken), &app)).Methods("POST")
+	rtr.HandleFunc("/calendar/{token}.ics", showFeed).Methods("GET")
+	rtr.Handle("/series", EmployeeHandler(RequireLogin(showSeriesList), &app)).Methods("GET")
+	rtr.Handle("/series", EmployeeHandler(RequireLogin(createSeries), &app)).Methods("PUT")
+	rtr.Handle("/series/{id}", EmployeeHandler(RequireLogin(showSeries), &app)).Methods("GET")
+	rtr.Handle("/series/{id}", EmployeeHandler(RequireLogin(updateSeries), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/series/{id}", EmployeeHandler(RequireLogin(removeSeries), &app)).Methods("DELETE")
+	rtr.Handle("/series/{id}/occurrences/{day}", EmployeeHandler(RequireLogin(updateOccurrence), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/series/{id}/occurrences/{day}", EmployeeHandler(RequireLogin(removeOccurrence), &app)).Methods("DELETE")
+	rtr.Handle("/series/{id}/occurrences/{day}/complete", EmployeeHandler(RequireLogin(completeOccurrence), &app)).Methods("POST")
+	rtr.Handle("/clients", EmployeeHandler(RequireLogin(showClients), &app)).Methods("GET")
+	rtr.Handle("/clients", EmployeeHandler(RequireLogin(createClient), &app)).Methods("PUT")
+	rtr.Handle("/clients/{id}", EmployeeHandler(RequireLogin(showClient), &app)).Methods("GET")
+	rtr.Handle("/clients/{id}", EmployeeHandler(RequireLogin(updateClient), &app)).Methods("POST", "PATCH")
+	rtr.Handle("/clients/{id}", EmployeeHandler(RequireAdmin(removeClient), &app)).Methods("DELETE")
+	rtr.Handle("/clients/{id}/restore", EmployeeHandler(RequireAdmin(restoreClient), &app)).Methods("POST")
+	rtr.Handle("/", EmployeeHandler(showIndex, &app)).Methods("GET")
+	return rtr
+}
+
 func processLogin(w http.ResponseWriter, r *http.Request, s *Session) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	code, _ := strconv.Atoi(r.FormValue("code"))
-	var employee Employee
-	res := app.DB.Collection("employees").FindOne(ctx, bson.M{"code": code})
-	if res.Err() == nil {
-		err := res.Decode(&employee)
-		if err == nil {
-			err = s.StoreEmployeeId(employee.Id)
-		}
+	ip := clientIP(r)
+	name := r.FormValue("name")
+	if wait := app.Logins.Allow(ip, name); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+	code := r.FormValue("code")
+	employee, err := app.Employees.GetByName(ctx, name)
+	if err == ErrNotFound || (err == nil && employee.Archived) {
+		employee, err = nil, nil
+	}
+	if err == nil && employee.CheckCode(code) {
+		app.Logins.Succeed(ip, name)
+		err = s.StoreEmployeeId(employee.Id)
 		if err == nil {
 			w.Header().Set("Content-Type", "application/vnd.api+json")
 			json.NewEncoder(w).Encode(employee)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+	} else if err == nil {
+		app.Logins.Fail(ip, name)
+		http.Error(w, "Invalid employee name or code", http.StatusUnauthorized)
 	} else {
-		http.Error(w, "Invalid employee code", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -305,43 +546,32 @@ func showEmployees(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 	onlyNames := r.FormValue("only-names") == "true"
-	if e != nil && (e.Admin || onlyNames) {
-		findOptions := options.Find()
-		findOptions.SetSort(bson.D{{"name", 1}})
-		cur, err := app.DB.Collection("employees").Find(ctx, bson.D{}, findOptions)
-		if err == nil {
-			w.Header().Set("Content-Type", "application/vnd.api+json")
-			if onlyNames {
-				employeeMap := make(map[string]string)
-				for cur.Next(ctx) {
-					var employee Employee
-					if err = cur.Decode(&employee); err == nil {
-						employeeMap[employee.Id.Hex()] = employee.Name
-					}
-				}
-				json.NewEncoder(w).Encode(employeeMap)
-			} else {
-				var employees []Employee
-				for cur.Next(ctx) {
-					var employee Employee
-					if err = cur.Decode(&employee); err == nil {
-						employees = append(employees, employee)
-					}
-				}
-				err = json.NewEncoder(w).Encode(employees)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
+	if !e.Admin && !onlyNames {
+		accessDenied(w)
+		return
+	}
+	employees, err := app.Employees.List(ctx)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		tags := make([]string, len(employees))
+		for i := range employees {
+			tags[i] = employees[i].ETag()
+		}
+		w.Header().Set("ETag", listETag(tags))
+		if onlyNames {
+			employeeMap := make(map[string]string)
+			for _, employee := range employees {
+				employeeMap[employee.Id.Hex()] = employee.Name
 			}
+			json.NewEncoder(w).Encode(employeeMap)
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			err = json.NewEncoder(w).Encode(employees)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
 		}
 	} else {
-		if e == nil {
-			http.Error(w, "Please log in", http.StatusUnauthorized)
-		} else {
-			http.Error(w, "Access denied", http.StatusUnauthorized)
-		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -353,15 +583,58 @@ func createEmployee(w http.ResponseWriter, r *http.Request, e *Employee) {
 	var employee Employee
 	err := decoder.Decode(&employee)
 	if err == nil {
-		_, err := app.DB.Collection("employees").InsertOne(ctx, &employee)
+		employee.Id = primitive.NilObjectID
+		employee.Archived, employee.ArchivedAt = false, 0
+		err = employee.SetCode(employee.Code)
+	}
+	if err == nil {
+		err = checkEmployeeName(ctx, &employee)
+	}
+	if err == nil {
+		err = employee.validateCompensation()
+	}
+	if err == nil {
+		err = app.Employees.Insert(ctx, &employee)
 		if err == nil {
+			w.Header().Set("ETag", employee.ETag())
 			w.Header().Set("Content-Type", "application/vnd.api+json")
 			json.NewEncoder(w).Encode(employee)
 		}
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+	}
+}
+
+// Updates decode the request onto the stored document, so only the fields
+// present in the request change. Identifiers and server-managed fields
+// are restored afterwards and the stored document is sent back.
+
+func decodePatch(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func showEmployee(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var employee *Employee
+	employeeId, err := routeId(r)
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", employee.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(employee)
 	}
 }
 
@@ -369,269 +642,319 @@ func updateEmployee(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	var employee Employee
-	vars := mux.Vars(r)
-	employeeId, err := primitive.ObjectIDFromHex(vars["id"])
+	var employee *Employee
+	employeeId, err := routeId(r)
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
+
+	if err == nil && !ifMatch(r, employee.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil {
+		version, archived, archivedAt := employee.Version, employee.Archived, employee.ArchivedAt
+		err = decodePatch(r, employee)
+		employee.Id = employeeId
+		employee.Version = version
+		// archiving goes through DELETE and restore
+		employee.Archived, employee.ArchivedAt = archived, archivedAt
+	}
+
+	if err == nil && employee.Code != "" {
+		err = employee.SetCode(employee.Code)
+	}
+
 	if err == nil {
-		decoder := json.NewDecoder(r.Body)
-		err = decoder.Decode(&employee)
+		err = checkEmployeeName(ctx, employee)
 	}
 
 	if err == nil {
-		res := app.DB.Collection("employees").FindOneAndUpdate(ctx, bson.M{"_id": employeeId}, bson.M{"$set": employee})
-		err = res.Err()
+		err = employee.validateCompensation()
+	}
+
+	if err == nil {
+		err = app.Employees.Update(ctx, employeeId, employee)
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		employee, err = app.Employees.Get(ctx, employeeId)
+		if err == nil && conflict {
+			writeConflict(w, employee.ETag(), employee)
+			return
+		}
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 	} else {
+		w.Header().Set("ETag", employee.ETag())
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(employee)
 	}
 }
 
+// removeEmployee applies the delete policy, see DeletePolicy. Records,
+// appointments and series are reassigned to the employee given by the "to" parameter.
 func removeEmployee(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	vars := mux.Vars(r)
-	employeeId, err := primitive.ObjectIDFromHex(vars["id"])
+	policy, err := deletePolicy(r, app.EmployeeDeletePolicy)
+	if err != nil {
+		writeError(w, err)
+		return
+	} else if policy == ArchiveOnDelete {
+		setEmployeeArchived(w, r, true)
+		return
+	}
+
+	var employee *Employee
+	employeeId, err := routeId(r)
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
+
+	if err == nil && !ifMatch(r, employee.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil && policy == ReassignOnDelete {
+		var to primitive.ObjectID
+		if to, err = primitive.ObjectIDFromHex(r.URL.Query().Get("to")); err != nil {
+			err = invalidParameter("to", err)
+		} else if to == employeeId {
+			err = invalidReference("to", to, "Records cannot be reassigned to the removed employee")
+		} else if _, err = activeEmployee(ctx, "to", to); err == nil {
+			err = reassignAndRemove(ctx, employee, to)
+		}
+	} else if err == nil {
+		err = checkNoRecords(ctx, RecordFilter{EmployeeId: employeeId}, "employee")
+		if err == nil {
+			err = checkNoReferences(ctx, employeeId, primitive.NilObjectID)
+		}
+		if err == nil {
+			err = app.Employees.Delete(ctx, employeeId, expectedVersion(r, employee.Version))
+		}
+	}
+
+	if err == ErrConflict {
+		if employee, err = app.Employees.Get(ctx, employeeId); err == nil {
+			writeConflict(w, employee.ETag(), employee)
+			return
+		}
+	}
 
-	_, err = app.DB.Collection("employees").DeleteOne(ctx, bson.M{"_id": employeeId})
 	if err == nil {
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(employeeId)
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 	}
 }
 
-// Records
+// reassignAndRemove moves everything of the employee to another one and
+// removes the employee. The employee is archived first, which checks the
+// version before anything is moved and keeps new entries from being assigned
+// to the employee meanwhile. Failures after that leave the employee archived,
+// removing it again finishes the job.
+func reassignAndRemove(ctx context.Context, employee *Employee, to primitive.ObjectID) error {
+	if !employee.Archived {
+		employee.Archived = true
+		employee.ArchivedAt = primitive.NewDateTimeFromTime(time.Now())
+		if err := app.Employees.Update(ctx, employee.Id, employee); err != nil {
+			return err
+		}
+	}
+	err := reassignEmployee(ctx, employee.Id, to)
+	if err == nil {
+		err = app.Employees.Delete(ctx, employee.Id, employee.Version)
+	}
+	if err != nil {
+		return &APIError{
+			Status:  http.StatusConflict,
+			Code:    "partially-removed",
+			Message: "The employee has been archived, but not removed: " + err.Error(),
+			Details: map[string]string{"id": employee.Id.Hex(), "to": to.Hex()},
+		}
+	}
+	return nil
+}
 
-func showRecords(w http.ResponseWriter, r *http.Request, e *Employee) {
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
+// employeeReassigner is a store of documents assigned to employees.
+type employeeReassigner interface {
+	ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error)
+}
 
-	if e != nil {
-		var records []Record
-		query := bson.M{}
-		if !e.Admin {
-			query["employeeid"] = e.Id
+// reassignEmployee moves the records, appointments and series of an employee to another one.
+func reassignEmployee(ctx context.Context, from, to primitive.ObjectID) error {
+	kinds := []string{"records", "appointments", "series"}
+	for i, store := range []employeeReassigner{app.Records, app.Appointments, app.Series} {
+		moved, err := store.ReassignEmployee(ctx, from, to)
+		if err != nil {
+			return err
 		}
-		findOptions := options.Find()
-		findOptions.SetSort(bson.D{{"date", -1}})
-		findOptions.SetLimit(200)
-		cur, err := app.DB.Collection("records").Find(ctx, query, findOptions)
-		if err == nil {
-			for cur.Next(ctx) {
-				var record Record
-				if err = cur.Decode(&record); err == nil {
-					records = append(records, record)
-				}
-			}
-			w.Header().Set("Content-Type", "application/vnd.api+json")
-			json.NewEncoder(w).Encode(records)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if moved > 0 {
+			log.Printf("Reassigned %d %s of employee %s to %s.", moved, kinds[i], from.Hex(), to.Hex())
 		}
-	} else {
-		http.Error(w, "Please log in", http.StatusUnauthorized)
 	}
+	return nil
 }
 
-func exportRecords(w http.ResponseWriter, r *http.Request, e *Employee) {
+func restoreEmployee(w http.ResponseWriter, r *http.Request, e *Employee) {
+	setEmployeeArchived(w, r, false)
+}
+
+func setEmployeeArchived(w http.ResponseWriter, r *http.Request, archived bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	if e != nil && e.Admin {
-		var records []Record
-		clientMap := make(map[primitive.ObjectID]Client)
-		employeeMap := make(map[primitive.ObjectID]Employee)
-		query := bson.D{}
-		findOptions := options.Find()
-		findOptions.SetSort(bson.D{{"date", -1}})
-		findOptions.SetLimit(200)
-		cur, err := app.DB.Collection("records").Find(ctx, query, findOptions)
-		if err == nil {
-			for cur.Next(ctx) {
-				var record Record
-				err = cur.Decode(&record)
-				if err == nil {
-					records = append(records, record)
-				}
-			}
-		}
+	var employee *Employee
+	employeeId, err := routeId(r)
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
 
-		if err == nil {
-			cur, err = app.DB.Collection("clients").Find(ctx, query)
-			if err == nil {
-				for cur.Next(ctx) {
-					var client Client
-					err = cur.Decode(&client)
-					if err == nil {
-						clientMap[client.Id] = client
-					}
-				}
-			}
+	if err == nil && !ifMatch(r, employee.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil && employee.Archived != archived {
+		employee.Archived = archived
+		employee.ArchivedAt = 0
+		if archived {
+			employee.ArchivedAt = primitive.NewDateTimeFromTime(time.Now())
 		}
-		if err == nil {
-			cur, err = app.DB.Collection("employees").Find(ctx, query)
-			if err == nil {
-				for cur.Next(ctx) {
-					var employee Employee
-					err = cur.Decode(&employee)
-					if err == nil {
-						employeeMap[employee.Id] = employee
-					}
-				}
-			}
+		err = app.Employees.Update(ctx, employeeId, employee)
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		employee, err = app.Employees.Get(ctx, employeeId)
+		if err == nil && conflict {
+			writeConflict(w, employee.ETag(), employee)
+			return
 		}
-		if err == nil {
-			b := &bytes.Buffer{}
-			wr := csv.NewWriter(b)
-			for _, record := range records {
-				row := make([]string, 5)
-				client := clientMap[record.ClientId]
-				employee := employeeMap[record.EmployeeId]
-				row[0] = record.Date.Time().Format(`2006-01-02`)
-				row[1] = strconv.Itoa(record.Price)
-				row[2] = strconv.Itoa(record.EmployeeIncome)
-				row[3] = client.Name
-				row[4] = employee.Name
-				wr.Write(row)
-			}
-			wr.Flush()
+	}
 
-			w.Header().Set("Content-Type", "text/csv")
-			w.Write(b.Bytes())
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", employee.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(employee)
+	}
+}
 
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+// checkEmployeeName ensures names stay unique, as they identify employees on login.
+func checkEmployeeName(ctx context.Context, employee *Employee) error {
+	if accountKey(employee.Name) == "" {
+		return ErrNameRequired
+	}
+	other, err := app.Employees.GetByName(ctx, employee.Name)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err == nil && other.Id != employee.Id {
+		err = ErrDuplicateName
+	}
+	return err
+}
+
+func showLockouts(w http.ResponseWriter, r *http.Request, e *Employee) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(app.Logins.Lockouts())
+}
+
+func clearLockouts(w http.ResponseWriter, r *http.Request, e *Employee) {
+	if ip := r.FormValue("ip"); ip != "" {
+		app.Logins.ClearIP(ip)
 	} else {
-		http.Error(w, "Administrator zone", http.StatusUnauthorized)
+		app.Logins.ClearAll()
 	}
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(app.Logins.Lockouts())
 }
 
-func exportExcel(w http.ResponseWriter, r *http.Request, e *Employee) {
+func clearEmployeeLockout(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	if e != nil && e.Admin {
-		vars := mux.Vars(r)
+	employeeId, err := routeId(r)
+	var employee *Employee
+	if err == nil {
+		employee, err = app.Employees.Get(ctx, employeeId)
+	}
+	if err == nil {
+		app.Logins.ClearAccount(employee.Name)
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(employeeId)
+	} else {
+		writeError(w, err)
+	}
+}
 
-		date, err := time.Parse("2006-01", vars["date"])
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		fromDate := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
-		toDate := fromDate.AddDate(0, 1, 0)
+// Records
 
-		var records []Record
-		clientMap := make(map[primitive.ObjectID]Client)
-		employeeMap := make(map[primitive.ObjectID]Employee)
+func showRecords(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
 
-		findOptions := options.Find()
-		findOptions.SetSort(bson.D{{"date", -1}})
-		query := bson.M{
-			"date": bson.M{
-				"$gte": fromDate,
-				"$lt":  toDate,
-			},
+	var page RecordPage
+	filter, err := ParseRecordFilter(r.URL.Query())
+	if err == nil {
+		if !e.Admin {
+			filter.EmployeeId = e.Id
 		}
-		blankQuery := bson.M{}
-		cur, err := app.DB.Collection("records").Find(ctx, query, findOptions)
-		if err == nil {
-			for cur.Next(ctx) {
-				var record Record
-				err = cur.Decode(&record)
-				if err == nil {
-					records = append(records, record)
-				}
-			}
+		page.Records, err = app.Records.List(ctx, filter)
+	}
+	if err == nil {
+		page.Total, err = app.Records.Count(ctx, filter)
+	}
+	if err == nil {
+		if page.Records == nil {
+			page.Records = []Record{}
 		}
-		if err == nil {
-			cur, err = app.DB.Collection("clients").Find(ctx, blankQuery)
-			if err == nil {
-				for cur.Next(ctx) {
-					var client Client
-					err = cur.Decode(&client)
-					if err == nil {
-						clientMap[client.Id] = client
-					}
-				}
-			}
+		page.Count = len(page.Records)
+		tags := make([]string, page.Count)
+		for i := range page.Records {
+			tags[i] = page.Records[i].ETag()
 		}
-		if err == nil {
-			cur, err = app.DB.Collection("employees").Find(ctx, blankQuery)
-			if err == nil {
-				for cur.Next(ctx) {
-					var employee Employee
-					err = cur.Decode(&employee)
-					if err == nil {
-						employeeMap[employee.Id] = employee
-					}
-				}
-			}
+		if int64(page.Count) == filter.Limit {
+			last := page.Records[page.Count-1]
+			page.Next = RecordCursor{Date: last.Date, Id: last.Id}.String()
 		}
+		w.Header().Set("ETag", listETag(tags))
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(page)
+	} else {
+		writeError(w, err)
+	}
+}
 
-		if err == nil {
-			var buf bytes.Buffer
-			var sheet *xlsx.Sheet
-			writer := io.Writer(&buf)
-			file := xlsx.NewFile()
-			sheet, err = file.AddSheet("Sheet1")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			header := sheet.AddRow()
-			headerDate := header.AddCell()
-			headerDate.Value = "Date"
-			headerPrice := header.AddCell()
-			headerPrice.Value = "Price"
-			headerEmployeeIncome := header.AddCell()
-			headerEmployeeIncome.Value = "EmployeeIncome"
-			headerClient := header.AddCell()
-			headerClient.Value = "Client"
-			headerEmployee := header.AddCell()
-			headerEmployee.Value = "Employee"
-
-			sheet.SetColWidth(0, 4, 15.)
-
-			for _, record := range records {
-				row := sheet.AddRow()
-				client := clientMap[record.ClientId]
-				employee := employeeMap[record.EmployeeId]
-				cellDate := row.AddCell()
-				cellDate.SetDate(record.Date.Time())
-				cellPrice := row.AddCell()
-				cellPrice.SetInt(record.Price)
-				cellEmployeeIncome := row.AddCell()
-				cellEmployeeIncome.SetInt(record.EmployeeIncome)
-				cellClient := row.AddCell()
-				cellClient.Value = client.Name
-				cellEmployee := row.AddCell()
-				cellEmployee.Value = employee.Name
-			}
-
-			err = file.Write(writer)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// loadNameMaps fetches all clients and employees indexed by ID, for use in exports.
+func loadNameMaps(ctx context.Context) (map[primitive.ObjectID]Client, map[primitive.ObjectID]Employee, error) {
+	clientMap := make(map[primitive.ObjectID]Client)
+	employeeMap := make(map[primitive.ObjectID]Employee)
 
-			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-			w.Write(buf.Bytes())
+	// archived clients still have records to be named
+	clients, err := app.Clients.List(ctx, ClientFilter{Archived: AllClients})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, client := range clients {
+		clientMap[client.Id] = client
+	}
 
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	} else {
-		http.Error(w, "Administrator zone", http.StatusUnauthorized)
+	employees, err := app.Employees.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, employee := range employees {
+		employeeMap[employee.Id] = employee
 	}
+	return clientMap, employeeMap, nil
 }
 
 func createRecord(w http.ResponseWriter, r *http.Request, e *Employee) {
@@ -642,15 +965,72 @@ func createRecord(w http.ResponseWriter, r *http.Request, e *Employee) {
 	var record Record
 	err := decoder.Decode(&record)
 	if err == nil {
-		_, err := app.DB.Collection("records").InsertOne(ctx, &record)
-		if err == nil {
-			w.Header().Set("Content-Type", "application/vnd.api+json")
-			json.NewEncoder(w).Encode(record)
+		record.Id = primitive.NilObjectID
+		record.AppointmentId = primitive.NilObjectID
+		record.Override = nil
+		record.PriceOverridden, record.IncomeOverridden = false, false
+		if record.EmployeeId.IsZero() {
+			record.EmployeeId = e.Id
 		}
+		if record.Duration == 0 {
+			record.Duration = defaultDuration
+		}
+		err = authorizeRecord(e, &record)
+	}
+	if err == nil {
+		err = checkRecordReferences(ctx, &record, nil)
+	}
+	if err == nil {
+		err = record.applyRates(ctx, nil)
+	}
+	if err == nil {
+		record.Override, err = checkConflicts(ctx, r, e, nil, []slot{recordSlot(&record)}, nil)
+	}
+	undo := func() {}
+	if err == nil {
+		undo, err = drawDown(ctx, &record, nil)
+	}
+	if err == nil {
+		err = app.Records.Insert(ctx, &record)
+		if err != nil {
+			undo()
+		}
+	}
+	var created *Record
+	if err == nil {
+		renumberSessions(ctx, &record, nil)
+		created, err = app.Records.Get(ctx, record.Id)
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", created.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+func showRecord(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var record *Record
+	recordId, err := routeId(r)
+	if err == nil {
+		record, err = app.Records.Get(ctx, recordId)
+	}
+
+	if err == nil && !e.Admin && record.EmployeeId != e.Id {
+		err = ErrNotFound
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", record.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(record)
 	}
 }
 
@@ -658,23 +1038,85 @@ func updateRecord(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	vars := mux.Vars(r)
-	recordId, err := primitive.ObjectIDFromHex(vars["id"])
-	var record Record
+	var record *Record
+	recordId, err := routeId(r)
+	if err == nil {
+		record, err = app.Records.Get(ctx, recordId)
+	}
 
 	if err == nil {
-		decoder := json.NewDecoder(r.Body)
-		err = decoder.Decode(&record)
+		err = authorizeRecord(e, record)
 	}
 
+	if err == nil && !ifMatch(r, record.ETag()) {
+		err = ErrConflict
+	}
+
+	var stored Record
 	if err == nil {
-		res := app.DB.Collection("records").FindOneAndUpdate(ctx, bson.M{"_id": recordId}, bson.M{"$set": record})
-		err = res.Err()
+		stored = *record
+		err = decodePatch(r, record)
+		record.Id = recordId
+		record.Version = stored.Version
+		record.AppointmentId = stored.AppointmentId
+		record.Override = stored.Override
+	}
+
+	if err == nil {
+		err = authorizeRecord(e, record)
+	}
+
+	if err == nil {
+		err = checkRecordReferences(ctx, record, &stored)
+	}
+
+	if err == nil {
+		err = record.applyRates(ctx, &stored)
+	}
+
+	// payments and invoices stay with the charge as it was, the price is compared once recomputed
+	if err == nil && (record.ClientId != stored.ClientId || record.PackageId != stored.PackageId || !record.Price.Equal(stored.Price)) {
+		err = checkUnpaid(ctx, PaymentFilter{RecordId: recordId}, "record")
+	}
+
+	if err == nil && (record.ClientId != stored.ClientId || record.Date != stored.Date || !record.Price.Equal(stored.Price)) {
+		err = checkNotInvoiced(ctx, recordId)
+	}
+
+	if err == nil && recordSlot(record).moved(recordSlot(&stored)) {
+		record.Override, err = checkConflicts(ctx, r, e, stored.Override, []slot{recordSlot(record)}, nil)
+	}
+
+	undo := func() {}
+	if err == nil {
+		undo, err = drawDown(ctx, record, &stored)
+	}
+
+	if err == nil {
+		err = app.Records.Update(ctx, recordId, record)
+		if err != nil {
+			undo()
+		} else if record.PackageId != stored.PackageId {
+			releaseSession(ctx, stored.PackageId)
+		}
+		if err == nil && (record.Date != stored.Date || record.EmployeeId != stored.EmployeeId) {
+			renumberSessions(ctx, record, &stored)
+		}
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		record, err = app.Records.Get(ctx, recordId)
+		if err == nil && conflict {
+			writeConflict(w, record.ETag(), record)
+			return
+		}
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 	} else {
+		w.Header().Set("ETag", record.ETag())
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(record)
 	}
@@ -684,18 +1126,49 @@ func removeRecord(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	vars := mux.Vars(r)
-	recordId, err := primitive.ObjectIDFromHex(vars["id"])
+	var record *Record
+	recordId, err := routeId(r)
+	if err == nil {
+		record, err = app.Records.Get(ctx, recordId)
+	}
+
+	if err == nil {
+		err = authorizeRecord(e, record)
+	}
+
+	if err == nil && !ifMatch(r, record.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil {
+		err = checkUnpaid(ctx, PaymentFilter{RecordId: recordId}, "record")
+	}
+
+	if err == nil {
+		err = checkNotInvoiced(ctx, recordId)
+	}
+
+	if err == nil {
+		err = app.Records.Delete(ctx, recordId, expectedVersion(r, record.Version))
+	}
 
 	if err == nil {
-		_, err = app.DB.Collection("records").DeleteOne(ctx, bson.M{"_id": recordId})
+		releaseSession(ctx, record.PackageId)
+		renumberSessions(ctx, nil, record)
+	}
+
+	if err == ErrConflict {
+		if record, err = app.Records.Get(ctx, recordId); err == nil {
+			writeConflict(w, record.ETag(), record)
+			return
+		}
 	}
 
 	if err == nil {
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(recordId)
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 	}
 }
 
@@ -705,29 +1178,32 @@ func showClients(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	if e != nil {
-		var clients []Client
-		findOptions := options.Find()
-		findOptions.SetSort(bson.D{{"name", 1}})
-		cur, err := app.DB.Collection("clients").Find(ctx, bson.M{}, findOptions)
-		if err == nil {
-			for cur.Next(ctx) {
-				var client Client
-				err = cur.Decode(&client)
-				if err == nil {
-					clients = append(clients, client)
-				}
-			}
-			w.Header().Set("Content-Type", "application/vnd.api+json")
-			err = json.NewEncoder(w).Encode(clients)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var page ClientPage
+	filter, err := ParseClientFilter(r.URL.Query())
+	if err == nil {
+		page.Clients, err = app.Clients.List(ctx, filter)
+	}
+	if err == nil {
+		page.Total, err = app.Clients.Count(ctx, filter)
+	}
+	if err == nil {
+		if page.Clients == nil {
+			page.Clients = []Client{}
+		}
+		page.Count = len(page.Clients)
+		tags := make([]string, page.Count)
+		for i := range page.Clients {
+			tags[i] = page.Clients[i].ETag()
 		}
+		if int64(page.Count) == filter.Limit {
+			last := page.Clients[page.Count-1]
+			page.Next = ClientCursor{SortName: last.SortName, Id: last.Id}.String()
+		}
+		w.Header().Set("ETag", listETag(tags))
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(page)
 	} else {
-		http.Error(w, "Please log in", http.StatusUnauthorized)
+		writeError(w, err)
 	}
 }
 
@@ -739,17 +1215,42 @@ func createClient(w http.ResponseWriter, r *http.Request, e *Employee) {
 	var client Client
 	err := decoder.Decode(&client)
 	if err == nil {
+		client.Id = primitive.NilObjectID
+		client.Archived, client.ArchivedAt = false, 0
 		client.Registered = primitive.NewDateTimeFromTime(time.Now())
 		client.LastModified = client.Registered
-		_, err := app.DB.Collection("clients").InsertOne(ctx, &client)
+		err = client.validatePrices(ctx, nil)
+	}
+	if err == nil {
+		err = app.Clients.Insert(ctx, &client)
 		if err == nil {
+			w.Header().Set("ETag", client.ETag())
 			w.Header().Set("Content-Type", "application/vnd.api+json")
-			json.NewEncoder(w).Encode(client)
+			json.NewEncoder(w).Encode(&client)
 		}
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+	}
+}
+
+func showClient(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var client *Client
+	clientId, err := routeId(r)
+	if err == nil {
+		client, err = app.Clients.Get(ctx, clientId)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", client.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(client)
 	}
 }
 
@@ -757,50 +1258,166 @@ func updateClient(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	vars := mux.Vars(r)
-	clientId, err := primitive.ObjectIDFromHex(vars["id"])
-	var client Client
+	var client *Client
+	clientId, err := routeId(r)
+	if err == nil {
+		client, err = app.Clients.Get(ctx, clientId)
+	}
 
+	if err == nil && !ifMatch(r, client.ETag()) {
+		err = ErrConflict
+	}
+
+	var stored []ClientPrice
 	if err == nil {
-		decoder := json.NewDecoder(r.Body)
-		err = decoder.Decode(&client)
+		registered, version := client.Registered, client.Version
+		archived, archivedAt := client.Archived, client.ArchivedAt
+		// the prices are copied, decoding reuses the array of the slice
+		stored = append(stored, client.Prices...)
+		err = decodePatch(r, client)
+		client.Id = clientId
+		client.Version = version
+		client.Registered = registered
+		client.Archived, client.ArchivedAt = archived, archivedAt
+		client.LastModified = primitive.NewDateTimeFromTime(time.Now())
 	}
 
 	if err == nil {
-		res := app.DB.Collection("clients").FindOneAndUpdate(ctx, bson.M{"_id": clientId}, bson.M{"$set": client})
-		err = res.Err()
+		err = client.validatePrices(ctx, stored)
+	}
+
+	if err == nil {
+		err = app.Clients.Update(ctx, clientId, client)
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		client, err = app.Clients.Get(ctx, clientId)
+		if err == nil && conflict {
+			writeConflict(w, client.ETag(), client)
+			return
+		}
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 	} else {
+		w.Header().Set("ETag", client.ETag())
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(client)
 	}
 }
 
+// removeClient applies the delete policy, by default the client is only archived
+// and their records keep pointing at them.
 func removeClient(w http.ResponseWriter, r *http.Request, e *Employee) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	vars := mux.Vars(r)
-	clientId, err := primitive.ObjectIDFromHex(vars["id"])
+	policy, err := deletePolicy(r, app.ClientDeletePolicy)
+	if err == nil && policy == ReassignOnDelete {
+		err = invalidParameter("policy", fmt.Errorf("records cannot be reassigned to another client"))
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	} else if policy == ArchiveOnDelete {
+		setClientArchived(w, r, true)
+		return
+	}
+
+	var client *Client
+	clientId, err := routeId(r)
+	if err == nil {
+		client, err = app.Clients.Get(ctx, clientId)
+	}
+
+	if err == nil && !ifMatch(r, client.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil {
+		err = checkNoRecords(ctx, RecordFilter{ClientId: clientId}, "client")
+	}
 
 	if err == nil {
-		_, err = app.DB.Collection("clients").DeleteOne(ctx, bson.M{"_id": clientId})
+		err = checkNoReferences(ctx, primitive.NilObjectID, clientId)
+	}
+
+	if err == nil {
+		err = app.Clients.Delete(ctx, clientId, expectedVersion(r, client.Version))
+	}
+
+	if err == ErrConflict {
+		if client, err = app.Clients.Get(ctx, clientId); err == nil {
+			writeConflict(w, client.ETag(), client)
+			return
+		}
 	}
 
 	if err == nil {
 		w.Header().Set("Content-Type", "application/vnd.api+json")
 		json.NewEncoder(w).Encode(clientId)
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+	}
+}
+
+func restoreClient(w http.ResponseWriter, r *http.Request, e *Employee) {
+	setClientArchived(w, r, false)
+}
+
+func setClientArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var client *Client
+	clientId, err := routeId(r)
+	if err == nil {
+		client, err = app.Clients.Get(ctx, clientId)
+	}
+
+	if err == nil && !ifMatch(r, client.ETag()) {
+		err = ErrConflict
+	}
+
+	if err == nil && client.Archived != archived {
+		now := primitive.NewDateTimeFromTime(time.Now())
+		client.Archived = archived
+		client.ArchivedAt = 0
+		if archived {
+			client.ArchivedAt = now
+		}
+		client.LastModified = now
+		err = app.Clients.Update(ctx, clientId, client)
+	}
+
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		client, err = app.Clients.Get(ctx, clientId)
+		if err == nil && conflict {
+			writeConflict(w, client.ETag(), client)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", client.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(client)
 	}
 }
 
 func renderTemplate(w http.ResponseWriter, data *ViewData) {
+	renderPage(w, "layout", data)
+}
+
+// renderPage executes the named template of the templates directory.
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
 	tmpl := template.Must(template.ParseGlob(app.TemplatesPath + "/*.html"))
-	err := tmpl.ExecuteTemplate(w, "layout", data)
+	err := tmpl.ExecuteTemplate(w, name, data)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
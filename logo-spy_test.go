@@ -2,13 +2,27 @@ package main
 
 import (
 	"encoding/json"
-	"gopkg.in/mgo.v2/bson"
 	"testing"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+func shortDateNow(t *testing.T) primitive.DateTime {
+	var err error
+	if app.Location == nil {
+		app.Location, err = time.LoadLocation("Europe/Warsaw")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().In(app.Location)
+	return primitive.NewDateTimeFromTime(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, app.Location))
+}
+
 func TestShortDateBSON(t *testing.T) {
-	sd := ShortDate(time.Now())
+	sd := shortDateNow(t)
 	client := Client{Name: "Test", Birthday: sd}
 	mClient, err := bson.Marshal(client)
 	if err != nil {
@@ -19,15 +33,15 @@ func TestShortDateBSON(t *testing.T) {
 	if err != nil {
 		t.Error("Unexpected error", err)
 	}
-	if sd.String() != uClient.Birthday.String() {
-		t.Errorf("Invalid unmarchalled birthday: %s, expected: %s", uClient.Birthday, sd)
+	if sd != uClient.Birthday {
+		t.Errorf("Invalid unmarchalled birthday: %v, expected: %v", uClient.Birthday, sd)
 	}
 }
 
 func TestShortDateJSON(t *testing.T) {
-	sd := ShortDate(time.Now())
+	sd := shortDateNow(t)
 	client := Client{Name: "Test", Birthday: sd}
-	mClient, err := json.Marshal(client)
+	mClient, err := json.Marshal(&client)
 	if err != nil {
 		t.Error("Unexpected error", err)
 	}
@@ -36,7 +50,7 @@ func TestShortDateJSON(t *testing.T) {
 	if err != nil {
 		t.Error("Unexpected error", err)
 	}
-	if sd.String() != uClient.Birthday.String() {
-		t.Errorf("Invalid unmarchalled birthday: %s, expected: %s", uClient.Birthday, sd)
+	if sd != uClient.Birthday {
+		t.Errorf("Invalid unmarchalled birthday: %v, expected: %v", uClient.Birthday, sd)
 	}
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Money is an amount in minor units of its currency, e.g. grosze. Money
+// without a currency is in the currency of the clinic, see App.Currency.
+// Amounts are encoded in JSON as decimal strings, "87.50", followed by the
+// currency code when it is not the one of the clinic.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"` // ISO 4217 code
+
+	// legacy tells that the amount was stored by older versions as a number of
+	// whole units, see MigrateMoney.
+	legacy bool
+}
+
+// minorUnits per unit of the currency, all currencies of the clinic have cents.
+const minorUnits = 100
+
+// NewMoney returns the amount given in minor units in the currency of the clinic.
+func NewMoney(minor int64) Money {
+	return Money{Amount: minor, Currency: app.Currency}
+}
+
+func invalidMoney(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-money", Message: message}
+}
+
+// ParseMoney parses a decimal amount with at most two fractional digits,
+// separated by a point or a comma, optionally followed by the currency code.
+func ParseMoney(s string) (Money, error) {
+	return parseMoney(s, app.Currency)
+}
+
+// parseMoney is ParseMoney accepting the currency of an amount stored before
+// the currency of the clinic changed too, see UnmarshalJSON.
+func parseMoney(s string, stored string) (Money, error) {
+	s = strings.TrimSpace(s)
+	currency := app.Currency
+	if i := strings.LastIndexByte(s, ' '); i >= 0 {
+		s, currency = strings.TrimSpace(s[:i]), strings.ToUpper(s[i+1:])
+	}
+	if currency != app.Currency && currency != stored {
+		return Money{}, invalidMoney(fmt.Sprintf("Amounts in %s are not supported, use %s", currency, app.Currency))
+	}
+	negative := strings.HasPrefix(s, "-")
+	units, cents := strings.TrimPrefix(s, "-"), ""
+	if i := strings.IndexAny(units, ".,"); i >= 0 {
+		units, cents = units[:i], units[i+1:]
+	}
+	if units == "" || len(cents) > 2 || strings.Trim(units+cents, "0123456789") != "" {
+		return Money{}, invalidMoney(fmt.Sprintf("Invalid amount %q", s))
+	}
+	amount, err := strconv.ParseInt(units+(cents + "00")[:2], 10, 64)
+	if err != nil {
+		return Money{}, invalidMoney(fmt.Sprintf("Invalid amount %q", s))
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return app.Currency
+	}
+	return m.Currency
+}
+
+// Decimal formats the amount without the currency, e.g. "87.50".
+func (m Money) Decimal() string {
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/minorUnits, amount%minorUnits)
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.currency()
+}
+
+// Float is the amount in units, for spreadsheets.
+func (m Money) Float() float64 {
+	return float64(m.Amount) / minorUnits
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Equal(other Money) bool {
+	return m.Amount == other.Amount && m.currency() == other.currency()
+}
+
+// Add sums amounts in the same currency.
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount + other.Amount, Currency: m.currency()}
+}
+
+// Sub subtracts an amount in the same currency.
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.currency()}
+}
+
+// Scale multiplies the amount by num/den, rounded half away from zero to minor units.
+func (m Money) Scale(num, den int64) Money {
+	return Money{Amount: divRound(m.Amount*num, den), Currency: m.currency()}
+}
+
+// Percent of the amount, rounded to minor units.
+func (m Money) Percent(percent float64) Money {
+	return Money{Amount: int64(math.Round(float64(m.Amount) * percent / 100)), Currency: m.currency()}
+}
+
+func divRound(a, b int64) int64 {
+	if (a < 0) != (b < 0) {
+		return (a - b/2) / b
+	}
+	return (a + b/2) / b
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.currency() == app.Currency {
+		return json.Marshal(m.Decimal())
+	}
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts decimal strings and numbers, which older clients send
+// for whole units. Null and empty strings leave the amount untouched, so that
+// partial updates keep it. Amounts in the currency of the stored one are accepted,
+// so that what MarshalJSON has written can be sent back.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" || s == `""` {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	money, err := parseMoney(s, m.currency())
+	if err == nil {
+		*m = money
+	}
+	return err
+}
+
+// UnmarshalBSONValue reads amounts stored by older versions as numbers of whole units too.
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Int32:
+		*m = Money{Amount: int64(value.Int32()) * minorUnits, Currency: app.Currency, legacy: true}
+		return nil
+	case bsontype.Int64:
+		*m = Money{Amount: value.Int64() * minorUnits, Currency: app.Currency, legacy: true}
+		return nil
+	case bsontype.Double:
+		*m = Money{Amount: int64(math.Round(value.Double() * minorUnits)), Currency: app.Currency, legacy: true}
+		return nil
+	case bsontype.Null, bsontype.Undefined:
+		*m = Money{}
+		return nil
+	}
+	type plain Money
+	var stored plain
+	if err := value.Unmarshal(&stored); err != nil {
+		return err
+	}
+	*m = Money(stored)
+	return nil
+}
+
+var currencySymbols = map[string]string{"PLN": "zł", "EUR": "€", "USD": "$", "GBP": "£", "CHF": "CHF"}
+
+// currencyFormat is the spreadsheet number format of amounts in the currency of m.
+func currencyFormat(m Money) string {
+	symbol, ok := currencySymbols[m.currency()]
+	if !ok {
+		symbol = m.currency()
+	}
+	return `#,##0.00\ "` + symbol + `"`
+}
+
+// settle marks the amounts as converted, telling whether any was stored by older versions.
+func settle(amounts ...*Money) bool {
+	legacy := false
+	for _, amount := range amounts {
+		legacy = legacy || amount.legacy
+		amount.legacy = false
+	}
+	return legacy
+}
+
+// hasLegacyMoney tells whether the record has amounts stored by older versions.
+func (r *Record) hasLegacyMoney() bool {
+	return r.Price.legacy || r.EmployeeIncome.legacy
+}
+
+// migrateLegacyMoney converts amounts of the employee stored by older versions,
+// percentages of rules were stored as amounts then. It tells whether there were any.
+func (e *Employee) migrateLegacyMoney() bool {
+	migrated := settle(&e.HourlyNet)
+	for i := range e.Compensation {
+		rule := &e.Compensation[i]
+		if rule.Scheme == PercentOfPrice && rule.Amount.legacy {
+			rule.Percent, rule.Amount = rule.Amount.Float(), Money{legacy: true}
+		}
+		if rule.Scheme == PercentOfPrice && rule.HomeVisitAmount.legacy {
+			rule.HomeVisitPercent, rule.HomeVisitAmount = rule.HomeVisitAmount.Float(), Money{legacy: true}
+		}
+		if settle(&rule.Amount, &rule.HomeVisitAmount, &rule.BonusAmount) {
+			migrated = true
+		}
+	}
+	return migrated
+}
+
+func migrateLegacyPrices(periods []*PricePeriod) bool {
+	migrated := false
+	for _, period := range periods {
+		if settle(&period.Amount) {
+			migrated = true
+		}
+	}
+	return migrated
+}
+
+// MigrateMoney rewrites amounts stored by older versions as numbers of whole
+// units, which are read as Money already, in minor units with the currency.
+func (app *App) MigrateMoney(ctx context.Context) error {
+	records, err := app.Records.List(ctx, RecordFilter{LegacyMoney: true})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		settle(&record.Price, &record.EmployeeIncome)
+		if err = app.Records.Update(ctx, record.Id, &record); err != nil {
+			return err
+		}
+	}
+	if len(records) > 0 {
+		log.Printf("Converted amounts of %d records to %s minor units.", len(records), app.Currency)
+	}
+
+	employees, err := app.Employees.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, employee := range employees {
+		if !employee.migrateLegacyMoney() {
+			continue
+		}
+		if err = app.Employees.Update(ctx, employee.Id, &employee); err != nil {
+			return err
+		}
+		log.Printf("Converted amounts of employee: %s.", employee.Name)
+	}
+
+	clients, err := app.Clients.List(ctx, ClientFilter{Archived: AllClients})
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		var periods []*PricePeriod
+		for i := range client.Prices {
+			periods = append(periods, &client.Prices[i].PricePeriod)
+		}
+		if !migrateLegacyPrices(periods) {
+			continue
+		}
+		if err = app.Clients.Update(ctx, client.Id, &client); err != nil {
+			return err
+		}
+		log.Printf("Converted prices of client: %s.", client.Name)
+	}
+
+	services, err := app.Services.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		var periods []*PricePeriod
+		for i := range service.Prices {
+			periods = append(periods, &service.Prices[i])
+		}
+		if !migrateLegacyPrices(periods) {
+			continue
+		}
+		if err = app.Services.Update(ctx, service.Id, &service); err != nil {
+			return err
+		}
+		log.Printf("Converted prices of service: %s.", service.Name)
+	}
+	return nil
+}
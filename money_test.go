@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// units returns whole units in the currency of the clinic.
+func units(n int64) Money {
+	return NewMoney(n * minorUnits)
+}
+
+func TestParseMoney(t *testing.T) {
+	setupTestApp(t)
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"87.50", 8750},
+		{"87,5", 8750},
+		{"87", 8700},
+		{"0.05", 5},
+		{"-3.20", -320},
+		{" 12.34 pln ", 1234},
+	}
+	for _, test := range tests {
+		money, err := ParseMoney(test.input)
+		if err != nil || money.Amount != test.expected || money.Currency != "PLN" {
+			t.Errorf("%q: expected %d, got: %+v %v", test.input, test.expected, money, err)
+		}
+	}
+	for _, input := range []string{"", "1.234", "1e3", "12.3.4", "abc", "12 EUR", "-"} {
+		if money, err := ParseMoney(input); err == nil {
+			t.Errorf("%q: expected an error, got: %+v", input, money)
+		}
+	}
+
+	if amount := NewMoney(1001).Scale(45, 60); amount.Amount != 751 {
+		t.Errorf("Expected 7.51, got: %s", amount)
+	}
+	if amount := NewMoney(-1001).Scale(45, 60); amount.Amount != -751 {
+		t.Errorf("Expected -7.51, got: %s", amount)
+	}
+	if amount := NewMoney(8750).Percent(12.5); amount.Amount != 1094 {
+		t.Errorf("Expected 10.94, got: %s", amount)
+	}
+}
+
+func TestMoneyEncoding(t *testing.T) {
+	setupTestApp(t)
+	var record struct {
+		Price  Money `json:"price"`
+		Income Money `json:"income"`
+		Other  Money `json:"other"`
+	}
+	record.Other = units(5)
+	if err := json.Unmarshal([]byte(`{"price": "87.50", "income": 60, "other": null}`), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Price.Amount != 8750 || record.Income.Amount != 6000 || record.Other.Amount != 500 {
+		t.Errorf("Unexpected decoding: %+v", record)
+	}
+	data, _ := json.Marshal(record)
+	if expected := `{"price":"87.50","income":"60.00","other":"5.00"}`; string(data) != expected {
+		t.Errorf("Expected %s, got: %s", expected, data)
+	}
+	if err := json.Unmarshal([]byte(`{"price": "10 EUR"}`), &record); err == nil {
+		t.Errorf("Expected an error for another currency")
+	}
+	// amounts stored before the currency of the clinic changed are written back as read
+	record.Other = Money{Amount: 8750, Currency: "EUR"}
+	data, _ = json.Marshal(record)
+	if err := json.Unmarshal(data, &record); err != nil || !record.Other.Equal(Money{Amount: 8750, Currency: "EUR"}) {
+		t.Errorf("Expected %s to be read back, got: %+v %v", data, record.Other, err)
+	}
+
+	data, _ = bson.Marshal(bson.M{"price": 90, "income": 45.5, "other": NewMoney(1234)})
+	if err := bson.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Price.Amount != 9000 || !record.Price.legacy || record.Income.Amount != 4550 || record.Other.Amount != 1234 || record.Other.legacy {
+		t.Errorf("Unexpected BSON decoding: %+v", record)
+	}
+	if raw := bson.Raw(data).Lookup("other").Document(); raw.Lookup("currency").StringValue() != "PLN" {
+		t.Errorf("Expected the currency to be stored: %s", raw)
+	}
+}
+
+func TestMigrateMoney(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	legacy := func(units int64) Money {
+		return Money{Amount: units * minorUnits, Currency: "PLN", legacy: true}
+	}
+	employee := Employee{Name: "Therapist", HourlyNet: legacy(50), Compensation: []CompensationRule{
+		{EffectiveFrom: "2021-01-01", Scheme: PercentOfPrice, Amount: legacy(40)},
+	}}
+	app.Employees.Insert(ctx, &employee)
+	record := Record{EmployeeId: employee.Id, Duration: 60, Price: legacy(90), EmployeeIncome: legacy(50)}
+	app.Records.Insert(ctx, &record)
+
+	if err := app.MigrateMoney(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := app.Records.List(ctx, RecordFilter{LegacyMoney: true}); len(records) != 0 {
+		t.Errorf("Expected no legacy records left, got: %+v", records)
+	}
+	migrated, _ := app.Employees.Get(ctx, employee.Id)
+	if rule := migrated.Compensation[0]; rule.Percent != 40 || !rule.Amount.IsZero() {
+		t.Errorf("Expected the percentage to be moved, got: %+v", rule)
+	}
+}
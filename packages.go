@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Package is a number of sessions the client paid for in advance. Records
+// drawing down the package are charged its price per session.
+type Package struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ClientId  primitive.ObjectID `json:"clientId"`
+	ServiceId primitive.ObjectID `json:"serviceId"` // the default service when zero
+	Sessions  int                `json:"sessions"`  // purchased
+	// Remaining sessions are maintained by PackageStore.Consume and Release.
+	Remaining  int                `json:"remaining"`
+	Price      Money              `json:"price"`      // paid for all sessions
+	ValidFrom  string             `json:"validFrom"`  // day in ShortDateLayout
+	ValidUntil string             `json:"validUntil"` // inclusive day in ShortDateLayout
+	Purchased  primitive.DateTime `json:"purchased"`
+	Version    int64              `json:"version"`
+}
+
+// Used sessions of the package.
+func (p *Package) Used() int {
+	return p.Sessions - p.Remaining
+}
+
+// SessionPrice is the share of the price paid for one session.
+func (p *Package) SessionPrice() Money {
+	return p.Price.Scale(1, int64(p.Sessions))
+}
+
+func invalidPackage(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-package", Message: message}
+}
+
+func (p *Package) validate() error {
+	if p.Sessions <= 0 {
+		return invalidPackage("Package needs at least one session")
+	}
+	if p.Remaining < 0 {
+		return invalidPackage(fmt.Sprintf("%d sessions have been used already", p.Used()))
+	}
+	if p.Price.IsNegative() {
+		return invalidPackage("Price cannot be negative")
+	}
+	for _, day := range []string{p.ValidFrom, p.ValidUntil} {
+		if _, err := time.ParseInLocation(ShortDateLayout, day, app.Location); err != nil {
+			return invalidPackage(fmt.Sprintf("Invalid validity date %q", day))
+		}
+	}
+	if p.ValidUntil < p.ValidFrom {
+		return invalidPackage("Package expires before it is valid")
+	}
+	return nil
+}
+
+// recordPackage loads the package of the record and checks that it can pay for the session.
+func recordPackage(ctx context.Context, r *Record) (*Package, error) {
+	p, err := app.Packages.Get(ctx, r.PackageId)
+	if err == ErrNotFound {
+		return nil, invalidReference("packageId", r.PackageId, "Package does not exist")
+	} else if err != nil {
+		return nil, err
+	}
+	if p.ClientId != r.ClientId {
+		return nil, invalidReference("packageId", r.PackageId, "Package belongs to another client")
+	}
+	if day := MarshalDate(r.Date, ShortDateLayout); day < p.ValidFrom || day > p.ValidUntil {
+		return nil, invalidReference("packageId", r.PackageId, "Package is valid from "+p.ValidFrom+" until "+p.ValidUntil)
+	}
+	serviceId := p.ServiceId
+	if serviceId.IsZero() {
+		service, err := defaultService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		serviceId = service.Id
+	}
+	if r.ServiceId != serviceId {
+		return nil, invalidReference("packageId", r.PackageId, "Package is for another service")
+	}
+	return p, nil
+}
+
+func packageExhausted(id primitive.ObjectID) error {
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "package-exhausted",
+		Message: "There are no sessions left in the package",
+		Details: map[string]string{"packageId": id.Hex()},
+	}
+}
+
+// drawDown consumes a session of the package of the record, when the record
+// is new or has been moved to the package. The returned undo gives the
+// session back in case the record cannot be saved.
+func drawDown(ctx context.Context, record, stored *Record) (func(), error) {
+	undo := func() {}
+	if record.PackageId.IsZero() || (stored != nil && stored.PackageId == record.PackageId) {
+		return undo, nil
+	}
+	if err := app.Packages.Consume(ctx, record.PackageId); err == ErrExhausted {
+		return undo, packageExhausted(record.PackageId)
+	} else if err != nil {
+		return undo, err
+	}
+	return func() { releaseSession(ctx, record.PackageId) }, nil
+}
+
+// releaseSession gives a session back to the package, after the record drawing it down has gone.
+func releaseSession(ctx context.Context, packageId primitive.ObjectID) {
+	if packageId.IsZero() {
+		return
+	}
+	if err := app.Packages.Release(ctx, packageId); err != nil {
+		log.Printf("Cannot release a session of package %s: %v", packageId.Hex(), err)
+	}
+}
+
+func loadPackage(ctx context.Context, r *http.Request) (*Package, error) {
+	id, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.Packages.Get(ctx, id)
+}
+
+func writePackages(w http.ResponseWriter, packages []Package, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if packages == nil {
+		packages = []Package{}
+	}
+	tags := make([]string, len(packages))
+	for i := range packages {
+		tags[i] = packages[i].ETag()
+	}
+	w.Header().Set("ETag", listETag(tags))
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(packages)
+}
+
+// showClientPackages lists the packages of the client, soonest expiring first.
+func showClientPackages(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var packages []Package
+	clientId, err := routeId(r)
+	if err == nil {
+		_, err = app.Clients.Get(ctx, clientId)
+	}
+	if err == nil {
+		filter := PackageFilter{ClientId: clientId, WithRemaining: r.URL.Query().Get("remaining") == "true"}
+		packages, err = app.Packages.List(ctx, filter)
+	}
+	writePackages(w, packages, err)
+}
+
+// createPackage sells a package to the client.
+func createPackage(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var p Package
+	clientId, err := routeId(r)
+	if err == nil {
+		_, err = activeClient(ctx, "clientId", clientId)
+	}
+	if err == nil {
+		err = json.NewDecoder(r.Body).Decode(&p)
+	}
+	if err == nil {
+		p.Id = primitive.NilObjectID
+		p.ClientId = clientId
+		p.Remaining = p.Sessions
+		p.Purchased = primitive.NewDateTimeFromTime(time.Now())
+		if p.ValidFrom == "" {
+			p.ValidFrom = time.Now().In(app.Location).Format(ShortDateLayout)
+		}
+		err = p.validate()
+	}
+	if err == nil && !p.ServiceId.IsZero() {
+		if _, err = app.Services.Get(ctx, p.ServiceId); err == ErrNotFound {
+			err = invalidReference("serviceId", p.ServiceId, "Service does not exist")
+		}
+	}
+	if err == nil {
+		err = app.Packages.Insert(ctx, &p)
+	}
+	writePackage(w, ctx, &p, err)
+}
+
+func showPackage(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	p, err := loadPackage(ctx, r)
+	writePackage(w, ctx, p, err)
+}
+
+// updatePackage corrects the package. Changing the number of sessions keeps
+// the used ones, the client and the remaining sessions cannot be changed.
+func updatePackage(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	p, err := loadPackage(ctx, r)
+	if err == nil && !ifMatch(r, p.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil {
+		stored := *p
+		err = decodePatch(r, p)
+		p.Id, p.Version, p.ClientId, p.Purchased = stored.Id, stored.Version, stored.ClientId, stored.Purchased
+		p.Remaining = p.Sessions - stored.Used()
+	}
+	if err == nil {
+		err = p.validate()
+	}
+	if err == nil {
+		err = app.Packages.Update(ctx, p.Id, p)
+	}
+	writePackage(w, ctx, p, err)
+}
+
+// removePackage removes a package sold by mistake, used packages stay.
+func removePackage(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	p, err := loadPackage(ctx, r)
+	if err == nil && !ifMatch(r, p.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil && p.Used() > 0 {
+		err = &APIError{
+			Status:  http.StatusConflict,
+			Code:    "package-used",
+			Message: fmt.Sprintf("%d sessions of the package have been used", p.Used()),
+		}
+	}
+	if err == nil {
+		err = checkUnpaid(ctx, PaymentFilter{PackageId: p.Id}, "package")
+	}
+	if err == nil {
+		err = app.Packages.Delete(ctx, p.Id, expectedVersion(r, p.Version))
+	}
+
+	if err == ErrConflict {
+		writePackage(w, ctx, p, err)
+	} else if err == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(p.Id)
+	} else {
+		writeError(w, err)
+	}
+}
+
+// writePackage responds with the current copy of the package after a write.
+func writePackage(w http.ResponseWriter, ctx context.Context, p *Package, err error) {
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		p, err = app.Packages.Get(ctx, p.Id)
+		if err == nil && conflict {
+			writeConflict(w, p.ETag(), p)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", p.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// PackageExpiry is a package with sessions left which expires soon or has expired.
+type PackageExpiry struct {
+	Package
+	ClientName string `json:"clientName"`
+	// UnusedValue is the price paid for the remaining sessions.
+	UnusedValue Money `json:"unusedValue"`
+	DaysLeft    int   `json:"daysLeft"` // negative for expired packages
+}
+
+// ExpiringPackages reports packages with sessions left expiring in the range of days.
+func ExpiringPackages(ctx context.Context, from, to string) ([]PackageExpiry, error) {
+	packages, err := app.Packages.List(ctx, PackageFilter{ExpiresFrom: from, ExpiresTo: to, WithRemaining: true})
+	if err != nil {
+		return nil, err
+	}
+	clients, _, err := loadNameMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(app.Location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, app.Location)
+	report := []PackageExpiry{}
+	for _, p := range packages {
+		until, _ := time.ParseInLocation(ShortDateLayout, p.ValidUntil, app.Location)
+		report = append(report, PackageExpiry{
+			Package:     p,
+			ClientName:  clients[p.ClientId].Name,
+			UnusedValue: p.SessionPrice().Scale(int64(p.Remaining), 1),
+			// days are counted by the calendar, whatever the daylight saving time
+			DaysLeft: int(math.Round(until.Sub(today).Hours() / 24)),
+		})
+	}
+	return report, nil
+}
+
+// showPackageExpiry reports packages with sessions left expiring between from
+// and to, by default within the next 30 days. Expired packages are reported
+// when from is in the past.
+func showPackageExpiry(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var report []PackageExpiry
+	var err error
+	query := r.URL.Query()
+	now := time.Now().In(app.Location)
+	days := map[string]string{
+		"from": now.Format(ShortDateLayout),
+		"to":   now.AddDate(0, 0, 30).Format(ShortDateLayout),
+	}
+	for name := range days {
+		if value := query.Get(name); value != "" && err == nil {
+			if _, err = time.ParseInLocation(ShortDateLayout, value, app.Location); err != nil {
+				err = invalidParameter(name, err)
+			}
+			days[name] = value
+		}
+	}
+	if err == nil {
+		report, err = ExpiringPackages(ctx, days["from"], days["to"])
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPackageDrawdown(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(60)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	other := Client{Name: "Anna"}
+	app.Clients.Insert(ctx, &other)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	today := time.Now().In(app.Location)
+	w := s.request("PUT", "/clients/"+client.Id.Hex()+"/packages", map[string]interface{}{
+		"sessions": 2, "price": "150", "validUntil": today.AddDate(0, 0, 20).Format(ShortDateLayout),
+	})
+	var p Package
+	json.NewDecoder(w.Body).Decode(&p)
+	if w.Code != http.StatusOK || p.Remaining != 2 || p.ClientId != client.Id {
+		t.Fatalf("Selling a package failed: %d %s", w.Code, w.Body)
+	}
+
+	save := func(clientId string, hoursAgo int) (*Record, int) {
+		w := s.request("PUT", "/records", map[string]interface{}{
+			"clientId":  clientId,
+			"packageId": p.Id.Hex(),
+			"date":      today.Add(-time.Duration(hoursAgo) * time.Hour).Format(DateTimeLayout),
+			"duration":  90,
+		})
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		return &record, w.Code
+	}
+	first, code := save(client.Id.Hex(), 1)
+	if code != http.StatusOK || !first.Price.Equal(units(75)) {
+		t.Errorf("Expected the share of the package price, got: %d %+v", code, first)
+	}
+	if _, code = save(other.Id.Hex(), 2); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a package of another client, got: %d", code)
+	}
+	if _, code = save(client.Id.Hex(), 3); code != http.StatusOK {
+		t.Errorf("Expected the second session, got: %d", code)
+	}
+	if _, code = save(client.Id.Hex(), 4); code != http.StatusConflict {
+		t.Errorf("Expected 409 for an exhausted package, got: %d", code)
+	}
+
+	if w := s.request("DELETE", "/records/"+first.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body)
+	}
+	if stored, _ := app.Packages.Get(ctx, p.Id); stored.Remaining != 1 {
+		t.Errorf("Expected the session to be released, got: %+v", stored)
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	if w := admin.request("DELETE", "/packages/"+p.Id.Hex(), nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a used package, got: %d", w.Code)
+	}
+	w = admin.request("GET", "/reports/packages", nil)
+	var report []PackageExpiry
+	json.NewDecoder(w.Body).Decode(&report)
+	if w.Code != http.StatusOK || len(report) != 1 || report[0].ClientName != "Jan" || !report[0].UnusedValue.Equal(units(75)) {
+		t.Errorf("Unexpected expiry report: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPackageValidity(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	p := Package{ClientId: client.Id, Sessions: 5, Remaining: 5, Price: units(400), ValidFrom: "2021-03-01", ValidUntil: "2021-03-31"}
+	app.Packages.Insert(ctx, &p)
+	service, _ := defaultService(ctx)
+
+	for _, test := range []struct {
+		date  time.Time
+		valid bool
+	}{
+		{time.Date(2021, 3, 31, 23, 30, 0, 0, app.Location), true},
+		{time.Date(2021, 4, 1, 0, 30, 0, 0, app.Location), false},
+		{time.Date(2021, 2, 28, 23, 30, 0, 0, app.Location), false},
+	} {
+		record := Record{ClientId: client.Id, PackageId: p.Id, ServiceId: service.Id, Date: primitive.NewDateTimeFromTime(test.date)}
+		if _, err := recordPackage(ctx, &record); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got: %v", test.date, test.valid, err)
+		}
+	}
+}
+
+func TestConcurrentConsume(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	p := Package{Sessions: 10, Remaining: 10, ValidFrom: "2021-01-01", ValidUntil: "2021-12-31"}
+	app.Packages.Insert(ctx, &p)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := app.Packages.Consume(ctx, p.Id); err == nil {
+				mu.Lock()
+				consumed++
+				mu.Unlock()
+			} else if err != ErrExhausted {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if stored, _ := app.Packages.Get(ctx, p.Id); consumed != 10 || stored.Remaining != 0 {
+		t.Errorf("Expected all 10 sessions consumed once, got: %d %+v", consumed, stored)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// RecordPage is the envelope of the records listing.
+type RecordPage struct {
+	Records []Record `json:"records"`
+	Count   int      `json:"count"` // records on this page
+	Total   int64    `json:"total"` // records matching the filter
+	Next    string   `json:"next,omitempty"`
+}
+
+// Cursors are opaque to clients: base64 of "<unix millis>:<hex id>".
+
+func (c RecordCursor) String() string {
+	raw := fmt.Sprintf("%d:%s", int64(c.Date), c.Id.Hex())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseRecordCursor(s string) (*RecordCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	millis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &RecordCursor{Date: primitive.DateTime(millis), Id: id}, nil
+}
+
+func invalidParameter(name string, err error) error {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    "invalid-parameter",
+		Message: fmt.Sprintf("Invalid %s: %v", name, err),
+		Details: map[string]string{"parameter": name},
+	}
+}
+
+// parseDay reads a date in the clinic time zone, "to" dates include the whole day.
+func parseDay(value string, endOfDay bool) (time.Time, error) {
+	t, err := time.ParseInLocation(ShortDateLayout, value, app.Location)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// ParseRecordFilter reads the listing parameters: from, to (days, inclusive),
+// employee, client, minPrice, maxPrice, sort (date or -date), limit and cursor.
+func ParseRecordFilter(query url.Values) (filter RecordFilter, err error) {
+	filter.Limit = defaultPageSize
+	ids := map[string]*primitive.ObjectID{"employee": &filter.EmployeeId, "client": &filter.ClientId}
+	for name, id := range ids {
+		if value := query.Get(name); value != "" {
+			if *id, err = primitive.ObjectIDFromHex(value); err != nil {
+				return filter, invalidParameter(name, err)
+			}
+		}
+	}
+	days := map[string]*time.Time{"from": &filter.From, "to": &filter.To}
+	for name, day := range days {
+		if value := query.Get(name); value != "" {
+			if *day, err = parseDay(value, name == "to"); err != nil {
+				return filter, invalidParameter(name, err)
+			}
+		}
+	}
+	prices := map[string]**Money{"minPrice": &filter.MinPrice, "maxPrice": &filter.MaxPrice}
+	for name, price := range prices {
+		if value := query.Get(name); value != "" {
+			p, err := ParseMoney(value)
+			if err != nil {
+				return filter, invalidParameter(name, err)
+			}
+			*price = &p
+		}
+	}
+	switch query.Get("sort") {
+	case "", "-date":
+	case "date":
+		filter.Ascending = true
+	default:
+		return filter, invalidParameter("sort", fmt.Errorf("expected date or -date"))
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.ParseInt(value, 10, 64); err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			return filter, invalidParameter("limit", fmt.Errorf("expected a number from 1 to %d", maxPageSize))
+		}
+	}
+	if value := query.Get("cursor"); value != "" {
+		if filter.After, err = ParseRecordCursor(value); err != nil {
+			return filter, invalidParameter("cursor", err)
+		}
+	}
+	return filter, nil
+}
+
+// ClientPage is the envelope of the clients listing.
+type ClientPage struct {
+	Clients []Client `json:"clients"`
+	Count   int      `json:"count"`
+	Total   int64    `json:"total"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// Client cursors are base64 of "<hex id>:<sort name>".
+
+func (c ClientCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Id.Hex() + ":" + c.SortName))
+}
+
+func ParseClientCursor(s string) (*ClientCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCursor{SortName: parts[1], Id: id}, nil
+}
+
+// ParseClientFilter reads the listing parameters: q (search terms matched as
+// prefixes of name, phone, email, city or post code), archived (false, true
+// or all), limit and cursor.
+func ParseClientFilter(query url.Values) (filter ClientFilter, err error) {
+	filter.Limit = defaultPageSize
+	filter.Terms = SearchTerms(query.Get("q"))
+	switch query.Get("archived") {
+	case "", "false":
+	case "true":
+		filter.Archived = ArchivedClients
+	case "all":
+		filter.Archived = AllClients
+	default:
+		return filter, invalidParameter("archived", fmt.Errorf("expected false, true or all"))
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.ParseInt(value, 10, 64); err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			return filter, invalidParameter("limit", fmt.Errorf("expected a number from 1 to %d", maxPageSize))
+		}
+	}
+	if value := query.Get("cursor"); value != "" {
+		if filter.After, err = ParseClientCursor(value); err != nil {
+			return filter, invalidParameter("cursor", err)
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PaymentMethod string
+
+const (
+	Cash         PaymentMethod = "cash"
+	Card         PaymentMethod = "card"
+	BankTransfer PaymentMethod = "transfer"
+)
+
+// Payment is money received from the client, allocated to the sessions and
+// packages it pays for. The part which is not allocated is the client's credit.
+type Payment struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ClientId  primitive.ObjectID `json:"clientId"`
+	Date      string             `json:"date"` // day in ShortDateLayout
+	Amount    Money              `json:"amount"`
+	Method    PaymentMethod      `json:"method"`
+	Reference string             `json:"reference"` // e.g. the title of the transfer
+	// Allocations sent as null when the payment is created are made by
+	// paying the oldest charges of the client first.
+	Allocations []Allocation       `json:"allocations"`
+	EmployeeId  primitive.ObjectID `json:"employeeId"` // who took the payment
+	Version     int64              `json:"version"`
+}
+
+// Allocation is the part of a payment for a record or a package.
+type Allocation struct {
+	RecordId  primitive.ObjectID `json:"recordId,omitempty" bson:"recordid,omitempty"`
+	PackageId primitive.ObjectID `json:"packageId,omitempty" bson:"packageid,omitempty"`
+	Amount    Money              `json:"amount"`
+}
+
+func (a Allocation) target() primitive.ObjectID {
+	if a.RecordId.IsZero() {
+		return a.PackageId
+	}
+	return a.RecordId
+}
+
+// Allocated is the part of the payment allocated to charges.
+func (p *Payment) Allocated() Money {
+	total := NewMoney(0)
+	for _, allocation := range p.Allocations {
+		total = total.Add(allocation.Amount)
+	}
+	return total
+}
+
+func invalidPayment(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-payment", Message: message}
+}
+
+func (p *Payment) validate() error {
+	switch p.Method {
+	case Cash, Card, BankTransfer:
+	default:
+		return invalidPayment(fmt.Sprintf("Unknown payment method %q, expected cash, card or transfer", p.Method))
+	}
+	if _, err := time.ParseInLocation(ShortDateLayout, p.Date, app.Location); err != nil {
+		return invalidPayment(fmt.Sprintf("Invalid date %q", p.Date))
+	}
+	if p.Amount.IsNegative() || p.Amount.IsZero() {
+		return invalidPayment("Amount has to be positive")
+	}
+	return nil
+}
+
+// Charge is what the client has to pay for, a session or a package. Sessions
+// drawing down a package are paid with the package.
+type Charge struct {
+	RecordId    primitive.ObjectID `json:"recordId,omitempty"`
+	PackageId   primitive.ObjectID `json:"packageId,omitempty"`
+	Date        string             `json:"date"` // day in ShortDateLayout
+	Description string             `json:"description"`
+	Amount      Money              `json:"amount"`
+	Paid        Money              `json:"paid"` // allocated by payments
+}
+
+func (c *Charge) Due() Money {
+	return c.Amount.Sub(c.Paid)
+}
+
+// ledger holds the charges and payments of a client, both oldest first.
+type ledger struct {
+	charges  []Charge
+	payments []Payment
+	byTarget map[primitive.ObjectID]*Charge
+}
+
+func (l *ledger) charge(id primitive.ObjectID) *Charge {
+	if l.byTarget == nil {
+		l.byTarget = make(map[primitive.ObjectID]*Charge)
+		for i := range l.charges {
+			c := &l.charges[i]
+			if c.RecordId.IsZero() {
+				l.byTarget[c.PackageId] = c
+			} else {
+				l.byTarget[c.RecordId] = c
+			}
+		}
+	}
+	return l.byTarget[id]
+}
+
+// buildLedgers groups the charges and payments by client and allocates the payments.
+func buildLedgers(records []Record, packages []Package, payments []Payment, services map[primitive.ObjectID]Service) map[primitive.ObjectID]*ledger {
+	ledgers := make(map[primitive.ObjectID]*ledger)
+	of := func(clientId primitive.ObjectID) *ledger {
+		if ledgers[clientId] == nil {
+			ledgers[clientId] = &ledger{}
+		}
+		return ledgers[clientId]
+	}
+	for _, r := range records {
+		if !r.PackageId.IsZero() {
+			continue
+		}
+		l := of(r.ClientId)
+		l.charges = append(l.charges, Charge{
+			RecordId:    r.Id,
+			Date:        MarshalDate(r.Date, ShortDateLayout),
+			Description: services[r.ServiceId].Name,
+			Amount:      r.Price,
+			Paid:        NewMoney(0),
+		})
+	}
+	for _, p := range packages {
+		l := of(p.ClientId)
+		l.charges = append(l.charges, Charge{
+			PackageId:   p.Id,
+			Date:        MarshalDate(p.Purchased, ShortDateLayout),
+			Description: fmt.Sprintf("Package of %d sessions", p.Sessions),
+			Amount:      p.Price,
+			Paid:        NewMoney(0),
+		})
+	}
+	for _, p := range payments {
+		l := of(p.ClientId)
+		l.payments = append(l.payments, p)
+	}
+	for _, l := range ledgers {
+		sort.SliceStable(l.charges, func(i, j int) bool {
+			return l.charges[i].Date < l.charges[j].Date
+		})
+		sort.SliceStable(l.payments, func(i, j int) bool {
+			return l.payments[i].Date < l.payments[j].Date
+		})
+		for _, p := range l.payments {
+			for _, allocation := range p.Allocations {
+				if c := l.charge(allocation.target()); c != nil {
+					c.Paid = c.Paid.Add(allocation.Amount)
+				}
+			}
+		}
+	}
+	return ledgers
+}
+
+// loadServiceMap returns the services by id, the default one also by the zero id.
+func loadServiceMap(ctx context.Context) (map[primitive.ObjectID]Service, error) {
+	list, err := app.Services.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[primitive.ObjectID]Service)
+	for _, service := range list {
+		services[service.Id] = service
+		if service.Default {
+			// records which do not name a service are of the default one, see defaultService
+			services[primitive.NilObjectID] = service
+		}
+	}
+	return services, nil
+}
+
+// clientLedger loads the ledger of the client, leaving out the payment which is being changed.
+func clientLedger(ctx context.Context, clientId, except primitive.ObjectID) (*ledger, error) {
+	records, err := app.Records.List(ctx, RecordFilter{ClientId: clientId, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	packages, err := app.Packages.List(ctx, PackageFilter{ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	payments, err := app.Payments.List(ctx, PaymentFilter{ClientId: clientId})
+	if err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		if payments[i].Id == except {
+			payments = append(payments[:i], payments[i+1:]...)
+			break
+		}
+	}
+	services, err := loadServiceMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if l := buildLedgers(records, packages, payments, services)[clientId]; l != nil {
+		return l, nil
+	}
+	return &ledger{}, nil
+}
+
+// allocate pays the oldest charges which are due first, as far as the amount of the payment allows.
+func (l *ledger) allocate(p *Payment) {
+	p.Allocations = []Allocation{}
+	left := p.Amount
+	for _, c := range l.charges {
+		due := c.Due()
+		if left.IsZero() || left.IsNegative() {
+			break
+		}
+		if due.IsZero() || due.IsNegative() {
+			continue
+		}
+		if due.Amount > left.Amount {
+			due = left
+		}
+		p.Allocations = append(p.Allocations, Allocation{RecordId: c.RecordId, PackageId: c.PackageId, Amount: due})
+		left = left.Sub(due)
+	}
+}
+
+// checkAllocations verifies that the payment pays only charges of the client
+// which are due and that it covers its allocations.
+func (l *ledger) checkAllocations(p *Payment) error {
+	allocated := make(map[primitive.ObjectID]Money)
+	for _, allocation := range p.Allocations {
+		if allocation.RecordId.IsZero() == allocation.PackageId.IsZero() {
+			return invalidPayment("Allocation needs either a record or a package")
+		}
+		if allocation.Amount.IsNegative() || allocation.Amount.IsZero() {
+			return invalidPayment("Allocated amounts have to be positive")
+		}
+		id := allocation.target()
+		c := l.charge(id)
+		if c == nil {
+			field := "recordId"
+			if allocation.RecordId.IsZero() {
+				field = "packageId"
+			}
+			return invalidReference(field, id, "Not a charge of the client, sessions of packages are paid with the package")
+		}
+		allocated[id] = allocated[id].Add(allocation.Amount)
+		if due := c.Due(); allocated[id].Amount > due.Amount {
+			return invalidPayment(fmt.Sprintf("%s of %s has %s left to pay", c.Description, c.Date, due))
+		}
+	}
+	if allocated := p.Allocated(); allocated.Amount > p.Amount.Amount {
+		return invalidPayment(fmt.Sprintf("Allocations of %s exceed the payment", allocated))
+	}
+	return nil
+}
+
+// checkOverpaid runs once the payment is stored, payments of the client
+// taken concurrently could have paid the same charges in the meantime.
+func checkOverpaid(ctx context.Context, p *Payment) error {
+	l, err := clientLedger(ctx, p.ClientId, primitive.NilObjectID)
+	if err != nil {
+		return err
+	}
+	for _, allocation := range p.Allocations {
+		if c := l.charge(allocation.target()); c != nil && c.Due().IsNegative() {
+			return &APIError{
+				Status:  http.StatusConflict,
+				Code:    "overpaid",
+				Message: fmt.Sprintf("%s of %s has been paid in the meantime, try again", c.Description, c.Date),
+			}
+		}
+	}
+	return nil
+}
+
+// checkUnpaid refuses changes of charges which payments are allocated to.
+func checkUnpaid(ctx context.Context, filter PaymentFilter, what string) error {
+	payments, err := app.Payments.List(ctx, filter)
+	if err != nil || len(payments) == 0 {
+		return err
+	}
+	ids := make([]string, len(payments))
+	for i := range payments {
+		ids[i] = payments[i].Id.Hex()
+	}
+	return &APIError{
+		Status:  http.StatusConflict,
+		Code:    "has-payments",
+		Message: fmt.Sprintf("The %s has been paid for, change the allocations of its payments first", what),
+		Details: map[string]interface{}{"payments": ids},
+	}
+}
+
+// ClientBalance sums up the charges and payments of a client.
+type ClientBalance struct {
+	ClientId   primitive.ObjectID `json:"clientId"`
+	ClientName string             `json:"clientName"`
+	Charged    Money              `json:"charged"`
+	Paid       Money              `json:"paid"`
+	// Due is what the client owes, negative for a credit.
+	Due Money `json:"due"`
+	// Unallocated part of the payments, available for future charges.
+	Unallocated   Money  `json:"unallocated"`
+	UnpaidCharges int    `json:"unpaidCharges"`
+	OldestUnpaid  string `json:"oldestUnpaid,omitempty"` // day of the oldest charge due
+}
+
+func (l *ledger) balance(client *Client) ClientBalance {
+	b := ClientBalance{ClientId: client.Id, ClientName: client.Name, Charged: NewMoney(0), Paid: NewMoney(0), Unallocated: NewMoney(0)}
+	for _, c := range l.charges {
+		b.Charged = b.Charged.Add(c.Amount)
+		if due := c.Due(); !due.IsZero() && !due.IsNegative() {
+			b.UnpaidCharges++
+			if b.OldestUnpaid == "" {
+				b.OldestUnpaid = c.Date
+			}
+		}
+	}
+	for _, p := range l.payments {
+		b.Paid = b.Paid.Add(p.Amount)
+		b.Unallocated = b.Unallocated.Add(p.Amount.Sub(p.Allocated()))
+	}
+	b.Due = b.Charged.Sub(b.Paid)
+	return b
+}
+
+// StatementEntry is a charge or a payment on the statement, with the amount
+// due after it.
+type StatementEntry struct {
+	Date        string             `json:"date"`
+	Kind        string             `json:"kind"` // session, package or payment
+	Id          primitive.ObjectID `json:"id"`
+	Description string             `json:"description"`
+	Charge      Money              `json:"charge"`
+	Payment     Money              `json:"payment"`
+	Paid        Money              `json:"paid"` // of the charge
+	Due         Money              `json:"due"`
+}
+
+// Statement lists charges and payments of the client between From and To.
+type Statement struct {
+	ClientBalance
+	From    string           `json:"from,omitempty"`
+	To      string           `json:"to,omitempty"`
+	Opening Money            `json:"opening"` // due before From
+	Entries []StatementEntry `json:"entries"`
+	Closing Money            `json:"closing"` // due at the end of To
+}
+
+func (l *ledger) statement(client *Client, from, to string) Statement {
+	var entries []StatementEntry
+	for _, c := range l.charges {
+		entry := StatementEntry{Date: c.Date, Kind: "session", Id: c.RecordId, Description: c.Description, Charge: c.Amount, Payment: NewMoney(0), Paid: c.Paid}
+		if c.RecordId.IsZero() {
+			entry.Kind, entry.Id = "package", c.PackageId
+		}
+		entries = append(entries, entry)
+	}
+	for _, p := range l.payments {
+		description := string(p.Method)
+		if p.Reference != "" {
+			description += ": " + p.Reference
+		}
+		entries = append(entries, StatementEntry{Date: p.Date, Kind: "payment", Id: p.Id, Description: description, Charge: NewMoney(0), Payment: p.Amount, Paid: NewMoney(0)})
+	}
+	// charges of a day come before its payments
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date < entries[j].Date
+	})
+
+	s := Statement{ClientBalance: l.balance(client), From: from, To: to, Opening: NewMoney(0), Entries: []StatementEntry{}}
+	due := NewMoney(0)
+	for _, entry := range entries {
+		due = due.Add(entry.Charge).Sub(entry.Payment)
+		entry.Due = due
+		switch {
+		case from != "" && entry.Date < from:
+			s.Opening = due
+		case to != "" && entry.Date > to:
+		default:
+			s.Entries = append(s.Entries, entry)
+			s.Closing = due
+		}
+	}
+	if len(s.Entries) == 0 {
+		s.Closing = s.Opening
+	}
+	return s
+}
+
+// OutstandingBalances reports clients who owe for their sessions, the largest
+// debts first. Balances are summed up while the records are streamed, only the
+// payments and packages are held in memory, so that the records of all clients never are.
+func OutstandingBalances(ctx context.Context, all bool) ([]ClientBalance, error) {
+	clients, err := app.Clients.List(ctx, ClientFilter{Archived: AllClients})
+	if err != nil {
+		return nil, err
+	}
+	payments, err := app.Payments.List(ctx, PaymentFilter{})
+	if err != nil {
+		return nil, err
+	}
+	packages, err := app.Packages.List(ctx, PackageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[primitive.ObjectID]*ClientBalance)
+	of := func(clientId primitive.ObjectID) *ClientBalance {
+		if balances[clientId] == nil {
+			balances[clientId] = &ClientBalance{ClientId: clientId, Charged: NewMoney(0), Paid: NewMoney(0), Unallocated: NewMoney(0)}
+		}
+		return balances[clientId]
+	}
+	// paid sums up the allocations by their charge
+	paid := make(map[primitive.ObjectID]Money)
+	for _, p := range payments {
+		b := of(p.ClientId)
+		b.Paid = b.Paid.Add(p.Amount)
+		b.Unallocated = b.Unallocated.Add(p.Amount.Sub(p.Allocated()))
+		for _, allocation := range p.Allocations {
+			paid[allocation.target()] = paid[allocation.target()].Add(allocation.Amount)
+		}
+	}
+	charge := func(clientId, id primitive.ObjectID, date string, amount Money) {
+		b := of(clientId)
+		b.Charged = b.Charged.Add(amount)
+		if due := amount.Sub(paid[id]); !due.IsZero() && !due.IsNegative() {
+			b.UnpaidCharges++
+			if b.OldestUnpaid == "" || date < b.OldestUnpaid {
+				b.OldestUnpaid = date
+			}
+		}
+	}
+	for _, p := range packages {
+		charge(p.ClientId, p.Id, MarshalDate(p.Purchased, ShortDateLayout), p.Price)
+	}
+	// sessions drawing down a package are paid with the package, see buildLedgers
+	err = app.Records.Each(ctx, RecordFilter{}, func(r *Record) error {
+		if r.PackageId.IsZero() {
+			charge(r.ClientId, r.Id, MarshalDate(r.Date, ShortDateLayout), r.Price)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := []ClientBalance{}
+	for _, client := range clients {
+		b := balances[client.Id]
+		if b == nil {
+			continue
+		}
+		b.ClientName = client.Name
+		b.Due = b.Charged.Sub(b.Paid)
+		if all || b.UnpaidCharges > 0 {
+			report = append(report, *b)
+		}
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Due.Amount > report[j].Due.Amount
+	})
+	return report, nil
+}
+
+func loadPayment(ctx context.Context, r *http.Request) (*Payment, error) {
+	id, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.Payments.Get(ctx, id)
+}
+
+func loadRouteClient(ctx context.Context, r *http.Request) (*Client, error) {
+	id, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.Clients.Get(ctx, id)
+}
+
+func showClientPayments(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var payments []Payment
+	client, err := loadRouteClient(ctx, r)
+	if err == nil {
+		payments, err = app.Payments.List(ctx, PaymentFilter{ClientId: client.Id})
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if payments == nil {
+		payments = []Payment{}
+	}
+	tags := make([]string, len(payments))
+	for i := range payments {
+		tags[i] = payments[i].ETag()
+	}
+	w.Header().Set("ETag", listETag(tags))
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(payments)
+}
+
+// createPayment takes a payment from the client, allocating it to the oldest
+// charges due unless the allocations are given.
+func createPayment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var p Payment
+	var l *ledger
+	client, err := loadRouteClient(ctx, r)
+	if err == nil {
+		err = json.NewDecoder(r.Body).Decode(&p)
+	}
+	if err == nil {
+		p.Id = primitive.NilObjectID
+		p.ClientId = client.Id
+		p.EmployeeId = e.Id
+		if p.Date == "" {
+			p.Date = time.Now().In(app.Location).Format(ShortDateLayout)
+		}
+		err = p.validate()
+	}
+	if err == nil {
+		l, err = clientLedger(ctx, client.Id, primitive.NilObjectID)
+	}
+	if err == nil {
+		if p.Allocations == nil {
+			l.allocate(&p)
+		}
+		err = l.checkAllocations(&p)
+	}
+	if err == nil {
+		err = app.Payments.Insert(ctx, &p)
+	}
+	if err == nil {
+		if err = checkOverpaid(ctx, &p); err != nil {
+			app.Payments.Delete(ctx, p.Id, AnyVersion)
+		}
+	}
+	writePayment(w, ctx, &p, err)
+}
+
+func showPayment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	p, err := loadPayment(ctx, r)
+	writePayment(w, ctx, p, err)
+}
+
+// updatePayment corrects the payment or its allocations, the client cannot be changed.
+func updatePayment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var l *ledger
+	var stored Payment
+	p, err := loadPayment(ctx, r)
+	if err == nil && !ifMatch(r, p.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil {
+		stored = *p
+		// decoding reuses the array of the allocations
+		stored.Allocations = append([]Allocation(nil), p.Allocations...)
+		err = decodePatch(r, p)
+		p.Id, p.Version, p.ClientId, p.EmployeeId = stored.Id, stored.Version, stored.ClientId, stored.EmployeeId
+	}
+	if err == nil {
+		err = p.validate()
+	}
+	if err == nil {
+		l, err = clientLedger(ctx, p.ClientId, p.Id)
+	}
+	if err == nil {
+		err = l.checkAllocations(p)
+	}
+	if err == nil {
+		err = app.Payments.Update(ctx, p.Id, p)
+	}
+	if err == nil {
+		if err = checkOverpaid(ctx, p); err != nil {
+			stored.Version = p.Version
+			app.Payments.Update(ctx, p.Id, &stored)
+		}
+	}
+	writePayment(w, ctx, p, err)
+}
+
+// removePayment removes a payment taken by mistake, the charges it paid become due again.
+func removePayment(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	p, err := loadPayment(ctx, r)
+	if err == nil && !ifMatch(r, p.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil {
+		err = app.Payments.Delete(ctx, p.Id, expectedVersion(r, p.Version))
+	}
+
+	if err == ErrConflict {
+		writePayment(w, ctx, p, err)
+	} else if err == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(p.Id)
+	} else {
+		writeError(w, err)
+	}
+}
+
+// writePayment responds with the current copy of the payment after a write.
+func writePayment(w http.ResponseWriter, ctx context.Context, p *Payment, err error) {
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		p, err = app.Payments.Get(ctx, p.Id)
+		if err == nil && conflict {
+			writeConflict(w, p.ETag(), p)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", p.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// showStatement lists the charges and payments of the client with the balance,
+// optionally limited to the days from and to.
+func showStatement(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var statement Statement
+	var l *ledger
+	query := r.URL.Query()
+	client, err := loadRouteClient(ctx, r)
+	for _, name := range []string{"from", "to"} {
+		if value := query.Get(name); value != "" && err == nil {
+			if _, err = time.ParseInLocation(ShortDateLayout, value, app.Location); err != nil {
+				err = invalidParameter(name, err)
+			}
+		}
+	}
+	if err == nil {
+		l, err = clientLedger(ctx, client.Id, primitive.NilObjectID)
+	}
+	if err == nil {
+		statement = l.statement(client, query.Get("from"), query.Get("to"))
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(statement)
+	}
+}
+
+// showOutstandingBalances reports clients with charges due, all clients with
+// any charges or payments when all is true.
+func showOutstandingBalances(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	report, err := OutstandingBalances(ctx, r.URL.Query().Get("all") == "true")
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPayments(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(60)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+
+	day := func(d int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2021, 3, d, 10, 0, 0, 0, app.Location))
+	}
+	first := Record{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(1), Duration: 60, Price: units(90)}
+	second := Record{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(8), Duration: 60, Price: units(90)}
+	p := Package{ClientId: client.Id, Sessions: 2, Remaining: 1, Price: units(150), ValidFrom: "2021-03-10", ValidUntil: "2021-06-30", Purchased: day(10)}
+	app.Packages.Insert(ctx, &p)
+	prepaid := Record{EmployeeId: therapist.Id, ClientId: client.Id, Date: day(12), Duration: 60, Price: units(75), PackageId: p.Id}
+	for _, record := range []*Record{&first, &second, &prepaid} {
+		app.Records.Insert(ctx, record)
+	}
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	path := "/clients/" + client.Id.Hex()
+	w := s.request("PUT", path+"/payments", map[string]interface{}{"date": "2021-03-15", "amount": "120", "method": "card"})
+	var payment Payment
+	json.NewDecoder(w.Body).Decode(&payment)
+	if w.Code != http.StatusOK || len(payment.Allocations) != 2 || payment.EmployeeId != therapist.Id {
+		t.Fatalf("Payment failed: %d %+v", w.Code, payment)
+	}
+	if a := payment.Allocations; a[0].RecordId != first.Id || !a[0].Amount.Equal(units(90)) || a[1].RecordId != second.Id || !a[1].Amount.Equal(units(30)) {
+		t.Errorf("Expected the oldest sessions paid first, got: %+v", a)
+	}
+
+	for _, allocation := range []map[string]interface{}{
+		{"recordId": first.Id.Hex(), "amount": "10"},
+		{"recordId": prepaid.Id.Hex(), "amount": "10"},
+		{"packageId": p.Id.Hex(), "amount": "200"},
+	} {
+		w := s.request("PUT", path+"/payments", map[string]interface{}{
+			"date": "2021-03-16", "amount": "200", "method": "cash", "allocations": []interface{}{allocation},
+		})
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for allocation %v, got: %d %s", allocation, w.Code, w.Body)
+		}
+	}
+	if w := s.request("PUT", path+"/payments", map[string]interface{}{"amount": "10", "method": "cheque"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown method, got: %d", w.Code)
+	}
+
+	w = s.request("GET", path+"/statement?from=2021-03-05", nil)
+	var statement Statement
+	json.NewDecoder(w.Body).Decode(&statement)
+	if w.Code != http.StatusOK || !statement.Due.Equal(units(210)) || statement.UnpaidCharges != 2 || statement.OldestUnpaid != "2021-03-08" {
+		t.Fatalf("Unexpected balance: %d %+v", w.Code, statement.ClientBalance)
+	}
+	if len(statement.Entries) != 3 || !statement.Opening.Equal(units(90)) || !statement.Closing.Equal(units(210)) {
+		t.Errorf("Unexpected statement: %+v", statement)
+	}
+
+	if w := s.request("DELETE", "/records/"+first.Id.Hex(), nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a paid record, got: %d", w.Code)
+	}
+	if w := s.request("PATCH", "/records/"+first.Id.Hex(), map[string]interface{}{"duration": 30}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a change of the price of a paid record, got: %d %s", w.Code, w.Body)
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	w = admin.request("GET", "/reports/balances", nil)
+	var balances []ClientBalance
+	json.NewDecoder(w.Body).Decode(&balances)
+	if w.Code != http.StatusOK || len(balances) != 1 || balances[0].ClientName != "Jan" || !balances[0].Due.Equal(units(210)) || balances[0] != statement.ClientBalance {
+		t.Errorf("Unexpected balances: %d %+v", w.Code, balances)
+	}
+
+	if w := admin.request("DELETE", "/payments/"+payment.Id.Hex(), nil); w.Code != http.StatusOK {
+		t.Fatalf("Removing the payment failed: %d %s", w.Code, w.Body)
+	}
+	w = s.request("GET", path+"/statement", nil)
+	json.NewDecoder(w.Body).Decode(&statement)
+	if !statement.Due.Equal(units(330)) || statement.UnpaidCharges != 3 {
+		t.Errorf("Expected all charges due again, got: %+v", statement.ClientBalance)
+	}
+}
+
+func TestCheckOverpaid(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	record := Record{ClientId: client.Id, Date: primitive.NewDateTimeFromTime(time.Date(2021, 3, 1, 10, 0, 0, 0, app.Location)), Duration: 60, Price: units(90)}
+	app.Records.Insert(ctx, &record)
+
+	// two payments of the same session taken at once
+	payment := func() *Payment {
+		p := &Payment{ClientId: client.Id, Date: "2021-03-01", Amount: units(60), Method: Cash,
+			Allocations: []Allocation{{RecordId: record.Id, Amount: units(60)}}}
+		app.Payments.Insert(ctx, p)
+		return p
+	}
+	first := payment()
+	if err := checkOverpaid(ctx, first); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	second := payment()
+	if err, ok := checkOverpaid(ctx, second).(*APIError); !ok || err.Status != http.StatusConflict {
+		t.Errorf("Expected 409 for an overpaid session, got: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tealeg/xlsx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PayrollStatement sums up the sessions of an employee in a month.
+type PayrollStatement struct {
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	Name       string             `json:"name"`
+	Month      string             `json:"month"` // e.g. "2021-03"
+	Sessions   int                `json:"sessions"`
+	Minutes    int                `json:"minutes"`
+	Hours      float64            `json:"hours"`
+	// Gross income of the clinic from the sessions, the sum of their prices.
+	Gross   Money         `json:"gross"`
+	Income  Money         `json:"income"` // of the employee
+	Records []PayrollItem `json:"records"`
+}
+
+// PayrollItem is a session on the statement.
+type PayrollItem struct {
+	RecordId  primitive.ObjectID `json:"recordId"`
+	Date      string             `json:"date"` // in DateTimeLayout
+	Client    string             `json:"client"`
+	Service   string             `json:"service"`
+	Duration  int                `json:"duration"`
+	HomeVisit bool               `json:"homeVisit"`
+	Price     Money              `json:"price"`
+	Income    Money              `json:"income"`
+
+	time time.Time
+}
+
+// Payroll makes statements of the month for the employees with sessions, or
+// only for the given employee, sorted by name.
+func Payroll(ctx context.Context, month time.Time, employeeId primitive.ObjectID) ([]PayrollStatement, error) {
+	from, to := monthBounds(month)
+	records, err := app.Records.List(ctx, RecordFilter{EmployeeId: employeeId, From: from, To: to, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	clients, employees, err := loadNameMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	services, err := loadServiceMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byEmployee := make(map[primitive.ObjectID]*PayrollStatement)
+	statement := func(id primitive.ObjectID) *PayrollStatement {
+		if byEmployee[id] == nil {
+			byEmployee[id] = &PayrollStatement{
+				EmployeeId: id,
+				Name:       employees[id].Name,
+				Month:      from.Format("2006-01"),
+				Gross:      NewMoney(0),
+				Income:     NewMoney(0),
+				Records:    []PayrollItem{},
+			}
+		}
+		return byEmployee[id]
+	}
+	if !employeeId.IsZero() {
+		statement(employeeId)
+	}
+	for _, record := range records {
+		s := statement(record.EmployeeId)
+		s.Sessions++
+		s.Minutes += record.Duration
+		s.Gross = s.Gross.Add(record.Price)
+		s.Income = s.Income.Add(record.EmployeeIncome)
+		s.Records = append(s.Records, PayrollItem{
+			RecordId:  record.Id,
+			Date:      MarshalDate(record.Date, DateTimeLayout),
+			Client:    clients[record.ClientId].Name,
+			Service:   services[record.ServiceId].Name,
+			Duration:  record.Duration,
+			HomeVisit: record.HomeVisit,
+			Price:     record.Price,
+			Income:    record.EmployeeIncome,
+			time:      record.Date.Time().In(app.Location),
+		})
+	}
+
+	statements := []PayrollStatement{}
+	for _, s := range byEmployee {
+		s.Hours = float64(s.Minutes) / 60
+		statements = append(statements, *s)
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		return statements[i].Name < statements[j].Name
+	})
+	return statements, nil
+}
+
+// payrollRequest reads the month and the employee of a payroll request.
+// Employees other than admins get only their own statement.
+func payrollRequest(r *http.Request, e *Employee, month string) (time.Time, primitive.ObjectID, error) {
+	var employeeId primitive.ObjectID
+	date, err := time.ParseInLocation("2006-01", month, app.Location)
+	if err != nil {
+		return date, employeeId, invalidParameter("month", err)
+	}
+	if value := r.URL.Query().Get("employee"); value != "" {
+		if employeeId, err = primitive.ObjectIDFromHex(value); err != nil {
+			return date, employeeId, invalidParameter("employee", err)
+		}
+	}
+	if !e.Admin {
+		if !employeeId.IsZero() && employeeId != e.Id {
+			return date, employeeId, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    "not-owner",
+				Message: "Statements of other employees are available to admins only",
+			}
+		}
+		employeeId = e.Id
+	}
+	return date, employeeId, nil
+}
+
+func showPayroll(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var statements []PayrollStatement
+	month, employeeId, err := payrollRequest(r, e, mux.Vars(r)["month"])
+	if err == nil {
+		statements, err = Payroll(ctx, month, employeeId)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(statements)
+	}
+}
+
+// sheetName makes a valid and unique name of a sheet for the employee.
+func sheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "Employee"
+	}
+	if runes := []rune(name); len(runes) > 28 {
+		name = string(runes[:28])
+	}
+	unique := name
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s %d", name, i)
+	}
+	used[unique] = true
+	return unique
+}
+
+// payrollWorkbook makes a sheet per statement.
+func payrollWorkbook(statements []PayrollStatement) (*xlsx.File, error) {
+	file := xlsx.NewFile()
+	if len(statements) == 0 {
+		_, err := file.AddSheet("Payroll")
+		return file, err
+	}
+	used := make(map[string]bool)
+	for _, s := range statements {
+		sheet, err := file.AddSheet(sheetName(s.Name, used))
+		if err != nil {
+			return nil, err
+		}
+		sheet.AddRow().AddCell().Value = s.Name + ", " + s.Month
+		summary := func(label string, set func(*xlsx.Cell)) {
+			row := sheet.AddRow()
+			row.AddCell().Value = label
+			set(row.AddCell())
+		}
+		summary("Sessions", func(c *xlsx.Cell) { c.SetInt(s.Sessions) })
+		summary("Hours", func(c *xlsx.Cell) { c.SetFloat(s.Hours) })
+		summary("Gross", func(c *xlsx.Cell) { c.SetFloatWithFormat(s.Gross.Float(), currencyFormat(s.Gross)) })
+		summary("Income", func(c *xlsx.Cell) { c.SetFloatWithFormat(s.Income.Float(), currencyFormat(s.Income)) })
+		sheet.AddRow()
+
+		header := sheet.AddRow()
+		for _, title := range []string{"Date", "Client", "Service", "Minutes", "Home visit", "Price", "Income"} {
+			header.AddCell().Value = title
+		}
+		for _, item := range s.Records {
+			row := sheet.AddRow()
+			setExcelDate(row.AddCell(), item.time, "yyyy-mm-dd hh:mm")
+			row.AddCell().Value = item.Client
+			row.AddCell().Value = item.Service
+			row.AddCell().SetInt(item.Duration)
+			row.AddCell().SetBool(item.HomeVisit)
+			row.AddCell().SetFloatWithFormat(item.Price.Float(), currencyFormat(item.Price))
+			row.AddCell().SetFloatWithFormat(item.Income.Float(), currencyFormat(item.Income))
+		}
+		sheet.SetColWidth(0, 0, 17.)
+		sheet.SetColWidth(1, 2, 25.)
+		sheet.SetColWidth(3, 6, 12.)
+	}
+	return file, nil
+}
+
+func exportPayrollExcel(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var statements []PayrollStatement
+	var file *xlsx.File
+	var buf bytes.Buffer
+	month, employeeId, err := payrollRequest(r, e, mux.Vars(r)["month"])
+	if err == nil {
+		statements, err = Payroll(ctx, month, employeeId)
+	}
+	if err == nil {
+		file, err = payrollWorkbook(statements)
+	}
+	if err == nil {
+		err = file.Write(&buf)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payroll-%s.xlsx"`, month.Format("2006-01")))
+		w.Write(buf.Bytes())
+	}
+}
+
+// PayrollView is rendered by the payroll template.
+type PayrollView struct {
+	Month      string
+	Statements []PayrollStatement
+}
+
+// showPayrollPage renders the statements for printing.
+func showPayrollPage(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var statements []PayrollStatement
+	month, employeeId, err := payrollRequest(r, e, mux.Vars(r)["month"])
+	if err == nil {
+		statements, err = Payroll(ctx, month, employeeId)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		renderPage(w, "payroll", &PayrollView{Month: month.Format("2006-01"), Statements: statements})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tealeg/xlsx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPayroll(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist"}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	other := Employee{Name: "Another/Therapist"}
+	app.Employees.Insert(ctx, &other)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	at := func(month time.Month, day, hour, minute int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2021, month, day, hour, minute, 0, 0, app.Location))
+	}
+	for _, record := range []Record{
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: at(3, 1, 0, 30), Duration: 60, Price: units(90), EmployeeIncome: units(50)},
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: at(3, 31, 23, 30), Duration: 30, Price: units(45), EmployeeIncome: units(25)},
+		{EmployeeId: therapist.Id, ClientId: client.Id, Date: at(4, 1, 0, 30), Duration: 60, Price: units(90), EmployeeIncome: units(50)},
+		{EmployeeId: other.Id, ClientId: client.Id, Date: at(3, 15, 12, 0), Duration: 60, Price: units(90), EmployeeIncome: units(60)},
+	} {
+		app.Records.Insert(ctx, &record)
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	w := admin.request("GET", "/payroll/2021-03", nil)
+	var statements []PayrollStatement
+	json.NewDecoder(w.Body).Decode(&statements)
+	if w.Code != http.StatusOK || len(statements) != 2 {
+		t.Fatalf("Payroll failed: %d %+v", w.Code, statements)
+	}
+	if s := statements[1]; s.Name != "Therapist" || s.Sessions != 2 || s.Hours != 1.5 || !s.Gross.Equal(units(135)) || !s.Income.Equal(units(75)) || len(s.Records) != 2 {
+		t.Errorf("Unexpected statement: %+v", s)
+	}
+	if item := statements[1].Records[0]; item.Service != "Therapy session" {
+		t.Errorf("Expected the default service for a record without one, got: %q", item.Service)
+	}
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	w = s.request("GET", "/payroll/2021-03", nil)
+	json.NewDecoder(w.Body).Decode(&statements)
+	if w.Code != http.StatusOK || len(statements) != 1 || statements[0].EmployeeId != therapist.Id {
+		t.Errorf("Expected only the own statement, got: %d %+v", w.Code, statements)
+	}
+	if w := s.request("GET", "/payroll/2021-03.xlsx?employee="+other.Id.Hex(), nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for the statement of another employee, got: %d", w.Code)
+	}
+
+	w = admin.request("GET", "/payroll/2021-03.xlsx", nil)
+	file, err := xlsx.OpenBinary(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Cannot open the workbook: %v", err)
+	}
+	if len(file.Sheets) != 2 || file.Sheets[0].Name != "Another-Therapist" || file.Sheets[1].Name != "Therapist" {
+		t.Errorf("Expected a sheet per employee, got: %d sheets", len(file.Sheets))
+	}
+
+	w = s.request("GET", "/payroll/2021-03.html", nil)
+	if page := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(page, "Therapist") || strings.Contains(page, "Another") {
+		t.Errorf("Unexpected page: %d %s", w.Code, page)
+	}
+}
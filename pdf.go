@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pdfDocument writes simple A4 documents with text and lines in the standard
+// Helvetica fonts, which PDF readers provide, so no fonts are embedded.
+// Coordinates are in points from the top left corner of the page.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+}
+
+const (
+	pdfPageWidth  = 595.28
+	pdfPageHeight = 841.89
+)
+
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.AddPage()
+	return d
+}
+
+func (d *pdfDocument) AddPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+}
+
+// Text writes s with its baseline at y.
+func (d *pdfDocument) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfEscape(pdfEncode(s)))
+}
+
+// TextRight writes s in the regular font ending at x.
+func (d *pdfDocument) TextRight(x, y, size float64, s string) {
+	d.Text(x-pdfTextWidth(s, size), y, size, false, s)
+}
+
+func (d *pdfDocument) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.page, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// pdfGlyphs extends WinAnsiEncoding with the Polish letters, from code 128 on.
+var pdfGlyphs = []struct {
+	r     rune
+	name  string
+	width int
+}{
+	{'ą', "aogonek", 556}, {'ć', "cacute", 500}, {'ę', "eogonek", 556}, {'ł', "lslash", 222},
+	{'ń', "nacute", 556}, {'ó', "oacute", 556}, {'ś', "sacute", 500}, {'ź', "zacute", 500},
+	{'ż', "zdotaccent", 500}, {'Ą', "Aogonek", 667}, {'Ć', "Cacute", 722}, {'Ę', "Eogonek", 667},
+	{'Ł', "Lslash", 556}, {'Ń', "Nacute", 722}, {'Ó', "Oacute", 778}, {'Ś', "Sacute", 667},
+	{'Ź', "Zacute", 611}, {'Ż', "Zdotaccent", 611},
+}
+
+// helveticaWidths of ASCII characters from the space on, in 1/1000 of the font size.
+var helveticaWidths = []int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfEncode maps the text to the codes of the fonts, characters without a glyph become "?".
+func pdfEncode(s string) []byte {
+	encoded := make([]byte, 0, len(s))
+next:
+	for _, r := range s {
+		if r >= ' ' && r <= '~' {
+			encoded = append(encoded, byte(r))
+			continue
+		}
+		for i, glyph := range pdfGlyphs {
+			if glyph.r == r {
+				encoded = append(encoded, byte(128+i))
+				continue next
+			}
+		}
+		encoded = append(encoded, '?')
+	}
+	return encoded
+}
+
+func pdfEscape(b []byte) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(string(b))
+}
+
+func pdfTextWidth(s string, size float64) float64 {
+	width := 0
+	for _, c := range pdfEncode(s) {
+		if c >= 128 {
+			width += pdfGlyphs[c-128].width
+		} else {
+			width += helveticaWidths[c-' ']
+		}
+	}
+	return float64(width) * size / 1000
+}
+
+// WriteTo writes the document in the PDF format.
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) int {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+		return len(offsets)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// objects 1 and 2 are the catalog and the page tree, pages come after the fonts
+	const pagesObject = 2
+	object(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObject))
+	pagesOffset := len(offsets)
+	offsets = append(offsets, 0)
+
+	differences := []string{"128"}
+	for _, glyph := range pdfGlyphs {
+		differences = append(differences, "/"+glyph.name)
+	}
+	encoding := object("<< /Type /Encoding /BaseEncoding /WinAnsiEncoding /Differences [" + strings.Join(differences, " ") + "] >>")
+	regular := object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding %d 0 R >>", encoding))
+	bold := object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding %d 0 R >>", encoding))
+
+	var kids []string
+	for _, page := range d.pages {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(page.Bytes())
+		zw.Close()
+		content := object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.Bytes()))
+		id := object(fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> >> /Contents %d 0 R >>",
+			pagesObject, pdfPageWidth, pdfPageHeight, regular, bold, content))
+		kids = append(kids, fmt.Sprintf("%d 0 R", id))
+	}
+
+	// the page tree is written last, its offset fills the reserved entry
+	offsets[pagesOffset] = out.Len()
+	fmt.Fprintf(&out, "%d 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", pagesObject, strings.Join(kids, " "), len(kids))
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.WriteTo(w)
+}
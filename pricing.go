@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Service is a kind of session on the price list, e.g. a diagnosis or a therapy session.
+type Service struct {
+	Id   primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code string             `json:"code"` // unique
+	Name string             `json:"name"`
+	// Default service is assumed for records which do not name one, there is exactly one.
+	Default bool `json:"default"`
+	// Prices sorted by the start of their validity.
+	Prices  []PricePeriod `json:"prices"`
+	Version int64         `json:"version"`
+}
+
+// PricePeriod is a price per rateMinutes valid from From until Until. Both
+// are inclusive days in ShortDateLayout, empty ones leave the period open.
+type PricePeriod struct {
+	From   string `json:"from"`
+	Until  string `json:"until"`
+	Amount Money  `json:"amount"`
+}
+
+// ClientPrice overrides the price list for the client.
+type ClientPrice struct {
+	ServiceId   primitive.ObjectID `json:"serviceId"`
+	PricePeriod `bson:",inline"`
+}
+
+// covers tells whether the period includes the day.
+func (p PricePeriod) covers(day string) bool {
+	return (p.From == "" || p.From <= day) && (p.Until == "" || day <= p.Until)
+}
+
+// priceOn returns the price valid on the day.
+func priceOn(periods []PricePeriod, day string) (Money, bool) {
+	for _, period := range periods {
+		if period.covers(day) {
+			return period.Amount, true
+		}
+	}
+	return Money{}, false
+}
+
+func invalidPrice(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-price", Message: message}
+}
+
+// validatePeriods checks the periods and sorts them, they must not overlap.
+func validatePeriods(periods []PricePeriod) error {
+	for _, period := range periods {
+		for _, day := range []string{period.From, period.Until} {
+			if _, err := time.ParseInLocation(ShortDateLayout, day, app.Location); day != "" && err != nil {
+				return invalidPrice(fmt.Sprintf("Invalid date %q", day))
+			}
+		}
+		if period.From != "" && period.Until != "" && period.Until < period.From {
+			return invalidPrice(fmt.Sprintf("Price valid from %s ends before it starts", period.From))
+		}
+		if period.Amount.IsNegative() {
+			return invalidPrice("Prices cannot be negative")
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].From < periods[j].From
+	})
+	for i := 1; i < len(periods); i++ {
+		if previous := periods[i-1]; previous.Until == "" || previous.Until >= periods[i].From {
+			return invalidPrice(fmt.Sprintf("Prices valid from %q and %s overlap", previous.From, periods[i].From))
+		}
+	}
+	return nil
+}
+
+// checkStartedPeriods refuses changes of the prices in effect until today,
+// sessions have been charged by them. Started periods may only be ended,
+// not before today, so that a new price follows them.
+func checkStartedPeriods(stored, periods []PricePeriod) error {
+	today := time.Now().In(app.Location).Format(ShortDateLayout)
+	open := func(until string) bool {
+		return until == "" || until >= today
+	}
+	started := make(map[string]PricePeriod)
+	for _, period := range stored {
+		if period.From <= today {
+			started[period.From] = period
+		}
+	}
+	refused := invalidPrice("Prices in effect until " + today + " cannot be changed, add a price valid from a later day instead")
+	for _, period := range periods {
+		before, ok := started[period.From]
+		if !ok && period.From <= today {
+			return refused
+		}
+		if !ok {
+			continue
+		}
+		if !period.Amount.Equal(before.Amount) || (period.Until != before.Until && !(open(before.Until) && open(period.Until))) {
+			return refused
+		}
+		delete(started, period.From)
+	}
+	if len(started) > 0 {
+		return refused
+	}
+	return nil
+}
+
+func (s *Service) validate() error {
+	if s.Code == "" || s.Name == "" {
+		return invalidPrice("Service needs a code and a name")
+	}
+	return validatePeriods(s.Prices)
+}
+
+// validatePrices checks the overrides of the client, grouped by service. Like
+// prices of services, the stored ones in effect until today cannot be changed,
+// see checkStartedPeriods.
+func (c *Client) validatePrices(ctx context.Context, stored []ClientPrice) error {
+	byService := make(map[primitive.ObjectID][]PricePeriod)
+	for _, price := range c.Prices {
+		if _, ok := byService[price.ServiceId]; !ok {
+			if _, err := app.Services.Get(ctx, price.ServiceId); err == ErrNotFound {
+				return invalidPrice("Unknown service " + price.ServiceId.Hex())
+			} else if err != nil {
+				return err
+			}
+		}
+		byService[price.ServiceId] = append(byService[price.ServiceId], price.PricePeriod)
+	}
+	for _, periods := range byService {
+		if err := validatePeriods(periods); err != nil {
+			return err
+		}
+	}
+	storedByService := make(map[primitive.ObjectID][]PricePeriod)
+	for _, price := range stored {
+		storedByService[price.ServiceId] = append(storedByService[price.ServiceId], price.PricePeriod)
+	}
+	for serviceId, periods := range storedByService {
+		if err := checkStartedPeriods(periods, byService[serviceId]); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(c.Prices, func(i, j int) bool {
+		return c.Prices[i].From < c.Prices[j].From
+	})
+	return nil
+}
+
+// defaultService returns the service assumed for records which do not name one.
+func defaultService(ctx context.Context) (*Service, error) {
+	services, err := app.Services.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if service.Default {
+			return &service, nil
+		}
+	}
+	return nil, invalidRecord("There is no default service on the price list")
+}
+
+// servicePrice resolves the price of the service for the client on the date,
+// the client's own price takes precedence over the price list.
+func servicePrice(ctx context.Context, client *Client, serviceId primitive.ObjectID, date primitive.DateTime) (Money, error) {
+	day := MarshalDate(date, ShortDateLayout)
+	for _, price := range client.Prices {
+		if price.ServiceId == serviceId && price.covers(day) {
+			return price.Amount, nil
+		}
+	}
+	service, err := app.Services.Get(ctx, serviceId)
+	if err == ErrNotFound {
+		return Money{}, invalidRecord("Unknown service " + serviceId.Hex())
+	} else if err != nil {
+		return Money{}, err
+	}
+	amount, ok := priceOn(service.Prices, day)
+	if !ok {
+		return Money{}, invalidRecord(fmt.Sprintf("%s has no price on %s", service.Name, day))
+	}
+	return amount, nil
+}
+
+// SeedServices fills an empty price list with the services of the clinic at DefaultPrice.
+func (app *App) SeedServices(ctx context.Context) error {
+	services, err := app.Services.List(ctx)
+	if err != nil || len(services) > 0 {
+		return err
+	}
+	for _, service := range []Service{
+		{Code: "diagnosis", Name: "Diagnosis"},
+		{Code: "therapy", Name: "Therapy session", Default: true},
+		{Code: "consultation", Name: "Consultation"},
+	} {
+		service.Prices = []PricePeriod{{Amount: app.DefaultPrice}}
+		if err = app.Services.Insert(ctx, &service); err != nil {
+			return err
+		}
+	}
+	log.Printf("Created the price list with the default price of %s.", app.DefaultPrice)
+	return nil
+}
+
+// MigrateClientPrices turns special prices stored by older versions into
+// overrides of the default service, valid ever since.
+func (app *App) MigrateClientPrices(ctx context.Context) error {
+	clients, err := app.Clients.List(ctx, ClientFilter{Archived: AllClients})
+	if err != nil {
+		return err
+	}
+	var service *Service
+	for _, client := range clients {
+		if client.LegacySpecialPrice == 0 {
+			continue
+		}
+		if service == nil {
+			if service, err = defaultService(ctx); err != nil {
+				return err
+			}
+		}
+		price := NewMoney(int64(client.LegacySpecialPrice) * minorUnits)
+		client.Prices = append(client.Prices, ClientPrice{ServiceId: service.Id, PricePeriod: PricePeriod{Amount: price}})
+		client.LegacySpecialPrice = 0
+		if err = app.Clients.Update(ctx, client.Id, &client); err != nil {
+			return err
+		}
+		log.Printf("Moved the special price of client to the price list: %s.", client.Name)
+	}
+	return nil
+}
+
+// makeDefault takes the default flag away from the other services.
+func makeDefault(ctx context.Context, service *Service) error {
+	services, err := app.Services.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range services {
+		if other.Default && other.Id != service.Id {
+			other.Default = false
+			if err = app.Services.Update(ctx, other.Id, &other); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func showServices(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	services, err := app.Services.List(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if services == nil {
+		services = []Service{}
+	}
+	tags := make([]string, len(services))
+	for i := range services {
+		tags[i] = services[i].ETag()
+	}
+	w.Header().Set("ETag", listETag(tags))
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	json.NewEncoder(w).Encode(services)
+}
+
+func createService(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var service Service
+	err := json.NewDecoder(r.Body).Decode(&service)
+	if err == nil {
+		service.Id = primitive.NilObjectID
+		err = service.validate()
+	}
+	if err == nil {
+		err = app.Services.Insert(ctx, &service)
+	}
+	if err == nil && service.Default {
+		err = makeDefault(ctx, &service)
+	}
+	writeService(w, ctx, &service, err)
+}
+
+func loadService(ctx context.Context, r *http.Request) (*Service, error) {
+	id, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.Services.Get(ctx, id)
+}
+
+func showService(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	service, err := loadService(ctx, r)
+	writeService(w, ctx, service, err)
+}
+
+// updateService changes the service. Prices which have been in effect stay,
+// see checkStartedPeriods, records keep the amounts resolved when they were saved.
+func updateService(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	service, err := loadService(ctx, r)
+	if err == nil && !ifMatch(r, service.ETag()) {
+		err = ErrConflict
+	}
+	var stored Service
+	if err == nil {
+		stored = *service
+		// decoding reuses the array of the prices
+		stored.Prices = append([]PricePeriod(nil), service.Prices...)
+		err = decodePatch(r, service)
+		service.Id, service.Version = stored.Id, stored.Version
+		if err == nil && stored.Default && !service.Default {
+			err = invalidPrice("Make another service the default instead")
+		}
+	}
+	if err == nil {
+		err = service.validate()
+	}
+	if err == nil {
+		err = checkStartedPeriods(stored.Prices, service.Prices)
+	}
+	if err == nil {
+		err = app.Services.Update(ctx, service.Id, service)
+	}
+	if err == nil && service.Default {
+		err = makeDefault(ctx, service)
+	}
+	writeService(w, ctx, service, err)
+}
+
+// writeService responds with the current copy of the service after a write.
+func writeService(w http.ResponseWriter, ctx context.Context, service *Service, err error) {
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		service, err = app.Services.Get(ctx, service.Id)
+		if err == nil && conflict {
+			writeConflict(w, service.ETag(), service)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", service.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(service)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// specialPrice is a price of the default service for the client, valid ever since.
+func specialPrice(t *testing.T, amount int64) []ClientPrice {
+	service, err := defaultService(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []ClientPrice{{ServiceId: service.Id, PricePeriod: PricePeriod{Amount: units(amount)}}}
+}
+
+func TestValidatePeriods(t *testing.T) {
+	setupTestApp(t)
+	valid := []PricePeriod{{From: "2021-07-01", Amount: units(100)}, {Until: "2021-06-30", Amount: units(90)}}
+	if err := validatePeriods(valid); err != nil || valid[0].Until != "2021-06-30" {
+		t.Errorf("Expected sorted periods, got: %v %+v", err, valid)
+	}
+	if amount, ok := priceOn(valid, "2021-06-30"); !ok || !amount.Equal(units(90)) {
+		t.Errorf("Expected 90 on the last day of the period, got: %s", amount)
+	}
+	for _, periods := range [][]PricePeriod{
+		{{From: "2021-07-01"}, {From: "2021-08-01"}},
+		{{Until: "2021-07-01"}, {From: "2021-07-01"}},
+		{{From: "2021-07-01", Until: "2021-06-01"}},
+		{{From: "2021-02-30"}},
+		{{Amount: units(-1)}},
+	} {
+		if err, ok := validatePeriods(periods).(*APIError); !ok || err.Status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %+v, got: %v", periods, err)
+		}
+	}
+}
+
+func TestPriceList(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(60)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+	w := s.request("GET", "/services", nil)
+	var services []Service
+	json.NewDecoder(w.Body).Decode(&services)
+	if w.Code != http.StatusOK || len(services) != 3 {
+		t.Fatalf("Services failed: %d %s", w.Code, w.Body)
+	}
+	codes := make(map[string]Service)
+	for _, service := range services {
+		codes[service.Code] = service
+	}
+	therapy, consultation := codes["therapy"], codes["consultation"]
+	if !therapy.Default || len(therapy.Prices) != 1 || !therapy.Prices[0].Amount.Equal(units(90)) {
+		t.Errorf("Unexpected default service: %+v", therapy)
+	}
+	if w := s.request("PATCH", "/services/"+therapy.Id.Hex(), map[string]interface{}{"name": "Therapy"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-admin, got: %d", w.Code)
+	}
+
+	// prices of the past, they cannot be changed any more
+	therapy.Prices = []PricePeriod{{Until: "2021-06-30", Amount: units(90)}, {From: "2021-07-01", Amount: units(100)}}
+	if err := app.Services.Update(ctx, therapy.Id, &therapy); err != nil {
+		t.Fatal(err)
+	}
+	consultation.Prices = []PricePeriod{{From: "2021-01-01", Amount: units(90)}}
+	if err := app.Services.Update(ctx, consultation.Id, &consultation); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	if w := admin.request("PATCH", "/services/"+therapy.Id.Hex(), map[string]interface{}{"default": false}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for no default service, got: %d", w.Code)
+	}
+	if w := admin.request("PUT", "/services", map[string]interface{}{"code": "therapy", "name": "Copy"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate code, got: %d", w.Code)
+	}
+
+	w = s.request("PUT", "/clients", map[string]interface{}{
+		"name": "Jan",
+		"prices": []ClientPrice{
+			{ServiceId: consultation.Id, PricePeriod: PricePeriod{From: "2021-06-15", Until: "2021-07-15", Amount: units(50)}},
+		},
+	})
+	var client Client
+	json.NewDecoder(w.Body).Decode(&client)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Client failed: %d %s", w.Code, w.Body)
+	}
+	if w := s.request("PATCH", "/clients/"+client.Id.Hex(), map[string]interface{}{
+		"prices": []ClientPrice{{ServiceId: therapy.Id}, {ServiceId: therapy.Id, PricePeriod: PricePeriod{From: "2021-01-01"}}},
+	}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for overlapping client prices, got: %d", w.Code)
+	}
+	started := ClientPrice{ServiceId: consultation.Id, PricePeriod: PricePeriod{From: "2021-06-15", Until: "2021-07-15", Amount: units(50)}}
+	for _, prices := range [][]ClientPrice{{}, {{ServiceId: consultation.Id, PricePeriod: PricePeriod{From: "2021-06-15", Until: "2021-07-15", Amount: units(60)}}}} {
+		if w := s.request("PATCH", "/clients/"+client.Id.Hex(), map[string]interface{}{"prices": prices}); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for a change of started client prices %+v, got: %d", prices, w.Code)
+		}
+	}
+	later := ClientPrice{ServiceId: therapy.Id, PricePeriod: PricePeriod{From: "2999-01-01", Amount: units(120)}}
+	if w := s.request("PATCH", "/clients/"+client.Id.Hex(), map[string]interface{}{"prices": []ClientPrice{started, later}}); w.Code != http.StatusOK {
+		t.Errorf("Expected a later client price to be added, got: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		date    string
+		service Service
+		price   int64
+	}{
+		{"2021-06-30 - 10:00", therapy, 90},
+		{"2021-07-01 - 10:00", therapy, 100},
+		{"2021-07-15 - 10:00", consultation, 50},
+		{"2021-07-16 - 10:00", consultation, 90},
+	}
+	var records []Record
+	for _, test := range tests {
+		w := s.request("PUT", "/records", map[string]interface{}{
+			"clientId":  client.Id.Hex(),
+			"date":      test.date,
+			"serviceId": test.service.Id.Hex(),
+		})
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		if w.Code != http.StatusOK || !record.Price.Equal(units(test.price)) || record.ServiceId != test.service.Id {
+			t.Errorf("%s %s: expected %d, got: %d %+v", test.date, test.service.Code, test.price, w.Code, record)
+		}
+		records = append(records, record)
+	}
+	w = s.request("PUT", "/records", map[string]interface{}{"clientId": client.Id.Hex(), "date": "2021-08-01 - 10:00"})
+	var record Record
+	json.NewDecoder(w.Body).Decode(&record)
+	if w.Code != http.StatusOK || record.ServiceId != therapy.Id {
+		t.Errorf("Expected the default service, got: %d %s", w.Code, w.Body)
+	}
+
+	// prices before the first one on the list are unknown
+	if w := s.request("PUT", "/records", map[string]interface{}{
+		"clientId":  client.Id.Hex(),
+		"date":      "2020-12-31 - 10:00",
+		"serviceId": consultation.Id.Hex(),
+	}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for no price, got: %d %s", w.Code, w.Body)
+	}
+
+	// prices in effect stay, a new one may follow them
+	today := time.Now().In(app.Location)
+	path := "/services/" + therapy.Id.Hex()
+	for _, prices := range [][]PricePeriod{
+		{{Until: "2021-06-30", Amount: units(95)}, {From: "2021-07-01", Amount: units(100)}},
+		{{Until: "2021-06-29", Amount: units(90)}, {From: "2021-07-01", Amount: units(100)}},
+		{{Until: "2021-06-30", Amount: units(90)}, {From: "2021-07-01", Until: today.AddDate(0, 0, -1).Format(ShortDateLayout), Amount: units(100)}},
+		{{Until: "2021-06-30", Amount: units(90)}, {From: "2021-07-01", Until: today.AddDate(0, 0, -2).Format(ShortDateLayout), Amount: units(100)},
+			{From: today.AddDate(0, 0, -1).Format(ShortDateLayout), Amount: units(110)}},
+	} {
+		if w := admin.request("PATCH", path, map[string]interface{}{"prices": prices}); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for changed prices %+v, got: %d %s", prices, w.Code, w.Body)
+		}
+	}
+	w = admin.request("PATCH", path, map[string]interface{}{"prices": []PricePeriod{
+		{Until: "2021-06-30", Amount: units(90)},
+		{From: "2021-07-01", Until: today.Format(ShortDateLayout), Amount: units(100)},
+		{From: today.AddDate(0, 0, 1).Format(ShortDateLayout), Amount: units(110)},
+	}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Adding a price failed: %d %s", w.Code, w.Body)
+	}
+
+	// records keep their amounts unless the session changes
+	changed, _ := app.Services.Get(ctx, therapy.Id)
+	changed.Prices[0].Amount = units(80)
+	app.Services.Update(ctx, changed.Id, changed)
+	path = "/records/" + records[0].Id.Hex()
+	for _, test := range []struct {
+		change map[string]interface{}
+		price  int64
+	}{
+		{map[string]interface{}{"homeVisit": true}, 90},
+		{map[string]interface{}{"duration": 30}, 40},
+	} {
+		w := s.request("PATCH", path, test.change)
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		if w.Code != http.StatusOK || !record.Price.Equal(units(test.price)) {
+			t.Errorf("%v: expected %d, got: %d %s", test.change, test.price, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMigrateClientPrices(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	client := Client{Name: "Jan", LegacySpecialPrice: 70}
+	app.Clients.Insert(ctx, &client)
+
+	if err := app.MigrateClientPrices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	migrated, _ := app.Clients.Get(ctx, client.Id)
+	if migrated.LegacySpecialPrice != 0 || len(migrated.Prices) != 1 || !migrated.Prices[0].Amount.Equal(units(70)) {
+		t.Fatalf("Unexpected migration: %+v", migrated)
+	}
+	price, err := servicePrice(ctx, migrated, migrated.Prices[0].ServiceId, primitive.NewDateTimeFromTime(time.Now()))
+	if err != nil || !price.Equal(units(70)) {
+		t.Errorf("Expected the special price, got: %s %v", price, err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rateMinutes is the length of a session which prices and hourly rates are given for.
+const rateMinutes = 60
+
+// prorate scales an amount given per rateMinutes to the duration, rounded to minor units.
+func prorate(amount Money, minutes int) Money {
+	return amount.Scale(int64(minutes), rateMinutes)
+}
+
+// resolveAmount decides between the computed amount and the one set by hand. An
+// amount differing from the previous one is a manual override, unless it equals
+// the computed one. Overrides are kept until cleared by resetting the flag.
+func resolveAmount(value Money, overridden bool, previous Money, previousOverridden bool, computed Money) (Money, bool) {
+	switch {
+	case !value.Equal(previous):
+		return value, !value.Equal(computed)
+	case previousOverridden && overridden:
+		return previous, true
+	default:
+		return computed, false
+	}
+}
+
+func invalidRecord(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-record", Message: message}
+}
+
+// End of the session.
+func (r *Record) End() primitive.DateTime {
+	return primitive.NewDateTimeFromTime(r.Date.Time().Add(time.Duration(r.Duration) * time.Minute))
+}
+
+// Hours of the session.
+func (r *Record) Hours() float64 {
+	return float64(r.Duration) / 60
+}
+
+// repriced tells whether the session changed in what its price depends on.
+func (r *Record) repriced(stored *Record) bool {
+	return r.Date != stored.Date || r.Duration != stored.Duration || r.ClientId != stored.ClientId ||
+		r.ServiceId != stored.ServiceId || r.PackageId != stored.PackageId
+}
+
+// applyRates computes Price and EmployeeIncome of the record from the price
+// of its service for the client, prorated by the duration, and the employee's
+// compensation rule, both in effect on the date of the record. Amounts set by hand are kept and flagged, stored is nil for new records.
+// Computed amounts of stored records change only with the session, not with later rates.
+func (r *Record) applyRates(ctx context.Context, stored *Record) error {
+	if r.Duration <= 0 {
+		return invalidRecord("Duration of the session has to be positive")
+	}
+	employee, err := app.Employees.Get(ctx, r.EmployeeId)
+	if err != nil {
+		return err
+	}
+	client, err := app.Clients.Get(ctx, r.ClientId)
+	if err != nil {
+		return err
+	}
+	if r.ServiceId.IsZero() && !r.PackageId.IsZero() {
+		// sessions paid with a package are of its service
+		if p, err := app.Packages.Get(ctx, r.PackageId); err == nil {
+			r.ServiceId = p.ServiceId
+		}
+	}
+	if r.ServiceId.IsZero() {
+		service, err := defaultService(ctx)
+		if err != nil {
+			return err
+		}
+		r.ServiceId = service.Id
+	}
+	// zero amounts of new records are computed
+	previous := Record{}
+	if stored != nil {
+		previous = *stored
+	}
+
+	var price Money
+	if stored != nil && !stored.PriceOverridden && !r.repriced(stored) {
+		price = stored.Price
+	} else if r.PackageId.IsZero() {
+		if price, err = servicePrice(ctx, client, r.ServiceId, r.Date); err != nil {
+			return err
+		}
+		price = prorate(price, r.Duration)
+	} else {
+		// the client has paid for the session already
+		p, err := recordPackage(ctx, r)
+		if err != nil {
+			return err
+		}
+		price = p.SessionPrice()
+	}
+	if stored == nil {
+		previous.Price = price
+		if r.Price.IsZero() {
+			r.Price = price
+		}
+	}
+	r.Price, r.PriceOverridden = resolveAmount(r.Price, r.PriceOverridden, previous.Price, previous.PriceOverridden, price)
+
+	// the income may depend on the price
+	var income Money
+	if stored != nil && !stored.IncomeOverridden && !r.repriced(stored) &&
+		r.EmployeeId == stored.EmployeeId && r.HomeVisit == stored.HomeVisit && r.Price.Equal(stored.Price) {
+		income = stored.EmployeeIncome
+	} else {
+		ordinal, err := monthOrdinal(ctx, r)
+		if err != nil {
+			return err
+		}
+		income = employee.CompensationRule(r.Date).Income(r, ordinal)
+	}
+	if stored == nil {
+		previous.EmployeeIncome = income
+		if r.EmployeeIncome.IsZero() {
+			r.EmployeeIncome = income
+		}
+	}
+	r.EmployeeIncome, r.IncomeOverridden = resolveAmount(r.EmployeeIncome, r.IncomeOverridden, previous.EmployeeIncome, previous.IncomeOverridden, income)
+	return nil
+}
+
+// MigrateRecordDurations gives records stored before durations were tracked the default one.
+func (app *App) MigrateRecordDurations(ctx context.Context) error {
+	records, err := app.Records.List(ctx, RecordFilter{MissingDuration: true})
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	clients, employees, err := loadNameMaps(ctx)
+	if err != nil {
+		return err
+	}
+	service, err := defaultService(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		// amounts were entered by hand then, the ones differing from the rates stay as they are
+		client, employee := clients[record.ClientId], employees[record.EmployeeId]
+		record.Duration = defaultDuration
+		record.ServiceId = service.Id
+		price, err := servicePrice(ctx, &client, service.Id, record.Date)
+		if _, invalid := err.(*APIError); err != nil && !invalid {
+			return err
+		}
+		record.PriceOverridden = err != nil || !record.Price.Equal(prorate(price, record.Duration))
+		record.IncomeOverridden = !record.EmployeeIncome.Equal(prorate(employee.HourlyNet, record.Duration))
+		if err = app.Records.Update(ctx, record.Id, &record); err != nil {
+			return err
+		}
+	}
+	log.Printf("Set the default duration of %d records.", len(records))
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResolveAmount(t *testing.T) {
+	setupTestApp(t)
+	tests := []struct {
+		value              int64
+		overridden         bool
+		previous           int64
+		previousOverridden bool
+		computed           int64
+		expected           int64
+		expectedOverridden bool
+	}{
+		{90, false, 90, false, 90, 90, false},    // nothing changed
+		{90, false, 90, false, 135, 135, false},  // recomputed, e.g. for a longer session
+		{100, false, 90, false, 90, 100, true},   // set by hand
+		{90, false, 100, true, 90, 90, false},    // set back to the computed amount
+		{100, true, 100, true, 135, 100, true},   // kept
+		{100, false, 100, true, 135, 135, false}, // override cleared
+	}
+	for _, test := range tests {
+		value, overridden := resolveAmount(units(test.value), test.overridden, units(test.previous), test.previousOverridden, units(test.computed))
+		if !value.Equal(units(test.expected)) || overridden != test.expectedOverridden {
+			t.Errorf("%+v: got %s %v", test, value, overridden)
+		}
+	}
+}
+
+func TestRecordRates(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(60)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan", Prices: specialPrice(t, 80)}
+	app.Clients.Insert(ctx, &client)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+
+	date := time.Now().In(app.Location).Format(DateTimeLayout)
+	earlier := time.Now().Add(-3 * time.Hour).In(app.Location).Format(DateTimeLayout)
+	save := func(method, path string, body map[string]interface{}) Record {
+		w := s.request(method, path, body)
+		var record Record
+		json.NewDecoder(w.Body).Decode(&record)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s failed: %d %s", method, path, w.Code, w.Body)
+		}
+		return record
+	}
+	check := func(record Record, price, income int64, priceOverridden, incomeOverridden bool) {
+		t.Helper()
+		if !record.Price.Equal(units(price)) || !record.EmployeeIncome.Equal(units(income)) || record.PriceOverridden != priceOverridden || record.IncomeOverridden != incomeOverridden {
+			t.Errorf("Expected %d%s/%d%s, got: %+v", price, map[bool]string{true: "*"}[priceOverridden],
+				income, map[bool]string{true: "*"}[incomeOverridden], record)
+		}
+	}
+
+	computed := save("PUT", "/records", map[string]interface{}{"clientId": client.Id.Hex(), "date": date, "duration": 45})
+	check(computed, 60, 45, false, false)
+	manual := save("PUT", "/records", map[string]interface{}{"clientId": client.Id.Hex(), "date": earlier, "price": 100})
+	check(manual, 100, 60, true, false)
+	if manual.Duration != defaultDuration {
+		t.Errorf("Expected the default duration, got: %d", manual.Duration)
+	}
+
+	computed = save("PATCH", "/records/"+computed.Id.Hex(), map[string]interface{}{"duration": 90, "price": 60})
+	check(computed, 120, 90, false, false)
+	manual = save("PATCH", "/records/"+manual.Id.Hex(), map[string]interface{}{"duration": 30})
+	check(manual, 100, 30, true, false)
+	manual = save("PATCH", "/records/"+manual.Id.Hex(), map[string]interface{}{"priceOverridden": false})
+	check(manual, 40, 30, false, false)
+
+	if w := s.request("PATCH", "/records/"+manual.Id.Hex(), map[string]interface{}{"duration": 0}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for no duration, got: %d", w.Code)
+	}
+
+	w := s.request("GET", "/reports/hours", nil)
+	var summaries []HoursSummary
+	json.NewDecoder(w.Body).Decode(&summaries)
+	if w.Code != http.StatusOK || len(summaries) != 1 {
+		t.Fatalf("Hours failed: %d %s", w.Code, w.Body)
+	}
+	if summary := summaries[0]; summary.Sessions != 2 || summary.Minutes != 120 || summary.Hours != 2 || !summary.Income.Equal(units(120)) {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+func TestMigrateRecordDurations(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	employee := Employee{Name: "Therapist", HourlyNet: units(50)}
+	app.Employees.Insert(ctx, &employee)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	record := Record{EmployeeId: employee.Id, ClientId: client.Id, Price: units(90), EmployeeIncome: units(45)}
+	app.Records.Insert(ctx, &record)
+
+	if err := app.MigrateRecordDurations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	migrated, _ := app.Records.Get(ctx, record.Id)
+	if migrated.Duration != defaultDuration || migrated.PriceOverridden || !migrated.IncomeOverridden {
+		t.Errorf("Unexpected migration: %+v", migrated)
+	}
+}
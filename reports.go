@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// HoursSummary sums up the sessions of an employee.
+type HoursSummary struct {
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	Name       string             `json:"name"`
+	Sessions   int                `json:"sessions"`
+	Minutes    int                `json:"minutes"`
+	Hours      float64            `json:"hours"`
+	Income     Money              `json:"income"`
+}
+
+// SummarizeHours sums up the records per employee, sorted by name.
+func SummarizeHours(records []Record, employees map[primitive.ObjectID]Employee) []HoursSummary {
+	byEmployee := make(map[primitive.ObjectID]*HoursSummary)
+	summaries := []HoursSummary{}
+	for _, record := range records {
+		summary, ok := byEmployee[record.EmployeeId]
+		if !ok {
+			summary = &HoursSummary{EmployeeId: record.EmployeeId, Name: employees[record.EmployeeId].Name}
+			byEmployee[record.EmployeeId] = summary
+		}
+		summary.Sessions++
+		summary.Minutes += record.Duration
+		summary.Income = summary.Income.Add(record.EmployeeIncome)
+	}
+	for _, summary := range byEmployee {
+		summary.Hours = float64(summary.Minutes) / 60
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// showHours reports hours worked per employee, filtered like the records
+// listing. Employees other than admins see only their own hours.
+func showHours(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var records []Record
+	var employees map[primitive.ObjectID]Employee
+	filter, err := ParseRecordFilter(r.URL.Query())
+	if err == nil {
+		filter.After, filter.Limit = nil, 0
+		if !e.Admin {
+			filter.EmployeeId = e.Id
+		}
+		records, err = app.Records.List(ctx, filter)
+	}
+	if err == nil {
+		_, employees, err = loadNameMaps(ctx)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(SummarizeHours(records, employees))
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Period is the length of the buckets of the revenue report. Buckets are
+// computed in app.Location, weeks are ISO weeks starting on Monday.
+type Period string
+
+const (
+	Day   Period = "day"
+	Week  Period = "week"
+	Month Period = "month"
+	Year  Period = "year"
+)
+
+func ParsePeriod(value string) (Period, error) {
+	switch period := Period(value); period {
+	case Day, Week, Month, Year:
+		return period, nil
+	}
+	return "", fmt.Errorf("expected day, week, month or year")
+}
+
+// mongoFormat formats dates like key, for $dateToString.
+func (p Period) mongoFormat() string {
+	switch p {
+	case Day:
+		return "%Y-%m-%d"
+	case Week:
+		return "%G-W%V"
+	case Year:
+		return "%Y"
+	}
+	return "%Y-%m"
+}
+
+// key names the period which includes t, e.g. "2021-03" or "2021-W09".
+func (p Period) key(t time.Time) string {
+	t = t.In(app.Location)
+	switch p {
+	case Day:
+		return t.Format(ShortDateLayout)
+	case Week:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case Year:
+		return t.Format("2006")
+	}
+	return t.Format("2006-01")
+}
+
+// start of the period which includes t.
+func (p Period) start(t time.Time) time.Time {
+	t = t.In(app.Location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, app.Location)
+	switch p {
+	case Week:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case Month:
+		return day.AddDate(0, 0, 1-day.Day())
+	case Year:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, app.Location)
+	}
+	return day
+}
+
+// add moves the start of a period by n periods.
+func (p Period) add(t time.Time, n int) time.Time {
+	switch p {
+	case Week:
+		return t.AddDate(0, 0, 7*n)
+	case Month:
+		return t.AddDate(0, n, 0)
+	case Year:
+		return t.AddDate(n, 0, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+// RevenueGrouping tells how RecordStore.Revenue groups the records.
+type RevenueGrouping struct {
+	Period     Period
+	ByEmployee bool
+	ByClient   bool
+}
+
+// RevenueBucket sums up the records of a period, of an employee or a client
+// when grouped by them.
+type RevenueBucket struct {
+	Period     string
+	EmployeeId primitive.ObjectID
+	ClientId   primitive.ObjectID
+	Sessions   int
+	Revenue    Money // sum of prices
+	Income     Money // sum of employee incomes
+}
+
+// RevenueFigures of a row or of the whole report. Margin is what the clinic
+// keeps of the revenue after paying the employees.
+type RevenueFigures struct {
+	Sessions int   `json:"sessions"`
+	Revenue  Money `json:"revenue"`
+	Income   Money `json:"income"`
+	Margin   Money `json:"margin"`
+}
+
+func (f *RevenueFigures) add(b *RevenueBucket) {
+	f.Sessions += b.Sessions
+	f.Revenue = f.Revenue.Add(b.Revenue)
+	f.Income = f.Income.Add(b.Income)
+	f.Margin = f.Revenue.Sub(f.Income)
+}
+
+func zeroFigures() RevenueFigures {
+	return RevenueFigures{Revenue: NewMoney(0), Income: NewMoney(0), Margin: NewMoney(0)}
+}
+
+// RevenueRow is a period of the report, of an employee or a client when grouped by them.
+type RevenueRow struct {
+	Period       string             `json:"period"`
+	EmployeeId   primitive.ObjectID `json:"employeeId,omitempty"`
+	EmployeeName string             `json:"employeeName,omitempty"`
+	ClientId     primitive.ObjectID `json:"clientId,omitempty"`
+	ClientName   string             `json:"clientName,omitempty"`
+	RevenueFigures
+	// PreviousPeriod is compared with the period, when the report compares periods.
+	PreviousPeriod string          `json:"previousPeriod,omitempty"`
+	Previous       *RevenueFigures `json:"previous,omitempty"`
+	// Change of the revenue in percent, nil when there was no revenue to compare with.
+	Change *float64 `json:"change,omitempty"`
+}
+
+// RevenueReport sums up revenue per period between From and To, which are
+// extended to whole periods.
+type RevenueReport struct {
+	Period  Period         `json:"period"`
+	From    string         `json:"from"`
+	To      string         `json:"to"` // inclusive
+	Compare string         `json:"compare,omitempty"`
+	Rows    []RevenueRow   `json:"rows"`
+	Total   RevenueFigures `json:"total"`
+	// PreviousTotal of the range compared with.
+	PreviousTotal *RevenueFigures `json:"previousTotal,omitempty"`
+}
+
+// RevenueRequest describes the report, zero ids do not filter.
+type RevenueRequest struct {
+	RevenueGrouping
+	From, To   time.Time // days, To inclusive
+	EmployeeId primitive.ObjectID
+	ClientId   primitive.ObjectID
+	// Compare with the previous range of the same length, "previous", or with
+	// the same range a year before, "year".
+	Compare string
+}
+
+type revenueKey struct {
+	index      int // of the period within the range
+	employeeId primitive.ObjectID
+	clientId   primitive.ObjectID
+}
+
+// revenueBuckets loads the buckets of count periods from start, keyed by the index of their period.
+func revenueBuckets(ctx context.Context, request *RevenueRequest, start time.Time, count int) (map[revenueKey]*RevenueBucket, []string, error) {
+	keys := make([]string, count)
+	index := make(map[string]int)
+	for i := range keys {
+		keys[i] = request.Period.key(request.Period.add(start, i))
+		index[keys[i]] = i
+	}
+	filter := RecordFilter{EmployeeId: request.EmployeeId, ClientId: request.ClientId, From: start, To: request.Period.add(start, count)}
+	buckets, err := app.Records.Revenue(ctx, filter, request.RevenueGrouping)
+	if err != nil {
+		return nil, nil, err
+	}
+	byKey := make(map[revenueKey]*RevenueBucket)
+	for i := range buckets {
+		b := &buckets[i]
+		if i, ok := index[b.Period]; ok {
+			byKey[revenueKey{i, b.EmployeeId, b.ClientId}] = b
+		}
+	}
+	return byKey, keys, nil
+}
+
+// Revenue makes the report, comparing periods with the same periods of the range compared with.
+func Revenue(ctx context.Context, request RevenueRequest) (*RevenueReport, error) {
+	p := request.Period
+	start := p.start(request.From)
+	end := p.start(request.To)
+	count := 0
+	for t := start; !t.After(end); t = p.add(start, count) {
+		count++
+	}
+	current, keys, err := revenueBuckets(ctx, &request, start, count)
+	if err != nil {
+		return nil, err
+	}
+	report := &RevenueReport{
+		Period:  p,
+		From:    start.Format(ShortDateLayout),
+		To:      p.add(start, count).AddDate(0, 0, -1).Format(ShortDateLayout),
+		Compare: request.Compare,
+		Rows:    []RevenueRow{},
+		Total:   zeroFigures(),
+	}
+
+	var previous map[revenueKey]*RevenueBucket
+	var previousKeys []string
+	switch request.Compare {
+	case "":
+	case "previous":
+		previous, previousKeys, err = revenueBuckets(ctx, &request, p.add(start, -count), count)
+	case "year":
+		yearAgo := start.AddDate(-1, 0, 0)
+		if p == Week {
+			// the same weeks of the year before start on Mondays too
+			yearAgo = start.AddDate(0, 0, -52*7)
+		}
+		previous, previousKeys, err = revenueBuckets(ctx, &request, yearAgo, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// rows of periods without sessions are kept when not grouped, for charts
+	rows := make(map[revenueKey]bool)
+	if !request.ByEmployee && !request.ByClient {
+		for i := range keys {
+			rows[revenueKey{index: i}] = true
+		}
+	}
+	for key := range current {
+		rows[key] = true
+	}
+	for key := range previous {
+		rows[key] = true
+	}
+	clients, employees, err := loadNameMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		total := zeroFigures()
+		report.PreviousTotal = &total
+	}
+	for key := range rows {
+		row := RevenueRow{
+			Period:         keys[key.index],
+			EmployeeId:     key.employeeId,
+			EmployeeName:   employees[key.employeeId].Name,
+			ClientId:       key.clientId,
+			ClientName:     clients[key.clientId].Name,
+			RevenueFigures: zeroFigures(),
+		}
+		if b := current[key]; b != nil {
+			row.add(b)
+			report.Total.add(b)
+		}
+		if previous != nil {
+			figures := zeroFigures()
+			if b := previous[key]; b != nil {
+				figures.add(b)
+				report.PreviousTotal.add(b)
+			}
+			row.PreviousPeriod, row.Previous = previousKeys[key.index], &figures
+			if !figures.Revenue.IsZero() {
+				change := float64(row.Revenue.Amount-figures.Revenue.Amount) * 100 / float64(figures.Revenue.Amount)
+				row.Change = &change
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		a, b := report.Rows[i], report.Rows[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if a.EmployeeName != b.EmployeeName {
+			return a.EmployeeName < b.EmployeeName
+		}
+		return a.ClientName < b.ClientName
+	})
+	return report, nil
+}
+
+// maxRevenuePeriods keeps reports by day within a few years.
+const maxRevenuePeriods = 1000
+
+// ParseRevenueRequest reads the parameters of the report: period, from, to,
+// employee, client, groupBy (employee, client or both separated by a comma)
+// and compare. It reports the current year by month by default.
+func ParseRevenueRequest(query map[string][]string) (RevenueRequest, error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	now := time.Now().In(app.Location)
+	request := RevenueRequest{
+		RevenueGrouping: RevenueGrouping{Period: Month},
+		From:            time.Date(now.Year(), 1, 1, 0, 0, 0, 0, app.Location),
+		To:              now,
+		Compare:         get("compare"),
+	}
+	if request.Compare != "" && request.Compare != "previous" && request.Compare != "year" {
+		return request, invalidParameter("compare", fmt.Errorf("expected previous or year"))
+	}
+	var err error
+	if value := get("period"); value != "" {
+		if request.Period, err = ParsePeriod(value); err != nil {
+			return request, invalidParameter("period", err)
+		}
+	}
+	for name, day := range map[string]*time.Time{"from": &request.From, "to": &request.To} {
+		if value := get(name); value != "" {
+			if *day, err = time.ParseInLocation(ShortDateLayout, value, app.Location); err != nil {
+				return request, invalidParameter(name, err)
+			}
+		}
+	}
+	if request.To.Before(request.From) {
+		return request, invalidParameter("to", fmt.Errorf("before from"))
+	}
+	if request.Period == Day && request.To.Sub(request.From) > maxRevenuePeriods*24*time.Hour {
+		return request, invalidParameter("to", fmt.Errorf("at most %d days can be reported by day", maxRevenuePeriods))
+	}
+	for name, id := range map[string]*primitive.ObjectID{"employee": &request.EmployeeId, "client": &request.ClientId} {
+		if value := get(name); value != "" {
+			if *id, err = primitive.ObjectIDFromHex(value); err != nil {
+				return request, invalidParameter(name, err)
+			}
+		}
+	}
+	if value := get("groupBy"); value != "" {
+		for _, dimension := range strings.Split(value, ",") {
+			switch strings.TrimSpace(dimension) {
+			case "employee":
+				request.ByEmployee = true
+			case "client":
+				request.ByClient = true
+			default:
+				return request, invalidParameter("groupBy", fmt.Errorf("expected employee or client"))
+			}
+		}
+	}
+	return request, nil
+}
+
+// showRevenue reports revenue, employee income and the margin of the clinic per period.
+func showRevenue(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var report *RevenueReport
+	request, err := ParseRevenueRequest(r.URL.Query())
+	if err == nil {
+		report, err = Revenue(ctx, request)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
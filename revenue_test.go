@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPeriods(t *testing.T) {
+	setupTestApp(t)
+	sunday := time.Date(2021, 1, 3, 23, 30, 0, 0, app.Location)
+	if key := Week.key(sunday); key != "2020-W53" {
+		t.Errorf("Expected the ISO week, got: %s", key)
+	}
+	if start := Week.start(sunday); start.Format(ShortDateLayout) != "2020-12-28" {
+		t.Errorf("Expected the week to start on Monday, got: %s", start)
+	}
+	// 00:30 in Warsaw is still the previous month in UTC
+	if key := Month.key(time.Date(2021, 4, 1, 0, 30, 0, 0, app.Location)); key != "2021-04" {
+		t.Errorf("Expected the month in the clinic timezone, got: %s", key)
+	}
+}
+
+func TestRevenue(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	alice := Employee{Name: "Alice"}
+	app.Employees.Insert(ctx, &alice)
+	bob := Employee{Name: "Bob"}
+	app.Employees.Insert(ctx, &bob)
+	client := Client{Name: "Jan"}
+	app.Clients.Insert(ctx, &client)
+	at := func(month time.Month, day, hour, minute int) primitive.DateTime {
+		return primitive.NewDateTimeFromTime(time.Date(2021, month, day, hour, minute, 0, 0, app.Location))
+	}
+	for _, record := range []Record{
+		{EmployeeId: alice.Id, ClientId: client.Id, Date: at(2, 10, 10, 0), Price: units(80), EmployeeIncome: units(40)},
+		{EmployeeId: alice.Id, ClientId: client.Id, Date: at(3, 31, 23, 30), Price: units(100), EmployeeIncome: units(60)},
+		{EmployeeId: bob.Id, ClientId: client.Id, Date: at(4, 1, 0, 30), Price: units(90), EmployeeIncome: units(50)},
+	} {
+		app.Records.Insert(ctx, &record)
+	}
+
+	admin := newTestSession(t)
+	admin.login("admin", "1234")
+	get := func(query string) (RevenueReport, int) {
+		w := admin.request("GET", "/reports/revenue?"+query, nil)
+		var report RevenueReport
+		json.NewDecoder(w.Body).Decode(&report)
+		return report, w.Code
+	}
+	report, code := get("from=2021-03-15&to=2021-04-10&compare=previous")
+	if code != http.StatusOK || report.From != "2021-03-01" || report.To != "2021-04-30" || len(report.Rows) != 2 {
+		t.Fatalf("Unexpected report: %d %+v", code, report)
+	}
+	march := report.Rows[0]
+	if march.Period != "2021-03" || march.Sessions != 1 || !march.Revenue.Equal(units(100)) || !march.Margin.Equal(units(40)) {
+		t.Errorf("Unexpected March: %+v", march)
+	}
+	if march.PreviousPeriod != "2021-01" || march.Previous == nil || march.Previous.Sessions != 0 || march.Change != nil {
+		t.Errorf("Expected March to be compared with January, got: %+v", march)
+	}
+	if april := report.Rows[1]; april.PreviousPeriod != "2021-02" || april.Change == nil || *april.Change != 12.5 {
+		t.Errorf("Expected April to be compared with February, got: %+v", april)
+	}
+	if !report.Total.Revenue.Equal(units(190)) || report.PreviousTotal == nil || !report.PreviousTotal.Revenue.Equal(units(80)) {
+		t.Errorf("Unexpected totals: %+v %+v", report.Total, report.PreviousTotal)
+	}
+
+	report, _ = get("period=year&from=2021-01-01&to=2021-12-31&groupBy=employee")
+	if len(report.Rows) != 2 || report.Rows[0].EmployeeName != "Alice" || report.Rows[0].Sessions != 2 || report.Rows[1].EmployeeName != "Bob" {
+		t.Errorf("Unexpected rows by employee: %+v", report.Rows)
+	}
+	report, _ = get("period=day&from=2021-03-31&to=2021-04-01&employee=" + bob.Id.Hex())
+	if len(report.Rows) != 2 || report.Rows[0].Sessions != 0 || report.Rows[1].Period != "2021-04-01" || report.Rows[1].Sessions != 1 {
+		t.Errorf("Unexpected days: %+v", report.Rows)
+	}
+
+	for _, query := range []string{"period=quarter", "groupBy=service", "compare=last", "from=2021-05-01&to=2021-04-01"} {
+		if _, code := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got: %d", query, code)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var polishLetters = strings.NewReplacer(
+	"ą", "a", "ć", "c", "ę", "e", "ł", "l", "ń", "n", "ó", "o", "ś", "s", "ź", "z", "ż", "z",
+)
+
+// FoldText lower-cases the text and strips Polish diacritics, so that
+// "Łukasz Żółć" is found by typing "lukasz zolc".
+func FoldText(s string) string {
+	return polishLetters.Replace(strings.ToLower(strings.TrimSpace(s)))
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// SearchTerms splits a query into folded terms, each of them has to prefix-match one of the keywords.
+func SearchTerms(q string) []string {
+	return strings.Fields(FoldText(q))
+}
+
+// updateSearchFields derives the fields used to search and sort clients.
+// Stores call it whenever a client is written.
+func (c *Client) updateSearchFields() {
+	c.SortName = FoldText(c.Name)
+	keywords := make(map[string]bool)
+	add := func(words ...string) {
+		for _, word := range words {
+			if word != "" {
+				keywords[word] = true
+			}
+		}
+	}
+	add(strings.Fields(c.SortName)...)
+	add(strings.Fields(FoldText(c.Address.City))...)
+	add(FoldText(c.Email), FoldText(c.Address.PostCode), digitsOnly(c.Address.PostCode))
+	tel := digitsOnly(c.Tel)
+	add(tel)
+	if strings.HasPrefix(tel, "48") && len(tel) == 11 {
+		add(tel[2:]) // without the country code
+	}
+	c.Keywords = make([]string, 0, len(keywords))
+	for keyword := range keywords {
+		c.Keywords = append(c.Keywords, keyword)
+	}
+	sort.Strings(c.Keywords)
+}
+
+// MigrateClientSearchFields fills the search fields of clients stored by older versions of the application.
+func (app *App) MigrateClientSearchFields(ctx context.Context) error {
+	clients, err := app.Clients.List(ctx, ClientFilter{Archived: AllClients})
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		if client.Keywords != nil {
+			continue
+		}
+		if err = app.Clients.Update(ctx, client.Id, &client); err != nil {
+			return err
+		}
+		log.Printf("Indexed client for search: %s.", client.Name)
+	}
+	return nil
+}
+
+// matchesTerms tells whether every term prefix-matches some keyword of the client.
+func (c *Client) matchesTerms(terms []string) bool {
+	for _, term := range terms {
+		found := false
+		for _, keyword := range c.Keywords {
+			if strings.HasPrefix(keyword, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Recurrence is the supported subset of RFC 5545 recurrence rules:
+// FREQ=WEEKLY with an optional INTERVAL and either COUNT or UNTIL.
+type Recurrence struct {
+	Interval int       // in weeks, 1 for weekly, 2 for biweekly
+	Count    int       // number of occurrences, skipped ones included
+	Until    time.Time // day of the last possible occurrence
+}
+
+const rruleUntilLayout = "20060102"
+
+func ParseRRule(rule string) (Recurrence, error) {
+	rec := Recurrence{Interval: 1}
+	weekly := false
+	for _, part := range strings.Split(strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return rec, fmt.Errorf("malformed rule part %q", part)
+		}
+		var err error
+		switch kv[0] {
+		case "FREQ":
+			if kv[1] != "WEEKLY" {
+				return rec, fmt.Errorf("only weekly rules are supported")
+			}
+			weekly = true
+		case "INTERVAL":
+			if rec.Interval, err = strconv.Atoi(kv[1]); err != nil || rec.Interval < 1 {
+				return rec, fmt.Errorf("invalid interval %q", kv[1])
+			}
+		case "COUNT":
+			if rec.Count, err = strconv.Atoi(kv[1]); err != nil || rec.Count < 1 {
+				return rec, fmt.Errorf("invalid count %q", kv[1])
+			}
+		case "UNTIL":
+			value := kv[1]
+			if len(value) > len(rruleUntilLayout) {
+				value = value[:len(rruleUntilLayout)] // the time of day is ignored
+			}
+			if rec.Until, err = time.ParseInLocation(rruleUntilLayout, value, app.Location); err != nil {
+				return rec, fmt.Errorf("invalid until %q", kv[1])
+			}
+		default:
+			return rec, fmt.Errorf("unsupported rule part %s", kv[0])
+		}
+	}
+	if !weekly {
+		return rec, fmt.Errorf("FREQ=WEEKLY is required")
+	}
+	if rec.Count > 0 && !rec.Until.IsZero() {
+		return rec, fmt.Errorf("COUNT and UNTIL cannot be combined")
+	}
+	return rec, nil
+}
+
+func (rec Recurrence) String() string {
+	rule := "FREQ=WEEKLY"
+	if rec.Interval > 1 {
+		rule += fmt.Sprintf(";INTERVAL=%d", rec.Interval)
+	}
+	if rec.Count > 0 {
+		rule += fmt.Sprintf(";COUNT=%d", rec.Count)
+	}
+	if !rec.Until.IsZero() {
+		rule += ";UNTIL=" + rec.Until.Format(rruleUntilLayout)
+	}
+	return rule
+}
+
+// Series describes appointments repeated at the same weekday and hour.
+// Occurrences are not stored, they are expanded on demand. Only the ones
+// which were changed, cancelled or completed are stored as appointments.
+type Series struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EmployeeId primitive.ObjectID `json:"employeeId"`
+	ClientId   primitive.ObjectID `json:"clientId"`
+	Start      primitive.DateTime `json:"start"` // the first occurrence
+	Duration   int                `json:"duration"`
+	Room       string             `json:"room"`
+	RRule      string             `json:"rrule"`
+	SkipDates  []string           `json:"skipDates"` // days without an occurrence, e.g. holidays
+	Override   *ConflictOverride  `json:"override,omitempty" bson:"override,omitempty"`
+	Version    int64              `json:"version"`
+}
+
+func (s *Series) MarshalJSON() ([]byte, error) {
+	type Alias Series
+	return json.Marshal(&struct {
+		Start string `json:"start"`
+		*Alias
+	}{
+		Start: MarshalDate(s.Start, DateTimeLayout),
+		Alias: (*Alias)(s),
+	})
+}
+
+// UnmarshalJSON leaves the start untouched when missing in data, see Client.UnmarshalJSON.
+func (s *Series) UnmarshalJSON(data []byte) error {
+	type Alias Series
+	aux := &struct {
+		Start *string `json:"start"`
+		*Alias
+	}{
+		Alias: (*Alias)(s),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Start != nil {
+		if err := UnmarshalDate(*aux.Start, &s.Start, DateTimeLayout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Series) recurrence() Recurrence {
+	rec, err := ParseRRule(s.RRule)
+	if err != nil {
+		// rules are validated before they are stored
+		return Recurrence{Interval: 1, Count: 1}
+	}
+	return rec
+}
+
+// occurrence returns the start of the i-th occurrence, at the same wall
+// clock time also across DST changes.
+func (s *Series) occurrence(i int, rec Recurrence) time.Time {
+	return s.Start.Time().In(app.Location).AddDate(0, 0, 7*rec.Interval*i)
+}
+
+func (s *Series) skipped(day string) bool {
+	for _, skip := range s.SkipDates {
+		if skip == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Occurrences returns starts of the occurrences in [from, to).
+func (s *Series) Occurrences(from, to time.Time) []time.Time {
+	rec := s.recurrence()
+	period := time.Duration(7*rec.Interval) * 24 * time.Hour
+	i := 0
+	if first := s.Start.Time(); from.After(first) {
+		// jump close to from, one period earlier to be safe around DST changes
+		if i = int(from.Sub(first)/period) - 1; i < 0 {
+			i = 0
+		}
+	}
+	var starts []time.Time
+	for ; rec.Count == 0 || i < rec.Count; i++ {
+		start := s.occurrence(i, rec)
+		if !start.Before(to) || (!rec.Until.IsZero() && !start.Before(rec.Until.AddDate(0, 0, 1))) {
+			break
+		}
+		if start.Before(from) || s.skipped(start.Format(ShortDateLayout)) {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// find returns the index and the start of the occurrence on the day.
+func (s *Series) find(day string) (int, time.Time, bool) {
+	date, err := time.ParseInLocation(ShortDateLayout, day, app.Location)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	starts := s.Occurrences(date, date.AddDate(0, 0, 1))
+	if len(starts) == 0 {
+		return 0, time.Time{}, false
+	}
+	rec := s.recurrence()
+	first := s.Start.Time().In(app.Location)
+	days := starts[0].Sub(first).Hours() / 24
+	return int(days+0.5) / (7 * rec.Interval), starts[0], true
+}
+
+// Appointment returns the occurrence starting at start as a not stored appointment.
+func (s *Series) Appointment(start time.Time) Appointment {
+	return Appointment{
+		EmployeeId: s.EmployeeId,
+		ClientId:   s.ClientId,
+		Start:      primitive.NewDateTimeFromTime(start),
+		Duration:   s.Duration,
+		Room:       s.Room,
+		Status:     Planned,
+		SeriesId:   s.Id,
+		Occurrence: start.In(app.Location).Format(ShortDateLayout),
+	}
+}
+
+func invalidSeries(message string) error {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "invalid-series", Message: message}
+}
+
+// validate checks the fields and the references of the series, stored is nil for new ones.
+func (s *Series) validate(ctx context.Context, stored *Series) error {
+	if s.Start == 0 {
+		return invalidSeries("Start of the series is required")
+	}
+	if s.Duration <= 0 {
+		return invalidSeries("Duration of the appointments has to be positive")
+	}
+	rec, err := ParseRRule(s.RRule)
+	if err != nil {
+		return invalidSeries("Invalid rule: " + err.Error())
+	}
+	s.RRule = rec.String()
+	for _, day := range s.SkipDates {
+		if _, err := time.ParseInLocation(ShortDateLayout, day, app.Location); err != nil {
+			return invalidSeries("Invalid skip date " + day)
+		}
+	}
+	if stored == nil || s.EmployeeId != stored.EmployeeId {
+		if _, err := activeEmployee(ctx, "employeeId", s.EmployeeId); err != nil {
+			return err
+		}
+	}
+	if stored == nil || s.ClientId != stored.ClientId {
+		if _, err := activeClient(ctx, "clientId", s.ClientId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func authorizeSeries(e *Employee, series *Series) error {
+	if e.Admin || series.EmployeeId == e.Id {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    "not-owner",
+		Message: "Series of other employees cannot be changed",
+	}
+}
+
+// ListAppointments returns stored appointments matching the filter together
+// with occurrences of series, which are expanded only for bounded ranges.
+func ListAppointments(ctx context.Context, filter AppointmentFilter) ([]Appointment, error) {
+	appointments, err := app.Appointments.List(ctx, filter)
+	if err != nil || filter.To.IsZero() {
+		return appointments, err
+	}
+	seriesList, err := app.Series.List(ctx, SeriesFilter{EmployeeId: filter.EmployeeId, ClientId: filter.ClientId, StartBefore: filter.To})
+	if err != nil {
+		return nil, err
+	}
+	for _, series := range seriesList {
+		// stored occurrences replace the expanded ones, even when moved out of the range
+		stored, err := app.Appointments.List(ctx, AppointmentFilter{SeriesId: series.Id})
+		if err != nil {
+			return nil, err
+		}
+		replaced := make(map[string]bool)
+		for _, appointment := range stored {
+			replaced[appointment.Occurrence] = true
+		}
+		for _, start := range series.Occurrences(filter.From, filter.To) {
+			if occurrence := series.Appointment(start); !replaced[occurrence.Occurrence] {
+				appointments = append(appointments, occurrence)
+			}
+		}
+	}
+	sort.SliceStable(appointments, func(i, j int) bool {
+		return appointments[i].Start < appointments[j].Start
+	})
+	if filter.Limit > 0 && int64(len(appointments)) > filter.Limit {
+		appointments = appointments[:filter.Limit]
+	}
+	return appointments, nil
+}
+
+// materialize returns the stored occurrence of the series on the day, storing it first if needed.
+func materialize(ctx context.Context, series *Series, day string) (*Appointment, error) {
+	stored, err := storedOccurrence(ctx, series.Id, day)
+	if err != ErrNotFound {
+		return stored, err
+	}
+	_, start, ok := series.find(day)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	appointment := series.Appointment(start)
+	err = app.Appointments.Insert(ctx, &appointment)
+	if err == ErrDuplicate {
+		// stored by a concurrent request
+		return storedOccurrence(ctx, series.Id, day)
+	}
+	return &appointment, err
+}
+
+func storedOccurrence(ctx context.Context, seriesId primitive.ObjectID, day string) (*Appointment, error) {
+	stored, err := app.Appointments.List(ctx, AppointmentFilter{SeriesId: seriesId})
+	if err != nil {
+		return nil, err
+	}
+	for _, appointment := range stored {
+		if appointment.Occurrence == day {
+			return &appointment, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// truncate ends the series before the i-th occurrence.
+func (s *Series) truncate(i int, day string) {
+	rec := s.recurrence()
+	if rec.Count > 0 {
+		rec.Count = i
+	} else {
+		date, _ := time.ParseInLocation(ShortDateLayout, day, app.Location)
+		rec.Until = date.AddDate(0, 0, -1)
+	}
+	s.RRule = rec.String()
+}
+
+// following returns a new series of the occurrences from the i-th one on.
+func (s *Series) following(i int, start time.Time) Series {
+	following := *s
+	following.Id = primitive.NilObjectID
+	following.Start = primitive.NewDateTimeFromTime(start)
+	rec := s.recurrence()
+	if rec.Count > 0 {
+		rec.Count -= i
+	}
+	following.RRule = rec.String()
+	day := start.In(app.Location).Format(ShortDateLayout)
+	following.SkipDates = nil
+	for _, skip := range s.SkipDates {
+		if skip >= day {
+			following.SkipDates = append(following.SkipDates, skip)
+		}
+	}
+	return following
+}
+
+// moveOccurrences hands stored occurrences from the day on over to another
+// series, or removes them when to is nil. Completed, cancelled and missed
+// occurrences are kept, planned ones are replaced by the new series.
+func moveOccurrences(ctx context.Context, from primitive.ObjectID, day string, to *Series) error {
+	stored, err := app.Appointments.List(ctx, AppointmentFilter{SeriesId: from})
+	if err != nil {
+		return err
+	}
+	for _, appointment := range stored {
+		if appointment.Occurrence < day {
+			continue
+		}
+		if appointment.Status == Planned {
+			err = app.Appointments.Delete(ctx, appointment.Id, AnyVersion)
+		} else if to != nil {
+			appointment.SeriesId = to.Id
+			err = app.Appointments.Update(ctx, appointment.Id, &appointment)
+		}
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers
+
+func showSeriesList(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var filter SeriesFilter
+	var err error
+	query := r.URL.Query()
+	ids := map[string]*primitive.ObjectID{"employee": &filter.EmployeeId, "client": &filter.ClientId}
+	for name, id := range ids {
+		if value := query.Get(name); value != "" && err == nil {
+			if *id, err = primitive.ObjectIDFromHex(value); err != nil {
+				err = invalidParameter(name, err)
+			}
+		}
+	}
+	if !e.Admin {
+		filter.EmployeeId = e.Id
+	}
+
+	var list []Series
+	if err == nil {
+		list, err = app.Series.List(ctx, filter)
+	}
+	if err == nil {
+		if list == nil {
+			list = []Series{}
+		}
+		tags := make([]string, len(list))
+		for i := range list {
+			tags[i] = list[i].ETag()
+		}
+		w.Header().Set("ETag", listETag(tags))
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(list)
+	} else {
+		writeError(w, err)
+	}
+}
+
+// createSeries starts the series at the given start or, when only the time
+// of day is given ("time": "15:00"), at the client's therapy start date.
+func createSeries(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var series Series
+	var input struct {
+		Time string `json:"time"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &series)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &input)
+	}
+	if err == nil {
+		series.Id = primitive.NilObjectID
+		series.Override = nil
+		if series.EmployeeId.IsZero() {
+			series.EmployeeId = e.Id
+		}
+		if series.Duration == 0 {
+			series.Duration = defaultDuration
+		}
+		err = authorizeSeries(e, &series)
+	}
+	if err == nil && series.Start == 0 && input.Time != "" {
+		var client *Client
+		if client, err = activeClient(ctx, "clientId", series.ClientId); err == nil {
+			if client.TherapyFrom == 0 {
+				err = invalidSeries("The client has no therapy start date, give the start of the series")
+			} else {
+				day := MarshalDate(client.TherapyFrom, ShortDateLayout)
+				if err = UnmarshalDate(day+" - "+input.Time, &series.Start, DateTimeLayout); err != nil {
+					err = invalidParameter("time", err)
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = series.validate(ctx, nil)
+	}
+	if err == nil {
+		series.Override, err = checkConflicts(ctx, r, e, nil, seriesSlots(&series), nil)
+	}
+	if err == nil {
+		err = app.Series.Insert(ctx, &series)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", series.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(&series)
+	}
+}
+
+// loadSeries gets the series of the request which the employee may change.
+func loadSeries(ctx context.Context, r *http.Request, e *Employee) (*Series, error) {
+	seriesId, err := routeId(r)
+	if err != nil {
+		return nil, err
+	}
+	series, err := app.Series.Get(ctx, seriesId)
+	if err == nil && !e.Admin && series.EmployeeId != e.Id {
+		err = ErrNotFound
+	}
+	return series, err
+}
+
+func showSeries(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	series, err := loadSeries(ctx, r, e)
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", series.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(series)
+	}
+}
+
+// patchSeries applies the request onto the series, keeping the fields out of
+// client control. Occurrences of the replaced series, from the day on, are
+// not taken for conflicts.
+func patchSeries(ctx context.Context, r *http.Request, e *Employee, series *Series, replaced primitive.ObjectID, day string) error {
+	stored := *series
+	err := decodePatch(r, series)
+	series.Id = stored.Id
+	series.Version = stored.Version
+	series.Override = stored.Override
+	if err == nil {
+		err = authorizeSeries(e, series)
+	}
+	if err == nil {
+		err = series.validate(ctx, &stored)
+	}
+	if err == nil && series.redated(&stored) {
+		err = checkRedating(ctx, series, &stored, replaced, day)
+	}
+	if err == nil && series.rescheduled(&stored) {
+		series.Override, err = checkConflicts(ctx, r, e, stored.Override, seriesSlots(series), func(other slot) bool {
+			return other.seriesId == replaced && other.occurrence >= day
+		})
+	}
+	return err
+}
+
+// rescheduled tells whether the occurrences take other time, persons or room than before.
+func (s *Series) rescheduled(before *Series) bool {
+	schedule := func(s Series) Series {
+		s.Id, s.Version, s.Override = primitive.NilObjectID, 0, nil
+		return s
+	}
+	return !reflect.DeepEqual(schedule(*s), schedule(*before))
+}
+
+// redated tells whether the occurrences fall on other days than before,
+// so stored occurrences, which are identified by their day, no longer match them.
+func (s *Series) redated(before *Series) bool {
+	return MarshalDate(s.Start, ShortDateLayout) != MarshalDate(before.Start, ShortDateLayout) ||
+		s.recurrence().Interval != before.recurrence().Interval
+}
+
+// checkRedating allows moving the occurrences to other days only where no
+// occurrence was completed, cancelled or missed, those stay on their days and
+// the series would repeat them. Before is the series, or the part of it from
+// the day on, as it was.
+func checkRedating(ctx context.Context, series, before *Series, replaced primitive.ObjectID, day string) error {
+	if day != "" {
+		// the following occurrences may not take the weeks of the earlier ones
+		previous := before.Start.Time().In(app.Location).AddDate(0, 0, -7*before.recurrence().Interval)
+		if MarshalDate(series.Start, ShortDateLayout) <= previous.Format(ShortDateLayout) {
+			return invalidSeries("The occurrences from " + day + " on cannot start before " + previous.AddDate(0, 0, 1).Format(ShortDateLayout))
+		}
+	}
+	stored, err := app.Appointments.List(ctx, AppointmentFilter{SeriesId: replaced})
+	if err != nil {
+		return err
+	}
+	for _, appointment := range stored {
+		if appointment.Occurrence >= day && appointment.Status != Planned {
+			return invalidSeries("The occurrence on " + appointment.Occurrence + " (" + string(appointment.Status) +
+				") stays on its day, change the days only of the occurrences after it with scope=following")
+		}
+	}
+	return nil
+}
+
+// updateWholeSeries stores the patched series. Stored occurrences keep their
+// changes, unless the series moved to other days, which replaces them.
+func updateWholeSeries(ctx context.Context, r *http.Request, e *Employee, series *Series) error {
+	var err error
+	if !ifMatch(r, series.ETag()) {
+		err = ErrConflict
+	}
+	before := *series
+	if err == nil {
+		err = patchSeries(ctx, r, e, series, series.Id, "")
+	}
+	if err == nil {
+		err = app.Series.Update(ctx, series.Id, series)
+	}
+	if err == nil && series.redated(&before) {
+		err = moveOccurrences(ctx, series.Id, "", series)
+	}
+	return err
+}
+
+// updateSeries changes the whole series, see updateWholeSeries.
+func updateSeries(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	series, err := loadSeries(ctx, r, e)
+	if err == nil {
+		err = updateWholeSeries(ctx, r, e, series)
+	}
+	writeSeries(w, ctx, series, err)
+}
+
+// writeSeries responds with the current copy of the series after a write.
+func writeSeries(w http.ResponseWriter, ctx context.Context, series *Series, err error) {
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		if series != nil {
+			series, err = app.Series.Get(ctx, series.Id)
+		}
+		if err == nil && conflict {
+			writeConflict(w, series.ETag(), series)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", series.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(series)
+	}
+}
+
+// removeSeries removes the series with its occurrences, completed ones stay.
+func removeSeries(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	series, err := loadSeries(ctx, r, e)
+	if err == nil && !ifMatch(r, series.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil {
+		err = app.Series.Delete(ctx, series.Id, expectedVersion(r, series.Version))
+	}
+	if err == nil {
+		err = moveOccurrences(ctx, series.Id, "", nil)
+	}
+
+	if err == ErrConflict {
+		writeSeries(w, ctx, series, err)
+	} else if err == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(series.Id)
+	} else {
+		writeError(w, err)
+	}
+}
+
+// Occurrences, identified by their day
+
+type EditScope string
+
+const (
+	ThisOccurrence      EditScope = "this"
+	FollowingOccurrence EditScope = "following"
+	WholeSeries         EditScope = "all"
+)
+
+func parseScope(r *http.Request) (EditScope, error) {
+	switch scope := EditScope(r.URL.Query().Get("scope")); scope {
+	case "":
+		return ThisOccurrence, nil
+	case ThisOccurrence, FollowingOccurrence, WholeSeries:
+		return scope, nil
+	}
+	return "", invalidParameter("scope", fmt.Errorf("expected this, following or all"))
+}
+
+func outOfSeries(day string) error {
+	return invalidSeries("The occurrence on " + day + " is no longer a part of the series, it can be changed only alone")
+}
+
+// loadOccurrence gets the series and the index of its occurrence named in the request.
+func loadOccurrence(ctx context.Context, r *http.Request, e *Employee) (*Series, string, int, time.Time, error) {
+	day := mux.Vars(r)["day"]
+	series, err := loadSeries(ctx, r, e)
+	if err != nil {
+		return nil, day, 0, time.Time{}, err
+	}
+	i, start, ok := series.find(day)
+	if !ok {
+		// stored occurrences are still reachable, but only one by one
+		if _, err = storedOccurrence(ctx, series.Id, day); err != nil {
+			return nil, day, 0, time.Time{}, err
+		}
+		i = -1
+	}
+	return series, day, i, start, nil
+}
+
+// updateOccurrence changes a single occurrence, the occurrence and the
+// following ones (as a new series) or the whole series, depending on scope.
+func updateOccurrence(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	scope, err := parseScope(r)
+	var series *Series
+	var day string
+	var i int
+	var start time.Time
+	if err == nil {
+		series, day, i, start, err = loadOccurrence(ctx, r, e)
+	}
+	if err == nil && i < 0 && scope != ThisOccurrence {
+		err = outOfSeries(day)
+	}
+
+	if err == nil && scope == ThisOccurrence {
+		var appointment *Appointment
+		if appointment, err = materialize(ctx, series, day); err == nil {
+			editOccurrence(w, r, e, ctx, appointment)
+			return
+		}
+	}
+
+	if err == nil && (scope == WholeSeries || i == 0) {
+		writeSeries(w, ctx, series, updateWholeSeries(ctx, r, e, series))
+		return
+	}
+
+	if err == nil && !ifMatch(r, series.ETag()) {
+		err = ErrConflict
+	}
+	var following Series
+	if err == nil {
+		following = series.following(i, start)
+		err = patchSeries(ctx, r, e, &following, series.Id, day)
+	}
+	if err == nil {
+		err = app.Series.Insert(ctx, &following)
+	}
+	if err == nil {
+		series.truncate(i, day)
+		if err = app.Series.Update(ctx, series.Id, series); err != nil {
+			app.Series.Delete(ctx, following.Id, AnyVersion)
+		}
+	}
+	if err == nil {
+		err = moveOccurrences(ctx, series.Id, day, &following)
+	}
+	if err == nil {
+		series = &following
+	}
+	writeSeries(w, ctx, series, err)
+}
+
+// editOccurrence applies the request onto a stored occurrence, like updateAppointment.
+func editOccurrence(w http.ResponseWriter, r *http.Request, e *Employee, ctx context.Context, appointment *Appointment) {
+	var err error
+	if r.Header.Get("If-Match") != "" && !ifMatch(r, appointment.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil && appointment.Status == Completed {
+		err = appointmentCompleted(appointment)
+	}
+	stored := *appointment
+	if err == nil {
+		err = decodePatch(r, appointment)
+		appointment.Id = stored.Id
+		appointment.Version = stored.Version
+		appointment.RecordId = stored.RecordId
+		appointment.SeriesId, appointment.Occurrence = stored.SeriesId, stored.Occurrence
+		appointment.Override = stored.Override
+	}
+	if err == nil {
+		err = authorizeAppointment(e, appointment)
+	}
+	if err == nil {
+		err = appointment.validate(ctx, &stored)
+	}
+	if err == nil {
+		appointment.Override, err = appointment.checkConflicts(ctx, r, e, &stored)
+	}
+	if err == nil {
+		err = app.Appointments.Update(ctx, appointment.Id, appointment)
+	}
+	if err == nil || err == ErrConflict {
+		conflict := err == ErrConflict
+		appointment, err = app.Appointments.Get(ctx, stored.Id)
+		if err == nil && conflict {
+			writeConflict(w, appointment.ETag(), appointment)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(appointment)
+	}
+}
+
+// removeOccurrence cancels a single occurrence, ends the series before the
+// occurrence or removes the whole series, depending on scope.
+func removeOccurrence(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	scope, err := parseScope(r)
+	var series *Series
+	var day string
+	var i int
+	if err == nil {
+		series, day, i, _, err = loadOccurrence(ctx, r, e)
+	}
+	if err == nil && i < 0 && scope != ThisOccurrence {
+		err = outOfSeries(day)
+	}
+
+	if err == nil && scope == ThisOccurrence {
+		var appointment *Appointment
+		if appointment, err = materialize(ctx, series, day); err == nil {
+			if r.Header.Get("If-Match") != "" && !ifMatch(r, appointment.ETag()) {
+				err = ErrConflict
+			} else if appointment.Status == Completed {
+				err = appointmentCompleted(appointment)
+			} else {
+				appointment.Status = Cancelled
+				err = app.Appointments.Update(ctx, appointment.Id, appointment)
+			}
+		}
+		if err == ErrConflict {
+			if appointment, err = app.Appointments.Get(ctx, appointment.Id); err == nil {
+				writeConflict(w, appointment.ETag(), appointment)
+				return
+			}
+		}
+		if err != nil {
+			writeError(w, err)
+		} else {
+			w.Header().Set("ETag", appointment.ETag())
+			w.Header().Set("Content-Type", "application/vnd.api+json")
+			json.NewEncoder(w).Encode(appointment)
+		}
+		return
+	}
+
+	if err == nil && !ifMatch(r, series.ETag()) {
+		err = ErrConflict
+	}
+	if err == nil && (scope == WholeSeries || i == 0) {
+		if err = app.Series.Delete(ctx, series.Id, series.Version); err == nil {
+			err = moveOccurrences(ctx, series.Id, "", nil)
+		}
+		if err == nil {
+			w.Header().Set("Content-Type", "application/vnd.api+json")
+			json.NewEncoder(w).Encode(series.Id)
+			return
+		}
+	} else if err == nil {
+		series.truncate(i, day)
+		if err = app.Series.Update(ctx, series.Id, series); err == nil {
+			err = moveOccurrences(ctx, series.Id, day, nil)
+		}
+	}
+	writeSeries(w, ctx, series, err)
+}
+
+// completeOccurrence stores the occurrence, if not stored yet, and completes it.
+// Completing an occurrence twice fails, so it never yields two records.
+func completeOccurrence(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var appointment *Appointment
+	var record *Record
+	series, day, _, _, err := loadOccurrence(ctx, r, e)
+	if err == nil {
+		appointment, err = materialize(ctx, series, day)
+	}
+	if err == nil {
+		record, err = complete(ctx, e, appointment)
+	}
+
+	if err == ErrConflict {
+		if appointment, err = app.Appointments.Get(ctx, appointment.Id); err == nil {
+			writeConflict(w, appointment.ETag(), appointment)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("ETag", appointment.ETag())
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(AppointmentCompletion{appointment, record})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRRule(t *testing.T) {
+	setupTestApp(t)
+	valid := map[string]string{
+		"FREQ=WEEKLY;COUNT=10":                  "FREQ=WEEKLY;COUNT=10",
+		"RRULE:freq=weekly;interval=2":          "FREQ=WEEKLY;INTERVAL=2",
+		"FREQ=WEEKLY;UNTIL=20201231T235959Z":    "FREQ=WEEKLY;UNTIL=20201231",
+		"FREQ=WEEKLY;INTERVAL=1;UNTIL=20201231": "FREQ=WEEKLY;UNTIL=20201231",
+	}
+	for rule, expected := range valid {
+		rec, err := ParseRRule(rule)
+		if err != nil {
+			t.Errorf("ParseRRule(%q): %v", rule, err)
+		} else if rec.String() != expected {
+			t.Errorf("ParseRRule(%q): expected %s, got %s", rule, expected, rec)
+		}
+	}
+	for _, rule := range []string{"", "FREQ=DAILY", "FREQ=WEEKLY;COUNT=2;UNTIL=20201231", "FREQ=WEEKLY;INTERVAL=0", "FREQ=WEEKLY;BYDAY=MO"} {
+		if _, err := ParseRRule(rule); err == nil {
+			t.Errorf("ParseRRule(%q): expected an error", rule)
+		}
+	}
+}
+
+func TestSeriesOccurrences(t *testing.T) {
+	setupTestApp(t)
+	day := func(value string) time.Time {
+		date, _ := time.ParseInLocation(ShortDateLayout, value, app.Location)
+		return date
+	}
+	// summer time ends on 2020-10-25
+	start := time.Date(2020, 10, 12, 9, 0, 0, 0, app.Location)
+	series := func(rule string, skip ...string) *Series {
+		return &Series{Start: primitive.NewDateTimeFromTime(start), RRule: rule, SkipDates: skip}
+	}
+	tests := []struct {
+		series   *Series
+		from, to string
+		expected []string
+	}{
+		{series("FREQ=WEEKLY;COUNT=3"), "2020-01-01", "2021-01-01", []string{"2020-10-12", "2020-10-19", "2020-10-26"}},
+		{series("FREQ=WEEKLY;COUNT=3", "2020-10-19"), "2020-01-01", "2021-01-01", []string{"2020-10-12", "2020-10-26"}},
+		{series("FREQ=WEEKLY;INTERVAL=2;UNTIL=20201109"), "2020-01-01", "2021-01-01", []string{"2020-10-12", "2020-10-26", "2020-11-09"}},
+		{series("FREQ=WEEKLY"), "2020-12-01", "2020-12-15", []string{"2020-12-07", "2020-12-14"}},
+		{series("FREQ=WEEKLY"), "2020-01-01", "2020-10-12", nil},
+	}
+	for _, test := range tests {
+		starts := test.series.Occurrences(day(test.from), day(test.to))
+		if len(starts) != len(test.expected) {
+			t.Errorf("%s from %s to %s: expected %v, got %v", test.series.RRule, test.from, test.to, test.expected, starts)
+			continue
+		}
+		for i, start := range starts {
+			if start.Format(ShortDateLayout) != test.expected[i] || start.Hour() != 9 {
+				t.Errorf("%s: expected %s at 9:00, got %v", test.series.RRule, test.expected[i], start)
+			}
+		}
+	}
+
+	if i, _, ok := series("FREQ=WEEKLY").find("2020-11-02"); !ok || i != 3 {
+		t.Errorf("Expected 2020-11-02 to be the occurrence 3, got %d %v", i, ok)
+	}
+	if _, _, ok := series("FREQ=WEEKLY").find("2020-11-03"); ok {
+		t.Errorf("Expected no occurrence on 2020-11-03")
+	}
+}
+
+func TestSeries(t *testing.T) {
+	setupTestApp(t)
+	ctx := context.Background()
+	therapist := Employee{Name: "Therapist", HourlyNet: units(50)}
+	therapist.SetCode("1111")
+	app.Employees.Insert(ctx, &therapist)
+	client := Client{Name: "Jan", Prices: specialPrice(t, 80)}
+	UnmarshalDate("2020-03-02", &client.TherapyFrom, ShortDateLayout)
+	app.Clients.Insert(ctx, &client)
+
+	s := newTestSession(t)
+	s.login("therapist", "1111")
+
+	w := s.request("PUT", "/series", map[string]interface{}{
+		"clientId": client.Id.Hex(),
+		"time":     "10:00",
+		"rrule":    "FREQ=WEEKLY;COUNT=6",
+	})
+	var series Series
+	json.NewDecoder(w.Body).Decode(&series)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Create failed: %d %s", w.Code, w.Body)
+	}
+	if got := MarshalDate(series.Start, DateTimeLayout); got != "2020-03-02 - 10:00" || series.EmployeeId != therapist.Id {
+		t.Errorf("Unexpected series: %+v", series)
+	}
+	path := "/series/" + series.Id.Hex()
+
+	list := func() []Appointment {
+		w := s.request("GET", "/appointments?from=2020-03-01&to=2020-05-01", nil)
+		var appointments []Appointment
+		json.NewDecoder(w.Body).Decode(&appointments)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Listing failed: %d %s", w.Code, w.Body)
+		}
+		return appointments
+	}
+	if appointments := list(); len(appointments) != 6 || appointments[5].Occurrence != "2020-04-06" {
+		t.Fatalf("Expected 6 weekly occurrences, got: %+v", appointments)
+	}
+
+	// a single occurrence moved to another hour
+	w = s.request("PATCH", path+"/occurrences/2020-03-09", map[string]interface{}{"start": "2020-03-10 - 12:00"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Changing an occurrence failed: %d %s", w.Code, w.Body)
+	}
+	// a cancelled one
+	if w := s.request("DELETE", path+"/occurrences/2020-03-16", nil); w.Code != http.StatusOK {
+		t.Fatalf("Cancelling an occurrence failed: %d %s", w.Code, w.Body)
+	}
+	appointments := list()
+	if len(appointments) != 6 || MarshalDate(appointments[1].Start, DateTimeLayout) != "2020-03-10 - 12:00" || appointments[2].Status != Cancelled {
+		t.Errorf("Unexpected occurrences: %+v", appointments)
+	}
+	// with a stale tag
+	if w := s.requestIfMatch("DELETE", path+"/occurrences/2020-03-09", `"stale"`, nil); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale occurrence, got: %d %s", w.Code, w.Body)
+	}
+
+	// completing twice yields a single record
+	for i, expected := range []int{http.StatusOK, http.StatusConflict} {
+		if w := s.request("POST", path+"/occurrences/2020-03-02/complete", nil); w.Code != expected {
+			t.Errorf("Completion %d: expected %d, got: %d %s", i, expected, w.Code, w.Body)
+		}
+	}
+	if count, _ := app.Records.Count(ctx, RecordFilter{}); count != 1 {
+		t.Errorf("Expected 1 record, got: %d", count)
+	}
+
+	// days of the series with a completed occurrence stay
+	if w := s.request("PATCH", path, map[string]interface{}{"start": "2020-03-03 - 10:00"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for moving a completed occurrence, got: %d %s", w.Code, w.Body)
+	}
+
+	// this and following moved to 15:00
+	w = s.request("PATCH", path+"/occurrences/2020-03-23?scope=following", map[string]interface{}{"start": "2020-03-23 - 15:00"})
+	var following Series
+	json.NewDecoder(w.Body).Decode(&following)
+	if w.Code != http.StatusOK || following.Id == series.Id || following.RRule != "FREQ=WEEKLY;COUNT=3" {
+		t.Fatalf("Splitting failed: %d %+v", w.Code, following)
+	}
+	stored, _ := app.Series.Get(ctx, series.Id)
+	if stored.RRule != "FREQ=WEEKLY;COUNT=3" {
+		t.Errorf("Expected the series to end before the split, got: %s", stored.RRule)
+	}
+	appointments = list()
+	if len(appointments) != 6 || appointments[3].Start.Time().In(app.Location).Hour() != 15 || appointments[3].SeriesId != following.Id {
+		t.Errorf("Unexpected occurrences after the split: %+v", appointments)
+	}
+
+	if w := s.request("PATCH", path+"/occurrences/2020-03-24", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a day without an occurrence, got: %d", w.Code)
+	}
+
+	// the following ones moved to Tuesdays, not into the week before
+	followingPath := "/series/" + following.Id.Hex() + "/occurrences/2020-03-30?scope=following"
+	if w := s.request("PATCH", followingPath, map[string]interface{}{"start": "2020-03-23 - 15:00"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for moving into an earlier week, got: %d %s", w.Code, w.Body)
+	}
+	if w := s.request("PATCH", followingPath, map[string]interface{}{"start": "2020-03-31 - 15:00"}); w.Code != http.StatusOK {
+		t.Fatalf("Moving the following occurrences failed: %d %s", w.Code, w.Body)
+	}
+	if appointments = list(); len(appointments) != 6 || appointments[4].Occurrence != "2020-03-31" || appointments[5].Occurrence != "2020-04-07" {
+		t.Errorf("Unexpected occurrences after moving: %+v", appointments)
+	}
+
+	// the whole series is removed, completed and cancelled occurrences stay
+	if w := s.request("DELETE", path+"/occurrences/2020-03-09?scope=all", nil); w.Code != http.StatusOK {
+		t.Fatalf("Removing the series failed: %d %s", w.Code, w.Body)
+	}
+	if appointments = list(); len(appointments) != 5 || appointments[0].Status != Completed || appointments[1].Status != Cancelled {
+		t.Errorf("Unexpected occurrences after removal: %+v", appointments)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/gorilla/sessions"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -73,22 +72,19 @@ func SessionHandler(h func(http.ResponseWriter, *http.Request, *Session), store
 	})
 }
 
-func EmployeeHandler(h func(http.ResponseWriter, *http.Request, *Employee), app *App) http.Handler {
+func EmployeeHandler(h EmployeeHandlerFunc, app *App) http.Handler {
 	return SessionHandler(func(w http.ResponseWriter, r *http.Request, s *Session) {
 		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 		defer cancel()
 		id, ok := s.GetEmployeeId()
-		employee := Employee{}
+		var employee *Employee
 		if ok {
-			res := app.DB.Collection("employees").FindOne(ctx, bson.M{"_id": id})
-			err := res.Err()
-			if err == nil {
-				err = res.Decode(&employee)
-			}
-			ok = err == nil
+			var err error
+			employee, err = app.Employees.Get(ctx, id)
+			ok = err == nil && !employee.Archived
 		}
 		if ok {
-			h(w, r, &employee)
+			h(w, r, employee)
 		} else {
 			h(w, r, nil)
 		}
@@ -7,18 +7,38 @@
     clients: {},
     records: {},
     lastRecords: [],
+    nextRecords: null,
+    recordsPageSize: 100,
     employees: {},
     employeeNames: {},
-    hourlyGross: 90,
+    services: {},
+    appointments: {},
+    week: null,
     employee: global.employee,
 
+    // loadClients fetches all clients, archived ones too, so that their records keep names.
     loadClients: function() {
       var self = this;
-      return $.get("/clients").done(function(clients) {
+      var clients = [];
+      function loadPage(cursor) {
+        var params = {archived: 'all', limit: 500};
+        if (cursor) {
+          params.cursor = cursor;
+        }
+        return $.get("/clients", params).then(function(page) {
+          clients = clients.concat(page.clients);
+          return page.next ? loadPage(page.next) : clients;
+        });
+      }
+      return loadPage().done(function(clients) {
         self.clients = mapById(clients);
       });
     },
 
+    activeClients: function() {
+      return _.filter(this.clients, function(client) { return !client.archived; });
+    },
+
     loadEmployees: function() {
       var self = this;
       if (this.employee && this.employee.admin) {
@@ -34,17 +54,60 @@
       }
     },
 
+    loadServices: function() {
+      var self = this;
+      return $.get("/services", null, null, "json").done(function(services) {
+        self.services = mapById(services);
+      });
+    },
+
+    defaultService: function() {
+      return _.findWhere(this.services, {default: true});
+    },
+
     loadRecords: function() {
       var self = this;
-      return $.get("/records", "json").done(function(records) {
-        self.records = mapById(records);
-        self.lastRecords = records;
+      return $.get("/records", {limit: this.recordsPageSize}, null, "json").done(function(page) {
+        self.records = mapById(page.records);
+        self.lastRecords = page.records;
+        self.nextRecords = page.next;
+      });
+    },
+
+    loadCalendar: function() {
+      var self = this;
+      var week = moment(this.week || undefined).format('YYYY-MM-DD');
+      return $.get("/employees/" + this.employee.id + "/calendar/" + week, null, null, "json").done(function(calendar) {
+        self.calendar = calendar;
+        var appointments = _.flatten(_.pluck(calendar.days, 'appointments'));
+        _.each(appointments, function(appointment) {
+          if (/^0+$/.test(appointment.id)) {
+            // occurrence of a series, not stored yet
+            appointment.id = appointment.seriesId + '/' + appointment.occurrence;
+            appointment.url = '/series/' + appointment.id.replace('/', '/occurrences/');
+            appointment.version = undefined;
+          } else {
+            appointment.url = '/appointments/' + appointment.id;
+          }
+        });
+        self.appointments = mapById(appointments);
+      });
+    },
+
+    loadMoreRecords: function() {
+      var self = this;
+      var params = {limit: this.recordsPageSize, cursor: this.nextRecords};
+      return $.get("/records", params, null, "json").done(function(page) {
+        _.extend(self.records, mapById(page.records));
+        self.lastRecords = self.lastRecords.concat(page.records);
+        self.nextRecords = page.next;
+        self.resolveRelations();
       });
     },
 
     loadData: function() {
       var self = this;
-      return $.when(this.loadClients(), this.loadEmployees(), this.loadRecords()).done(function() {
+      return $.when(this.loadClients(), this.loadEmployees(), this.loadServices(), this.loadRecords()).done(function() {
         self.resolveRelations();
       });
     },
@@ -87,8 +150,14 @@
         app.employee = employee;
         $('body').trigger('refresh');
       })
-      .fail(function() {
-        $('.js-signin .alert').fadeIn();
+      .fail(function(xhr) {
+        var $alert = $('.js-signin .alert');
+        if (xhr.status == 429) {
+          $alert.text(xhr.responseText);
+        } else {
+          $alert.text("The given name or code is invalid!");
+        }
+        $alert.fadeIn();
       })
       .always(function() {
         $this.prop("disabled", false);
@@ -118,16 +187,33 @@
     $target.trigger('refresh');
   });
 
+  function renderClients($panel, clients) {
+    var compiled = _.template($panel.find("script").text());
+    var items = _.map(clients, function(client) { return compiled(client) });
+    $panel.find(".items").html(items.join("\n"));
+  }
+
   $("#clients").on('refresh', function() {
     var $panel = $(this);
-    app.loadClients().done(function(clients) {
-      var compiled = _.template($panel.find("script").text());
-      var items = _.map(app.clients, function(client) { return compiled(client) });
-      $panel.find(".items").html(items.join("\n"));
+    $panel.find(".js-client-search").val('');
+    app.loadClients().done(function() {
+      renderClients($panel, app.activeClients());
     });
     return false; // stop propagation
   });
 
+  $("#clients .js-client-search").on('input', _.debounce(function() {
+    var $panel = $("#clients");
+    var query = $(this).val();
+    if (query.trim() === '') {
+      renderClients($panel, app.activeClients());
+      return;
+    }
+    $.get("/clients", {q: query, limit: 100}).done(function(page) {
+      renderClients($panel, page.clients);
+    }).fail(showError);
+  }, 300));
+
   $('.js-add-client').on('show.bs.modal', function (event) {
     var $link = $(event.relatedTarget);
     if ($link.length > 0) { // triggered by button not datepicker
@@ -141,12 +227,41 @@
         }
       }
       populateForm($form, client);
+      renderClientPrices($form, client.prices || []);
      }
   });
 
+  var clientPrice = _.template($('#client-price').html() || '');
+
+  function renderClientPrices($form, prices) {
+    $form.find('.js-client-prices tbody').html(_.map(prices, clientPrice).join("\n"));
+  }
+
+  function readClientPrices($form) {
+    return $form.find('.js-price').map(function() {
+      var price = {};
+      $(this).find('[data-field]').each(function() {
+        var field = $(this).data('field');
+        price[field] = $(this).val();
+      });
+      return price;
+    }).get();
+  }
+
+  $('.js-add-client .js-add-price').click(function() {
+    var service = app.defaultService() || {};
+    var price = {serviceId: service.id, from: moment().format('YYYY-MM-DD'), until: '', amount: ''};
+    $('.js-add-client .js-client-prices tbody').append(clientPrice(price));
+  });
+
+  $('.js-add-client').on('click', '.js-remove-price', function() {
+    $(this).closest('.js-price').remove();
+  });
+
   $(".js-add-client button.js-save").click(function() {
     var $form = $('.js-add-client form');
     var json = $form.serializeJSON();
+    json.prices = readClientPrices($form);
     var client_id = $form.data('object-id');
     var existing = client_id && client_id != '';
     var type = existing ? 'POST' : 'PUT';
@@ -154,13 +269,10 @@
     if (existing) {
       url += '/' + client_id;
     }
-    $.ajax({
-      url: url,
-      type: type,
-      data: JSON.stringify(json)
-    }).done(function() {
+    sendVersioned(url, type, existing && app.clients[client_id], json)
+      .done(function() {
         $("#clients").trigger('refresh');
-      }).always(function() {
+      }).fail(showError).always(function() {
         $('.js-add-client').modal('hide');
       })
   });
@@ -168,46 +280,59 @@
   $(".js-add-client button.js-remove").click(function() {
     var $form = $('.js-add-client form');
     var client_id = $form.data('object-id');
-    $.ajax({
-      url: '/clients/'+client_id,
-      type: 'DELETE'
-    }).done(function() {
-      $("#clients").trigger('refresh');
-    }).always(function() {
+    sendVersioned('/clients/'+client_id, 'DELETE', app.clients[client_id])
+      .done(function() {
+        $("#clients").trigger('refresh');
+      }).fail(showError).always(function() {
       $('.js-add-client').modal('hide');
     });
   });
 
   /** records */
 
+  function renderRecords($panel) {
+    var compiled = _.template($panel.find("script").text());
+    var items = _.map(app.lastRecords, function(record) {
+      if (record.client===undefined) {
+        record.client = {id: record.clientId};
+      }
+      return compiled(record);
+    });
+    $panel.find(".items").html(items.join("\n"));
+    $panel.find(".js-more-records").toggle(!!app.nextRecords);
+  }
+
   $("#records").on('refresh', function() {
     var $panel = $(this);
     app.loadData().done(function() {
-        var compiled = _.template($panel.find("script").text());
-        var items = _.map(app.lastRecords, function(record) {
-          if (record.client===undefined) {
-            record.client = {id: record.clientId};
-          }
-          return compiled(record);
-        });
-        $panel.find(".items").html(items.join("\n"));
-      });
+      renderRecords($panel);
+    });
     return false; // stop propagation
   });
 
+  $("#records .js-more-records").click(function() {
+    var $panel = $("#records");
+    app.loadMoreRecords().done(function() {
+      renderRecords($panel);
+    });
+    return false;
+  });
+
   $('.js-record-modal').on('show.bs.modal', function (event) {
     var $link = $(event.relatedTarget);
     if ($link.length > 0) { // triggered by button not datepicker
       var $form = $(this).find('form');
       var record_id = $link.data('id'); // Extract client to be updated
       var now = new Date();
+      // amounts left empty are computed by the server
       var record = {
         date: formatDateTime(now),
-        employeeIncome: app.employee.hourlyNet,
-        price: app.hourlyGross
+        duration: 60,
+        serviceId: (app.defaultService() || {}).id
       };
       var $clients_select = $form.find("select#recordClient");
       fillClientsSelect($clients_select);
+      fillServicesSelect($form.find("select.js-services"));
       if (record_id) {
         record = app.records[record_id];
         if (!record) {
@@ -215,44 +340,62 @@
         }
       }
       populateForm($form, record);
+      fillPackagesSelect($form.find("select.js-packages"), $clients_select.val(), record.packageId);
      }
   });
 
-  $('.js-record-modal form select#recordClient').change(function() {
-    var client_id = $(this).val();
-    var client = app.clients[client_id];
-    if (client) {
-      var price = client.specialPrice || app.hourlyGross;
-      $('.js-record-modal form input#recordPrice').val(price);
-    } else {
-      console.error("Cannot find client with id: " + client_id)
-    }
+  $('.js-record-modal select#recordClient').change(function() {
+    var $form = $(this).closest('form');
+    fillPackagesSelect($form.find("select.js-packages"), $(this).val());
   });
 
   $(".js-record-modal button.js-remove").click(function() {
     var $form = $('.js-record-modal form');
     var record_id = $form.data('object-id');
-    $.ajax({
-      url: '/records/'+record_id,
-      type: 'DELETE'
-    }).done(function() {
-      $("#records").trigger('refresh');
-    }).always(function() {
+    sendVersioned('/records/'+record_id, 'DELETE', app.records[record_id])
+      .done(function() {
+        $("#records").trigger('refresh');
+      }).fail(showError).always(function() {
       $('.js-record-modal').modal('hide');
     });
   });
 
   function fillClientsSelect($select) {
     $select.empty();
-    _.each(app.clients, function(client) {
+    _.each(app.activeClients(), function(client) {
       $select.append("<option value='"+client.id+"'>"+client.name+"</option>");
     });
   }
 
+  // fillPackagesSelect offers the packages of the client with sessions left,
+  // keeping the one the record draws down already.
+  function fillPackagesSelect($select, clientId, selected) {
+    $select.empty().append($("<option>").val("").text("Price list"));
+    if (!clientId) {
+      return;
+    }
+    $.getJSON('/clients/' + clientId + '/packages?remaining=true').done(function(packages) {
+      if (selected && !_.findWhere(packages, {id: selected})) {
+        $select.append($("<option>").val(selected).text("Package in use"));
+      }
+      _.each(packages, function(p) {
+        var label = p.remaining + "/" + p.sessions + " sessions until " + p.validUntil;
+        $select.append($("<option>").val(p.id).text(label));
+      });
+      $select.val(selected || "");
+    });
+  }
+
+  function fillServicesSelect($select) {
+    $select.empty();
+    _.each(app.services, function(service) {
+      $select.append($("<option>").val(service.id).text(service.name));
+    });
+  }
+
   $(".js-record-modal button.js-save").click(function() {
     var $form = $('.js-record-modal form');
     var json = $form.serializeJSON();
-    json['employeeId'] = app.employee.id;
     var record_id = $form.data('object-id');
     var existing = (record_id && record_id != '');
     var type = existing ? 'POST' : 'PUT';
@@ -260,24 +403,114 @@
     if (existing) {
       url += '/' + record_id;
     }
-    $.ajax({
-      url: url,
-      type: type,
-      data: JSON.stringify(json)
-    }).done(function() {
-      $("#records").trigger('refresh');
-    }).always(function() {
+    sendVersioned(url, type, existing && app.records[record_id], json)
+      .then(null, overrideConflicts(url, type, existing && app.records[record_id], json))
+      .done(function() {
+        $("#records").trigger('refresh');
+      }).fail(showError).always(function() {
       $('.js-record-modal').modal('hide');
     });
   });
 
+  /** calendar */
+
+  $("#calendar").on('refresh', function() {
+    var $panel = $(this);
+    app.loadCalendar().done(function() {
+      var compiled = _.template($panel.find("script").text());
+      var days = _.map(app.calendar.days, function(day) {
+        _.each(day.appointments, function(appointment) {
+          appointment.client = app.clients[appointment.clientId] || {id: appointment.clientId};
+        });
+        return compiled(day);
+      });
+      $panel.find(".js-week").text(app.calendar.week);
+      $panel.find(".items").html(days.join("\n"));
+    });
+    return false; // stop propagation
+  });
+
+  $("#calendar .js-week-shift").click(function() {
+    var days = $(this).data('days');
+    app.week = days ? moment(app.week || undefined).add(days, 'days').toDate() : null;
+    $("#calendar").trigger('refresh');
+    return false;
+  });
+
+  $("#calendar .js-feed-token").click(function() {
+    if (!confirm("A new calendar address will be generated, the previous one stops working. Continue?")) {
+      return false;
+    }
+    $.ajax({url: '/employees/' + app.employee.id + '/feed-token', type: 'POST', dataType: 'json'})
+      .done(function(feed) {
+        prompt("Subscribe to this address in your calendar application:", location.origin + feed.url);
+      }).fail(showError);
+    return false;
+  });
+
+  $('.js-appointment-modal').on('show.bs.modal', function (event) {
+    var $link = $(event.relatedTarget);
+    if ($link.length > 0) { // triggered by button not datepicker
+      var $form = $(this).find('form');
+      var appointment_id = $link.data('id');
+      var appointment = {start: formatDateTime(new Date()), duration: 60, status: 'planned'};
+      fillClientsSelect($form.find("select#appointmentClient"));
+      if (appointment_id) {
+        appointment = app.appointments[appointment_id];
+      }
+      populateForm($form, appointment);
+      var planned = appointment_id && appointment.status == 'planned';
+      $(this).find('.js-complete').toggle(!!planned);
+      $(this).find('.js-save').toggle(appointment.status != 'completed');
+    }
+  });
+
+  $(".js-appointment-modal button.js-save").click(function() {
+    var $form = $('.js-appointment-modal form');
+    var json = $form.serializeJSON();
+    var appointment_id = $form.data('object-id');
+    var existing = appointment_id && appointment_id != '';
+    var url = existing ? app.appointments[appointment_id].url : '/appointments';
+    sendVersioned(url, existing ? 'POST' : 'PUT', existing && app.appointments[appointment_id], json)
+      .then(null, overrideConflicts(url, existing ? 'POST' : 'PUT', existing && app.appointments[appointment_id], json))
+      .done(function() {
+        $("#calendar").trigger('refresh');
+      }).fail(showError).always(function() {
+        $('.js-appointment-modal').modal('hide');
+      });
+  });
+
+  $(".js-appointment-modal button.js-complete").click(function() {
+    var appointment_id = $('.js-appointment-modal form').data('object-id');
+    var appointment = app.appointments[appointment_id];
+    sendVersioned(appointment.url + '/complete', 'POST', appointment)
+      .done(function() {
+        $("#calendar").trigger('refresh');
+        $("#records").trigger('refresh');
+      }).fail(showError).always(function() {
+        $('.js-appointment-modal').modal('hide');
+      });
+  });
+
+  $(".js-appointment-modal button.js-remove").click(function() {
+    var appointment_id = $('.js-appointment-modal form').data('object-id');
+    var appointment = app.appointments[appointment_id];
+    sendVersioned(appointment.url, 'DELETE', appointment)
+      .done(function() {
+        $("#calendar").trigger('refresh');
+      }).fail(showError).always(function() {
+        $('.js-appointment-modal').modal('hide');
+      });
+  });
+
   /** employees */
 
   $("#employees").on('refresh', function() {
     var $panel = $(this);
     app.loadEmployees().done(function() {
       var compiled = _.template($panel.find("script").text());
-      var items = _.map(app.employees, function(employee) { return compiled(employee) });
+      var active = _.filter(app.employees, function(employee) { return !employee.archived; });
+      var items = _.map(active, function(employee) { return compiled(employee) });
       $panel.find(".items").html(items.join("\n"));
     });
     return false; // stop propagation
@@ -296,12 +529,47 @@
         }
       }
       populateForm($form, employee);
+      renderCompensation($form, employee.compensation || []);
      }
   });
 
+  var compensationRule = _.template($('#compensation-rule').html() || '');
+
+  function renderCompensation($form, rules) {
+    $form.find('.js-compensation tbody').html(_.map(rules, compensationRule).join("\n"));
+  }
+
+  function readCompensation($form) {
+    return $form.find('.js-rule').map(function() {
+      var rule = {};
+      $(this).find('[data-field]').each(function() {
+        var field = $(this).data('field');
+        rule[field] = field == 'bonusThreshold' ? (parseInt($(this).val(), 10) || 0) : $(this).val();
+      });
+      if (rule.scheme == 'percent') {
+        // amounts of percentage rules are given in percent
+        rule.percent = parseFloat(rule.amount) || 0;
+        rule.homeVisitPercent = parseFloat(rule.homeVisitAmount) || 0;
+        rule.amount = rule.homeVisitAmount = '0';
+      }
+      return rule;
+    }).get();
+  }
+
+  $('.js-employee-modal .js-add-rule').click(function() {
+    var rule = {effectiveFrom: moment().format('YYYY-MM-DD'), scheme: 'hourly', amount: '', percent: 0,
+      homeVisitAmount: '', homeVisitPercent: 0, bonusThreshold: 0, bonusAmount: ''};
+    $('.js-employee-modal .js-compensation tbody').append(compensationRule(rule));
+  });
+
+  $('.js-employee-modal').on('click', '.js-remove-rule', function() {
+    $(this).closest('.js-rule').remove();
+  });
+
   $(".js-employee-modal button.js-save").click(function() {
     var $form = $('.js-employee-modal form');
     var json = $form.serializeJSON();
+    json.compensation = readCompensation($form);
     var employee_id = $form.data('object-id');
     var existing = employee_id && employee_id != '';
     var type = existing ? 'POST' : 'PUT';
@@ -309,13 +577,10 @@
     if (existing) {
       url += '/' + employee_id;
     }
-    $.ajax({
-      url: url,
-      type: type,
-      data: JSON.stringify(json)
-    }).done(function() {
+    sendVersioned(url, type, existing && app.employees[employee_id], json)
+      .done(function() {
         $("#employees").trigger('refresh');
-      }).always(function() {
+      }).fail(showError).always(function() {
         $('.js-employee-modal').modal('hide');
       })
   });
@@ -323,12 +588,19 @@
   $(".js-employee-modal button.js-remove").click(function() {
     var $form = $('.js-employee-modal form');
     var employee_id = $form.data('object-id');
-    $.ajax({
-      url: '/employees/'+employee_id,
-      type: 'DELETE'
-    }).done(function() {
-      $("#employees").trigger('refresh');
-    }).always(function() {
+    var employee = app.employees[employee_id];
+    sendVersioned('/employees/'+employee_id, 'DELETE', employee)
+      .then(null, function(xhr) {
+        // employees with records can only be archived, their records stay
+        if (xhr.status == 409 && xhr.responseJSON && xhr.responseJSON.code == 'has-records' &&
+            confirm(xhr.responseJSON.error + ".\n\nArchive " + employee.name + " instead?")) {
+          return sendVersioned('/employees/'+employee_id+'?policy=archive', 'DELETE', employee);
+        }
+        return xhr;
+      })
+      .done(function() {
+        $("#employees").trigger('refresh');
+      }).fail(showError).always(function() {
       $('.js-employee-modal').modal('hide');
     });
   });  /** common */
@@ -353,6 +625,70 @@
     $('body').trigger('refresh');
   });
 
+  // sendVersioned sends a change made to the original object. When the
+  // server copy has changed in the meantime the user decides whether to
+  // apply the change anyway or to keep the server copy.
+  function sendVersioned(url, type, original, data) {
+    var headers = {};
+    if (original && original.id && original.version !== undefined) {
+      headers['If-Match'] = '"' + original.id + '-' + original.version + '"';
+    }
+    return $.ajax({
+      url: url,
+      type: type,
+      headers: headers,
+      data: data ? JSON.stringify(data) : undefined
+    }).then(null, function(xhr) {
+      var current = xhr.responseJSON && xhr.responseJSON.details;
+      if (xhr.status == 412 && current && confirmConflict(current, data)) {
+        return sendVersioned(url, type, current, data);
+      }
+      return xhr;
+    });
+  }
+
+  function confirmConflict(current, mine) {
+    var differences = _.chain(mine || {}).keys().filter(function(key) {
+      return !_.isEqual(current[key], mine[key]);
+    }).map(function(key) {
+      return key + ": " + JSON.stringify(current[key]) + " -> " + JSON.stringify(mine[key]);
+    }).value();
+    var message = "This entry has been changed by someone else in the meantime.\n\n";
+    if (differences.length > 0) {
+      message += "Server copy -> your version:\n" + differences.join("\n") + "\n\n";
+    }
+    message += "Press OK to apply your change anyway or Cancel to keep the server copy.";
+    return confirm(message);
+  }
+
+  // overrideConflicts lets admins save an entry despite scheduling conflicts
+  function overrideConflicts(url, type, original, data) {
+    return function(xhr) {
+      var body = xhr.responseJSON;
+      if (xhr.status != 409 || !body || body.code != 'scheduling-conflict' || !(app.employee && app.employee.admin)) {
+        return xhr;
+      }
+      var conflicts = _.map(body.details, function(conflict) {
+        return conflict.start + " - " + conflict.end + " (" + conflict.with.join(", ") + ")";
+      });
+      if (confirm(body.error + ":\n\n" + conflicts.join("\n") + "\n\nSave anyway?")) {
+        return sendVersioned(url + (url.indexOf('?') < 0 ? '?' : '&') + 'override=true', type, original, data);
+      }
+      return xhr;
+    };
+  }
+
+  function showError(xhr) {
+    if (xhr.status == 412) {
+      return; // the user has chosen the server copy
+    }
+    var message = xhr.responseText;
+    if (xhr.responseJSON && xhr.responseJSON.error) {
+      message = xhr.responseJSON.error;
+    }
+    alert(message);
+  }
+
   function mapById(collection) {
     return _.reduce(collection, function(map, item) { map[item.id] = item; return map; }, {});
   }
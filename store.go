@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned by stores when the requested document does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned by stores when the document has been changed since it was read.
+var ErrConflict = errors.New("document was modified in the meantime")
+
+// ErrDuplicate is returned by stores when a document violates a unique constraint.
+var ErrDuplicate = errors.New("document already exists")
+
+// ErrExhausted is returned by PackageStore.Consume when no sessions are left in the package.
+var ErrExhausted = errors.New("no sessions left")
+
+// AnyVersion passed to Delete skips the version check.
+const AnyVersion int64 = -1
+
+// Documents carry a version, incremented by the store on each update.
+// Update succeeds only if the version of the given document matches the
+// stored one, Delete only if the given version does.
+
+type EmployeeStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Employee, error)
+	// GetByName matches the name case-insensitively.
+	GetByName(ctx context.Context, name string) (*Employee, error)
+	// GetByFeedToken finds the employee by the hash of the calendar feed token.
+	GetByFeedToken(ctx context.Context, tokenHash string) (*Employee, error)
+	// List returns all employees sorted by name.
+	List(ctx context.Context) ([]Employee, error)
+	Count(ctx context.Context) (int64, error)
+	Insert(ctx context.Context, employee *Employee) error
+	Update(ctx context.Context, id primitive.ObjectID, employee *Employee) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+}
+
+type ArchivedFilter int
+
+const (
+	ActiveClients ArchivedFilter = iota
+	ArchivedClients
+	AllClients
+)
+
+// ClientCursor points at the last client of a page, clients are ordered by name and id.
+type ClientCursor struct {
+	SortName string
+	Id       primitive.ObjectID
+}
+
+type ClientFilter struct {
+	Terms    []string // see SearchTerms
+	Archived ArchivedFilter
+	After    *ClientCursor // ignored by Count
+	Limit    int64         // ignored by Count
+}
+
+type ClientStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Client, error)
+	// List returns clients matching the filter sorted by name.
+	List(ctx context.Context, filter ClientFilter) ([]Client, error)
+	Count(ctx context.Context, filter ClientFilter) (int64, error)
+	Insert(ctx context.Context, client *Client) error
+	Update(ctx context.Context, id primitive.ObjectID, client *Client) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+}
+
+// RecordCursor points at the last record of a page. Records are ordered
+// by date and then by id, so that pages stay stable when dates repeat.
+type RecordCursor struct {
+	Date primitive.DateTime
+	Id   primitive.ObjectID
+}
+
+// RecordFilter narrows down RecordStore.List results. Zero values mean no restriction.
+type RecordFilter struct {
+	EmployeeId primitive.ObjectID
+	ClientId   primitive.ObjectID
+	From       time.Time // inclusive
+	To         time.Time // exclusive
+	MinPrice   *Money
+	MaxPrice   *Money
+	// MissingDuration matches records stored before durations were tracked.
+	MissingDuration bool
+	// LegacyMoney matches records with amounts stored by older versions, see MigrateMoney.
+	LegacyMoney bool
+	Ascending   bool          // oldest first instead of newest first
+	After       *RecordCursor // continue after this record, ignored by Count
+	Limit       int64         // ignored by Count
+}
+
+type RecordStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Record, error)
+	// List returns records matching the filter, newest first unless filter.Ascending.
+	List(ctx context.Context, filter RecordFilter) ([]Record, error)
+	Count(ctx context.Context, filter RecordFilter) (int64, error)
+	// Each calls fn for the records matching the filter in the order of List,
+	// one by one, until fn returns an error.
+	Each(ctx context.Context, filter RecordFilter, fn func(record *Record) error) error
+	// Insert fails with ErrDuplicate when the appointment of the record already has one.
+	Insert(ctx context.Context, record *Record) error
+	Update(ctx context.Context, id primitive.ObjectID, record *Record) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+	// ReassignEmployee moves all records of one employee to another, returning how many were moved.
+	ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error)
+	// Revenue sums up the records matching the filter per bucket of the grouping, in no particular order.
+	Revenue(ctx context.Context, filter RecordFilter, grouping RevenueGrouping) ([]RevenueBucket, error)
+}
+
+// AppointmentFilter narrows down AppointmentStore.List results. Zero values mean no restriction.
+type AppointmentFilter struct {
+	EmployeeId primitive.ObjectID
+	ClientId   primitive.ObjectID
+	SeriesId   primitive.ObjectID
+	From       time.Time // inclusive, compared with the start
+	To         time.Time // exclusive
+	Limit      int64
+}
+
+type AppointmentStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Appointment, error)
+	// List returns appointments matching the filter ordered by start.
+	List(ctx context.Context, filter AppointmentFilter) ([]Appointment, error)
+	// Insert fails with ErrDuplicate when the occurrence of the series already has an appointment.
+	Insert(ctx context.Context, appointment *Appointment) error
+	Update(ctx context.Context, id primitive.ObjectID, appointment *Appointment) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+	// ReassignEmployee moves all appointments of one employee to another, returning how many were moved.
+	ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error)
+}
+
+// SeriesFilter narrows down SeriesStore.List results. Zero values mean no restriction.
+type SeriesFilter struct {
+	EmployeeId  primitive.ObjectID
+	ClientId    primitive.ObjectID
+	StartBefore time.Time // series with the first occurrence before this time
+}
+
+type SeriesStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Series, error)
+	// List returns series matching the filter ordered by start.
+	List(ctx context.Context, filter SeriesFilter) ([]Series, error)
+	Insert(ctx context.Context, series *Series) error
+	Update(ctx context.Context, id primitive.ObjectID, series *Series) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+	// ReassignEmployee moves all series of one employee to another, returning how many were moved.
+	ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error)
+}
+
+type ServiceStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Service, error)
+	// List returns all services sorted by name.
+	List(ctx context.Context) ([]Service, error)
+	// Insert and Update fail with ErrDuplicate when another service has the code.
+	Insert(ctx context.Context, service *Service) error
+	Update(ctx context.Context, id primitive.ObjectID, service *Service) error
+}
+
+// PackageFilter narrows down PackageStore.List results. Zero values mean no restriction.
+type PackageFilter struct {
+	ClientId    primitive.ObjectID
+	ExpiresFrom string // inclusive day, compared with ValidUntil
+	ExpiresTo   string // inclusive day
+	// WithRemaining matches packages with sessions left.
+	WithRemaining bool
+}
+
+type PackageStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Package, error)
+	// List returns packages matching the filter, soonest expiring first.
+	List(ctx context.Context, filter PackageFilter) ([]Package, error)
+	Insert(ctx context.Context, p *Package) error
+	Update(ctx context.Context, id primitive.ObjectID, p *Package) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+	// Consume takes a session from the package atomically, so that concurrent
+	// records cannot overdraw it. It fails with ErrExhausted when none is left.
+	Consume(ctx context.Context, id primitive.ObjectID) error
+	// Release gives a consumed session back to the package.
+	Release(ctx context.Context, id primitive.ObjectID) error
+}
+
+// PaymentFilter narrows down PaymentStore.List results. Zero values mean no restriction.
+type PaymentFilter struct {
+	ClientId primitive.ObjectID
+	// RecordId and PackageId match payments allocated to the record or the package.
+	RecordId  primitive.ObjectID
+	PackageId primitive.ObjectID
+}
+
+type PaymentStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Payment, error)
+	// List returns payments matching the filter, oldest first.
+	List(ctx context.Context, filter PaymentFilter) ([]Payment, error)
+	Insert(ctx context.Context, p *Payment) error
+	Update(ctx context.Context, id primitive.ObjectID, p *Payment) error
+	Delete(ctx context.Context, id primitive.ObjectID, version int64) error
+}
+
+// InvoiceFilter narrows down InvoiceStore.List results. Zero values mean no restriction.
+type InvoiceFilter struct {
+	ClientId primitive.ObjectID
+	RecordId primitive.ObjectID // matches invoices with a line of the record
+	Year     int
+}
+
+type InvoiceStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Invoice, error)
+	// List returns invoices matching the filter in the order of their numbers.
+	List(ctx context.Context, filter InvoiceFilter) ([]Invoice, error)
+	// Issue stores the invoice numbered with the next sequence in the year of
+	// its issue date. Numbers follow the stored invoices, so there are no gaps.
+	// Issue fails with ErrDuplicate when a record of the invoice is already on
+	// another invoice, corrections may repeat them.
+	Issue(ctx context.Context, invoice *Invoice) error
+}
+
+// Indexer is implemented by stores which need database indexes, they are created at startup.
+type Indexer interface {
+	EnsureIndexes(ctx context.Context) error
+}
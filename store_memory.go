@@ -0,0 +1,1069 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// In-memory stores keep documents by value, so callers never share
+// state with the store. They are used in tests and in demo mode.
+// Slices are copied as well, see detached.
+
+// Employees
+
+// detached copies the slices of the employee, which a copy of the struct would share.
+func (e Employee) detached() Employee {
+	e.Compensation = append([]CompensationRule(nil), e.Compensation...)
+	return e
+}
+
+type memoryEmployeeStore struct {
+	mu        sync.RWMutex
+	employees map[primitive.ObjectID]Employee
+}
+
+func NewMemoryEmployeeStore() EmployeeStore {
+	return &memoryEmployeeStore{employees: make(map[primitive.ObjectID]Employee)}
+}
+
+func (s *memoryEmployeeStore) Get(ctx context.Context, id primitive.ObjectID) (*Employee, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	employee, ok := s.employees[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	employee = employee.detached()
+	return &employee, nil
+}
+
+func (s *memoryEmployeeStore) GetByName(ctx context.Context, name string) (*Employee, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, employee := range s.employees {
+		if strings.EqualFold(employee.Name, strings.TrimSpace(name)) {
+			employee = employee.detached()
+			return &employee, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryEmployeeStore) GetByFeedToken(ctx context.Context, tokenHash string) (*Employee, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, employee := range s.employees {
+		if employee.FeedTokenHash != "" && employee.FeedTokenHash == tokenHash {
+			employee = employee.detached()
+			return &employee, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryEmployeeStore) List(ctx context.Context) ([]Employee, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var employees []Employee
+	for _, employee := range s.employees {
+		employees = append(employees, employee.detached())
+	}
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].Name < employees[j].Name
+	})
+	return employees, nil
+}
+
+func (s *memoryEmployeeStore) Count(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.employees)), nil
+}
+
+func (s *memoryEmployeeStore) Insert(ctx context.Context, employee *Employee) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if employee.Id.IsZero() {
+		employee.Id = primitive.NewObjectID()
+	}
+	employee.Version = 1
+	s.employees[employee.Id] = employee.detached()
+	return nil
+}
+
+func (s *memoryEmployeeStore) Update(ctx context.Context, id primitive.ObjectID, employee *Employee) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.employees[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != employee.Version {
+		return ErrConflict
+	}
+	employee.Id = id
+	employee.Version++
+	s.employees[id] = employee.detached()
+	return nil
+}
+
+func (s *memoryEmployeeStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.employees[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.employees, id)
+	return nil
+}
+
+// Clients
+
+func (c Client) detached() Client {
+	c.Prices = append([]ClientPrice(nil), c.Prices...)
+	return c
+}
+
+type memoryClientStore struct {
+	mu      sync.RWMutex
+	clients map[primitive.ObjectID]Client
+}
+
+func NewMemoryClientStore() ClientStore {
+	return &memoryClientStore{clients: make(map[primitive.ObjectID]Client)}
+}
+
+func (s *memoryClientStore) Get(ctx context.Context, id primitive.ObjectID) (*Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	client = client.detached()
+	return &client, nil
+}
+
+func (filter ClientFilter) matches(client *Client) bool {
+	switch {
+	case filter.Archived == ActiveClients && client.Archived:
+		return false
+	case filter.Archived == ArchivedClients && !client.Archived:
+		return false
+	}
+	return client.matchesTerms(filter.Terms)
+}
+
+func clientBefore(a, b ClientCursor) bool {
+	if a.SortName != b.SortName {
+		return a.SortName < b.SortName
+	}
+	return a.Id.Hex() < b.Id.Hex()
+}
+
+func (s *memoryClientStore) List(ctx context.Context, filter ClientFilter) ([]Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var clients []Client
+	for _, client := range s.clients {
+		if !filter.matches(&client) {
+			continue
+		}
+		if filter.After != nil && !clientBefore(*filter.After, ClientCursor{client.SortName, client.Id}) {
+			continue
+		}
+		clients = append(clients, client.detached())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clientBefore(ClientCursor{clients[i].SortName, clients[i].Id}, ClientCursor{clients[j].SortName, clients[j].Id})
+	})
+	if filter.Limit > 0 && int64(len(clients)) > filter.Limit {
+		clients = clients[:filter.Limit]
+	}
+	return clients, nil
+}
+
+func (s *memoryClientStore) Count(ctx context.Context, filter ClientFilter) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int64
+	for _, client := range s.clients {
+		if filter.matches(&client) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryClientStore) Insert(ctx context.Context, client *Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client.Id.IsZero() {
+		client.Id = primitive.NewObjectID()
+	}
+	client.Version = 1
+	client.updateSearchFields()
+	s.clients[client.Id] = client.detached()
+	return nil
+}
+
+func (s *memoryClientStore) Update(ctx context.Context, id primitive.ObjectID, client *Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.clients[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != client.Version {
+		return ErrConflict
+	}
+	client.Id = id
+	client.Version++
+	client.updateSearchFields()
+	s.clients[id] = client.detached()
+	return nil
+}
+
+func (s *memoryClientStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.clients[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.clients, id)
+	return nil
+}
+
+// Records
+
+type memoryRecordStore struct {
+	mu      sync.RWMutex
+	records map[primitive.ObjectID]Record
+}
+
+func NewMemoryRecordStore() RecordStore {
+	return &memoryRecordStore{records: make(map[primitive.ObjectID]Record)}
+}
+
+func (s *memoryRecordStore) Get(ctx context.Context, id primitive.ObjectID) (*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (filter RecordFilter) matches(record *Record) bool {
+	if !filter.EmployeeId.IsZero() && record.EmployeeId != filter.EmployeeId {
+		return false
+	}
+	if !filter.ClientId.IsZero() && record.ClientId != filter.ClientId {
+		return false
+	}
+	date := record.Date.Time()
+	if !filter.From.IsZero() && date.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !date.Before(filter.To) {
+		return false
+	}
+	if filter.MinPrice != nil && record.Price.Amount < filter.MinPrice.Amount {
+		return false
+	}
+	if filter.MaxPrice != nil && record.Price.Amount > filter.MaxPrice.Amount {
+		return false
+	}
+	if filter.MissingDuration && record.Duration != 0 {
+		return false
+	}
+	if filter.LegacyMoney && !record.hasLegacyMoney() {
+		return false
+	}
+	return true
+}
+
+// recordBefore orders records by date and id, like the MongoDB indexes do.
+func recordBefore(date primitive.DateTime, id primitive.ObjectID, other RecordCursor) bool {
+	if date != other.Date {
+		return date < other.Date
+	}
+	return id.Hex() < other.Id.Hex()
+}
+
+func (s *memoryRecordStore) List(ctx context.Context, filter RecordFilter) ([]Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var records []Record
+	for _, record := range s.records {
+		if !filter.matches(&record) {
+			continue
+		}
+		if filter.After != nil {
+			before := recordBefore(record.Date, record.Id, *filter.After)
+			after := recordBefore(filter.After.Date, filter.After.Id, RecordCursor{record.Date, record.Id})
+			if (filter.Ascending && !after) || (!filter.Ascending && !before) {
+				continue
+			}
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		less := recordBefore(records[i].Date, records[i].Id, RecordCursor{records[j].Date, records[j].Id})
+		if filter.Ascending {
+			return less
+		}
+		return !less
+	})
+	if filter.Limit > 0 && int64(len(records)) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (s *memoryRecordStore) Each(ctx context.Context, filter RecordFilter, fn func(record *Record) error) error {
+	records, err := s.List(ctx, filter)
+	for i := 0; err == nil && i < len(records); i++ {
+		err = fn(&records[i])
+	}
+	return err
+}
+
+func (s *memoryRecordStore) Count(ctx context.Context, filter RecordFilter) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int64
+	for _, record := range s.records {
+		if filter.matches(&record) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryRecordStore) Insert(ctx context.Context, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.Id.IsZero() {
+		record.Id = primitive.NewObjectID()
+	}
+	if !record.AppointmentId.IsZero() {
+		for _, other := range s.records {
+			if other.AppointmentId == record.AppointmentId {
+				return ErrDuplicate
+			}
+		}
+	}
+	record.Version = 1
+	s.records[record.Id] = *record
+	return nil
+}
+
+func (s *memoryRecordStore) Update(ctx context.Context, id primitive.ObjectID, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.records[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != record.Version {
+		return ErrConflict
+	}
+	record.Id = id
+	record.Version++
+	s.records[id] = *record
+	return nil
+}
+
+func (s *memoryRecordStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.records[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.records, id)
+	return nil
+}
+
+func (s *memoryRecordStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for id, record := range s.records {
+		if record.EmployeeId == from {
+			record.EmployeeId = to
+			record.Version++
+			s.records[id] = record
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryRecordStore) Revenue(ctx context.Context, filter RecordFilter, grouping RevenueGrouping) ([]RevenueBucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	buckets := make(map[RevenueBucket]*RevenueBucket)
+	for _, record := range s.records {
+		if !filter.matches(&record) {
+			continue
+		}
+		key := RevenueBucket{Period: grouping.Period.key(record.Date.Time())}
+		if grouping.ByEmployee {
+			key.EmployeeId = record.EmployeeId
+		}
+		if grouping.ByClient {
+			key.ClientId = record.ClientId
+		}
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &RevenueBucket{Period: key.Period, EmployeeId: key.EmployeeId, ClientId: key.ClientId, Revenue: NewMoney(0), Income: NewMoney(0)}
+			buckets[key] = bucket
+		}
+		bucket.Sessions++
+		bucket.Revenue = bucket.Revenue.Add(record.Price)
+		bucket.Income = bucket.Income.Add(record.EmployeeIncome)
+	}
+	var list []RevenueBucket
+	for _, bucket := range buckets {
+		list = append(list, *bucket)
+	}
+	return list, nil
+}
+
+// Appointments
+
+type memoryAppointmentStore struct {
+	mu           sync.RWMutex
+	appointments map[primitive.ObjectID]Appointment
+}
+
+func NewMemoryAppointmentStore() AppointmentStore {
+	return &memoryAppointmentStore{appointments: make(map[primitive.ObjectID]Appointment)}
+}
+
+func (s *memoryAppointmentStore) Get(ctx context.Context, id primitive.ObjectID) (*Appointment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	appointment, ok := s.appointments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &appointment, nil
+}
+
+func (filter AppointmentFilter) matches(appointment *Appointment) bool {
+	if !filter.EmployeeId.IsZero() && appointment.EmployeeId != filter.EmployeeId {
+		return false
+	}
+	if !filter.ClientId.IsZero() && appointment.ClientId != filter.ClientId {
+		return false
+	}
+	if !filter.SeriesId.IsZero() && appointment.SeriesId != filter.SeriesId {
+		return false
+	}
+	start := appointment.Start.Time()
+	if !filter.From.IsZero() && start.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !start.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+func (s *memoryAppointmentStore) List(ctx context.Context, filter AppointmentFilter) ([]Appointment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var appointments []Appointment
+	for _, appointment := range s.appointments {
+		if filter.matches(&appointment) {
+			appointments = append(appointments, appointment)
+		}
+	}
+	sort.Slice(appointments, func(i, j int) bool {
+		if appointments[i].Start != appointments[j].Start {
+			return appointments[i].Start < appointments[j].Start
+		}
+		return appointments[i].Id.Hex() < appointments[j].Id.Hex()
+	})
+	if filter.Limit > 0 && int64(len(appointments)) > filter.Limit {
+		appointments = appointments[:filter.Limit]
+	}
+	return appointments, nil
+}
+
+func (s *memoryAppointmentStore) Insert(ctx context.Context, appointment *Appointment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if appointment.Id.IsZero() {
+		appointment.Id = primitive.NewObjectID()
+	}
+	if !appointment.SeriesId.IsZero() {
+		for _, other := range s.appointments {
+			if other.SeriesId == appointment.SeriesId && other.Occurrence == appointment.Occurrence {
+				return ErrDuplicate
+			}
+		}
+	}
+	appointment.Version = 1
+	s.appointments[appointment.Id] = *appointment
+	return nil
+}
+
+func (s *memoryAppointmentStore) Update(ctx context.Context, id primitive.ObjectID, appointment *Appointment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.appointments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != appointment.Version {
+		return ErrConflict
+	}
+	appointment.Id = id
+	appointment.Version++
+	s.appointments[id] = *appointment
+	return nil
+}
+
+func (s *memoryAppointmentStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.appointments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.appointments, id)
+	return nil
+}
+
+func (s *memoryAppointmentStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for id, appointment := range s.appointments {
+		if appointment.EmployeeId == from {
+			appointment.EmployeeId = to
+			appointment.Version++
+			s.appointments[id] = appointment
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Series
+
+type memorySeriesStore struct {
+	mu     sync.RWMutex
+	series map[primitive.ObjectID]Series
+}
+
+func NewMemorySeriesStore() SeriesStore {
+	return &memorySeriesStore{series: make(map[primitive.ObjectID]Series)}
+}
+
+func (s *memorySeriesStore) Get(ctx context.Context, id primitive.ObjectID) (*Series, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	series, ok := s.series[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &series, nil
+}
+
+func (s *memorySeriesStore) List(ctx context.Context, filter SeriesFilter) ([]Series, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Series
+	for _, series := range s.series {
+		if !filter.EmployeeId.IsZero() && series.EmployeeId != filter.EmployeeId {
+			continue
+		}
+		if !filter.ClientId.IsZero() && series.ClientId != filter.ClientId {
+			continue
+		}
+		if !filter.StartBefore.IsZero() && !series.Start.Time().Before(filter.StartBefore) {
+			continue
+		}
+		list = append(list, series)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Start != list[j].Start {
+			return list[i].Start < list[j].Start
+		}
+		return list[i].Id.Hex() < list[j].Id.Hex()
+	})
+	return list, nil
+}
+
+func (s *memorySeriesStore) Insert(ctx context.Context, series *Series) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if series.Id.IsZero() {
+		series.Id = primitive.NewObjectID()
+	}
+	series.Version = 1
+	s.series[series.Id] = *series
+	return nil
+}
+
+func (s *memorySeriesStore) Update(ctx context.Context, id primitive.ObjectID, series *Series) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.series[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != series.Version {
+		return ErrConflict
+	}
+	series.Id = id
+	series.Version++
+	s.series[id] = *series
+	return nil
+}
+
+func (s *memorySeriesStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.series[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.series, id)
+	return nil
+}
+
+func (s *memorySeriesStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int64
+	for id, series := range s.series {
+		if series.EmployeeId == from {
+			series.EmployeeId = to
+			series.Version++
+			s.series[id] = series
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Services
+
+func (s Service) detached() Service {
+	s.Prices = append([]PricePeriod(nil), s.Prices...)
+	return s
+}
+
+type memoryServiceStore struct {
+	mu       sync.RWMutex
+	services map[primitive.ObjectID]Service
+}
+
+func NewMemoryServiceStore() ServiceStore {
+	return &memoryServiceStore{services: make(map[primitive.ObjectID]Service)}
+}
+
+func (s *memoryServiceStore) Get(ctx context.Context, id primitive.ObjectID) (*Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	service, ok := s.services[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	service = service.detached()
+	return &service, nil
+}
+
+func (s *memoryServiceStore) List(ctx context.Context) ([]Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Service
+	for _, service := range s.services {
+		list = append(list, service.detached())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (s *memoryServiceStore) duplicate(service *Service) bool {
+	for id, other := range s.services {
+		if id != service.Id && other.Code == service.Code {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryServiceStore) Insert(ctx context.Context, service *Service) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if service.Id.IsZero() {
+		service.Id = primitive.NewObjectID()
+	}
+	if s.duplicate(service) {
+		return ErrDuplicate
+	}
+	service.Version = 1
+	s.services[service.Id] = service.detached()
+	return nil
+}
+
+func (s *memoryServiceStore) Update(ctx context.Context, id primitive.ObjectID, service *Service) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.services[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != service.Version {
+		return ErrConflict
+	}
+	service.Id = id
+	if s.duplicate(service) {
+		return ErrDuplicate
+	}
+	service.Version++
+	s.services[id] = service.detached()
+	return nil
+}
+
+// Packages
+
+type memoryPackageStore struct {
+	mu       sync.RWMutex
+	packages map[primitive.ObjectID]Package
+}
+
+func NewMemoryPackageStore() PackageStore {
+	return &memoryPackageStore{packages: make(map[primitive.ObjectID]Package)}
+}
+
+func (s *memoryPackageStore) Get(ctx context.Context, id primitive.ObjectID) (*Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.packages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (s *memoryPackageStore) List(ctx context.Context, filter PackageFilter) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Package
+	for _, p := range s.packages {
+		if !filter.ClientId.IsZero() && p.ClientId != filter.ClientId {
+			continue
+		}
+		if filter.ExpiresFrom != "" && p.ValidUntil < filter.ExpiresFrom {
+			continue
+		}
+		if filter.ExpiresTo != "" && p.ValidUntil > filter.ExpiresTo {
+			continue
+		}
+		if filter.WithRemaining && p.Remaining <= 0 {
+			continue
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ValidUntil != list[j].ValidUntil {
+			return list[i].ValidUntil < list[j].ValidUntil
+		}
+		return list[i].Id.Hex() < list[j].Id.Hex()
+	})
+	return list, nil
+}
+
+func (s *memoryPackageStore) Insert(ctx context.Context, p *Package) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	p.Version = 1
+	s.packages[p.Id] = *p
+	return nil
+}
+
+func (s *memoryPackageStore) Update(ctx context.Context, id primitive.ObjectID, p *Package) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.packages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != p.Version {
+		return ErrConflict
+	}
+	p.Id = id
+	p.Version++
+	s.packages[id] = *p
+	return nil
+}
+
+func (s *memoryPackageStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.packages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.packages, id)
+	return nil
+}
+
+func (s *memoryPackageStore) Consume(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.packages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.Remaining <= 0 {
+		return ErrExhausted
+	}
+	p.Remaining--
+	p.Version++
+	s.packages[id] = p
+	return nil
+}
+
+func (s *memoryPackageStore) Release(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.packages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if p.Remaining < p.Sessions {
+		p.Remaining++
+		p.Version++
+		s.packages[id] = p
+	}
+	return nil
+}
+
+// Payments
+
+func (p Payment) detached() Payment {
+	p.Allocations = append([]Allocation(nil), p.Allocations...)
+	return p
+}
+
+type memoryPaymentStore struct {
+	mu       sync.RWMutex
+	payments map[primitive.ObjectID]Payment
+}
+
+func NewMemoryPaymentStore() PaymentStore {
+	return &memoryPaymentStore{payments: make(map[primitive.ObjectID]Payment)}
+}
+
+func (s *memoryPaymentStore) Get(ctx context.Context, id primitive.ObjectID) (*Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	p = p.detached()
+	return &p, nil
+}
+
+func (s *memoryPaymentStore) List(ctx context.Context, filter PaymentFilter) ([]Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Payment
+	for _, p := range s.payments {
+		if !filter.ClientId.IsZero() && p.ClientId != filter.ClientId {
+			continue
+		}
+		if !filter.RecordId.IsZero() || !filter.PackageId.IsZero() {
+			allocated := false
+			for _, allocation := range p.Allocations {
+				if (!filter.RecordId.IsZero() && allocation.RecordId == filter.RecordId) ||
+					(!filter.PackageId.IsZero() && allocation.PackageId == filter.PackageId) {
+					allocated = true
+				}
+			}
+			if !allocated {
+				continue
+			}
+		}
+		list = append(list, p.detached())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date != list[j].Date {
+			return list[i].Date < list[j].Date
+		}
+		return list[i].Id.Hex() < list[j].Id.Hex()
+	})
+	return list, nil
+}
+
+func (s *memoryPaymentStore) Insert(ctx context.Context, p *Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	p.Version = 1
+	s.payments[p.Id] = p.detached()
+	return nil
+}
+
+func (s *memoryPaymentStore) Update(ctx context.Context, id primitive.ObjectID, p *Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.payments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != p.Version {
+		return ErrConflict
+	}
+	p.Id = id
+	p.Version++
+	s.payments[id] = p.detached()
+	return nil
+}
+
+func (s *memoryPaymentStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.payments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != AnyVersion && stored.Version != version {
+		return ErrConflict
+	}
+	delete(s.payments, id)
+	return nil
+}
+
+// Invoices
+
+func sharesRecords(a, b *Invoice) bool {
+	for _, line := range a.Lines {
+		for _, other := range b.Lines {
+			if !line.RecordId.IsZero() && line.RecordId == other.RecordId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (i Invoice) detached() Invoice {
+	i.Lines = append([]InvoiceLine(nil), i.Lines...)
+	return i
+}
+
+type memoryInvoiceStore struct {
+	mu       sync.RWMutex
+	invoices map[primitive.ObjectID]Invoice
+}
+
+func NewMemoryInvoiceStore() InvoiceStore {
+	return &memoryInvoiceStore{invoices: make(map[primitive.ObjectID]Invoice)}
+}
+
+func (s *memoryInvoiceStore) Get(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	invoice, ok := s.invoices[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	invoice = invoice.detached()
+	return &invoice, nil
+}
+
+func (s *memoryInvoiceStore) List(ctx context.Context, filter InvoiceFilter) ([]Invoice, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []Invoice
+	for _, invoice := range s.invoices {
+		if !filter.ClientId.IsZero() && invoice.ClientId != filter.ClientId {
+			continue
+		}
+		if filter.Year != 0 && invoice.Year != filter.Year {
+			continue
+		}
+		if !filter.RecordId.IsZero() {
+			found := false
+			for _, line := range invoice.Lines {
+				found = found || line.RecordId == filter.RecordId
+			}
+			if !found {
+				continue
+			}
+		}
+		list = append(list, invoice.detached())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Year != list[j].Year {
+			return list[i].Year < list[j].Year
+		}
+		return list[i].Sequence < list[j].Sequence
+	})
+	return list, nil
+}
+
+func (s *memoryInvoiceStore) Issue(ctx context.Context, invoice *Invoice) error {
+	year, err := invoiceYear(invoice)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sequence := 1
+	for _, other := range s.invoices {
+		if other.Year == year && other.Sequence >= sequence {
+			sequence = other.Sequence + 1
+		}
+		if invoice.Kind == InvoiceKindInvoice && other.Kind == InvoiceKindInvoice && sharesRecords(invoice, &other) {
+			return ErrDuplicate
+		}
+	}
+	invoice.Id = primitive.NewObjectID()
+	invoice.numbered(year, sequence)
+	s.invoices[invoice.Id] = invoice.detached()
+	return nil
+}
@@ -0,0 +1,1119 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if isDuplicateKey(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func isDuplicateKey(err error) bool {
+	var writeErrors []mongo.WriteError
+	if e, ok := err.(mongo.WriteException); ok {
+		writeErrors = e.WriteErrors
+	} else if e, ok := err.(mongo.BulkWriteException); ok {
+		for _, we := range e.WriteErrors {
+			writeErrors = append(writeErrors, we.WriteError)
+		}
+	}
+	for _, we := range writeErrors {
+		if we.Code == 11000 || we.Code == 11001 {
+			return true
+		}
+	}
+	return false
+}
+
+// mongoDocuments implements the operations shared by all stores.
+type mongoDocuments struct {
+	collection *mongo.Collection
+}
+
+func (d mongoDocuments) get(ctx context.Context, id primitive.ObjectID, document interface{}) error {
+	return mongoError(d.collection.FindOne(ctx, bson.M{"_id": id}).Decode(document))
+}
+
+// versionFilter matches the document in the given version. Documents
+// stored before versioning was introduced have no version, i.e. 0.
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	filter := bson.M{"_id": id}
+	if version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	} else if version != AnyVersion {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// missingOrConflict explains why a versioned write matched nothing.
+func (d mongoDocuments) missingOrConflict(ctx context.Context, id primitive.ObjectID) error {
+	count, err := d.collection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+func (d mongoDocuments) update(ctx context.Context, id primitive.ObjectID, version int64, update bson.M) error {
+	res, err := d.collection.UpdateOne(ctx, versionFilter(id, version), update)
+	if err == nil && res.MatchedCount == 0 {
+		err = d.missingOrConflict(ctx, id)
+	}
+	return err
+}
+
+// replace stores the whole document, so fields left empty are removed
+// instead of keeping their stored values like with $set of omitempty fields.
+func (d mongoDocuments) replace(ctx context.Context, id primitive.ObjectID, version int64, document interface{}) error {
+	res, err := d.collection.ReplaceOne(ctx, versionFilter(id, version), document)
+	if err == nil && res.MatchedCount == 0 {
+		err = d.missingOrConflict(ctx, id)
+	}
+	return mongoError(err)
+}
+
+// reassignEmployee moves the documents of one employee to another.
+func (d mongoDocuments) reassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	res, err := d.collection.UpdateMany(ctx, bson.M{"employeeid": from}, bson.M{
+		"$set": bson.M{"employeeid": to},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (d mongoDocuments) delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	res, err := d.collection.DeleteOne(ctx, versionFilter(id, version))
+	if err == nil && res.DeletedCount == 0 {
+		err = d.missingOrConflict(ctx, id)
+	}
+	return err
+}
+
+// Employees
+
+type mongoEmployeeStore struct {
+	mongoDocuments
+}
+
+func NewMongoEmployeeStore(db *mongo.Database) EmployeeStore {
+	return &mongoEmployeeStore{mongoDocuments{db.Collection("employees")}}
+}
+
+func (s *mongoEmployeeStore) Get(ctx context.Context, id primitive.ObjectID) (*Employee, error) {
+	var employee Employee
+	if err := s.get(ctx, id, &employee); err != nil {
+		return nil, err
+	}
+	return &employee, nil
+}
+
+func (s *mongoEmployeeStore) GetByName(ctx context.Context, name string) (*Employee, error) {
+	var employee Employee
+	findOptions := options.FindOne().SetCollation(&options.Collation{Locale: "pl", Strength: 2})
+	err := s.collection.FindOne(ctx, bson.M{"name": strings.TrimSpace(name)}, findOptions).Decode(&employee)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &employee, nil
+}
+
+func (s *mongoEmployeeStore) GetByFeedToken(ctx context.Context, tokenHash string) (*Employee, error) {
+	var employee Employee
+	err := s.collection.FindOne(ctx, bson.M{"feedtokenhash": tokenHash}).Decode(&employee)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &employee, nil
+}
+
+func (s *mongoEmployeeStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "feedtokenhash", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"feedtokenhash": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+func (s *mongoEmployeeStore) List(ctx context.Context) ([]Employee, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "name", Value: 1}})
+	cur, err := s.collection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var employees []Employee
+	err = cur.All(ctx, &employees)
+	return employees, err
+}
+
+func (s *mongoEmployeeStore) Count(ctx context.Context) (int64, error) {
+	return s.collection.CountDocuments(ctx, bson.M{})
+}
+
+func (s *mongoEmployeeStore) Insert(ctx context.Context, employee *Employee) error {
+	if employee.Id.IsZero() {
+		employee.Id = primitive.NewObjectID()
+	}
+	employee.Version = 1
+	_, err := s.collection.InsertOne(ctx, employee)
+	return err
+}
+
+func (s *mongoEmployeeStore) Update(ctx context.Context, id primitive.ObjectID, employee *Employee) error {
+	version := employee.Version
+	employee.Id = primitive.NilObjectID
+	employee.Version = version + 1
+	update := bson.M{"$set": employee}
+	if employee.LegacyCode == 0 {
+		// never leave a plaintext code behind
+		update["$unset"] = bson.M{"code": ""}
+	}
+	err := s.update(ctx, id, version, update)
+	employee.Id = id
+	if err != nil {
+		employee.Version = version
+	}
+	return err
+}
+
+func (s *mongoEmployeeStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+// Clients
+
+type mongoClientStore struct {
+	mongoDocuments
+}
+
+func NewMongoClientStore(db *mongo.Database) ClientStore {
+	return &mongoClientStore{mongoDocuments{db.Collection("clients")}}
+}
+
+func (s *mongoClientStore) Get(ctx context.Context, id primitive.ObjectID) (*Client, error) {
+	var client Client
+	if err := s.get(ctx, id, &client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func clientQuery(filter ClientFilter) bson.M {
+	query := bson.M{}
+	switch filter.Archived {
+	case ActiveClients:
+		query["archived"] = bson.M{"$ne": true}
+	case ArchivedClients:
+		query["archived"] = true
+	}
+	if len(filter.Terms) > 0 {
+		terms := bson.A{}
+		for _, term := range filter.Terms {
+			terms = append(terms, bson.M{"keywords": bson.M{"$regex": "^" + regexp.QuoteMeta(term)}})
+		}
+		query["$and"] = terms
+	}
+	return query
+}
+
+func (s *mongoClientStore) List(ctx context.Context, filter ClientFilter) ([]Client, error) {
+	query := clientQuery(filter)
+	if filter.After != nil {
+		query = bson.M{"$and": bson.A{query, bson.M{"$or": bson.A{
+			bson.M{"sortname": bson.M{"$gt": filter.After.SortName}},
+			bson.M{"sortname": filter.After.SortName, "_id": bson.M{"$gt": filter.After.Id}},
+		}}}}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "sortname", Value: 1}, {Key: "_id", Value: 1}})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(filter.Limit)
+	}
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var clients []Client
+	err = cur.All(ctx, &clients)
+	return clients, err
+}
+
+func (s *mongoClientStore) Count(ctx context.Context, filter ClientFilter) (int64, error) {
+	return s.collection.CountDocuments(ctx, clientQuery(filter))
+}
+
+func (s *mongoClientStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sortname", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "keywords", Value: 1}}},
+	})
+	return err
+}
+
+func (s *mongoClientStore) Insert(ctx context.Context, client *Client) error {
+	if client.Id.IsZero() {
+		client.Id = primitive.NewObjectID()
+	}
+	client.Version = 1
+	client.updateSearchFields()
+	_, err := s.collection.InsertOne(ctx, client)
+	return err
+}
+
+func (s *mongoClientStore) Update(ctx context.Context, id primitive.ObjectID, client *Client) error {
+	version := client.Version
+	client.Id = primitive.NilObjectID
+	client.Version = version + 1
+	client.updateSearchFields()
+	update := bson.M{"$set": client}
+	if client.LegacySpecialPrice == 0 {
+		update["$unset"] = bson.M{"specialprice": ""}
+	}
+	err := s.update(ctx, id, version, update)
+	client.Id = id
+	if err != nil {
+		client.Version = version
+	}
+	return err
+}
+
+func (s *mongoClientStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+// Records
+
+type mongoRecordStore struct {
+	mongoDocuments
+}
+
+func NewMongoRecordStore(db *mongo.Database) RecordStore {
+	return &mongoRecordStore{mongoDocuments{db.Collection("records")}}
+}
+
+func (s *mongoRecordStore) Get(ctx context.Context, id primitive.ObjectID) (*Record, error) {
+	var record Record
+	if err := s.get(ctx, id, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func recordQuery(filter RecordFilter) bson.M {
+	query := bson.M{}
+	if !filter.EmployeeId.IsZero() {
+		query["employeeid"] = filter.EmployeeId
+	}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	dateRange := bson.M{}
+	if !filter.From.IsZero() {
+		dateRange["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		dateRange["$lt"] = filter.To
+	}
+	if len(dateRange) > 0 {
+		query["date"] = dateRange
+	}
+	priceRange := bson.M{}
+	if filter.MinPrice != nil {
+		priceRange["$gte"] = filter.MinPrice.Amount
+	}
+	if filter.MaxPrice != nil {
+		priceRange["$lte"] = filter.MaxPrice.Amount
+	}
+	if len(priceRange) > 0 {
+		query["price.amount"] = priceRange
+	}
+	if filter.MissingDuration {
+		query["duration"] = bson.M{"$in": bson.A{nil, 0}}
+	}
+	if filter.LegacyMoney {
+		query["$or"] = bson.A{
+			bson.M{"price": bson.M{"$type": "number"}},
+			bson.M{"employeeincome": bson.M{"$type": "number"}},
+		}
+	}
+	return query
+}
+
+// recordFind makes the query and the options of List and Each.
+func recordFind(filter RecordFilter) (bson.M, *options.FindOptions) {
+	query := recordQuery(filter)
+	order, next := -1, "$lt"
+	if filter.Ascending {
+		order, next = 1, "$gt"
+	}
+	if filter.After != nil {
+		query = bson.M{"$and": bson.A{query, bson.M{"$or": bson.A{
+			bson.M{"date": bson.M{next: filter.After.Date}},
+			bson.M{"date": filter.After.Date, "_id": bson.M{next: filter.After.Id}},
+		}}}}
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "date", Value: order}, {Key: "_id", Value: order}})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(filter.Limit)
+	}
+	return query, findOptions
+}
+
+func (s *mongoRecordStore) List(ctx context.Context, filter RecordFilter) ([]Record, error) {
+	query, findOptions := recordFind(filter)
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	err = cur.All(ctx, &records)
+	return records, err
+}
+
+// recordBatchSize keeps the records held by Each few.
+const recordBatchSize = 500
+
+func (s *mongoRecordStore) Each(ctx context.Context, filter RecordFilter, fn func(record *Record) error) error {
+	query, findOptions := recordFind(filter)
+	cur, err := s.collection.Find(ctx, query, findOptions.SetBatchSize(recordBatchSize))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var record Record
+		if err = cur.Decode(&record); err != nil {
+			return err
+		}
+		if err = fn(&record); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *mongoRecordStore) Count(ctx context.Context, filter RecordFilter) (int64, error) {
+	return s.collection.CountDocuments(ctx, recordQuery(filter))
+}
+
+func (s *mongoRecordStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "employeeid", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "clientid", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		// an appointment is completed into one record at most
+		{
+			Keys: bson.D{{Key: "appointmentid", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"appointmentid": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+func (s *mongoRecordStore) Insert(ctx context.Context, record *Record) error {
+	if record.Id.IsZero() {
+		record.Id = primitive.NewObjectID()
+	}
+	record.Version = 1
+	_, err := s.collection.InsertOne(ctx, record)
+	return mongoError(err)
+}
+
+func (s *mongoRecordStore) Update(ctx context.Context, id primitive.ObjectID, record *Record) error {
+	version := record.Version
+	record.Id = primitive.NilObjectID
+	record.Version = version + 1
+	err := s.replace(ctx, id, version, record)
+	record.Id = id
+	if err != nil {
+		record.Version = version
+	}
+	return err
+}
+
+func (s *mongoRecordStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+func (s *mongoRecordStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	return s.reassignEmployee(ctx, from, to)
+}
+
+// Revenue groups the records in the database, periods are computed in the timezone of the clinic.
+func (s *mongoRecordStore) Revenue(ctx context.Context, filter RecordFilter, grouping RevenueGrouping) ([]RevenueBucket, error) {
+	id := bson.M{"period": bson.M{"$dateToString": bson.M{
+		"format":   grouping.Period.mongoFormat(),
+		"date":     "$date",
+		"timezone": app.Location.String(),
+	}}}
+	if grouping.ByEmployee {
+		id["employeeid"] = "$employeeid"
+	}
+	if grouping.ByClient {
+		id["clientid"] = "$clientid"
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: recordQuery(filter)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      id,
+			"sessions": bson.M{"$sum": 1},
+			"revenue":  bson.M{"$sum": "$price.amount"},
+			"income":   bson.M{"$sum": "$employeeincome.amount"},
+		}}},
+	}
+	cur, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Id struct {
+			Period     string             `bson:"period"`
+			EmployeeId primitive.ObjectID `bson:"employeeid"`
+			ClientId   primitive.ObjectID `bson:"clientid"`
+		} `bson:"_id"`
+		Sessions int   `bson:"sessions"`
+		Revenue  int64 `bson:"revenue"`
+		Income   int64 `bson:"income"`
+	}
+	if err = cur.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	buckets := make([]RevenueBucket, len(results))
+	for i, result := range results {
+		buckets[i] = RevenueBucket{
+			Period:     result.Id.Period,
+			EmployeeId: result.Id.EmployeeId,
+			ClientId:   result.Id.ClientId,
+			Sessions:   result.Sessions,
+			Revenue:    NewMoney(result.Revenue),
+			Income:     NewMoney(result.Income),
+		}
+	}
+	return buckets, nil
+}
+
+// Appointments
+
+type mongoAppointmentStore struct {
+	mongoDocuments
+}
+
+func NewMongoAppointmentStore(db *mongo.Database) AppointmentStore {
+	return &mongoAppointmentStore{mongoDocuments{db.Collection("appointments")}}
+}
+
+func (s *mongoAppointmentStore) Get(ctx context.Context, id primitive.ObjectID) (*Appointment, error) {
+	var appointment Appointment
+	if err := s.get(ctx, id, &appointment); err != nil {
+		return nil, err
+	}
+	return &appointment, nil
+}
+
+func (s *mongoAppointmentStore) List(ctx context.Context, filter AppointmentFilter) ([]Appointment, error) {
+	query := bson.M{}
+	if !filter.EmployeeId.IsZero() {
+		query["employeeid"] = filter.EmployeeId
+	}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	if !filter.SeriesId.IsZero() {
+		query["seriesid"] = filter.SeriesId
+	}
+	startRange := bson.M{}
+	if !filter.From.IsZero() {
+		startRange["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		startRange["$lt"] = filter.To
+	}
+	if len(startRange) > 0 {
+		query["start"] = startRange
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "start", Value: 1}, {Key: "_id", Value: 1}})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(filter.Limit)
+	}
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var appointments []Appointment
+	err = cur.All(ctx, &appointments)
+	return appointments, err
+}
+
+func (s *mongoAppointmentStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "employeeid", Value: 1}, {Key: "start", Value: 1}}},
+		{Keys: bson.D{{Key: "clientid", Value: 1}, {Key: "start", Value: 1}}},
+		// an occurrence of a series is stored once at most
+		{
+			Keys: bson.D{{Key: "seriesid", Value: 1}, {Key: "occurrence", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"seriesid": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+func (s *mongoAppointmentStore) Insert(ctx context.Context, appointment *Appointment) error {
+	if appointment.Id.IsZero() {
+		appointment.Id = primitive.NewObjectID()
+	}
+	appointment.Version = 1
+	_, err := s.collection.InsertOne(ctx, appointment)
+	return mongoError(err)
+}
+
+func (s *mongoAppointmentStore) Update(ctx context.Context, id primitive.ObjectID, appointment *Appointment) error {
+	version := appointment.Version
+	appointment.Id = primitive.NilObjectID
+	appointment.Version = version + 1
+	err := s.replace(ctx, id, version, appointment)
+	appointment.Id = id
+	if err != nil {
+		appointment.Version = version
+	}
+	return err
+}
+
+func (s *mongoAppointmentStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+func (s *mongoAppointmentStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	return s.reassignEmployee(ctx, from, to)
+}
+
+// Series
+
+type mongoSeriesStore struct {
+	mongoDocuments
+}
+
+func NewMongoSeriesStore(db *mongo.Database) SeriesStore {
+	return &mongoSeriesStore{mongoDocuments{db.Collection("series")}}
+}
+
+func (s *mongoSeriesStore) Get(ctx context.Context, id primitive.ObjectID) (*Series, error) {
+	var series Series
+	if err := s.get(ctx, id, &series); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+func (s *mongoSeriesStore) List(ctx context.Context, filter SeriesFilter) ([]Series, error) {
+	query := bson.M{}
+	if !filter.EmployeeId.IsZero() {
+		query["employeeid"] = filter.EmployeeId
+	}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	if !filter.StartBefore.IsZero() {
+		query["start"] = bson.M{"$lt": filter.StartBefore}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "start", Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var series []Series
+	err = cur.All(ctx, &series)
+	return series, err
+}
+
+func (s *mongoSeriesStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "employeeid", Value: 1}, {Key: "start", Value: 1}}},
+		{Keys: bson.D{{Key: "clientid", Value: 1}, {Key: "start", Value: 1}}},
+	})
+	return err
+}
+
+func (s *mongoSeriesStore) Insert(ctx context.Context, series *Series) error {
+	if series.Id.IsZero() {
+		series.Id = primitive.NewObjectID()
+	}
+	series.Version = 1
+	_, err := s.collection.InsertOne(ctx, series)
+	return err
+}
+
+func (s *mongoSeriesStore) Update(ctx context.Context, id primitive.ObjectID, series *Series) error {
+	version := series.Version
+	series.Id = primitive.NilObjectID
+	series.Version = version + 1
+	err := s.replace(ctx, id, version, series)
+	series.Id = id
+	if err != nil {
+		series.Version = version
+	}
+	return err
+}
+
+func (s *mongoSeriesStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+func (s *mongoSeriesStore) ReassignEmployee(ctx context.Context, from, to primitive.ObjectID) (int64, error) {
+	return s.reassignEmployee(ctx, from, to)
+}
+
+// Services
+
+type mongoServiceStore struct {
+	mongoDocuments
+}
+
+func NewMongoServiceStore(db *mongo.Database) ServiceStore {
+	return &mongoServiceStore{mongoDocuments{db.Collection("services")}}
+}
+
+func (s *mongoServiceStore) Get(ctx context.Context, id primitive.ObjectID) (*Service, error) {
+	var service Service
+	if err := s.get(ctx, id, &service); err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
+
+func (s *mongoServiceStore) List(ctx context.Context) ([]Service, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "name", Value: 1}})
+	cur, err := s.collection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var services []Service
+	err = cur.All(ctx, &services)
+	return services, err
+}
+
+func (s *mongoServiceStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (s *mongoServiceStore) Insert(ctx context.Context, service *Service) error {
+	if service.Id.IsZero() {
+		service.Id = primitive.NewObjectID()
+	}
+	service.Version = 1
+	_, err := s.collection.InsertOne(ctx, service)
+	return mongoError(err)
+}
+
+func (s *mongoServiceStore) Update(ctx context.Context, id primitive.ObjectID, service *Service) error {
+	version := service.Version
+	service.Id = primitive.NilObjectID
+	service.Version = version + 1
+	err := s.update(ctx, id, version, bson.M{"$set": service})
+	service.Id = id
+	if err != nil {
+		service.Version = version
+	}
+	return mongoError(err)
+}
+
+// Packages
+
+type mongoPackageStore struct {
+	mongoDocuments
+}
+
+func NewMongoPackageStore(db *mongo.Database) PackageStore {
+	return &mongoPackageStore{mongoDocuments{db.Collection("packages")}}
+}
+
+func (s *mongoPackageStore) Get(ctx context.Context, id primitive.ObjectID) (*Package, error) {
+	var p Package
+	if err := s.get(ctx, id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *mongoPackageStore) List(ctx context.Context, filter PackageFilter) ([]Package, error) {
+	query := bson.M{}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	expires := bson.M{}
+	if filter.ExpiresFrom != "" {
+		expires["$gte"] = filter.ExpiresFrom
+	}
+	if filter.ExpiresTo != "" {
+		expires["$lte"] = filter.ExpiresTo
+	}
+	if len(expires) > 0 {
+		query["validuntil"] = expires
+	}
+	if filter.WithRemaining {
+		query["remaining"] = bson.M{"$gt": 0}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "validuntil", Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var packages []Package
+	err = cur.All(ctx, &packages)
+	return packages, err
+}
+
+func (s *mongoPackageStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "clientid", Value: 1}, {Key: "validuntil", Value: 1}}},
+		{Keys: bson.D{{Key: "validuntil", Value: 1}}},
+	})
+	return err
+}
+
+func (s *mongoPackageStore) Insert(ctx context.Context, p *Package) error {
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	p.Version = 1
+	_, err := s.collection.InsertOne(ctx, p)
+	return err
+}
+
+func (s *mongoPackageStore) Update(ctx context.Context, id primitive.ObjectID, p *Package) error {
+	version := p.Version
+	p.Id = primitive.NilObjectID
+	p.Version = version + 1
+	err := s.update(ctx, id, version, bson.M{"$set": p})
+	p.Id = id
+	if err != nil {
+		p.Version = version
+	}
+	return err
+}
+
+func (s *mongoPackageStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+// Consume decrements the remaining sessions in a single conditional update,
+// so that concurrent drawdowns cannot take more sessions than there are.
+func (s *mongoPackageStore) Consume(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "remaining": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"remaining": -1, "version": 1}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if count, err := s.collection.CountDocuments(ctx, bson.M{"_id": id}); err != nil {
+			return err
+		} else if count == 0 {
+			return ErrNotFound
+		}
+		return ErrExhausted
+	}
+	return nil
+}
+
+func (s *mongoPackageStore) Release(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "$expr": bson.M{"$lt": bson.A{"$remaining", "$sessions"}}},
+		bson.M{"$inc": bson.M{"remaining": 1, "version": 1}})
+	if err == nil && res.MatchedCount == 0 {
+		if count, cerr := s.collection.CountDocuments(ctx, bson.M{"_id": id}); cerr != nil {
+			err = cerr
+		} else if count == 0 {
+			err = ErrNotFound
+		}
+	}
+	return err
+}
+
+// Payments
+
+type mongoPaymentStore struct {
+	mongoDocuments
+}
+
+func NewMongoPaymentStore(db *mongo.Database) PaymentStore {
+	return &mongoPaymentStore{mongoDocuments{db.Collection("payments")}}
+}
+
+func (s *mongoPaymentStore) Get(ctx context.Context, id primitive.ObjectID) (*Payment, error) {
+	var p Payment
+	if err := s.get(ctx, id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *mongoPaymentStore) List(ctx context.Context, filter PaymentFilter) ([]Payment, error) {
+	query := bson.M{}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	if !filter.RecordId.IsZero() {
+		query["allocations.recordid"] = filter.RecordId
+	}
+	if !filter.PackageId.IsZero() {
+		query["allocations.packageid"] = filter.PackageId
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "date", Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var payments []Payment
+	err = cur.All(ctx, &payments)
+	return payments, err
+}
+
+func (s *mongoPaymentStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "clientid", Value: 1}, {Key: "date", Value: 1}}},
+		{Keys: bson.D{{Key: "allocations.recordid", Value: 1}}},
+		{Keys: bson.D{{Key: "allocations.packageid", Value: 1}}},
+	})
+	return err
+}
+
+func (s *mongoPaymentStore) Insert(ctx context.Context, p *Payment) error {
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	p.Version = 1
+	_, err := s.collection.InsertOne(ctx, p)
+	return err
+}
+
+func (s *mongoPaymentStore) Update(ctx context.Context, id primitive.ObjectID, p *Payment) error {
+	version := p.Version
+	p.Id = primitive.NilObjectID
+	p.Version = version + 1
+	err := s.update(ctx, id, version, bson.M{"$set": p})
+	p.Id = id
+	if err != nil {
+		p.Version = version
+	}
+	return err
+}
+
+func (s *mongoPaymentStore) Delete(ctx context.Context, id primitive.ObjectID, version int64) error {
+	return s.delete(ctx, id, version)
+}
+
+// Invoices
+
+type mongoInvoiceStore struct {
+	mongoDocuments
+	// invoiced has a document per invoiced record, its id is the id of the record.
+	invoiced *mongo.Collection
+}
+
+func NewMongoInvoiceStore(db *mongo.Database) InvoiceStore {
+	return &mongoInvoiceStore{mongoDocuments{db.Collection("invoices")}, db.Collection("invoicedrecords")}
+}
+
+func (s *mongoInvoiceStore) Get(ctx context.Context, id primitive.ObjectID) (*Invoice, error) {
+	var invoice Invoice
+	if err := s.get(ctx, id, &invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+func (s *mongoInvoiceStore) List(ctx context.Context, filter InvoiceFilter) ([]Invoice, error) {
+	query := bson.M{}
+	if !filter.ClientId.IsZero() {
+		query["clientid"] = filter.ClientId
+	}
+	if !filter.RecordId.IsZero() {
+		query["lines.recordid"] = filter.RecordId
+	}
+	if filter.Year != 0 {
+		query["year"] = filter.Year
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "year", Value: 1}, {Key: "sequence", Value: 1}})
+	cur, err := s.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var invoices []Invoice
+	err = cur.All(ctx, &invoices)
+	return invoices, err
+}
+
+func (s *mongoInvoiceStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "year", Value: 1}, {Key: "sequence", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "clientid", Value: 1}}},
+		{Keys: bson.D{{Key: "lines.recordid", Value: 1}}},
+	})
+	if err == nil {
+		_, err = s.invoiced.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "invoiceid", Value: 1}}})
+	}
+	return err
+}
+
+// maxIssueAttempts bounds retries of Issue when invoices are issued concurrently.
+const maxIssueAttempts = 5
+
+// staleClaimAge is the age after which claims of records whose invoice has
+// not been stored are released, see claim.
+const staleClaimAge = time.Minute
+
+// Issue claims the records of the invoice first, so that concurrent invoices
+// of the same records fail, then takes the number following the last invoice
+// of the year. The unique index on the number makes a concurrent issue fail,
+// which then takes the next one.
+func (s *mongoInvoiceStore) Issue(ctx context.Context, invoice *Invoice) error {
+	year, err := invoiceYear(invoice)
+	if err != nil {
+		return err
+	}
+	invoice.Id = primitive.NewObjectID()
+	if err = s.claim(ctx, invoice); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		var last Invoice
+		findOptions := options.FindOne().SetSort(bson.D{{Key: "sequence", Value: -1}})
+		err = s.collection.FindOne(ctx, bson.M{"year": year}, findOptions).Decode(&last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			break
+		}
+		invoice.numbered(year, last.Sequence+1)
+		_, err = s.collection.InsertOne(ctx, invoice)
+		if err = mongoError(err); err != ErrDuplicate || attempt+1 == maxIssueAttempts {
+			break
+		}
+	}
+	if err != nil {
+		if releaseErr := s.release(invoice.Id); releaseErr != nil {
+			return releaseErr
+		}
+	}
+	return err
+}
+
+// claim stores the records of an invoice as invoiced, failing with
+// ErrDuplicate when one of them already is. Corrections claim nothing.
+// Claims left behind by an Issue interrupted before storing its invoice
+// are released once stale, and the records claimed again.
+func (s *mongoInvoiceStore) claim(ctx context.Context, invoice *Invoice) error {
+	var claims []interface{}
+	var recordIds []primitive.ObjectID
+	for _, line := range invoice.Lines {
+		if invoice.Kind == InvoiceKindInvoice && !line.RecordId.IsZero() {
+			claims = append(claims, bson.M{"_id": line.RecordId, "invoiceid": invoice.Id})
+			recordIds = append(recordIds, line.RecordId)
+		}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		_, err := s.invoiced.InsertMany(ctx, claims)
+		if err == nil {
+			return nil
+		}
+		// the records claimed before the duplicate are released
+		if releaseErr := s.release(invoice.Id); releaseErr != nil {
+			return releaseErr
+		}
+		if err = mongoError(err); err != ErrDuplicate || attempt > 0 {
+			return err
+		}
+		released, err := s.releaseStale(ctx, recordIds)
+		if err != nil {
+			return err
+		}
+		if !released {
+			return ErrDuplicate
+		}
+	}
+}
+
+// release removes the claims of an invoice. It runs on its own context,
+// so that the claims are removed when the one of the request has expired.
+func (s *mongoInvoiceStore) release(invoiceId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.invoiced.DeleteMany(ctx, bson.M{"invoiceid": invoiceId})
+	return err
+}
+
+// releaseStale removes the claims of the records made over staleClaimAge ago
+// for invoices which have not been stored, reporting whether there were any.
+func (s *mongoInvoiceStore) releaseStale(ctx context.Context, recordIds []primitive.ObjectID) (bool, error) {
+	cur, err := s.invoiced.Find(ctx, bson.M{"_id": bson.M{"$in": recordIds}})
+	if err != nil {
+		return false, err
+	}
+	var claims []struct {
+		RecordId  primitive.ObjectID `bson:"_id"`
+		InvoiceId primitive.ObjectID `bson:"invoiceid"`
+	}
+	if err = cur.All(ctx, &claims); err != nil {
+		return false, err
+	}
+	released := false
+	for _, claim := range claims {
+		// ids of invoices are generated when their records are claimed
+		if time.Since(claim.InvoiceId.Timestamp()) < staleClaimAge {
+			continue
+		}
+		count, err := s.collection.CountDocuments(ctx, bson.M{"_id": claim.InvoiceId})
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			continue
+		}
+		result, err := s.invoiced.DeleteOne(ctx, bson.M{"_id": claim.RecordId, "invoiceid": claim.InvoiceId})
+		if err != nil {
+			return false, err
+		}
+		released = released || result.DeletedCount > 0
+	}
+	return released, nil
+}
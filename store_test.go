@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// forEachBackend runs the test with the in-memory stores and, when
+// MONGO_TEST_URI names a server, with the stores of a temporary database.
+func forEachBackend(t *testing.T, test func(t *testing.T)) {
+	t.Run("memory", func(t *testing.T) {
+		setupTestApp(t)
+		test(t)
+	})
+	t.Run("mongo", func(t *testing.T) {
+		uri := os.Getenv("MONGO_TEST_URI")
+		if uri == "" {
+			t.Skip("MONGO_TEST_URI is not set")
+		}
+		setupTestApp(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := client.Database(fmt.Sprintf("logo-spy-test-%d", time.Now().UnixNano()))
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			db.Drop(ctx)
+			client.Disconnect(ctx)
+		})
+		app.UseMongoStores(db)
+		app.InitDB()
+		test(t)
+	})
+}
+
+func TestScheduleUpdateClearsOverride(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		override := &ConflictOverride{By: primitive.NewObjectID(), Conflicts: 2}
+		start := primitive.NewDateTimeFromTime(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+
+		appointment := Appointment{EmployeeId: primitive.NewObjectID(), Start: start, Duration: 60, Override: override}
+		if err := app.Appointments.Insert(ctx, &appointment); err != nil {
+			t.Fatal(err)
+		}
+		appointment.Override = nil
+		if err := app.Appointments.Update(ctx, appointment.Id, &appointment); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := app.Appointments.Get(ctx, appointment.Id); stored.Override != nil || stored.Version != 2 {
+			t.Errorf("Expected the override of the appointment to be cleared, got: %+v", stored)
+		}
+
+		series := Series{EmployeeId: primitive.NewObjectID(), Start: start, Duration: 60, RRule: "FREQ=WEEKLY;COUNT=4", Override: override}
+		if err := app.Series.Insert(ctx, &series); err != nil {
+			t.Fatal(err)
+		}
+		series.Override = nil
+		if err := app.Series.Update(ctx, series.Id, &series); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := app.Series.Get(ctx, series.Id); stored.Override != nil || stored.Version != 2 {
+			t.Errorf("Expected the override of the series to be cleared, got: %+v", stored)
+		}
+	})
+}
+
+func TestRecordUpdateClearsFields(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		record := Record{
+			EmployeeId:    primitive.NewObjectID(),
+			ClientId:      primitive.NewObjectID(),
+			Date:          primitive.NewDateTimeFromTime(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)),
+			ServiceId:     primitive.NewObjectID(),
+			PackageId:     primitive.NewObjectID(),
+			AppointmentId: primitive.NewObjectID(),
+			Override:      &ConflictOverride{By: primitive.NewObjectID(), Conflicts: 1},
+			Price:         units(90),
+		}
+		if err := app.Records.Insert(ctx, &record); err != nil {
+			t.Fatal(err)
+		}
+
+		// another package
+		otherPackage := primitive.NewObjectID()
+		record.PackageId = otherPackage
+		if err := app.Records.Update(ctx, record.Id, &record); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := app.Records.Get(ctx, record.Id)
+		if stored.PackageId != otherPackage || stored.Version != 2 {
+			t.Errorf("Expected the other package, got: %+v", stored)
+		}
+
+		// back to the default service, without a package, appointment or override
+		record.ServiceId, record.PackageId, record.AppointmentId, record.Override = primitive.NilObjectID, primitive.NilObjectID, primitive.NilObjectID, nil
+		if err := app.Records.Update(ctx, record.Id, &record); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ = app.Records.Get(ctx, record.Id)
+		if !stored.ServiceId.IsZero() || !stored.PackageId.IsZero() || !stored.AppointmentId.IsZero() || stored.Override != nil {
+			t.Errorf("Expected the fields to be cleared, got: %+v", stored)
+		}
+		if stored.Id != record.Id || !stored.Price.Equal(units(90)) || stored.Version != 3 {
+			t.Errorf("Expected the rest of the record to be kept, got: %+v", stored)
+		}
+
+		stale := *stored
+		stale.Version = 2
+		if err := app.Records.Update(ctx, record.Id, &stale); err != ErrConflict {
+			t.Errorf("Expected a conflict, got: %v", err)
+		}
+	})
+}
+
+func TestInvoiceIssueClaimsRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		recordId := primitive.NewObjectID()
+		invoice := func(kind InvoiceKind, recordIds ...primitive.ObjectID) *Invoice {
+			invoice := &Invoice{Kind: kind, IssueDate: "2021-02-01"}
+			for _, id := range recordIds {
+				invoice.Lines = append(invoice.Lines, InvoiceLine{RecordId: id, Amount: units(90)})
+			}
+			return invoice
+		}
+
+		first := invoice(InvoiceKindInvoice, recordId)
+		if err := app.Invoices.Issue(ctx, first); err != nil || first.Number != "1/2021" {
+			t.Fatalf("Issue failed: %v %s", err, first.Number)
+		}
+		other := primitive.NewObjectID()
+		if err := app.Invoices.Issue(ctx, invoice(InvoiceKindInvoice, other, recordId)); err != ErrDuplicate {
+			t.Errorf("Expected ErrDuplicate for an invoiced record, got: %v", err)
+		}
+		// the other record of the refused invoice stays free
+		if err := app.Invoices.Issue(ctx, invoice(InvoiceKindInvoice, other)); err != nil {
+			t.Errorf("Expected the other record to be invoiced, got: %v", err)
+		}
+		correction := invoice(InvoiceKindCorrection, recordId)
+		correction.Corrects = first.Id
+		if err := app.Invoices.Issue(ctx, correction); err != nil || correction.Number != "3/2021" {
+			t.Errorf("Expected a correction of the record, got: %v %s", err, correction.Number)
+		}
+	})
+}
+
+func TestMemoryRecordStoreList(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRecordStore()
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	base := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		record := Record{EmployeeId: alice, Date: primitive.NewDateTimeFromTime(base.AddDate(0, 0, i*10))}
+		if i%2 == 1 {
+			record.EmployeeId = bob
+		}
+		if err := store.Insert(ctx, &record); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if record.Id.IsZero() {
+			t.Fatal("Insert should assign an id")
+		}
+	}
+
+	records, _ := store.List(ctx, RecordFilter{})
+	if len(records) != 4 || records[0].Date < records[3].Date {
+		t.Errorf("Expected 4 records newest first, got: %v", records)
+	}
+	records, _ = store.List(ctx, RecordFilter{EmployeeId: alice})
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records of employee, got: %d", len(records))
+	}
+	records, _ = store.List(ctx, RecordFilter{From: base.AddDate(0, 0, 10), To: base.AddDate(0, 0, 30)})
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records in range, got: %d", len(records))
+	}
+	records, _ = store.List(ctx, RecordFilter{Limit: 3})
+	if len(records) != 3 {
+		t.Errorf("Expected 3 records with limit, got: %d", len(records))
+	}
+}
+
+func TestMemoryStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryClientStore()
+	client := Client{Name: "Test"}
+	if err := store.Update(ctx, primitive.NewObjectID(), &client); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if err := store.Delete(ctx, primitive.NewObjectID(), AnyVersion); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if _, err := store.Get(ctx, primitive.NewObjectID()); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestMemoryStoreVersions(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryClientStore()
+	client := Client{Name: "Test"}
+	store.Insert(ctx, &client)
+	if client.Version != 1 {
+		t.Errorf("Expected new document in version 1, got: %d", client.Version)
+	}
+
+	stale := client
+	client.Name = "Changed"
+	if err := store.Update(ctx, client.Id, &client); err != nil || client.Version != 2 {
+		t.Fatalf("Expected update to bump version, got: %v %d", err, client.Version)
+	}
+	if err := store.Update(ctx, stale.Id, &stale); err != ErrConflict {
+		t.Errorf("Expected ErrConflict for stale update, got: %v", err)
+	}
+	if err := store.Delete(ctx, client.Id, 1); err != ErrConflict {
+		t.Errorf("Expected ErrConflict for stale delete, got: %v", err)
+	}
+	if err := store.Delete(ctx, client.Id, 2); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
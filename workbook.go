@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tealeg/xlsx"
+)
+
+// ReportRange is the range of days of a workbook, From inclusive, To exclusive.
+type ReportRange struct {
+	Name     string // e.g. "2021-03", "2021-Q1" or "2021-01-01_2021-02-15"
+	From, To time.Time
+}
+
+var quarterPattern = regexp.MustCompile(`^(\d{4})-[Qq]([1-4])$`)
+
+// ParseReportRange reads a month, e.g. "2021-03", or a quarter, e.g. "2021-Q1".
+func ParseReportRange(value string) (ReportRange, error) {
+	if match := quarterPattern.FindStringSubmatch(value); match != nil {
+		year, _ := strconv.Atoi(match[1])
+		quarter, _ := strconv.Atoi(match[2])
+		from := time.Date(year, time.Month(3*quarter-2), 1, 0, 0, 0, 0, app.Location)
+		return ReportRange{Name: fmt.Sprintf("%d-Q%d", year, quarter), From: from, To: from.AddDate(0, 3, 0)}, nil
+	}
+	month, err := time.ParseInLocation("2006-01", value, app.Location)
+	if err != nil {
+		return ReportRange{}, fmt.Errorf("expected a month like 2021-03 or a quarter like 2021-Q1")
+	}
+	from, to := monthBounds(month)
+	return ReportRange{Name: month.Format("2006-01"), From: from, To: to}, nil
+}
+
+// maxWorkbookDays keeps custom ranges within what a workbook built in memory can hold.
+const maxWorkbookDays = 366
+
+// ParseCustomRange reads the from and to days of a custom range, to inclusive.
+func ParseCustomRange(from, to string) (ReportRange, error) {
+	var r ReportRange
+	var err error
+	if r.From, err = parseDay(from, false); err != nil {
+		return r, invalidParameter("from", err)
+	}
+	if r.To, err = parseDay(to, true); err != nil {
+		return r, invalidParameter("to", err)
+	}
+	if !r.To.After(r.From) {
+		return r, invalidParameter("to", fmt.Errorf("before from"))
+	}
+	if r.To.After(r.From.AddDate(0, 0, maxWorkbookDays)) {
+		return r, invalidParameter("to", fmt.Errorf("at most %d days can be exported", maxWorkbookDays))
+	}
+	r.Name = from + "_" + to
+	return r, nil
+}
+
+// workbook builds the sheets of the records workbook.
+type workbook struct {
+	file *xlsx.File
+	bold *xlsx.Style
+	used map[string]bool // names of the sheets of employees, see sheetName
+}
+
+func newWorkbook() *workbook {
+	bold := xlsx.NewStyle()
+	bold.Font.Bold = true
+	bold.ApplyFont = true
+	return &workbook{file: xlsx.NewFile(), bold: bold, used: make(map[string]bool)}
+}
+
+// sheet adds a sheet with the titles of the columns in a frozen header row.
+func (b *workbook) sheet(name string, titles ...string) (*xlsx.Sheet, error) {
+	sheet, err := b.file.AddSheet(name)
+	if err != nil {
+		return nil, err
+	}
+	header := sheet.AddRow()
+	for _, title := range titles {
+		cell := header.AddCell()
+		cell.Value = title
+		cell.SetStyle(b.bold)
+	}
+	sheet.SheetViews = []xlsx.SheetView{{Pane: &xlsx.Pane{YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft", State: "frozen"}}}
+	return sheet, nil
+}
+
+// label adds a bold cell, e.g. at the start of a total row.
+func (b *workbook) label(row *xlsx.Row, s string) {
+	cell := row.AddCell()
+	cell.Value = s
+	cell.SetStyle(b.bold)
+}
+
+func setMoney(cell *xlsx.Cell, m Money) {
+	cell.SetFloatWithFormat(m.Float(), currencyFormat(m))
+}
+
+// setFormula sets the formula with the value it computes, for readers which do not compute formulas.
+func setFormula(cell *xlsx.Cell, formula string, value float64, format string) {
+	cell.SetFloatWithFormat(value, format)
+	cell.SetFormula(formula)
+}
+
+// column names the cells of a column from row to row, 1-based like in formulas.
+func column(x, from, to int) string {
+	if to < from {
+		// sums of no rows refer to the first one, which is empty
+		to = from
+	}
+	return xlsx.GetCellIDStringFromCoords(x, from-1) + ":" + xlsx.GetCellIDStringFromCoords(x, to-1)
+}
+
+// sheetRef refers to a cell of another sheet.
+func sheetRef(sheet *xlsx.Sheet, cell string) string {
+	return "'" + strings.Replace(sheet.Name, "'", "''", -1) + "'!" + cell
+}
+
+const (
+	hoursFormat    = "0.00"
+	dateTimeFormat = "yyyy-mm-dd hh:mm"
+)
+
+// workbookSubtotal sums up the records of an employee or a client.
+type workbookSubtotal struct {
+	name     string
+	sessions int
+	minutes  int
+	revenue  Money
+	income   Money
+	rows     []*exportRow
+	sheet    *xlsx.Sheet
+	total    int // row of the subtotal on the sheet, 1-based
+}
+
+func (s *workbookSubtotal) add(x *exportRow) {
+	s.sessions++
+	s.minutes += x.record.Duration
+	s.revenue = s.revenue.Add(x.record.Price)
+	s.income = s.income.Add(x.record.EmployeeIncome)
+	s.rows = append(s.rows, x)
+}
+
+// recordsWorkbook makes the sheets of the records of the range: all records,
+// a sheet per employee with subtotals, a summary per client and totals.
+func recordsWorkbook(ctx context.Context, r ReportRange) (*xlsx.File, error) {
+	records, err := app.Records.List(ctx, RecordFilter{From: r.From, To: r.To, Ascending: true})
+	if err != nil {
+		return nil, err
+	}
+	lookup := newExportLookup()
+	var employees, clients []*workbookSubtotal
+	byEmployee := make(map[*Employee]*workbookSubtotal)
+	byClient := make(map[*Client]*workbookSubtotal)
+	var rows []*exportRow
+	for i := range records {
+		x, err := lookup.row(ctx, &records[i], ".")
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, x)
+		if byEmployee[x.employee] == nil {
+			byEmployee[x.employee] = &workbookSubtotal{name: x.employee.Name, revenue: NewMoney(0), income: NewMoney(0)}
+			employees = append(employees, byEmployee[x.employee])
+		}
+		byEmployee[x.employee].add(x)
+		if byClient[x.client] == nil {
+			byClient[x.client] = &workbookSubtotal{name: x.client.Name, revenue: NewMoney(0), income: NewMoney(0)}
+			clients = append(clients, byClient[x.client])
+		}
+		byClient[x.client].add(x)
+	}
+	sortSubtotals(employees)
+	sortSubtotals(clients)
+	moneyFormat := currencyFormat(NewMoney(0))
+
+	b := newWorkbook()
+	// the names of the sheets of the workbook are not left to employees
+	for _, name := range []string{"Records", "Clients", "Totals"} {
+		b.used[name] = true
+	}
+	sheet, err := b.sheet("Records", "Date", "Employee", "Client", "Service", "Minutes", "Hours", "Home visit", "Price", "Employee income", "Margin")
+	if err != nil {
+		return nil, err
+	}
+	for i, x := range rows {
+		row := sheet.AddRow()
+		setExcelDate(row.AddCell(), x.record.Date.Time(), dateTimeFormat)
+		row.AddCell().Value = x.employee.Name
+		row.AddCell().Value = x.client.Name
+		row.AddCell().Value = x.service.Name
+		row.AddCell().SetInt(x.record.Duration)
+		row.AddCell().SetFloatWithFormat(x.record.Hours(), hoursFormat)
+		row.AddCell().SetBool(x.record.HomeVisit)
+		setMoney(row.AddCell(), x.record.Price)
+		setMoney(row.AddCell(), x.record.EmployeeIncome)
+		margin := x.record.Price.Sub(x.record.EmployeeIncome)
+		setFormula(row.AddCell(), fmt.Sprintf("H%d-I%d", i+2, i+2), margin.Float(), currencyFormat(margin))
+	}
+	sheet.SetColWidth(0, 0, 17.)
+	sheet.SetColWidth(1, 3, 25.)
+	sheet.SetColWidth(4, 9, 14.)
+
+	for _, s := range employees {
+		if s.sheet, err = b.sheet(sheetName(s.name, b.used), "Date", "Client", "Service", "Minutes", "Hours", "Home visit", "Price", "Income"); err != nil {
+			return nil, err
+		}
+		for _, x := range s.rows {
+			row := s.sheet.AddRow()
+			setExcelDate(row.AddCell(), x.record.Date.Time(), dateTimeFormat)
+			row.AddCell().Value = x.client.Name
+			row.AddCell().Value = x.service.Name
+			row.AddCell().SetInt(x.record.Duration)
+			row.AddCell().SetFloatWithFormat(x.record.Hours(), hoursFormat)
+			row.AddCell().SetBool(x.record.HomeVisit)
+			setMoney(row.AddCell(), x.record.Price)
+			setMoney(row.AddCell(), x.record.EmployeeIncome)
+		}
+		s.total = len(s.rows) + 2
+		row := s.sheet.AddRow()
+		b.label(row, "Subtotal")
+		row.AddCell()
+		row.AddCell()
+		setFormula(row.AddCell(), "SUM("+column(3, 2, s.total-1)+")", float64(s.minutes), "0")
+		setFormula(row.AddCell(), "SUM("+column(4, 2, s.total-1)+")", float64(s.minutes)/60, hoursFormat)
+		row.AddCell()
+		setFormula(row.AddCell(), "SUM("+column(6, 2, s.total-1)+")", s.revenue.Float(), moneyFormat)
+		setFormula(row.AddCell(), "SUM("+column(7, 2, s.total-1)+")", s.income.Float(), moneyFormat)
+		s.sheet.SetColWidth(0, 0, 17.)
+		s.sheet.SetColWidth(1, 2, 25.)
+		s.sheet.SetColWidth(3, 7, 12.)
+	}
+
+	if sheet, err = b.sheet("Clients", "Client", "Sessions", "Hours", "Revenue"); err != nil {
+		return nil, err
+	}
+	total := &workbookSubtotal{revenue: NewMoney(0), income: NewMoney(0)}
+	for _, s := range clients {
+		row := sheet.AddRow()
+		row.AddCell().Value = s.name
+		row.AddCell().SetInt(s.sessions)
+		row.AddCell().SetFloatWithFormat(float64(s.minutes)/60, hoursFormat)
+		setMoney(row.AddCell(), s.revenue)
+		for _, x := range s.rows {
+			total.add(x)
+		}
+	}
+	row := sheet.AddRow()
+	b.label(row, "Total")
+	last := len(clients) + 1
+	setFormula(row.AddCell(), "SUM("+column(1, 2, last)+")", float64(total.sessions), "0")
+	setFormula(row.AddCell(), "SUM("+column(2, 2, last)+")", float64(total.minutes)/60, hoursFormat)
+	setFormula(row.AddCell(), "SUM("+column(3, 2, last)+")", total.revenue.Float(), moneyFormat)
+	sheet.SetColWidth(0, 0, 25.)
+	sheet.SetColWidth(1, 3, 12.)
+
+	// totals refer to the subtotals of the employees
+	if sheet, err = b.sheet("Totals", "Employee", "Sessions", "Hours", "Revenue", "Employee income", "Margin"); err != nil {
+		return nil, err
+	}
+	for i, s := range employees {
+		row := sheet.AddRow()
+		n := i + 2
+		row.AddCell().Value = s.name
+		setFormula(row.AddCell(), "COUNT("+sheetRef(s.sheet, column(0, 2, s.total-1))+")", float64(s.sessions), "0")
+		setFormula(row.AddCell(), sheetRef(s.sheet, fmt.Sprintf("E%d", s.total)), float64(s.minutes)/60, hoursFormat)
+		setFormula(row.AddCell(), sheetRef(s.sheet, fmt.Sprintf("G%d", s.total)), s.revenue.Float(), moneyFormat)
+		setFormula(row.AddCell(), sheetRef(s.sheet, fmt.Sprintf("H%d", s.total)), s.income.Float(), moneyFormat)
+		setFormula(row.AddCell(), fmt.Sprintf("D%d-E%d", n, n), s.revenue.Sub(s.income).Float(), moneyFormat)
+	}
+	row = sheet.AddRow()
+	b.label(row, "Total")
+	last = len(employees) + 1
+	setFormula(row.AddCell(), "SUM("+column(1, 2, last)+")", float64(total.sessions), "0")
+	setFormula(row.AddCell(), "SUM("+column(2, 2, last)+")", float64(total.minutes)/60, hoursFormat)
+	setFormula(row.AddCell(), "SUM("+column(3, 2, last)+")", total.revenue.Float(), moneyFormat)
+	setFormula(row.AddCell(), "SUM("+column(4, 2, last)+")", total.income.Float(), moneyFormat)
+	setFormula(row.AddCell(), fmt.Sprintf("D%d-E%d", last+1, last+1), total.revenue.Sub(total.income).Float(), moneyFormat)
+	sheet.AddRow()
+	for _, day := range []struct {
+		label string
+		t     time.Time
+	}{{"From", r.From}, {"To", r.To.AddDate(0, 0, -1)}} {
+		row = sheet.AddRow()
+		b.label(row, day.label)
+		setExcelDate(row.AddCell(), day.t, xlsx.DefaultDateFormat)
+	}
+	sheet.SetColWidth(0, 0, 25.)
+	sheet.SetColWidth(1, 5, 14.)
+	return b.file, nil
+}
+
+func sortSubtotals(subtotals []*workbookSubtotal) {
+	sort.SliceStable(subtotals, func(i, j int) bool {
+		return subtotals[i].name < subtotals[j].name
+	})
+}
+
+// exportExcel exports the records of a month, e.g. /records/2021-03.xlsx, of
+// a quarter, e.g. /records/2021-Q1.xlsx, or of the from and to days of
+// /records.xlsx.
+func exportExcel(w http.ResponseWriter, r *http.Request, e *Employee) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var reportRange ReportRange
+	var file *xlsx.File
+	var buf bytes.Buffer
+	var err error
+	if value, ok := mux.Vars(r)["date"]; ok {
+		if reportRange, err = ParseReportRange(value); err != nil {
+			err = invalidParameter("date", err)
+		}
+	} else {
+		query := r.URL.Query()
+		reportRange, err = ParseCustomRange(query.Get("from"), query.Get("to"))
+	}
+	if err == nil {
+		file, err = recordsWorkbook(ctx, reportRange)
+	}
+	if err == nil {
+		err = file.Write(&buf)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="records-%s.xlsx"`, reportRange.Name))
+		w.Write(buf.Bytes())
+	}
+}